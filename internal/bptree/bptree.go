@@ -44,7 +44,9 @@ func NewBplusTree(pool *pool.Bufferpool) *BPlusTree {
 	return bpt
 }
 
-func LoadBplusTree(pool *pool.Bufferpool, frameId uint64) *BPlusTree {
+// LoadBplusTree loads the b+ tree of the given frame from its root.
+// It returns a CorruptPageError if the root cannot be read back from disk.
+func LoadBplusTree(pool *pool.Bufferpool, frameId uint64) (*BPlusTree, error) {
 
 	bpt := &BPlusTree{}
 	bpt.pool = pool
@@ -52,27 +54,32 @@ func LoadBplusTree(pool *pool.Bufferpool, frameId uint64) *BPlusTree {
 	// Retrieve root page id from frame
 	root, err := pool.GetRoot(bpt.frameId)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
+	size, err := pool.GetSize(bpt.frameId)
+	if err != nil {
+		return nil, err
+	}
 	if root == 0 {
-		panic("Cannot load exiting b+ tree instance. Invalid page id. Got pageId 0")
+		return nil, &kverrors.InvalidMetadataError{Root: root, Size: size}
 	}
+	bpt.size = int(size)
 
 	bpt.root, err = bpt.where(root)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	bpt.order = uint64(len(bpt.root.Entries) / 2)
 	bpt.fanout = uint64(len(bpt.root.Children) / 2)
 
-	return bpt
+	return bpt, nil
 
 }
 
 // Insert puts a key/value pair in the B+ tree.
-func (bpt *BPlusTree) Insert(key [16]byte, value uint64) (success bool, err error) {
+func (bpt *BPlusTree) Insert(key []byte, value uint64) (success bool, err error) {
 
 	e := pool.Entry{Key: key, Value: value}
 
@@ -91,7 +98,7 @@ func (bpt *BPlusTree) Insert(key [16]byte, value uint64) (success bool, err erro
 }
 
 // Insert a subtree for a certain key in the B+ tree.
-func (bpt *BPlusTree) InsertSubTree(key [16]byte, frameId uint64) (success bool, err error) {
+func (bpt *BPlusTree) InsertSubTree(key []byte, frameId uint64) (success bool, err error) {
 
 	e := pool.Entry{Key: key, IsTree: true, Value: frameId}
 
@@ -99,44 +106,75 @@ func (bpt *BPlusTree) InsertSubTree(key [16]byte, frameId uint64) (success bool,
 
 	if success {
 		bpt.size++
-		return success, nil
+		return success, bpt.pool.Update(bpt.frameId, bpt.root.Id, uint64(bpt.size))
 	}
 
-	return success, err
+	if err != nil {
+		return success, err
+	}
+
+	return success, bpt.pool.Update(bpt.frameId, bpt.root.Id, uint64(bpt.size))
 }
 
 // Remove deletes a given key and its entry in the B+ tree.
-// This deletion is lazy, it only deletes the entry in the node without rebaleasing the tree.
-func (bpt *BPlusTree) Remove(key [16]byte) (value uint64, err error) {
+// A node left with too few entries borrows from a sibling or is merged with it, the pages of merged nodes
+// are released to the bufferpool and a root left with a single child is replaced by it.
+func (bpt *BPlusTree) Remove(key []byte) (value uint64, err error) {
 
-	if id, at, found, err := bpt.search(bpt.root.Id, key); err != nil {
+	// The root may have been evicted from the bufferpool since the tree last queried it.
+	root, err := bpt.where(bpt.root.Id)
+	if err != nil {
 		return 0, err
-	} else if found {
-		node, err := bpt.where(id)
+	}
+	bpt.root = root
 
+	ids, slots, err := bpt.trace(key)
+	if err != nil {
+		return 0, err
+	}
+	leaf, err := bpt.where(ids[len(ids)-1])
+	if err != nil {
+		return 0, err
+	}
+	at, found := leaf.Search(key)
+	if !found {
+		return 0, &kverrors.KeyNotFoundError{Key: key}
+	}
+	if bpt.pool.AppendOnly() {
+		ids, err = bpt.shadow(ids, slots)
 		if err != nil {
-			bpt.pool.Update(bpt.frameId, bpt.root.Id, uint64(bpt.size))
 			return 0, err
 		}
-
-		e, err := node.DeleteEntryAt(at)
-
+		leaf, err = bpt.where(ids[len(ids)-1])
 		if err != nil {
-			bpt.pool.Update(bpt.frameId, bpt.root.Id, uint64(bpt.size))
 			return 0, err
 		}
-		bpt.size--
+	}
 
-		return e.Value, bpt.pool.Update(bpt.frameId, bpt.root.Id, uint64(bpt.size))
+	e, err := leaf.DeleteEntryAt(at)
+	if err != nil {
+		return 0, err
 	}
+	bpt.size--
 
-	return 0, &kverrors.KeyNotFoundError{Key: key}
+	if at == 0 && leaf.NumberOfEntries > 0 {
+		err = bpt.separate(ids, slots, leaf.Entries[0])
+	}
+	if err == nil {
+		err = bpt.rebalance(ids, slots, len(ids)-1)
+	}
+	if err != nil {
+		bpt.pool.Update(bpt.frameId, bpt.root.Id, uint64(bpt.size))
+		return 0, err
+	}
+
+	return e.Value, bpt.pool.Update(bpt.frameId, bpt.root.Id, uint64(bpt.size))
 
 }
 
 // Search returns the valu for a given key among the nodes of the B+tree.
 // If the key is not found, it returns a nil pointer and an error.
-func (bpt *BPlusTree) Search(key [16]byte) (uint64, error) {
+func (bpt *BPlusTree) Search(key []byte) (uint64, error) {
 
 	if id, at, found, err := bpt.search(bpt.root.Id, key); err != nil {
 		return 0, err
@@ -155,7 +193,7 @@ func (bpt *BPlusTree) Search(key [16]byte) (uint64, error) {
 // Search returns the tree entry for a given key among the nodes of the B+tree.
 // Used for HB+ Trie instance.
 // If the key is not found, it returns a nil pointer and an error.
-func (bpt *BPlusTree) SearchTreeEntry(key [16]byte) (*pool.Entry, error) {
+func (bpt *BPlusTree) SearchTreeEntry(key []byte) (*pool.Entry, error) {
 
 	if id, at, found, err := bpt.search(bpt.root.Id, key); err != nil {
 		return nil, err
@@ -177,8 +215,14 @@ func (bpt *BPlusTree) Len() int { return bpt.size }
 // Returns the frame id of the current b+ tree instance
 func (bpt *BPlusTree) GetFrameId() uint64 { return bpt.frameId }
 
+// Prefix returns the key bytes skipped by the B+ tree, common to all the keys it holds.
+func (bpt *BPlusTree) Prefix() ([]byte, error) { return bpt.pool.GetPrefix(bpt.frameId) }
+
+// SetPrefix records the key bytes skipped by the B+ tree.
+func (bpt *BPlusTree) SetPrefix(prefix []byte) error { return bpt.pool.SetPrefix(bpt.frameId, prefix) }
+
 // search recursively search for a key in the node and its children.
-func (bpt *BPlusTree) search(id uint64, key [16]byte) (child uint64, at int, found bool, err error) {
+func (bpt *BPlusTree) search(id uint64, key []byte) (child uint64, at int, found bool, err error) {
 
 	node, err := bpt.where(id)
 	if err != nil {
@@ -199,80 +243,118 @@ func (bpt *BPlusTree) search(id uint64, key [16]byte) (child uint64, at int, fou
 	return bpt.search(childID, key)
 }
 
-// split the given three nodes
+// split the full node nID, the child at index i of the node pID, between itself and the empty node siblingID.
+// The node keeps the lower half of its entries and the sibling, inserted after it, takes the upper half.
+// Querying a node may evict any other one from the bufferpool, so each node is modified right after being queried.
 func (bpt *BPlusTree) split(pID, nID, siblingID uint64, i int) error {
 
-	p, err := bpt.where(pID)
+	n, err := bpt.where(nID)
 	if err != nil {
 		return err
 	}
 
-	n, err := bpt.where(nID)
-	if err != nil {
-		return err
+	leaf := n.IsLeaf()
+	next := n.Next
+	var separator pool.Entry
+	var entries []pool.Entry
+	var children []uint64
+	if leaf {
+		separator, entries = bpt.splitLeaf(n, siblingID)
+	} else {
+		separator, entries, children = bpt.splitNode(n)
 	}
 
 	sibling, err := bpt.where(siblingID)
 	if err != nil {
 		return err
 	}
-
-	if n.IsLeaf() {
-		bpt.splitLeaf(p, n, sibling, i)
-	} else {
-		bpt.splitNode(p, n, sibling, i)
+	copy(sibling.Entries[:], entries)
+	sibling.NumberOfEntries = uint64(len(entries))
+	copy(sibling.Children[:], children)
+	sibling.NumberOfChildren = uint64(len(children))
+	// Leaves are not linked in append-only mode.
+	if leaf && !bpt.pool.AppendOnly() {
+		sibling.Next = next
+		sibling.Prev = nID
 	}
+	sibling.Dirty = true
 
-	return nil
-}
+	// The leaf following a leaf being split must now point back to the sibling.
+	if leaf && next != 0 && !bpt.pool.AppendOnly() {
+		following, err := bpt.where(next)
+		if err != nil {
+			return err
+		}
+		following.Prev = siblingID
+		following.Dirty = true
+	}
 
-// split the (internal) node into the given three nodes
-func (bpt *BPlusTree) splitNode(left, middle, right *pool.Node, i int) error {
-	parentKey := middle.Entries[bpt.fanout-1]
-	copy(right.Entries[:], middle.Entries[:bpt.fanout])
-	right.NumberOfEntries = bpt.fanout - 1
-	copy(middle.Entries[:], middle.Entries[bpt.fanout:])
-	middle.NumberOfEntries = bpt.fanout
-	copy(right.Children[:], middle.Children[:bpt.fanout])
-	right.NumberOfChildren = bpt.fanout
-	copy(middle.Children[:], middle.Children[bpt.fanout:])
-	middle.NumberOfChildren = bpt.fanout
-	err := left.InsertChildAt(i, right)
+	p, err := bpt.where(pID)
 	if err != nil {
 		return err
 	}
-	err = left.InsertEntryAt(i, parentKey)
+	err = p.InsertChildIdAt(i+1, siblingID)
 	if err != nil {
 		return err
 	}
-	return nil
+	return p.InsertEntryAt(i, separator)
 }
 
-// split the leaf into the given three nodes
-func (bpt *BPlusTree) splitLeaf(left, middle, right *pool.Node, i int) error {
-	right.Next = middle.Next
-	right.Prev = middle.Id
-	middle.Next = right.Id
-
-	copy(right.Entries[:], middle.Entries[bpt.order:])
-	right.NumberOfEntries = bpt.order - 1
-	copy(middle.Entries[:], middle.Entries[:bpt.order])
-	middle.NumberOfEntries = bpt.order
-	err := left.InsertChildAt(i+1, right)
-	if err != nil {
-		return err
-	}
-	err = left.InsertEntryAt(i, right.Entries[0])
-	if err != nil {
-		return err
-	}
-	return nil
+// splitNode keeps the lower half of the children of the given (internal) node and returns the upper half,
+// along with the separator between both halves which moves up to the parent.
+func (bpt *BPlusTree) splitNode(n *pool.Node) (pool.Entry, []pool.Entry, []uint64) {
+	separator := n.Entries[bpt.fanout-1]
+	entries := append([]pool.Entry(nil), n.Entries[bpt.fanout:n.NumberOfEntries]...)
+	children := append([]uint64(nil), n.Children[bpt.fanout:n.NumberOfChildren]...)
+	n.NumberOfEntries = bpt.fanout - 1
+	n.NumberOfChildren = bpt.fanout
+	n.Dirty = true
+	return separator, entries, children
+}
 
+// splitLeaf keeps the lower half of the entries of the given leaf and returns the upper half,
+// whose first key is the separator copied up to the parent. The leaf now points to the given sibling.
+func (bpt *BPlusTree) splitLeaf(n *pool.Node, siblingID uint64) (pool.Entry, []pool.Entry) {
+	entries := append([]pool.Entry(nil), n.Entries[bpt.order:n.NumberOfEntries]...)
+	n.NumberOfEntries = bpt.order
+	if !bpt.pool.AppendOnly() {
+		n.Next = siblingID
+	}
+	n.Dirty = true
+	return entries[0], entries
 }
 
 // insert the key/value pair in the tree.
 // It may rebalance the tree by splitting nodes if necessary.
 func (bpt *BPlusTree) insert(e pool.Entry) (bool, error) {
+	if len(e.Key) > bpt.pool.ChunkSize() {
+		return false, &kverrors.InvalidSizeError{Got: len(e.Key), Should: bpt.pool.ChunkSize()}
+	}
+	// The node keeps the key, it must not share the caller's slice.
+	e.Key = append([]byte(nil), e.Key...)
+
+	// The root may have been evicted from the bufferpool since the tree last queried it.
+	root, err := bpt.where(bpt.root.Id)
+	if err != nil {
+		return false, err
+	}
+	bpt.root = root
+
+	if bpt.pool.AppendOnly() {
+		ids, slots, err := bpt.trace(e.Key)
+		if err != nil {
+			return false, err
+		}
+		_, err = bpt.shadow(ids, slots)
+		if err != nil {
+			return false, err
+		}
+		bpt.root, err = bpt.where(bpt.root.Id)
+		if err != nil {
+			return false, err
+		}
+	}
+
 	if bpt.full(bpt.root) {
 
 		id1, errAlloc1 := bpt.allocate()
@@ -285,25 +367,19 @@ func (bpt *BPlusTree) insert(e pool.Entry) (bool, error) {
 			return false, errAlloc2
 		}
 
-		n1, errFetching1 := bpt.where(id1)
-		n2, errFetching2 := bpt.where(id2)
-
-		if errFetching1 != nil {
-			return false, errFetching1
+		oldRoot := bpt.root.Id
+		newRoot, err := bpt.where(id1)
+		if err != nil {
+			return false, err
 		}
-		if errFetching2 != nil {
-			return false, errFetching2
+		err = newRoot.InsertChildIdAt(0, oldRoot)
+		if err != nil {
+			return false, err
 		}
-
-		newRoot := n1
-		rightSibling := n2
-		oldRoot := bpt.root
-
-		newRoot.InsertChildAt(0, oldRoot)
 		bpt.root = newRoot
 		bpt.pool.SetRoot(bpt.frameId, bpt.root.Id)
 
-		if err := bpt.split(newRoot.Id, oldRoot.Id, rightSibling.Id, 0); err != nil {
+		if err := bpt.split(id1, oldRoot, id2, 0); err != nil {
 			return false, err
 		}
 
@@ -382,15 +458,14 @@ func (bpt *BPlusTree) insertInternal(id uint64, e pool.Entry) (bool, error) {
 			return false, err
 		}
 
-		sibling, err := bpt.where(newid)
-
-		if err != nil {
+		if err := bpt.split(id, childID, newid, at); err != nil {
 
 			return false, err
 		}
 
-		if err := bpt.split(node.Id, child.Id, sibling.Id, at); err != nil {
-
+		// The split may have evicted the node from the bufferpool.
+		node, err = bpt.where(id)
+		if err != nil {
 			return false, err
 		}
 
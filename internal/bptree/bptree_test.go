@@ -1,11 +1,13 @@
 package bptree
 
 import (
+	"bytes"
 	"crypto/sha1"
 	"hbtrie/internal/pool"
 	"math/rand"
 	"os"
 	"path"
+	"sort"
 	"testing"
 )
 
@@ -46,7 +48,7 @@ func TestInsert(t *testing.T) {
 	step := 0
 	for key, value := range values {
 
-		success, err := store.Insert(key, value)
+		success, err := store.Insert(key[:], value)
 		if err != nil {
 			t.Errorf("[step %d] while inserting to kv store(%d): %v", step, key, err)
 			t.FailNow()
@@ -57,7 +59,7 @@ func TestInsert(t *testing.T) {
 			t.FailNow()
 		}
 
-		v, err := store.Search(key)
+		v, err := store.Search(key[:])
 		if err != nil {
 			t.Errorf("[step %d] while searching for key '%v': %v", step, key, err)
 			t.FailNow()
@@ -89,12 +91,12 @@ func TestUpdate(t *testing.T) {
 	step := 0
 	for key, value := range values {
 
-		_, err := store.Search(key)
+		_, err := store.Search(key[:])
 		if err != nil {
 			t.Errorf("[step %d] while searching for key '%v': %v", step, key, err)
 			t.FailNow()
 		}
-		success, err := store.Insert(key, value)
+		success, err := store.Insert(key[:], value)
 
 		if err != nil {
 			t.Errorf("[step %d] while inserting to kv store(%d): %v", step, key, err)
@@ -133,7 +135,7 @@ func TestPageEviction(t *testing.T) {
 	step := 0
 	for key, value := range values {
 
-		success, err := store.Insert(key, value)
+		success, err := store.Insert(key[:], value)
 		if err != nil {
 			t.Errorf("[step %d] while inserting to kv store(%d): %v", step, key, err)
 			t.FailNow()
@@ -144,7 +146,7 @@ func TestPageEviction(t *testing.T) {
 			t.FailNow()
 		}
 
-		v, err := store.Search(key)
+		v, err := store.Search(key[:])
 		if err != nil {
 			t.Errorf("[step %d] while searching for key '%v': %v", step, key, err)
 			t.FailNow()
@@ -175,7 +177,7 @@ func TestWriteOnDisk(t *testing.T) {
 	step := 0
 	for key, value := range values {
 
-		success, err := store.Insert(key, value)
+		success, err := store.Insert(key[:], value)
 		if err != nil {
 			t.Errorf("[step %d] while inserting to kv store(%d): %v", step, key, err)
 			t.FailNow()
@@ -186,7 +188,7 @@ func TestWriteOnDisk(t *testing.T) {
 			t.FailNow()
 		}
 
-		v, err := store.Search(key)
+		v, err := store.Search(key[:])
 		if err != nil {
 			t.Errorf("[step %d] while searching for key '%v': %v", step, key, err)
 			t.FailNow()
@@ -222,7 +224,7 @@ func TestWriteAndRetrieveFromDisk(t *testing.T) {
 	step := 0
 	for key, value := range values {
 
-		success, err := store.Insert(key, value)
+		success, err := store.Insert(key[:], value)
 		if err != nil {
 			t.Errorf("[step %d] while inserting to kv store(%d): %v", step, key, err)
 			t.FailNow()
@@ -233,7 +235,7 @@ func TestWriteAndRetrieveFromDisk(t *testing.T) {
 			t.FailNow()
 		}
 
-		v, err := store.Search(key)
+		v, err := store.Search(key[:])
 		if err != nil {
 			t.Errorf("[step %d] while searching for key '%v': %v", step, key, err)
 			t.FailNow()
@@ -265,7 +267,7 @@ func TestWriteAndRetrieveFromDisk(t *testing.T) {
 	step = 0
 	for key, value := range values {
 
-		v, err := store2.Search(key)
+		v, err := store2.Search(key[:])
 		if err != nil {
 			t.Errorf("[step %d] while searching for key '%v': %v", step, key, err)
 			t.FailNow()
@@ -315,7 +317,7 @@ func TestWriteAndRetrieveFromDiskMultiple(t *testing.T) {
 				t.Errorf("[step %d] expected frame id %d, got %d", step, step+1, store.frameId)
 				t.FailNow()
 			}
-			success, err := stores[step].Insert(key, value)
+			success, err := stores[step].Insert(key[:], value)
 			if err != nil {
 				t.Errorf("[step %d] while inserting to kv store(%d): %v", step, key, err)
 				t.FailNow()
@@ -326,7 +328,7 @@ func TestWriteAndRetrieveFromDiskMultiple(t *testing.T) {
 				t.FailNow()
 			}
 
-			v, err := store.Search(key)
+			v, err := store.Search(key[:])
 			if err != nil {
 				t.Errorf("[step %d] while searching for key '%v': %v", step, key, err)
 				t.FailNow()
@@ -377,7 +379,7 @@ func TestWriteAndRetrieveFromDiskMultiple(t *testing.T) {
 		step := 0
 
 		for _, store := range stores2 {
-			v, err := store.Search(key)
+			v, err := store.Search(key[:])
 			if err != nil {
 				t.Errorf("[step %d] while searching for key '%v': %v", step, key, err)
 				t.FailNow()
@@ -391,3 +393,261 @@ func TestWriteAndRetrieveFromDiskMultiple(t *testing.T) {
 		}
 	}
 }
+
+func TestCursor(t *testing.T) {
+	p, err := pool.NewBufferpool(5, storeDataPath)
+	if err != nil {
+		t.Errorf("could not create bufferpool: %v", err)
+		t.FailNow()
+	}
+	t.Cleanup(func() {
+		p.Close()
+		p.Clean()
+
+	})
+	store = NewBplusTree(p)
+
+	ok, err := store.Cursor().First()
+	if err != nil || ok {
+		t.Errorf("expected an empty tree, got %t: %v", ok, err)
+		t.FailNow()
+	}
+
+	keys := make([][16]byte, 0, size)
+	h := sha1.New()
+	for i := 0; i < size; i++ {
+		h.Write([]byte{byte(i)})
+		key := [16]byte{}
+		copy(key[:], h.Sum(nil)[:16])
+		keys = append(keys, key)
+		_, err := store.Insert(key[:], uint64(i))
+		if err != nil {
+			t.Errorf("[step %d] while inserting to kv store(%d): %v", i, key, err)
+			t.FailNow()
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i][:], keys[j][:]) < 0
+	})
+
+	cursor := store.Cursor()
+	step := 0
+	for ok, err := cursor.First(); ok; ok, err = cursor.Next() {
+		if err != nil {
+			t.Errorf("[step %d] while iterating: %v", step, err)
+			t.FailNow()
+		}
+		e, err := cursor.Entry()
+		if err != nil {
+			t.Errorf("[step %d] while reading entry: %v", step, err)
+			t.FailNow()
+		}
+		if !bytes.Equal(e.Key, keys[step][:]) {
+			t.Errorf("[step %d] expected %v, got %v", step, keys[step], e.Key)
+			t.FailNow()
+		}
+		step++
+	}
+	if step != len(keys) {
+		t.Errorf("expected %d entries, got %d", len(keys), step)
+		t.FailNow()
+	}
+
+	step = len(keys) - 1
+	for ok, err := cursor.Last(); ok; ok, err = cursor.Prev() {
+		if err != nil {
+			t.Errorf("[step %d] while iterating: %v", step, err)
+			t.FailNow()
+		}
+		e, err := cursor.Entry()
+		if err != nil {
+			t.Errorf("[step %d] while reading entry: %v", step, err)
+			t.FailNow()
+		}
+		if !bytes.Equal(e.Key, keys[step][:]) {
+			t.Errorf("[step %d] expected %v, got %v", step, keys[step], e.Key)
+			t.FailNow()
+		}
+		step--
+	}
+	if step != -1 {
+		t.Errorf("expected %d entries, got %d", len(keys), len(keys)-1-step)
+		t.FailNow()
+	}
+
+	for i := 0; i < 100; i++ {
+		at := rand.Intn(len(keys))
+		ok, err := cursor.Seek(keys[at][:])
+		if err != nil || !ok {
+			t.Errorf("[step %d] could not seek %v: %v", i, keys[at], err)
+			t.FailNow()
+		}
+		e, _ := cursor.Entry()
+		if !bytes.Equal(e.Key, keys[at][:]) {
+			t.Errorf("[step %d] expected %v, got %v", i, keys[at], e.Key)
+			t.FailNow()
+		}
+	}
+}
+
+func TestFreePages(t *testing.T) {
+	p, err := pool.NewBufferpool(5, storeDataPath)
+	if err != nil {
+		t.Errorf("could not create bufferpool: %v", err)
+		t.FailNow()
+	}
+	t.Cleanup(func() {
+		p.Close()
+		p.Clean()
+	})
+	store = NewBplusTree(p)
+
+	keys := make([][16]byte, 0, size)
+	h := sha1.New()
+	for i := 0; i < size; i++ {
+		h.Write([]byte{byte(i)})
+		key := [16]byte{}
+		copy(key[:], h.Sum(nil)[:16])
+		keys = append(keys, key)
+		_, err := store.Insert(key[:], uint64(i))
+		if err != nil {
+			t.Errorf("[step %d] while inserting to kv store(%d): %v", i, key, err)
+			t.FailNow()
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i][:], keys[j][:]) < 0 })
+	pages := p.Stats().Pages
+
+	// Removing the smallest half of the keys empties the leaves holding them.
+	for i, key := range keys[:size/2] {
+		_, err := store.Remove(key[:])
+		if err != nil {
+			t.Errorf("[step %d] while removing %v: %v", i, key, err)
+			t.FailNow()
+		}
+	}
+	free := p.Stats().FreePages
+	if free == 0 {
+		t.Errorf("expected free pages after removing %d keys", size/2)
+		t.FailNow()
+	}
+	cursor := store.Cursor()
+	ok, err := cursor.First()
+	for i := size / 2; i < size; i++ {
+		if err != nil || !ok {
+			t.Errorf("[step %d] expected an entry: %v", i, err)
+			t.FailNow()
+		}
+		e, _ := cursor.Entry()
+		if !bytes.Equal(e.Key, keys[i][:]) {
+			t.Errorf("[step %d] expected %v, got %v", i, keys[i], e.Key)
+			t.FailNow()
+		}
+		ok, err = cursor.Next()
+	}
+	if ok || err != nil {
+		t.Errorf("expected the end of the tree: %v", err)
+		t.FailNow()
+	}
+
+	// The free list survives a write and a reload of the tree.
+	err = store.Write()
+	if err != nil {
+		t.Errorf("while writing the tree: %v", err)
+		t.FailNow()
+	}
+	frameId := store.GetFrameId()
+	p.Close()
+	p, err = pool.NewBufferpool(5, storeDataPath)
+	if err != nil {
+		t.Errorf("could not create bufferpool: %v", err)
+		t.FailNow()
+	}
+	store, err = ReadBpTreeFromDisk(p, frameId)
+	if err != nil {
+		t.Errorf("while reading the tree: %v", err)
+		t.FailNow()
+	}
+	if p.Stats().FreePages != free {
+		t.Errorf("expected %d free pages, got %d", free, p.Stats().FreePages)
+		t.FailNow()
+	}
+
+	// Released pages are reused before new ones are allocated.
+	for i, key := range keys[:size/2] {
+		_, err := store.Insert(key[:], uint64(i))
+		if err != nil {
+			t.Errorf("[step %d] while inserting to kv store(%d): %v", i, key, err)
+			t.FailNow()
+		}
+	}
+	if p.Stats().FreePages >= free {
+		t.Errorf("expected fewer than %d free pages, got %d", free, p.Stats().FreePages)
+		t.FailNow()
+	}
+	if grown := p.Stats().Pages - pages; grown >= free {
+		t.Errorf("expected the %d free pages to be reused, %d pages allocated", free, grown)
+		t.FailNow()
+	}
+	for i, key := range keys {
+		_, err := store.Search(key[:])
+		if err != nil {
+			t.Errorf("[step %d] while searching %v: %v", i, key, err)
+			t.FailNow()
+		}
+	}
+}
+
+// depth returns the number of levels of the given tree, leaves included.
+func depth(t *testing.T, bpt *BPlusTree) int {
+	levels := 1
+	node, err := bpt.where(bpt.root.Id)
+	for err == nil && !node.IsLeaf() {
+		levels++
+		node, err = bpt.where(node.Children[0])
+	}
+	if err != nil {
+		t.Errorf("while querying node: %v", err)
+		t.FailNow()
+	}
+	return levels
+}
+
+func TestSplitDeepTree(t *testing.T) {
+	// With the greatest chunk size, nodes hold few entries: internal nodes below the root split after a few thousand keys.
+	for _, appendOnly := range []bool{false, true} {
+		p, err := pool.NewBufferpoolWithOptions(storeDataPath, &pool.Options{Allocation: 16, ChunkSize: pool.MaxChunkSize, AppendOnly: appendOnly})
+		if err != nil {
+			t.Errorf("could not create bufferpool: %v", err)
+			t.FailNow()
+		}
+		bpt := NewBplusTree(p)
+
+		r := rand.New(rand.NewSource(1))
+		expected := make(map[string]uint64)
+		for step := 0; depth(t, bpt) < 5; step++ {
+			key := make([]byte, 1+r.Intn(pool.MaxChunkSize))
+			r.Read(key)
+			value := r.Uint64()
+			_, err := bpt.Insert(key, value)
+			if err != nil {
+				t.Errorf("[step %d] while inserting %v: %v", step, key, err)
+				t.FailNow()
+			}
+			expected[string(key)] = value
+			if step%500 == 0 {
+				checkInvariants(t, bpt, p)
+			}
+		}
+		checkInvariants(t, bpt, p)
+		for key, value := range expected {
+			v, err := bpt.Search([]byte(key))
+			if err != nil || v != value {
+				t.Errorf("while searching %v: got %d, %v", []byte(key), v, err)
+				t.FailNow()
+			}
+		}
+		p.Close()
+		p.Clean()
+	}
+}
@@ -0,0 +1,208 @@
+package bptree
+
+import (
+	"hbtrie/internal/pool"
+)
+
+// Cursor walks the entries of a B+ tree in order by following the linked list of leaves.
+// In append-only mode, where leaves are not linked, the neighbouring leaves are found from the root.
+// A cursor holds page ids rather than memory references so that it survives page eviction.
+// It is invalidated by any subsequent insertion or removal in the tree.
+type Cursor struct {
+	bpt  *BPlusTree
+	node uint64
+	at   int
+}
+
+// Cursor returns a new cursor over the tree. It has to be positioned with First, Last or Seek before use.
+func (bpt *BPlusTree) Cursor() *Cursor {
+	return &Cursor{bpt: bpt}
+}
+
+// First positions the cursor on the smallest entry of the tree.
+// It returns false if the tree is empty.
+func (c *Cursor) First() (bool, error) {
+	id, err := c.bpt.leftmost(c.bpt.root.Id)
+	if err != nil {
+		return false, err
+	}
+	c.node, c.at = id, 0
+	return c.forward()
+}
+
+// Last positions the cursor on the greatest entry of the tree.
+// It returns false if the tree is empty.
+func (c *Cursor) Last() (bool, error) {
+	id, err := c.bpt.rightmost(c.bpt.root.Id)
+	if err != nil {
+		return false, err
+	}
+	node, err := c.bpt.where(id)
+	if err != nil {
+		return false, err
+	}
+	c.node, c.at = id, int(node.NumberOfEntries)-1
+	return c.backward()
+}
+
+// Seek positions the cursor on the smallest entry greater than or equal to the given key.
+// It returns false if there is no such entry.
+func (c *Cursor) Seek(key []byte) (bool, error) {
+	id, at, _, err := c.bpt.search(c.bpt.root.Id, key)
+	if err != nil {
+		return false, err
+	}
+	c.node, c.at = id, at
+	return c.forward()
+}
+
+// Next moves the cursor to the next entry. It returns false if there is none.
+func (c *Cursor) Next() (bool, error) {
+	if c.node == 0 {
+		return false, nil
+	}
+	c.at++
+	return c.forward()
+}
+
+// Prev moves the cursor to the previous entry. It returns false if there is none.
+func (c *Cursor) Prev() (bool, error) {
+	if c.node == 0 {
+		return false, nil
+	}
+	c.at--
+	return c.backward()
+}
+
+// Entry returns a copy of the entry the cursor is positioned on.
+func (c *Cursor) Entry() (pool.Entry, error) {
+	node, err := c.bpt.where(c.node)
+	if err != nil {
+		return pool.Entry{}, err
+	}
+	return node.Entries[c.at], nil
+}
+
+// forward skips to the following leaves until the cursor points to an existing entry.
+func (c *Cursor) forward() (bool, error) {
+	for c.node != 0 {
+		node, err := c.bpt.where(c.node)
+		if err != nil {
+			return false, err
+		}
+		if c.at < int(node.NumberOfEntries) {
+			return true, nil
+		}
+		next, err := c.bpt.following(c.node)
+		if err != nil {
+			return false, err
+		}
+		c.node, c.at = next, 0
+	}
+	return false, nil
+}
+
+// backward skips to the preceding leaves until the cursor points to an existing entry.
+func (c *Cursor) backward() (bool, error) {
+	for c.node != 0 {
+		if c.at >= 0 {
+			return true, nil
+		}
+		id, err := c.bpt.preceding(c.node)
+		if err != nil {
+			return false, err
+		}
+		c.node = id
+		if c.node == 0 {
+			break
+		}
+		prev, err := c.bpt.where(c.node)
+		if err != nil {
+			return false, err
+		}
+		c.at = int(prev.NumberOfEntries) - 1
+	}
+	return false, nil
+}
+
+// leftmost returns the id of the leftmost leaf under the given node.
+func (bpt *BPlusTree) leftmost(id uint64) (uint64, error) {
+	node, err := bpt.where(id)
+	if err != nil {
+		return 0, err
+	}
+	if node.IsLeaf() {
+		return id, nil
+	}
+	return bpt.leftmost(node.Children[0])
+}
+
+// rightmost returns the id of the rightmost leaf under the given node.
+func (bpt *BPlusTree) rightmost(id uint64) (uint64, error) {
+	node, err := bpt.where(id)
+	if err != nil {
+		return 0, err
+	}
+	if node.IsLeaf() {
+		return id, nil
+	}
+	return bpt.rightmost(node.Children[node.NumberOfChildren-1])
+}
+
+// following returns the id of the leaf following the given one, or zero if it is the last one.
+func (bpt *BPlusTree) following(id uint64) (uint64, error) {
+	node, err := bpt.where(id)
+	if err != nil {
+		return 0, err
+	}
+	if !bpt.pool.AppendOnly() {
+		return node.Next, nil
+	}
+	if node.NumberOfEntries == 0 {
+		return 0, nil
+	}
+	// The following leaf is the leftmost one of the closest subtree on the right of the path to the greatest key.
+	ids, slots, err := bpt.trace(node.Entries[node.NumberOfEntries-1].Key)
+	if err != nil {
+		return 0, err
+	}
+	for level := len(slots) - 1; level >= 0; level-- {
+		parent, err := bpt.where(ids[level])
+		if err != nil {
+			return 0, err
+		}
+		if slots[level]+1 < int(parent.NumberOfChildren) {
+			return bpt.leftmost(parent.Children[slots[level]+1])
+		}
+	}
+	return 0, nil
+}
+
+// preceding returns the id of the leaf preceding the given one, or zero if it is the first one.
+func (bpt *BPlusTree) preceding(id uint64) (uint64, error) {
+	node, err := bpt.where(id)
+	if err != nil {
+		return 0, err
+	}
+	if !bpt.pool.AppendOnly() {
+		return node.Prev, nil
+	}
+	if node.NumberOfEntries == 0 {
+		return 0, nil
+	}
+	// The preceding leaf is the rightmost one of the closest subtree on the left of the path to the smallest key.
+	ids, slots, err := bpt.trace(node.Entries[0].Key)
+	if err != nil {
+		return 0, err
+	}
+	for level := len(slots) - 1; level >= 0; level-- {
+		if slots[level] > 0 {
+			parent, err := bpt.where(ids[level])
+			if err != nil {
+				return 0, err
+			}
+			return bpt.rightmost(parent.Children[slots[level]-1])
+		}
+	}
+	return 0, nil
+}
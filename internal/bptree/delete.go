@@ -0,0 +1,322 @@
+package bptree
+
+import "hbtrie/internal/pool"
+
+// The deletion follows the path from the root to the leaf holding the key, then rebalances it bottom-up.
+// Since querying a node may evict another one from the bufferpool, a node is only modified right after being queried.
+
+// trace returns the ids of the nodes from the root to the leaf where the given key belongs,
+// along with the index of each of them among the children of its parent.
+func (bpt *BPlusTree) trace(key []byte) (ids []uint64, slots []int, err error) {
+	id := bpt.root.Id
+	for {
+		node, err := bpt.where(id)
+		if err != nil {
+			return nil, nil, err
+		}
+		ids = append(ids, id)
+		if node.IsLeaf() {
+			return ids, slots, nil
+		}
+		at, found := node.Search(key)
+		if found {
+			at++
+		}
+		slots = append(slots, at)
+		id = node.Children[at]
+	}
+}
+
+// separate sets the given entry, the new smallest one of the leaf ending the given path,
+// as the separator of the closest ancestor for which the leaf is not in the leftmost subtree.
+func (bpt *BPlusTree) separate(ids []uint64, slots []int, e pool.Entry) error {
+	for level := len(slots) - 1; level >= 0; level-- {
+		if slots[level] == 0 {
+			continue
+		}
+		node, err := bpt.where(ids[level])
+		if err != nil {
+			return err
+		}
+		node.Entries[slots[level]-1] = e
+		node.Dirty = true
+		return nil
+	}
+	return nil
+}
+
+// minEntries returns the least number of entries of a node other than the root.
+func (bpt *BPlusTree) minEntries(n *pool.Node) uint64 {
+	if n.IsLeaf() {
+		return bpt.fanout - 1
+	}
+	return bpt.order - 1
+}
+
+// rebalance restores the number of entries of the node at the given level of the given path.
+// A node with too few entries borrows one from a sibling that can spare it, or is merged with a sibling
+// otherwise, in which case its parent is rebalanced in turn.
+func (bpt *BPlusTree) rebalance(ids []uint64, slots []int, level int) error {
+	if level == 0 {
+		return bpt.collapse()
+	}
+	node, err := bpt.where(ids[level])
+	if err != nil {
+		return err
+	}
+	minimum := bpt.minEntries(node)
+	if node.NumberOfEntries >= minimum {
+		return nil
+	}
+
+	parent, err := bpt.where(ids[level-1])
+	if err != nil {
+		return err
+	}
+	slot := slots[level-1]
+	siblings := int(parent.NumberOfChildren)
+	var left, right uint64
+	if slot > 0 {
+		left = parent.Children[slot-1]
+	}
+	if slot < siblings-1 {
+		right = parent.Children[slot+1]
+	}
+
+	if left != 0 {
+		sibling, err := bpt.where(left)
+		if err != nil {
+			return err
+		}
+		if sibling.NumberOfEntries > minimum {
+			left, err = bpt.shadowChild(ids[level-1], slot-1)
+			if err != nil {
+				return err
+			}
+			return bpt.borrowLeft(ids[level-1], left, ids[level], slot)
+		}
+	}
+	if right != 0 {
+		sibling, err := bpt.where(right)
+		if err != nil {
+			return err
+		}
+		if sibling.NumberOfEntries > minimum {
+			right, err = bpt.shadowChild(ids[level-1], slot+1)
+			if err != nil {
+				return err
+			}
+			return bpt.borrowRight(ids[level-1], ids[level], right, slot)
+		}
+	}
+
+	// The right node of a merge is released, only the left one has to be copied.
+	if left != 0 {
+		left, err = bpt.shadowChild(ids[level-1], slot-1)
+		if err != nil {
+			return err
+		}
+		err = bpt.merge(ids[level-1], left, ids[level], slot-1)
+	} else if right != 0 {
+		err = bpt.merge(ids[level-1], ids[level], right, slot)
+	}
+	if err != nil {
+		return err
+	}
+	return bpt.rebalance(ids, slots, level-1)
+}
+
+// borrowLeft moves the greatest entry of the left sibling to the node at the given slot of the parent.
+func (bpt *BPlusTree) borrowLeft(parentId, leftId, nodeId uint64, slot int) error {
+	left, err := bpt.where(leftId)
+	if err != nil {
+		return err
+	}
+	last := int(left.NumberOfEntries) - 1
+	e, err := left.DeleteEntryAt(last)
+	if err != nil {
+		return err
+	}
+	var child uint64
+	if !left.IsLeaf() {
+		child, err = left.DeleteChildAt(int(left.NumberOfChildren) - 1)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The moved entry becomes the separator of a leaf, while the separator moves down to an internal node.
+	separator := e
+	if child != 0 {
+		parent, err := bpt.where(parentId)
+		if err != nil {
+			return err
+		}
+		separator, e = e, parent.Entries[slot-1]
+	}
+
+	node, err := bpt.where(nodeId)
+	if err != nil {
+		return err
+	}
+	err = node.InsertEntryAt(0, e)
+	if err != nil {
+		return err
+	}
+	if child != 0 {
+		err = node.InsertChildIdAt(0, child)
+		if err != nil {
+			return err
+		}
+	}
+
+	parent, err := bpt.where(parentId)
+	if err != nil {
+		return err
+	}
+	parent.Entries[slot-1] = separator
+	parent.Dirty = true
+	return nil
+}
+
+// borrowRight moves the smallest entry of the right sibling to the node at the given slot of the parent.
+func (bpt *BPlusTree) borrowRight(parentId, nodeId, rightId uint64, slot int) error {
+	right, err := bpt.where(rightId)
+	if err != nil {
+		return err
+	}
+	e, err := right.DeleteEntryAt(0)
+	if err != nil {
+		return err
+	}
+	var child uint64
+	if !right.IsLeaf() {
+		child, err = right.DeleteChildAt(0)
+		if err != nil {
+			return err
+		}
+	}
+	// The smallest entry left in a leaf becomes its separator, while the separator moves down to an internal node.
+	separator := right.Entries[0]
+	if child != 0 {
+		parent, err := bpt.where(parentId)
+		if err != nil {
+			return err
+		}
+		separator, e = e, parent.Entries[slot]
+	}
+
+	node, err := bpt.where(nodeId)
+	if err != nil {
+		return err
+	}
+	err = node.InsertEntryAt(int(node.NumberOfEntries), e)
+	if err != nil {
+		return err
+	}
+	if child != 0 {
+		err = node.InsertChildIdAt(int(node.NumberOfChildren), child)
+		if err != nil {
+			return err
+		}
+	}
+
+	parent, err := bpt.where(parentId)
+	if err != nil {
+		return err
+	}
+	parent.Entries[slot] = separator
+	parent.Dirty = true
+	return nil
+}
+
+// merge moves the entries of the right node into the left one, separated by the given entry index of the parent,
+// then removes the right node from the parent and releases its page.
+func (bpt *BPlusTree) merge(parentId, leftId, rightId uint64, at int) error {
+	right, err := bpt.where(rightId)
+	if err != nil {
+		return err
+	}
+	entries := append([]pool.Entry(nil), right.Entries[:right.NumberOfEntries]...)
+	children := append([]uint64(nil), right.Children[:right.NumberOfChildren]...)
+	next := right.Next
+
+	// The separator moves down between the entries of merged internal nodes.
+	if len(children) > 0 {
+		parent, err := bpt.where(parentId)
+		if err != nil {
+			return err
+		}
+		entries = append([]pool.Entry{parent.Entries[at]}, entries...)
+	}
+
+	left, err := bpt.where(leftId)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		err := left.InsertEntryAt(int(left.NumberOfEntries), e)
+		if err != nil {
+			return err
+		}
+	}
+	for _, child := range children {
+		err := left.InsertChildIdAt(int(left.NumberOfChildren), child)
+		if err != nil {
+			return err
+		}
+	}
+	if left.IsLeaf() && !bpt.pool.AppendOnly() {
+		left.Next = next
+		left.Dirty = true
+		if next != 0 {
+			n, err := bpt.where(next)
+			if err != nil {
+				return err
+			}
+			n.Prev = leftId
+			n.Dirty = true
+		}
+	}
+
+	parent, err := bpt.where(parentId)
+	if err != nil {
+		return err
+	}
+	_, err = parent.DeleteEntryAt(at)
+	if err != nil {
+		return err
+	}
+	_, err = parent.DeleteChildAt(at + 1)
+	if err != nil {
+		return err
+	}
+	return bpt.pool.FreeNode(bpt.frameId, rightId)
+}
+
+// collapse replaces an internal root holding a single child by that child and releases its page.
+func (bpt *BPlusTree) collapse() error {
+	for {
+		root, err := bpt.where(bpt.root.Id)
+		if err != nil {
+			return err
+		}
+		if root.IsLeaf() || root.NumberOfChildren > 1 {
+			bpt.root = root
+			return nil
+		}
+		child, err := bpt.where(root.Children[0])
+		if err != nil {
+			return err
+		}
+		bpt.root = child
+		err = bpt.pool.SetRoot(bpt.frameId, child.Id)
+		if err != nil {
+			return err
+		}
+		err = bpt.pool.FreeNode(bpt.frameId, root.Id)
+		if err != nil {
+			return err
+		}
+	}
+}
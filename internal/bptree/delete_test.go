@@ -0,0 +1,219 @@
+package bptree
+
+import (
+	"bytes"
+	"errors"
+	"hbtrie/internal/kverrors"
+	"hbtrie/internal/pool"
+	"math/rand"
+	"testing"
+)
+
+// checkInvariants walks the given tree and reports the first violated invariant of a B+ tree:
+// sorted entries within their separators, the smallest key of a subtree as its separator, the least number
+// of entries of the nodes other than the root, leaves at the same depth and chained in order, the size of the tree,
+// and every allocated page either reachable or free. Leaves are not chained and pages not reused in append-only mode.
+func checkInvariants(t *testing.T, bpt *BPlusTree, p *pool.Bufferpool) {
+	leaves := make([]*pool.Node, 0)
+	depth := -1
+	nodes := 0
+	count := 0
+
+	var walk func(id uint64, level int, lower, upper []byte) []byte
+	walk = func(id uint64, level int, lower, upper []byte) []byte {
+		node, err := bpt.where(id)
+		if err != nil {
+			t.Errorf("while querying node %d: %v", id, err)
+			t.FailNow()
+		}
+		nodes++
+		n := int(node.NumberOfEntries)
+		if id != bpt.root.Id && uint64(n) < bpt.minEntries(node) {
+			t.Errorf("node %d holds %d entries, expected at least %d", id, n, bpt.minEntries(node))
+			t.FailNow()
+		}
+		for i := 0; i < n; i++ {
+			key := node.Entries[i].Key
+			if i > 0 && bytes.Compare(node.Entries[i-1].Key, key) >= 0 {
+				t.Errorf("node %d: unsorted entries %v, %v", id, node.Entries[i-1].Key, key)
+				t.FailNow()
+			}
+			if (lower != nil && bytes.Compare(key, lower) < 0) || (upper != nil && bytes.Compare(key, upper) >= 0) {
+				t.Errorf("node %d: entry %v outside of [%v, %v)", id, key, lower, upper)
+				t.FailNow()
+			}
+		}
+
+		if node.IsLeaf() {
+			if depth == -1 {
+				depth = level
+			}
+			if level != depth {
+				t.Errorf("leaf %d at depth %d, expected %d", id, level, depth)
+				t.FailNow()
+			}
+			leaves = append(leaves, node)
+			count += n
+			if n == 0 {
+				return nil
+			}
+			return node.Entries[0].Key
+		}
+
+		if int(node.NumberOfChildren) != n+1 {
+			t.Errorf("node %d: %d children for %d entries", id, node.NumberOfChildren, n)
+			t.FailNow()
+		}
+		children := append([]uint64(nil), node.Children[:node.NumberOfChildren]...)
+		separators := make([][]byte, n)
+		for i := 0; i < n; i++ {
+			separators[i] = node.Entries[i].Key
+		}
+		var smallest []byte
+		for i, child := range children {
+			low, up := lower, upper
+			if i > 0 {
+				low = separators[i-1]
+			}
+			if i < n {
+				up = separators[i]
+			}
+			min := walk(child, level+1, low, up)
+			if i == 0 {
+				smallest = min
+			} else if !bytes.Equal(min, separators[i-1]) {
+				t.Errorf("node %d: separator %v of a subtree starting with %v", id, separators[i-1], min)
+				t.FailNow()
+			}
+		}
+		return smallest
+	}
+	walk(bpt.root.Id, 0, nil, nil)
+
+	if count != bpt.Len() {
+		t.Errorf("expected %d entries, found %d", bpt.Len(), count)
+		t.FailNow()
+	}
+	if p.AppendOnly() {
+		return
+	}
+	for i, leaf := range leaves {
+		prev, next := uint64(0), uint64(0)
+		if i > 0 {
+			prev = leaves[i-1].Id
+		}
+		if i < len(leaves)-1 {
+			next = leaves[i+1].Id
+		}
+		if leaf.Prev != prev || leaf.Next != next {
+			t.Errorf("leaf %d linked to %d and %d, expected %d and %d", leaf.Id, leaf.Prev, leaf.Next, prev, next)
+			t.FailNow()
+		}
+	}
+	stats := p.Stats()
+	if uint64(nodes)+stats.FreePages != stats.Pages {
+		t.Errorf("%d reachable and %d free pages out of %d", nodes, stats.FreePages, stats.Pages)
+		t.FailNow()
+	}
+}
+
+func TestRemoveInvariants(t *testing.T) {
+	// Nodes are evicted while being rebalanced, by the LRU policy of a small frame or by any policy of a small budget.
+	// The nodes of the greatest chunk size hold so few entries that the tree grows past 3 levels, internal nodes below
+	// the root being split, borrowed from and merged.
+	for _, chunkSize := range []int{pool.DefaultChunkSize, pool.MaxChunkSize} {
+		for _, options := range []pool.Options{{Allocation: 5}, {Budget: 8, Policy: pool.ARC}, {Budget: 8, Policy: pool.TwoQ}} {
+			options.ChunkSize = chunkSize
+			p, err := pool.NewBufferpoolWithOptions(storeDataPath, &options)
+			if err != nil {
+				t.Errorf("could not create bufferpool: %v", err)
+				t.FailNow()
+			}
+			levels := removeRandomly(t, p)
+			if chunkSize == pool.MaxChunkSize && levels < 4 {
+				t.Errorf("expected the tree to grow past 3 levels, got %d", levels)
+				t.FailNow()
+			}
+			p.Close()
+			p.Clean()
+		}
+	}
+}
+
+// removeRandomly checks the invariants of a tree of the given bufferpool along random inserts and removes
+// of keys up to the chunk size of the bufferpool, and returns the greatest number of levels of the tree.
+func removeRandomly(t *testing.T, p *pool.Bufferpool) int {
+	bpt := NewBplusTree(p)
+
+	r := rand.New(rand.NewSource(1))
+	expected := make(map[string]uint64)
+	keys := make([]string, 0)
+	levels := 0
+	for step := 0; step < 30000; step++ {
+		// Deletes become more frequent than inserts halfway, so that the tree grows then shrinks.
+		remove := r.Intn(100) < 35
+		if step > 15000 {
+			remove = r.Intn(100) < 65
+		}
+		if remove && len(keys) > 0 {
+			at := r.Intn(len(keys))
+			key := keys[at]
+			keys[at] = keys[len(keys)-1]
+			keys = keys[:len(keys)-1]
+			value, err := bpt.Remove([]byte(key))
+			if err != nil || value != expected[key] {
+				t.Errorf("[step %d] while removing %v: got %d, %v", step, []byte(key), value, err)
+				t.FailNow()
+			}
+			delete(expected, key)
+		} else {
+			key := make([]byte, 1+r.Intn(p.ChunkSize()))
+			r.Read(key)
+			if _, ok := expected[string(key)]; !ok {
+				keys = append(keys, string(key))
+			}
+			value := r.Uint64()
+			_, err := bpt.Insert(key, value)
+			if err != nil {
+				t.Errorf("[step %d] while inserting %v: %v", step, key, err)
+				t.FailNow()
+			}
+			expected[string(key)] = value
+		}
+		if step%2500 == 0 {
+			checkInvariants(t, bpt, p)
+			if d := depth(t, bpt); d > levels {
+				levels = d
+			}
+		}
+	}
+	checkInvariants(t, bpt, p)
+	for key, value := range expected {
+		v, err := bpt.Search([]byte(key))
+		if err != nil || v != value {
+			t.Errorf("while searching %v: got %d, %v", []byte(key), v, err)
+			t.FailNow()
+		}
+	}
+
+	// Removing every key leaves an empty root leaf, all the other pages being free.
+	for _, key := range keys {
+		_, err := bpt.Remove([]byte(key))
+		if err != nil {
+			t.Errorf("while removing %v: %v", []byte(key), err)
+			t.FailNow()
+		}
+	}
+	checkInvariants(t, bpt, p)
+	if stats := p.Stats(); stats.Pages-stats.FreePages != 1 {
+		t.Errorf("expected a single page in use, got %+v", stats)
+		t.FailNow()
+	}
+	var notFound *kverrors.KeyNotFoundError
+	_, err := bpt.Remove([]byte("missing"))
+	if !errors.As(err, &notFound) {
+		t.Errorf("expected a KeyNotFoundError, got %v", err)
+		t.FailNow()
+	}
+	return levels
+}
@@ -15,8 +15,11 @@ func (bpt *BPlusTree) where(id uint64) (*pool.Node, error) {
 func (bpt *BPlusTree) allocate() (uint64, error) {
 
 	node, err := bpt.pool.NewNode(bpt.frameId)
+	if err != nil {
+		return 0, err
+	}
 
-	return node.Id, err
+	return node.Id, nil
 }
 
 // Write writes the tree to disk according to the BufferPool logic.
@@ -0,0 +1,68 @@
+package bptree
+
+// In append-only mode, the nodes of the last committed version of the tree are copied before they are modified,
+// see pool.Bufferpool.AppendOnly. An insertion or a removal first copies the path from the root to the leaf
+// holding the key, so that the parent of each copy is a copy itself and points to it. A sibling involved
+// in a rebalancing is copied as well, right before it is modified.
+// The leaves are not linked either: relinking a copied leaf would copy its neighbours in turn.
+
+// immutable states whether the node with the given id has to be copied before it is modified.
+func (bpt *BPlusTree) immutable(id uint64) bool {
+	return bpt.pool.AppendOnly() && bpt.pool.Committed(bpt.frameId, id)
+}
+
+// shadow copies the nodes of the given path, as returned by trace, which have to be copied before they are modified.
+// It returns the ids of the nodes of the path once copied.
+func (bpt *BPlusTree) shadow(ids []uint64, slots []int) ([]uint64, error) {
+	copies := make([]uint64, len(ids))
+	id, err := bpt.shadowRoot()
+	if err != nil {
+		return nil, err
+	}
+	copies[0] = id
+	for level, slot := range slots {
+		id, err = bpt.shadowChild(copies[level], slot)
+		if err != nil {
+			return nil, err
+		}
+		copies[level+1] = id
+	}
+	return copies, nil
+}
+
+// shadowRoot copies the root if it has to be copied before it is modified, and returns the id of the root.
+func (bpt *BPlusTree) shadowRoot() (uint64, error) {
+	if !bpt.immutable(bpt.root.Id) {
+		return bpt.root.Id, nil
+	}
+	root, err := bpt.pool.Shadow(bpt.frameId, bpt.root.Id)
+	if err != nil {
+		return 0, err
+	}
+	bpt.root = root
+	return root.Id, bpt.pool.SetRoot(bpt.frameId, root.Id)
+}
+
+// shadowChild copies the child at the given slot of the given node if it has to be copied before it is modified,
+// and returns the id of the child. The given node must have been copied already.
+func (bpt *BPlusTree) shadowChild(parentId uint64, slot int) (uint64, error) {
+	parent, err := bpt.where(parentId)
+	if err != nil {
+		return 0, err
+	}
+	id := parent.Children[slot]
+	if !bpt.immutable(id) {
+		return id, nil
+	}
+	child, err := bpt.pool.Shadow(bpt.frameId, id)
+	if err != nil {
+		return 0, err
+	}
+	parent, err = bpt.where(parentId)
+	if err != nil {
+		return 0, err
+	}
+	parent.Children[slot] = child.Id
+	parent.Dirty = true
+	return child.Id, nil
+}
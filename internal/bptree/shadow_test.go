@@ -0,0 +1,155 @@
+package bptree
+
+import (
+	"bytes"
+	"hbtrie/internal/pool"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// checkVersion reads the tree rooted at the given page of the given tree and compares its entries with the given ones.
+func checkVersion(t *testing.T, bpt *BPlusTree, root uint64, expected map[string]uint64) {
+	node, err := bpt.where(root)
+	if err != nil {
+		t.Errorf("while querying root %d: %v", root, err)
+		t.FailNow()
+	}
+	version := &BPlusTree{pool: bpt.pool, frameId: bpt.frameId, root: node, size: len(expected), order: bpt.order, fanout: bpt.fanout}
+	keys := make([]string, 0, len(expected))
+	for key := range expected {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	c := version.Cursor()
+	ok, err := c.First()
+	for _, key := range keys {
+		if err != nil || !ok {
+			t.Errorf("expected %v, got %v", []byte(key), err)
+			t.FailNow()
+		}
+		e, err := c.Entry()
+		if err != nil || !bytes.Equal(e.Key, []byte(key)) || e.Value != expected[key] {
+			t.Errorf("expected %v: %d, got %v: %d, %v", []byte(key), expected[key], e.Key, e.Value, err)
+			t.FailNow()
+		}
+		ok, err = c.Next()
+	}
+	if err != nil || ok {
+		t.Errorf("expected the end of the tree, got %v", err)
+		t.FailNow()
+	}
+
+	// The leaves are walked backward from the root as well.
+	ok, err = c.Last()
+	for i := len(keys) - 1; i >= 0; i-- {
+		if err != nil || !ok {
+			t.Errorf("expected %v, got %v", []byte(keys[i]), err)
+			t.FailNow()
+		}
+		e, err := c.Entry()
+		if err != nil || !bytes.Equal(e.Key, []byte(keys[i])) {
+			t.Errorf("expected %v, got %v, %v", []byte(keys[i]), e.Key, err)
+			t.FailNow()
+		}
+		ok, err = c.Prev()
+	}
+	if err != nil || ok {
+		t.Errorf("expected the start of the tree, got %v", err)
+		t.FailNow()
+	}
+}
+
+func TestAppendOnly(t *testing.T) {
+	for _, options := range []*pool.Options{{Allocation: 5, AppendOnly: true}, {Budget: 8, AppendOnly: true}, {Budget: 8, SingleFile: true, AppendOnly: true}} {
+		p, err := pool.NewBufferpoolWithOptions(storeDataPath, options)
+		if err != nil {
+			t.Errorf("could not create bufferpool: %v", err)
+			t.FailNow()
+		}
+		bpt := NewBplusTree(p)
+
+		r := rand.New(rand.NewSource(1))
+		expected := make(map[string]uint64)
+		keys := make([]string, 0)
+		var committed map[string]uint64
+		var root uint64
+		for step := 0; step < 6000; step++ {
+			if r.Intn(100) < 40 && len(keys) > 0 {
+				at := r.Intn(len(keys))
+				key := keys[at]
+				keys[at] = keys[len(keys)-1]
+				keys = keys[:len(keys)-1]
+				_, err := bpt.Remove([]byte(key))
+				if err != nil {
+					t.Errorf("[step %d] while removing %v: %v", step, []byte(key), err)
+					t.FailNow()
+				}
+				delete(expected, key)
+			} else {
+				key := make([]byte, 1+r.Intn(16))
+				r.Read(key)
+				if _, ok := expected[string(key)]; !ok {
+					keys = append(keys, string(key))
+				}
+				value := r.Uint64()
+				_, err := bpt.Insert(key, value)
+				if err != nil {
+					t.Errorf("[step %d] while inserting %v: %v", step, key, err)
+					t.FailNow()
+				}
+				expected[string(key)] = value
+			}
+
+			// The pages of a commit are never written again: the committed version can still be read.
+			if step%1000 == 999 {
+				if committed != nil {
+					checkVersion(t, bpt, root, committed)
+				}
+				checkInvariants(t, bpt, p)
+				err := p.WriteTrie(bpt.GetFrameId(), uint64(bpt.Len()))
+				if err != nil {
+					t.Errorf("[step %d] while committing: %v", step, err)
+					t.FailNow()
+				}
+				committed = make(map[string]uint64, len(expected))
+				for key, value := range expected {
+					committed[key] = value
+				}
+				root = bpt.root.Id
+			}
+		}
+		checkVersion(t, bpt, root, committed)
+		checkVersion(t, bpt, bpt.root.Id, expected)
+
+		// A crash before the next commit leaves the last one intact, although modified pages have been evicted since.
+		p.Close()
+		p, err = pool.NewBufferpoolWithOptions(storeDataPath, &pool.Options{Allocation: 5})
+		if err != nil {
+			t.Errorf("could not reopen bufferpool: %v", err)
+			t.FailNow()
+		}
+		if !p.AppendOnly() {
+			t.Errorf("expected the append-only mode to be kept")
+			t.FailNow()
+		}
+		_, _, _, err = p.ReadTrie()
+		if err != nil {
+			t.Errorf("while reading trie: %v", err)
+			t.FailNow()
+		}
+		bpt, err = ReadBpTreeFromDisk(p, bpt.GetFrameId())
+		if err != nil {
+			t.Errorf("while reading tree: %v", err)
+			t.FailNow()
+		}
+		if bpt.Len() != len(committed) {
+			t.Errorf("expected %d committed entries, got %d", len(committed), bpt.Len())
+			t.FailNow()
+		}
+		checkVersion(t, bpt, bpt.root.Id, committed)
+		p.Close()
+		p.Clean()
+	}
+}
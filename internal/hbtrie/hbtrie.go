@@ -1,6 +1,7 @@
 package hbtrie
 
 import (
+	"bytes"
 	"errors"
 	"hbtrie/internal/bptree"
 	"hbtrie/internal/kverrors"
@@ -10,7 +11,7 @@ import (
 type HBTrieInstance struct {
 	rootTree  *bptree.BPlusTree // Pointer to Root B+ tree
 	pool      *pool.Bufferpool
-	chunkSize int // default 16 bytes
+	chunkSize int // configured in the bufferpool, default 16 bytes
 	size      uint64
 }
 
@@ -20,27 +21,40 @@ func NewHBPlusTrie(pool *pool.Bufferpool) *HBTrieInstance {
 
 	return &HBTrieInstance{
 		pool:      pool,
-		chunkSize: 16,
+		chunkSize: pool.ChunkSize(),
 		rootTree:  tree,
 	}
 }
 
-// Returns the value for the given key. If it does not exist return 0 and an error.
-func (hbt *HBTrieInstance) Search(key []byte) (uint64, error) {
+// Returns the value for the given key. If it does not exist return nil and an error.
+func (hbt *HBTrieInstance) Search(key []byte) ([]byte, error) {
 	// Search in the Root tree for the chunked key
-	val, _, _, err := hbt.search(hbt.rootTree, key)
+	position, _, _, err := hbt.search(hbt.rootTree, key, key)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	return val, nil
+	// The leaf entry holds the position of the value in the value log
+	return hbt.pool.ReadValue(position)
+}
+
+// Contains states whether the given key is in the trie, without reading its value.
+func (hbt *HBTrieInstance) Contains(key []byte) (bool, error) {
+	_, _, _, err := hbt.search(hbt.rootTree, key, key)
+	var keyError *kverrors.KeyNotFoundError
+	if errors.As(err, &keyError) {
+		return false, nil
+	}
+	return err == nil, err
 }
 
 // search recursively search for a key in the node and its children.
-func (hbt *HBTrieInstance) search(bpt *bptree.BPlusTree, key []byte) (uint64, []byte, *bptree.BPlusTree, error) {
-	chunkedKey, trimmedKey := createChunkFromKey(key)
+// key is the remaining of the full key once the chunks of the parent trees are consumed.
+// It returns the position of the record of the key, the remaining key and the tree where it is or should be inserted.
+func (hbt *HBTrieInstance) search(bpt *bptree.BPlusTree, key, full []byte) (uint64, []byte, *bptree.BPlusTree, error) {
+	chunkedKey, trimmedKey := hbt.createChunkFromKey(key)
 	// Search in the Root tree for the chunked key
-	val, err := bpt.SearchTreeEntry(*chunkedKey)
+	val, err := bpt.SearchTreeEntry(chunkedKey)
 	if err != nil {
 		return 0, key, bpt, err
 	}
@@ -49,25 +63,46 @@ func (hbt *HBTrieInstance) search(bpt *bptree.BPlusTree, key []byte) (uint64, []
 	if val.IsTree {
 		// Decode the frameId from the value field
 		// Load b+ tree instance using the frameid
-		subbpt := bptree.LoadBplusTree(hbt.pool, val.Value)
+		subbpt, prefix, err := hbt.loadSubTree(val)
+		if err != nil {
+			return 0, key, bpt, err
+		}
+		// The key diverges within the prefix skipped by the subtree, it belongs to the current tree.
+		if !bytes.HasPrefix(trimmedKey, prefix) {
+			return 0, key, bpt, &kverrors.KeyNotFoundError{Key: full}
+		}
 		// Call recursively search.
-		return hbt.search(subbpt, *trimmedKey)
-	} else {
-		// it is a leaf entry
-		return val.Value, key, bpt, nil
+		return hbt.search(subbpt, trimmedKey[len(prefix):], full)
+	}
+
+	// it is a leaf entry, it may be another key starting with the same chunks.
+	position := val.Value
+	stored, err := hbt.pool.ReadKey(position)
+	if err != nil {
+		return 0, key, bpt, err
 	}
+	if !bytes.Equal(stored, full) {
+		return 0, key, bpt, &kverrors.KeyNotFoundError{Key: full}
+	}
+	return position, key, bpt, nil
 }
 
 // Inserts the key and value in the trie.
-func (hbt *HBTrieInstance) Insert(key []byte, value uint64) (err error) {
+func (hbt *HBTrieInstance) Insert(key []byte, value []byte) (err error) {
 	errKeyNotFound := &kverrors.KeyNotFoundError{Key: key}
 
-	_, trimmedKey, bpt, err := hbt.search(hbt.rootTree, key)
+	// The key and value are appended to the value log and the leaf entry only holds their position
+	position, err := hbt.pool.WriteValue(key, value)
+	if err != nil {
+		return err
+	}
+
+	previous, trimmedKey, bpt, err := hbt.search(hbt.rootTree, key, key)
 	if err != nil {
 		// Key doesn't exist
 		if errors.As(err, &errKeyNotFound) {
 			hbt.size++
-			return hbt.insert(trimmedKey, value, bpt)
+			return hbt.insert(trimmedKey, key, position, bpt)
 		} else {
 			// Unknown error
 			return err
@@ -76,10 +111,37 @@ func (hbt *HBTrieInstance) Insert(key []byte, value uint64) (err error) {
 	}
 	// If key exists, then update the value
 	// We have the reference to the last subtree and the remaining key.
-	err = hbt.insert(trimmedKey, value, bpt)
+	err = hbt.insert(trimmedKey, key, position, bpt)
+	if err != nil {
+		return err
+	}
 
-	return err
+	// The previous record of the key is left to the next compaction.
+	return hbt.pool.ReleaseValue(previous)
+
+}
+
+// Deletes the key from the trie. It returns a KeyNotFoundError if the key doesn't exist.
+// A subtree left empty is removed from its parent, and a subtree left with a single key is replaced by it.
+func (hbt *HBTrieInstance) Delete(key []byte) error {
+	// We have the subtrees down to the one holding the leaf entry and the remaining key.
+	levels, trimmedKey, err := hbt.trace(key)
+	if err != nil {
+		return err
+	}
+
+	chunkedKey, _ := hbt.createChunkFromKey(trimmedKey)
+	position, err := levels[len(levels)-1].tree.Remove(chunkedKey)
+	if err != nil {
+		return err
+	}
+	hbt.size--
+	err = hbt.pool.ReleaseValue(position)
+	if err != nil {
+		return err
+	}
 
+	return hbt.collapse(levels)
 }
 
 // Returns the number of keys in the trie.
@@ -87,58 +149,256 @@ func (hbt *HBTrieInstance) Len() uint64 {
 	return hbt.size
 }
 
-// Recursively inserts the key and value in the trie and insert subsequent B+ trees if required.
-func (hbt *HBTrieInstance) insert(key []byte, value uint64, bpt *bptree.BPlusTree) error {
-	chunkedKey, trimmedKey := createChunkFromKey(key)
-	// If key is longer than 16 bytes
-	if len(key) > 16 {
-		subTree, err := hbt.createSubTree(bpt, *chunkedKey)
+// Recursively inserts the key and value in the trie.
+// A key is held by a leaf entry of its first distinct chunk, subsequent B+ trees are only created
+// when two keys share a chunk.
+func (hbt *HBTrieInstance) insert(key, full []byte, value uint64, bpt *bptree.BPlusTree) error {
+	var keyError *kverrors.KeyNotFoundError
+	chunkedKey, trimmedKey := hbt.createChunkFromKey(key)
+
+	e, err := bpt.SearchTreeEntry(chunkedKey)
+	if err != nil && !errors.As(err, &keyError) {
+		return err
+	}
+	if err == nil {
+		if e.IsTree {
+			subTree, prefix, err := hbt.loadSubTree(e)
+			if err != nil {
+				return err
+			}
+			if bytes.HasPrefix(trimmedKey, prefix) {
+				return hbt.insert(trimmedKey[len(prefix):], full, value, subTree)
+			}
+			// The key diverges within the prefix skipped by the subtree: it is split at the diverging chunk.
+			err = hbt.splitSubTree(bpt, chunkedKey, subTree, prefix, trimmedKey)
+			if err != nil {
+				return err
+			}
+			return hbt.insert(key, full, value, bpt)
+		}
+		stored, err := hbt.pool.ReadKey(e.Value)
 		if err != nil {
 			return err
 		}
-		// Create recursively a new b+ tree instance
-		return hbt.insert(*trimmedKey, value, subTree)
-	} else {
-		// Key is smaller than 16 bytes => create a leaf node.
-		success, err := bpt.Insert(*chunkedKey, value)
-		if success {
+		// Another key shares the chunk: both are moved to a new subtree.
+		if !bytes.Equal(stored, full) {
+			_, storedKey := hbt.createChunkFromKey(stored[len(full)-len(key):])
+			err := hbt.createSubTree(bpt, chunkedKey, storedKey, trimmedKey)
+			if err != nil {
+				return err
+			}
+			return hbt.insert(key, full, value, bpt)
+		}
+	}
+
+	// The chunk is free or holds the same key => insert or update the leaf entry.
+	_, err = bpt.Insert(chunkedKey, value)
+	return err
+}
+
+// branch is a b+ tree along the path of a key, with the chunk of the entry referencing it in its parent tree.
+type branch struct {
+	tree  *bptree.BPlusTree
+	chunk []byte
+}
+
+// trace returns the b+ trees from the root tree down to the one holding the leaf entry of the given key,
+// along with the remaining of the key in the last one. It returns a KeyNotFoundError if the key doesn't exist.
+func (hbt *HBTrieInstance) trace(key []byte) ([]branch, []byte, error) {
+	levels := []branch{{tree: hbt.rootTree}}
+	remaining := key
+	for {
+		chunkedKey, trimmedKey := hbt.createChunkFromKey(remaining)
+		e, err := levels[len(levels)-1].tree.SearchTreeEntry(chunkedKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !e.IsTree {
+			stored, err := hbt.pool.ReadKey(e.Value)
+			if err != nil {
+				return nil, nil, err
+			}
+			if !bytes.Equal(stored, key) {
+				return nil, nil, &kverrors.KeyNotFoundError{Key: key}
+			}
+			return levels, remaining, nil
+		}
+		subTree, prefix, err := hbt.loadSubTree(e)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !bytes.HasPrefix(trimmedKey, prefix) {
+			return nil, nil, &kverrors.KeyNotFoundError{Key: key}
+		}
+		levels = append(levels, branch{tree: subTree, chunk: chunkedKey})
+		remaining = trimmedKey[len(prefix):]
+	}
+}
+
+// collapse removes the subtrees of the given path left with less than two entries, from the deepest one up.
+// An empty subtree is removed from its parent tree, which may in turn be left with a single entry.
+// The single entry of a subtree takes its place in the parent tree: a leaf entry as it is, and the entry of another
+// subtree along with the chunks skipped by both, as long as they fit in a prefix.
+// The frame of a removed subtree is unregistered and its file deleted.
+func (hbt *HBTrieInstance) collapse(levels []branch) error {
+	for i := len(levels) - 1; i > 0; i-- {
+		subTree, parent, chunk := levels[i].tree, levels[i-1].tree, levels[i].chunk
+		switch subTree.Len() {
+		case 0:
+			_, err := parent.Remove(chunk)
+			if err != nil {
+				return err
+			}
+		case 1:
+			return hbt.replace(parent, chunk, subTree)
+		default:
 			return nil
 		}
+		err := hbt.pool.Unregister(subTree.GetFrameId())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
+// replace puts the single entry of the given subtree in place of the entry referencing it under the given chunk.
+func (hbt *HBTrieInstance) replace(parent *bptree.BPlusTree, chunk []byte, subTree *bptree.BPlusTree) error {
+	cursor := subTree.Cursor()
+	ok, err := cursor.First()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return &kverrors.KeyNotFoundError{Key: chunk}
+	}
+	e, err := cursor.Entry()
+	if err != nil {
 		return err
 	}
 
+	if e.IsTree {
+		prefix, err := subTree.Prefix()
+		if err != nil {
+			return err
+		}
+		survivor, skipped, err := hbt.loadSubTree(&e)
+		if err != nil {
+			return err
+		}
+		merged := append(append(append([]byte(nil), prefix...), e.Key...), skipped...)
+		if len(e.Key) != hbt.chunkSize || len(merged) > pool.MaxPrefixLen() {
+			return nil
+		}
+		err = survivor.SetPrefix(merged)
+		if err != nil {
+			return err
+		}
+		// The entry already exists, only the frame it points to is updated.
+		_, err = parent.InsertSubTree(chunk, survivor.GetFrameId())
+		if err != nil {
+			return err
+		}
+		return hbt.pool.Unregister(subTree.GetFrameId())
+	}
+
+	// The entry of the subtree is replaced by a leaf entry, which the b+ tree doesn't update in place.
+	_, err = parent.Remove(chunk)
+	if err != nil {
+		return err
+	}
+	_, err = parent.Insert(chunk, e.Value)
+	if err != nil {
+		return err
+	}
+	return hbt.pool.Unregister(subTree.GetFrameId())
 }
 
-func (hbt *HBTrieInstance) createSubTree(bpt *bptree.BPlusTree, key [16]byte) (*bptree.BPlusTree, error) {
+// Creates a subtree for the given chunk and moves the leaf entry holding it to the subtree.
+// stored is the remaining of the moved key after the chunk and key the remaining of the key being inserted.
+// The whole chunks they share are skipped by the subtree rather than creating one subtree per chunk.
+// The entry is held by the remaining of its key after the skipped prefix, or by an empty chunk if the key ends with it,
+// so that the slot holds both the key and the subtree.
+func (hbt *HBTrieInstance) createSubTree(bpt *bptree.BPlusTree, chunk, stored, key []byte) error {
 	subTree := bptree.NewBplusTree(hbt.pool)
 
-	treeFrameId := subTree.GetFrameId()
-	success, err := bpt.InsertSubTree(key, treeFrameId)
+	value, err := bpt.Remove(chunk)
+	if err != nil {
+		return err
+	}
+	prefix := stored[:hbt.commonChunks(stored, key)]
+	err = subTree.SetPrefix(prefix)
+	if err != nil {
+		return err
+	}
+	chunkedKey, _ := hbt.createChunkFromKey(stored[len(prefix):])
+	_, err = subTree.Insert(chunkedKey, value)
+	if err != nil {
+		return err
+	}
+
+	_, err = bpt.InsertSubTree(chunk, subTree.GetFrameId())
+	return err
+}
+
+// Splits the prefix skipped by the given subtree at the first chunk the given key doesn't share.
+// A new subtree skipping the shared chunks takes the place of the subtree for the given chunk,
+// and holds the subtree for the diverging chunk, which keeps skipping the remaining of the prefix.
+func (hbt *HBTrieInstance) splitSubTree(bpt *bptree.BPlusTree, chunk []byte, subTree *bptree.BPlusTree, prefix, key []byte) error {
+	shared := hbt.commonChunks(prefix, key)
+	parent := bptree.NewBplusTree(hbt.pool)
+	err := parent.SetPrefix(prefix[:shared])
+	if err != nil {
+		return err
+	}
+	chunkedKey, trimmedKey := hbt.createChunkFromKey(prefix[shared:])
+	_, err = parent.InsertSubTree(chunkedKey, subTree.GetFrameId())
+	if err != nil {
+		return err
+	}
+	err = subTree.SetPrefix(trimmedKey)
+	if err != nil {
+		return err
+	}
+	// The entry already exists, only the frame it points to is updated.
+	_, err = bpt.InsertSubTree(chunk, parent.GetFrameId())
+	return err
+}
 
-	if success {
-		return subTree, nil
+// Loads the subtree referenced by the given tree entry and returns the prefix it skips.
+func (hbt *HBTrieInstance) loadSubTree(e *pool.Entry) (*bptree.BPlusTree, []byte, error) {
+	subTree, err := bptree.LoadBplusTree(hbt.pool, e.Value)
+	if err != nil {
+		return nil, nil, err
 	}
+	prefix, err := subTree.Prefix()
+	return subTree, prefix, err
+}
 
-	return subTree, err
+// Returns the byte length of the whole chunks the given keys start with.
+// It is bounded so that the prefix can be skipped by a subtree.
+func (hbt *HBTrieInstance) commonChunks(a, b []byte) int {
+	n := 0
+	for n+hbt.chunkSize <= len(a) && n+hbt.chunkSize <= len(b) && n+hbt.chunkSize <= pool.MaxPrefixLen() {
+		if !bytes.Equal(a[n:n+hbt.chunkSize], b[n:n+hbt.chunkSize]) {
+			break
+		}
+		n += hbt.chunkSize
+	}
+	return n
 }
 
-// Returns the first 16 byte chunk and the rest of the given key.
-func createChunkFromKey(key []byte) (*[16]byte, *[]byte) {
-	chunkedKey := [16]byte{}
-	var trimmedKey []byte
-	if len(key) > 16 {
-		trimmedKey = make([]byte, 0, len(key)-16)
-		// Chunked key of 16 bytes
-		copy(chunkedKey[:], key[:16])
+// Returns the first chunk of the given key and the rest of it.
+// If the key is not longer than the chunk size, the chunk is the whole key and the rest is empty.
+// Chunks are not padded: the length of the last chunk is part of the identity of the key.
+func (hbt *HBTrieInstance) createChunkFromKey(key []byte) ([]byte, []byte) {
+	if len(key) > hbt.chunkSize {
+		// Chunked key of chunk size bytes
+		chunkedKey := append([]byte(nil), key[:hbt.chunkSize]...)
 		// original key removed prefix
-		trimmedKey = key[16:]
-	} else {
-		trimmedKey = make([]byte, 0, len(key))
-		copy(chunkedKey[:], key[:])
-		trimmedKey = key
+		return chunkedKey, key[hbt.chunkSize:]
 	}
-	return &chunkedKey, &trimmedKey
+	return append([]byte(nil), key...), []byte{}
 }
 
 // Writes the trie to disk.
@@ -147,23 +407,56 @@ func (hbt *HBTrieInstance) Write() error {
 	return hbt.pool.WriteTrie(hbt.rootTree.GetFrameId(), hbt.size)
 }
 
+// Compacts the files of the trie, see pool.Bufferpool.Compact. The root tree is loaded again from its new pages.
+func (hbt *HBTrieInstance) Compact() (pool.CompactionStats, error) {
+	c, err := hbt.StartCompaction()
+	if err != nil {
+		return pool.CompactionStats{}, err
+	}
+	c.Copy()
+	return hbt.FinishCompaction(c)
+}
+
+// Writes the trie and starts a compaction of its files, see pool.Bufferpool.StartCompaction.
+// The trie can be searched while the files are copied, but must not be modified until the compaction is finished.
+func (hbt *HBTrieInstance) StartCompaction() (*pool.Compaction, error) {
+	return hbt.pool.StartCompaction(hbt.rootTree.GetFrameId(), hbt.size)
+}
+
+// Finishes the given compaction once its files are copied, see pool.Compaction.Finish.
+// The root tree is loaded again from its new pages.
+func (hbt *HBTrieInstance) FinishCompaction(c *pool.Compaction) (pool.CompactionStats, error) {
+	stats, err := c.Finish()
+	if err != nil {
+		return stats, err
+	}
+	hbt.rootTree, err = bptree.LoadBplusTree(hbt.pool, hbt.rootTree.GetFrameId())
+	return stats, err
+}
+
 // Reads the trie from disk.
 func Read(pool *pool.Bufferpool) (*HBTrieInstance, error) {
 	trie := &HBTrieInstance{}
 	trie.pool = pool
-	rootId, size, nframes, err := pool.ReadTrie()
+	rootId, size, _, err := pool.ReadTrie()
 	if err != nil {
 		return trie, err
 	}
 
 	trie.size = size
-	trie.chunkSize = 16
-	root := bptree.LoadBplusTree(pool, rootId)
-	trie.rootTree = root
-
-	for i := uint64(1); i < nframes; i++ {
-		bptree.LoadBplusTree(pool, i)
+	trie.chunkSize = pool.ChunkSize()
+	trie.rootTree, err = bptree.LoadBplusTree(pool, rootId)
+	if err != nil {
+		return trie, err
+	}
 
+	for _, id := range pool.GetFrames() {
+		if id != rootId {
+			_, err = bptree.LoadBplusTree(pool, id)
+			if err != nil {
+				return trie, err
+			}
+		}
 	}
 	return trie, nil
 }
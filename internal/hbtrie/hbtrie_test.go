@@ -1,23 +1,35 @@
 package hbtrie
 
 import (
+	"bytes"
 	"crypto/sha1"
 	"crypto/sha512"
+	"errors"
+	"fmt"
+	"hbtrie/internal/kverrors"
 	"hbtrie/internal/pool"
 	"math/rand"
 	"os"
 	"path"
+	"sort"
 	"testing"
 )
 
-var values map[[64]byte]uint64
+var values map[[64]byte][]byte
 var storeDataPath = path.Join(os.TempDir(), "hbt_store_hbt_test")
 
 const size = 1000
 
+// randValue returns a byte slice of random size containing random bytes.
+func randValue() []byte {
+	b := make([]byte, rand.Intn(64))
+	rand.Read(b)
+	return b
+}
+
 func TestInit(t *testing.T) {
 
-	values = make(map[[64]byte]uint64)
+	values = make(map[[64]byte][]byte)
 	h := sha512.New()
 
 	for i := 0; i < size; i++ {
@@ -25,7 +37,7 @@ func TestInit(t *testing.T) {
 		key := [64]byte{}
 		copy(key[:32], h.Sum(nil)[:32])
 		copy(key[32:64], h.Sum(nil)[:32])
-		value := rand.Uint64()
+		value := randValue()
 		values[key] = value
 	}
 
@@ -60,7 +72,7 @@ func TestInsertBelowChunkSize(t *testing.T) {
 			t.FailNow()
 		}
 
-		if v != value {
+		if !bytes.Equal(v, value) {
 			t.Errorf("[step %d] expected %v, got %v", step, value, v)
 			t.FailNow()
 		}
@@ -96,7 +108,7 @@ func TestInsertAboveChunkSize(t *testing.T) {
 			t.FailNow()
 		}
 
-		if v != value {
+		if !bytes.Equal(v, value) {
 			t.Errorf("[step %d] expected %v, got %v", step, value, v)
 			t.FailNow()
 		}
@@ -132,7 +144,7 @@ func TestInsertSimilarAboveChunkSize(t *testing.T) {
 		// key := make([]byte, 0, 40)
 		// Pick randomely a prefix from a predefined list and append the key to it.
 		key := append(randomPrefix[rand.Intn(10)][:], h.Sum(nil)...)
-		value := rand.Uint64()
+		value := randValue()
 
 		err := store.Insert(key, value)
 		if err != nil {
@@ -146,7 +158,7 @@ func TestInsertSimilarAboveChunkSize(t *testing.T) {
 			t.FailNow()
 		}
 
-		if v != value {
+		if !bytes.Equal(v, value) {
 			t.Errorf("[step %d] expected %v, got %v", step, value, v)
 			t.FailNow()
 		}
@@ -174,7 +186,7 @@ func TestUpdateKeys(t *testing.T) {
 		// key := make([]byte, 0, 40)
 		// Pick randomely a prefix from a predefined list and append the key to it.
 		key := append(h.Sum(nil), h.Sum(nil)...)
-		value := rand.Uint64()
+		value := randValue()
 
 		err := store.Insert(key, value)
 		if err != nil {
@@ -184,7 +196,7 @@ func TestUpdateKeys(t *testing.T) {
 
 		// generate a new value
 		h.Write([]byte{byte(i * 10)})
-		value = rand.Uint64()
+		value = randValue()
 
 		// Update the value with the same key
 		err = store.Insert(key, value)
@@ -199,7 +211,7 @@ func TestUpdateKeys(t *testing.T) {
 			t.FailNow()
 		}
 
-		if v != value {
+		if !bytes.Equal(v, value) {
 			t.Errorf("[step %d] expected %v, got %v", step, value, v)
 			t.FailNow()
 		}
@@ -236,7 +248,7 @@ func TestInsertWithPageEviction(t *testing.T) {
 			t.FailNow()
 		}
 
-		if v != value {
+		if !bytes.Equal(v, value) {
 			t.Errorf("[step %d] expected %v, got %v", step, value, v)
 			t.FailNow()
 		}
@@ -277,7 +289,7 @@ func TestWriteAndRetrieveFromDisk(t *testing.T) {
 			t.FailNow()
 		}
 
-		if v != value {
+		if !bytes.Equal(v, value) {
 			t.Errorf("[step %d] expected %v, got %v", step, value, v)
 			t.FailNow()
 		}
@@ -320,7 +332,7 @@ func TestWriteAndRetrieveFromDisk(t *testing.T) {
 			t.FailNow()
 		}
 
-		if v != value {
+		if !bytes.Equal(v, value) {
 			t.Errorf("[step %d] expected %v, got %v", step, value, v)
 			t.FailNow()
 
@@ -333,3 +345,804 @@ func TestWriteAndRetrieveFromDisk(t *testing.T) {
 	p1.Clean()
 	p2.Clean()
 }
+
+func TestDelete(t *testing.T) {
+	TestInit(t)
+
+	p, err := pool.NewBufferpool(5, storeDataPath)
+	if err != nil {
+		t.Errorf("while creating bufferpool: %v", err)
+		t.FailNow()
+	}
+	t.Cleanup(func() {
+		p.Close()
+		p.Clean()
+	})
+	store := NewHBPlusTrie(p)
+
+	step := 0
+	for key, value := range values {
+		err := store.Insert(key[:], value)
+		if err != nil {
+			t.Errorf("[step %d] while inserting to kv store(%d): %v", step, key, err)
+			t.FailNow()
+		}
+		step++
+	}
+
+	deleted := make(map[[64]byte]bool)
+	step = 0
+	for key := range values {
+		if step%2 == 0 {
+			err := store.Delete(key[:])
+			if err != nil {
+				t.Errorf("[step %d] while deleting key '%v': %v", step, key, err)
+				t.FailNow()
+			}
+			deleted[key] = true
+		}
+		step++
+	}
+
+	expected := uint64(len(values) - len(deleted))
+	if store.Len() != expected {
+		t.Errorf("expected %d, got %d", expected, store.Len())
+		t.FailNow()
+	}
+
+	step = 0
+	for key, value := range values {
+		v, err := store.Search(key[:])
+		if deleted[key] {
+			var keyError *kverrors.KeyNotFoundError
+			if !errors.As(err, &keyError) {
+				t.Errorf("[step %d] expected key '%v' to be deleted, got %v", step, key, err)
+				t.FailNow()
+			}
+			err = store.Delete(key[:])
+			if !errors.As(err, &keyError) {
+				t.Errorf("[step %d] expected key '%v' to be already deleted, got %v", step, key, err)
+				t.FailNow()
+			}
+		} else {
+			if err != nil {
+				t.Errorf("[step %d] while searching for key '%v': %v", step, key, err)
+				t.FailNow()
+			}
+			if !bytes.Equal(v, value) {
+				t.Errorf("[step %d] expected %v, got %v", step, value, v)
+				t.FailNow()
+			}
+		}
+		step++
+	}
+
+	if store.Len() != expected {
+		t.Errorf("expected %d, got %d", expected, store.Len())
+		t.FailNow()
+	}
+}
+
+func TestIterator(t *testing.T) {
+	p, err := pool.NewBufferpool(5, storeDataPath)
+	if err != nil {
+		t.Errorf("while creating bufferpool: %v", err)
+		t.FailNow()
+	}
+	t.Cleanup(func() {
+		p.Close()
+		p.Clean()
+	})
+	store := NewHBPlusTrie(p)
+
+	h := sha1.New()
+	// Create 10 random prefixes
+	randomPrefix := make([][16]byte, 0, 10)
+	for i := 0; i < 10; i++ {
+		h.Write([]byte{byte(i)})
+		key := [16]byte{}
+		copy(key[:], h.Sum(nil)[:16])
+		randomPrefix = append(randomPrefix, key)
+	}
+
+	expected := make(map[string][]byte)
+	for i := 0; i < size; i++ {
+		h.Write([]byte{byte(i)})
+		var key []byte
+		if i%3 == 0 {
+			// Keys below the chunk size
+			key = h.Sum(nil)[:8]
+		} else {
+			key = append(randomPrefix[rand.Intn(10)][:], h.Sum(nil)...)
+		}
+		value := randValue()
+		err := store.Insert(key, value)
+		if err != nil {
+			t.Errorf("[step %d] while inserting to kv store(%d): %v", i, key, err)
+			t.FailNow()
+		}
+		expected[string(key)] = value
+	}
+
+	keys := make([]string, 0, len(expected))
+	for key := range expected {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	it := store.Iterator()
+	step := 0
+	for ok := it.First(); ok; ok = it.Next() {
+		if string(it.Key()) != keys[step] {
+			t.Errorf("[step %d] expected %v, got %v", step, []byte(keys[step]), it.Key())
+			t.FailNow()
+		}
+		if !bytes.Equal(it.Value(), expected[keys[step]]) {
+			t.Errorf("[step %d] expected %v, got %v", step, expected[keys[step]], it.Value())
+			t.FailNow()
+		}
+		step++
+	}
+	if step != len(keys) {
+		t.Errorf("expected %d keys, got %d", len(keys), step)
+		t.FailNow()
+	}
+
+	step = len(keys) - 1
+	for ok := it.Last(); ok; ok = it.Prev() {
+		if string(it.Key()) != keys[step] {
+			t.Errorf("[step %d] expected %v, got %v", step, []byte(keys[step]), it.Key())
+			t.FailNow()
+		}
+		step--
+	}
+	if step != -1 {
+		t.Errorf("expected %d keys, got %d", len(keys), len(keys)-1-step)
+		t.FailNow()
+	}
+
+	for i := 0; i < 100; i++ {
+		at := rand.Intn(len(keys))
+		// Seeking right after a key lands on the following one.
+		seek := append([]byte(keys[at]), 0)
+		ok := it.Seek(seek)
+		if at == len(keys)-1 {
+			if ok {
+				t.Errorf("[step %d] expected no key after %v, got %v", i, seek, it.Key())
+				t.FailNow()
+			}
+			continue
+		}
+		if !ok || string(it.Key()) != keys[at+1] {
+			t.Errorf("[step %d] expected %v, got %v", i, []byte(keys[at+1]), it.Key())
+			t.FailNow()
+		}
+		if !it.Prev() || string(it.Key()) != keys[at] {
+			t.Errorf("[step %d] expected %v, got %v", i, []byte(keys[at]), it.Key())
+			t.FailNow()
+		}
+	}
+
+	err = it.Close()
+	if err != nil {
+		t.Errorf("while closing iterator: %v", err)
+		t.FailNow()
+	}
+}
+
+func TestPrefixIterator(t *testing.T) {
+	p, err := pool.NewBufferpool(10, storeDataPath)
+	if err != nil {
+		t.Errorf("while creating bufferpool: %v", err)
+		t.FailNow()
+	}
+	t.Cleanup(func() {
+		p.Close()
+		p.Clean()
+	})
+	store := NewHBPlusTrie(p)
+
+	prefix := [32]byte{}
+	copy(prefix[:], "tenant-0000000001/users/0000000001")
+	for i := 0; i < size; i++ {
+		key := append(append([]byte{}, prefix[:]...), byte(i/256), byte(i))
+		err := store.Insert(key, []byte{byte(i / 256), byte(i)})
+		if err != nil {
+			t.Errorf("[step %d] while inserting to kv store(%d): %v", i, key, err)
+			t.FailNow()
+		}
+	}
+	err = store.Insert([]byte("tenant-2"), nil)
+	if err != nil {
+		t.Errorf("while inserting to kv store: %v", err)
+		t.FailNow()
+	}
+
+	// The iteration starts from the subtree owning the two chunks of the prefix.
+	it := store.PrefixIterator(append(prefix[:], 0))
+	if !bytes.Equal(it.base, prefix[:]) {
+		t.Errorf("expected iteration to start from %v, got %v", prefix, it.base)
+		t.FailNow()
+	}
+
+	step := 0
+	for ok := it.First(); ok; ok = it.Next() {
+		if !bytes.Equal(it.Value(), []byte{byte(step / 256), byte(step)}) {
+			t.Errorf("[step %d] expected %v, got %v", step, step, it.Value())
+			t.FailNow()
+		}
+		step++
+	}
+	if step != size {
+		t.Errorf("expected %d keys, got %d", size, step)
+		t.FailNow()
+	}
+
+	err = it.Close()
+	if err != nil {
+		t.Errorf("while closing iterator: %v", err)
+		t.FailNow()
+	}
+}
+
+func TestTrailingZeroBytes(t *testing.T) {
+	p, err := pool.NewBufferpool(10, storeDataPath)
+	if err != nil {
+		t.Errorf("while creating bufferpool: %v", err)
+		t.FailNow()
+	}
+	store := NewHBPlusTrie(p)
+
+	// Keys only differing by trailing zero bytes, within the first chunk and beyond it.
+	keys := [][]byte{
+		{},
+		[]byte("a"),
+		[]byte("a\x00"),
+		[]byte("a\x00\x00"),
+		append([]byte("b"), make([]byte, 15)...),
+		append([]byte("c"), make([]byte, 16)...),
+		append([]byte("c"), make([]byte, 17)...),
+		append([]byte("c"), make([]byte, 31)...),
+	}
+	for i, key := range keys {
+		err := store.Insert(key, []byte{byte(i)})
+		if err != nil {
+			t.Errorf("[step %d] while inserting to kv store(%v): %v", i, key, err)
+			t.FailNow()
+		}
+	}
+	if store.Len() != uint64(len(keys)) {
+		t.Errorf("expected %d, got %d", len(keys), store.Len())
+		t.FailNow()
+	}
+
+	// The keys are given in lexicographic order.
+	it := store.Iterator()
+	step := 0
+	for ok := it.First(); ok; ok = it.Next() {
+		if !bytes.Equal(it.Key(), keys[step]) {
+			t.Errorf("[step %d] expected %v, got %v", step, keys[step], it.Key())
+			t.FailNow()
+		}
+		step++
+	}
+	if step != len(keys) {
+		t.Errorf("expected %d keys, got %d", len(keys), step)
+		t.FailNow()
+	}
+
+	err = store.Write()
+	if err != nil {
+		t.Errorf("while writing to disk: %v", err)
+		t.FailNow()
+	}
+	err = p.Close()
+	if err != nil {
+		t.Errorf("while closing bufferpool: %v", err)
+		t.FailNow()
+	}
+	p, err = pool.NewBufferpool(10, storeDataPath)
+	if err != nil {
+		t.Errorf("while creating bufferpool: %v", err)
+		t.FailNow()
+	}
+	t.Cleanup(func() {
+		p.Close()
+		p.Clean()
+	})
+	store, err = Read(p)
+	if err != nil {
+		t.Errorf("while reading from file: %v", err)
+		t.FailNow()
+	}
+
+	for i, key := range keys {
+		v, err := store.Search(key)
+		if err != nil {
+			t.Errorf("[step %d] while searching for key '%v': %v", i, key, err)
+			t.FailNow()
+		}
+		if !bytes.Equal(v, []byte{byte(i)}) {
+			t.Errorf("[step %d] expected %v, got %v", i, []byte{byte(i)}, v)
+			t.FailNow()
+		}
+	}
+}
+
+func TestLeafAndSubTreeCollision(t *testing.T) {
+	p, err := pool.NewBufferpool(10, storeDataPath)
+	if err != nil {
+		t.Errorf("while creating bufferpool: %v", err)
+		t.FailNow()
+	}
+	store := NewHBPlusTrie(p)
+
+	// Each group holds a key of exactly one chunk and longer keys sharing it, inserted in every order.
+	groups := [][][]byte{
+		{[]byte("0123456789abcdef"), []byte("0123456789abcdefX"), []byte("0123456789abcdef0123456789abcdefY")},
+		{[]byte("fedcba9876543210Y"), []byte("fedcba9876543210")},
+		{[]byte("aaaaaaaaaaaaaaaa0123456789abcdefZ"), []byte("aaaaaaaaaaaaaaaa0123456789abcdef"), []byte("aaaaaaaaaaaaaaaa")},
+	}
+	keys := make([][]byte, 0)
+	for _, group := range groups {
+		for _, key := range group {
+			err := store.Insert(key, key)
+			if err != nil {
+				t.Errorf("while inserting to kv store(%s): %v", key, err)
+				t.FailNow()
+			}
+			keys = append(keys, key)
+		}
+	}
+	if store.Len() != uint64(len(keys)) {
+		t.Errorf("expected %d, got %d", len(keys), store.Len())
+		t.FailNow()
+	}
+
+	search := func(store *HBTrieInstance, keys [][]byte) {
+		for _, key := range keys {
+			v, err := store.Search(key)
+			if err != nil {
+				t.Errorf("while searching for key '%s': %v", key, err)
+				t.FailNow()
+			}
+			if !bytes.Equal(v, key) {
+				t.Errorf("expected %s, got %s", key, v)
+				t.FailNow()
+			}
+		}
+	}
+	search(store, keys)
+
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+	it := store.Iterator()
+	step := 0
+	for ok := it.First(); ok; ok = it.Next() {
+		if !bytes.Equal(it.Key(), keys[step]) {
+			t.Errorf("[step %d] expected %s, got %s", step, keys[step], it.Key())
+			t.FailNow()
+		}
+		step++
+	}
+	if step != len(keys) {
+		t.Errorf("expected %d keys, got %d", len(keys), step)
+		t.FailNow()
+	}
+
+	err = store.Write()
+	if err != nil {
+		t.Errorf("while writing to disk: %v", err)
+		t.FailNow()
+	}
+	err = p.Close()
+	if err != nil {
+		t.Errorf("while closing bufferpool: %v", err)
+		t.FailNow()
+	}
+	p, err = pool.NewBufferpool(10, storeDataPath)
+	if err != nil {
+		t.Errorf("while creating bufferpool: %v", err)
+		t.FailNow()
+	}
+	t.Cleanup(func() {
+		p.Close()
+		p.Clean()
+	})
+	store, err = Read(p)
+	if err != nil {
+		t.Errorf("while reading from file: %v", err)
+		t.FailNow()
+	}
+	search(store, keys)
+
+	// Deleting the key of one chunk keeps the longer ones, and the reverse.
+	err = store.Delete(groups[0][0])
+	if err != nil {
+		t.Errorf("while deleting key '%s': %v", groups[0][0], err)
+		t.FailNow()
+	}
+	_, err = store.Search(groups[0][0])
+	var keyError *kverrors.KeyNotFoundError
+	if !errors.As(err, &keyError) {
+		t.Errorf("expected a KeyNotFoundError, got %v", err)
+		t.FailNow()
+	}
+	search(store, groups[0][1:])
+	for _, key := range groups[1] {
+		err = store.Delete(key)
+		if err != nil {
+			t.Errorf("while deleting key '%s': %v", key, err)
+			t.FailNow()
+		}
+	}
+	err = store.Insert(groups[1][1], groups[1][1])
+	if err != nil {
+		t.Errorf("while inserting to kv store(%s): %v", groups[1][1], err)
+		t.FailNow()
+	}
+	search(store, groups[1][1:])
+}
+
+func TestLazySubTrees(t *testing.T) {
+	p, err := pool.NewBufferpool(10, storeDataPath)
+	if err != nil {
+		t.Errorf("while creating bufferpool: %v", err)
+		t.FailNow()
+	}
+	t.Cleanup(func() {
+		p.Close()
+		p.Clean()
+	})
+	store := NewHBPlusTrie(p)
+
+	// Hash keys without a common chunk are all held by the root tree.
+	h := sha512.New()
+	keys := make([][]byte, 0, size)
+	for i := 0; i < size; i++ {
+		h.Write([]byte{byte(i)})
+		key := make([]byte, 0, 256)
+		for len(key) < 256 {
+			key = append(key, h.Sum(nil)...)
+		}
+		keys = append(keys, key)
+		err := store.Insert(key, key[:8])
+		if err != nil {
+			t.Errorf("[step %d] while inserting to kv store(%v): %v", i, key, err)
+			t.FailNow()
+		}
+	}
+	if len(p.GetFrames()) != 1 {
+		t.Errorf("expected %d frame, got %d", 1, len(p.GetFrames()))
+		t.FailNow()
+	}
+
+	// A key sharing the first two chunks of another one creates a single subtree skipping the second chunk.
+	key := append(append([]byte{}, keys[0][:40]...), 1)
+	err = store.Insert(key, key)
+	if err != nil {
+		t.Errorf("while inserting to kv store(%v): %v", key, err)
+		t.FailNow()
+	}
+	if len(p.GetFrames()) != 2 {
+		t.Errorf("expected %d frames, got %d", 2, len(p.GetFrames()))
+		t.FailNow()
+	}
+	keys = append(keys, key)
+
+	for i, key := range keys {
+		v, err := store.Search(key)
+		if err != nil {
+			t.Errorf("[step %d] while searching for key '%v': %v", i, key, err)
+			t.FailNow()
+		}
+		if !bytes.Equal(v, key[:8]) && !bytes.Equal(v, key) {
+			t.Errorf("[step %d] unexpected value %v", i, v)
+			t.FailNow()
+		}
+	}
+	_, err = store.Search(keys[0][:40])
+	var keyError *kverrors.KeyNotFoundError
+	if !errors.As(err, &keyError) {
+		t.Errorf("expected a KeyNotFoundError, got %v", err)
+		t.FailNow()
+	}
+}
+
+func TestSkipPrefix(t *testing.T) {
+	p, err := pool.NewBufferpool(10, storeDataPath)
+	if err != nil {
+		t.Errorf("while creating bufferpool: %v", err)
+		t.FailNow()
+	}
+	store := NewHBPlusTrie(p)
+
+	// The keys share their first three chunks, the subtree of the first one skips the two others.
+	tenant := []byte("tenant-0000000001/namespace-000001/users/0000001")
+	keys := make([][]byte, 0, size+3)
+	for i := 0; i < size; i++ {
+		key := append(append([]byte{}, tenant...), byte(i/256), byte(i))
+		err := store.Insert(key, key)
+		if err != nil {
+			t.Errorf("[step %d] while inserting to kv store(%v): %v", i, key, err)
+			t.FailNow()
+		}
+		keys = append(keys, key)
+	}
+	if len(p.GetFrames()) != 2 {
+		t.Errorf("expected %d frames, got %d", 2, len(p.GetFrames()))
+		t.FailNow()
+	}
+	_, err = store.Search(tenant[:32])
+	var keyError *kverrors.KeyNotFoundError
+	if !errors.As(err, &keyError) {
+		t.Errorf("expected a KeyNotFoundError, got %v", err)
+		t.FailNow()
+	}
+
+	// Seeking keys diverging within the skipped chunks, before or after all the keys of the subtree.
+	it := store.Iterator()
+	for _, key := range [][]byte{tenant[:21], append(tenant[:20:20], 0), append(tenant[:20:20], 0xff)} {
+		ok := it.Seek(key)
+		if bytes.Compare(key, tenant) > 0 {
+			if ok {
+				t.Errorf("expected no key after %v, got %v", key, it.Key())
+				t.FailNow()
+			}
+			continue
+		}
+		if !ok || !bytes.Equal(it.Key(), keys[0]) {
+			t.Errorf("expected %v after seeking %v, got %v", keys[0], key, it.Key())
+			t.FailNow()
+		}
+	}
+	err = it.Close()
+	if err != nil {
+		t.Errorf("while closing iterator: %v", err)
+		t.FailNow()
+	}
+	it = store.PrefixIterator(tenant[:24])
+	if !bytes.Equal(it.base, tenant) {
+		t.Errorf("expected iteration to start from %v, got %v", tenant, it.base)
+		t.FailNow()
+	}
+
+	// Keys diverging within the skipped chunks split them back into one subtree per chunk.
+	diverging := [][]byte{
+		append(append([]byte{}, tenant[:20]...), 'x'),
+		append([]byte{}, tenant[:32]...),
+		append(append([]byte{}, tenant[:40]...), 'x'),
+	}
+	for i, key := range diverging {
+		err := store.Insert(key, key)
+		if err != nil {
+			t.Errorf("[step %d] while inserting to kv store(%v): %v", i, key, err)
+			t.FailNow()
+		}
+		keys = append(keys, key)
+	}
+	if len(p.GetFrames()) != 4 {
+		t.Errorf("expected %d frames, got %d", 4, len(p.GetFrames()))
+		t.FailNow()
+	}
+
+	err = store.Write()
+	if err != nil {
+		t.Errorf("while writing to disk: %v", err)
+		t.FailNow()
+	}
+	p.Close()
+	p, err = pool.NewBufferpool(10, storeDataPath)
+	if err != nil {
+		t.Errorf("while creating bufferpool: %v", err)
+		t.FailNow()
+	}
+	t.Cleanup(func() {
+		p.Close()
+		p.Clean()
+	})
+	store, err = Read(p)
+	if err != nil {
+		t.Errorf("while reading from file: %v", err)
+		t.FailNow()
+	}
+
+	for i, key := range keys {
+		v, err := store.Search(key)
+		if err != nil {
+			t.Errorf("[step %d] while searching for key '%v': %v", i, key, err)
+			t.FailNow()
+		}
+		if !bytes.Equal(v, key) {
+			t.Errorf("[step %d] expected %v, got %v", i, key, v)
+			t.FailNow()
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+	it = store.Iterator()
+	step := 0
+	for ok := it.First(); ok; ok = it.Next() {
+		if !bytes.Equal(it.Key(), keys[step]) {
+			t.Errorf("[step %d] expected %v, got %v", step, keys[step], it.Key())
+			t.FailNow()
+		}
+		step++
+	}
+	if step != len(keys) {
+		t.Errorf("expected %d keys, got %d", len(keys), step)
+		t.FailNow()
+	}
+
+	// Seeking keys around and within the skipped chunks.
+	for _, key := range [][]byte{tenant[:16], tenant[:21], tenant[:33], tenant, append(tenant[:40:40], 0xff)} {
+		at := sort.Search(len(keys), func(i int) bool {
+			return bytes.Compare(keys[i], key) >= 0
+		})
+		ok := it.Seek(key)
+		if at == len(keys) {
+			if ok {
+				t.Errorf("expected no key after %v, got %v", key, it.Key())
+				t.FailNow()
+			}
+			continue
+		}
+		if !ok || !bytes.Equal(it.Key(), keys[at]) {
+			t.Errorf("expected %v after seeking %v, got %v", keys[at], key, it.Key())
+			t.FailNow()
+		}
+	}
+	err = it.Close()
+	if err != nil {
+		t.Errorf("while closing iterator: %v", err)
+		t.FailNow()
+	}
+
+	it = store.PrefixIterator(tenant)
+	step = 0
+	for ok := it.Seek(tenant); ok && bytes.HasPrefix(it.Key(), tenant); ok = it.Next() {
+		step++
+	}
+	if step != size {
+		t.Errorf("expected %d keys, got %d", size, step)
+		t.FailNow()
+	}
+	err = it.Close()
+	if err != nil {
+		t.Errorf("while closing iterator: %v", err)
+		t.FailNow()
+	}
+}
+
+func TestCollapseSubTrees(t *testing.T) {
+	p, err := pool.NewBufferpool(10, storeDataPath)
+	if err != nil {
+		t.Errorf("while creating bufferpool: %v", err)
+		t.FailNow()
+	}
+	store := NewHBPlusTrie(p)
+
+	// The keys of the tenant are held by a subtree skipping their shared chunks, the diverging keys split it.
+	tenant := []byte("tenant-0000000001/namespace-000001/users/0000001")
+	keys := make([][]byte, 0, size)
+	for i := 0; i < size; i++ {
+		keys = append(keys, append(append([]byte{}, tenant...), byte(i/256), byte(i)))
+	}
+	diverging := [][]byte{
+		append(append([]byte{}, tenant[:20]...), 'x'),
+		append([]byte{}, tenant[:32]...),
+		append(append([]byte{}, tenant[:40]...), 'x'),
+	}
+	for i, key := range append(append([][]byte{}, keys...), diverging...) {
+		err := store.Insert(key, key)
+		if err != nil {
+			t.Errorf("[step %d] while inserting to kv store(%v): %v", i, key, err)
+			t.FailNow()
+		}
+	}
+	if len(p.GetFrames()) != 4 {
+		t.Errorf("expected %d frames, got %d", 4, len(p.GetFrames()))
+		t.FailNow()
+	}
+
+	// Each subtree left with a single subtree is replaced by it, which skips the chunks again.
+	for i, key := range diverging {
+		err := store.Delete(key)
+		if err != nil {
+			t.Errorf("[step %d] while deleting key '%v': %v", i, key, err)
+			t.FailNow()
+		}
+	}
+	frames := p.GetFrames()
+	if len(frames) != 2 {
+		t.Errorf("expected %d frames, got %d", 2, len(frames))
+		t.FailNow()
+	}
+	it := store.PrefixIterator(tenant[:24])
+	if !bytes.Equal(it.base, tenant) {
+		t.Errorf("expected iteration to start from %v, got %v", tenant, it.base)
+		t.FailNow()
+	}
+	err = it.Close()
+	if err != nil {
+		t.Errorf("while closing iterator: %v", err)
+		t.FailNow()
+	}
+
+	// The files of the unregistered frames are removed once the trie is written without them,
+	// and the unregistered frames are skipped when the trie is read back.
+	err = store.Write()
+	if err != nil {
+		t.Errorf("while writing to disk: %v", err)
+		t.FailNow()
+	}
+	for id := uint64(1); id < 5; id++ {
+		_, err := os.Stat(path.Join(storeDataPath, "hbdata", fmt.Sprintf("frame_%d.db", id)))
+		registered := id == frames[0] || id == frames[1]
+		if registered != (err == nil) {
+			t.Errorf("expected the file of frame %d to exist: %t, got %v", id, registered, err)
+			t.FailNow()
+		}
+	}
+	p.Close()
+	p, err = pool.NewBufferpool(10, storeDataPath)
+	if err != nil {
+		t.Errorf("while creating bufferpool: %v", err)
+		t.FailNow()
+	}
+	t.Cleanup(func() {
+		p.Close()
+		p.Clean()
+	})
+	store, err = Read(p)
+	if err != nil {
+		t.Errorf("while reading from file: %v", err)
+		t.FailNow()
+	}
+	if len(p.GetFrames()) != 2 {
+		t.Errorf("expected %d frames, got %d", 2, len(p.GetFrames()))
+		t.FailNow()
+	}
+
+	// The last key of the subtree replaces it in the root tree.
+	for i, key := range keys[1:] {
+		err := store.Delete(key)
+		if err != nil {
+			t.Errorf("[step %d] while deleting key '%v': %v", i, key, err)
+			t.FailNow()
+		}
+	}
+	if len(p.GetFrames()) != 1 || store.Len() != 1 {
+		t.Errorf("expected 1 frame and 1 key, got %d and %d", len(p.GetFrames()), store.Len())
+		t.FailNow()
+	}
+	v, err := store.Search(keys[0])
+	if err != nil || !bytes.Equal(v, keys[0]) {
+		t.Errorf("expected %v, got %v: %v", keys[0], v, err)
+		t.FailNow()
+	}
+
+	// Subtrees left empty are removed from their parent, a subtree holding a key ending with its chunk included.
+	short := append([]byte{}, tenant[:16]...)
+	for i, key := range [][]byte{short, keys[1]} {
+		err := store.Insert(key, key)
+		if err != nil {
+			t.Errorf("[step %d] while inserting to kv store(%v): %v", i, key, err)
+			t.FailNow()
+		}
+	}
+	for i, key := range [][]byte{keys[0], keys[1], short} {
+		err := store.Delete(key)
+		if err != nil {
+			t.Errorf("[step %d] while deleting key '%v': %v", i, key, err)
+			t.FailNow()
+		}
+	}
+	if len(p.GetFrames()) != 1 || store.Len() != 0 || store.rootTree.Len() != 0 {
+		t.Errorf("expected an empty root tree, got %d frames and %d keys", len(p.GetFrames()), store.Len())
+		t.FailNow()
+	}
+}
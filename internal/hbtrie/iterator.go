@@ -0,0 +1,312 @@
+package hbtrie
+
+import (
+	"bytes"
+	"errors"
+	"hbtrie/internal/bptree"
+	"hbtrie/internal/kverrors"
+	"hbtrie/internal/operations"
+	"hbtrie/internal/pool"
+)
+
+// level is the position of the iterator in one of the b+ trees of the trie.
+type level struct {
+	cursor *bptree.Cursor
+	prefix []byte // key bytes consumed by the parent trees and skipped by the tree
+}
+
+// Iterator walks the keys of the trie in lexicographic order.
+// It walks the leaves of each b+ tree and descends into the subtrees referenced by tree entries.
+// The iterator is invalidated by any subsequent insertion or deletion in the trie.
+type Iterator struct {
+	hbt   *HBTrieInstance
+	root  *bptree.BPlusTree // tree the iteration starts from
+	base  []byte            // key bytes leading to the root of the iteration
+	stack []*level
+	entry pool.Entry
+	valid bool
+	err   error
+}
+
+// Iterator returns a new iterator over the trie. It has to be positioned with First, Last or Seek before use.
+func (hbt *HBTrieInstance) Iterator() *Iterator {
+	return &Iterator{hbt: hbt, root: hbt.rootTree}
+}
+
+// PrefixIterator returns a new iterator that starts from the subtree owning the longest chunk aligned part of the given prefix.
+// All the keys starting with the prefix can be found from this subtree, but the remaining of the prefix is not enforced.
+// If the subtree cannot be reached, the error is reported by Close and the iterator cannot be positioned.
+func (hbt *HBTrieInstance) PrefixIterator(prefix []byte) *Iterator {
+	var keyError *kverrors.KeyNotFoundError
+	it := &Iterator{hbt: hbt, root: hbt.rootTree}
+	for len(prefix) >= hbt.chunkSize {
+		chunkedKey, trimmedKey := it.hbt.createChunkFromKey(prefix)
+		e, err := it.root.SearchTreeEntry(chunkedKey)
+		// No key starts with the prefix, seeking in the current tree will go past it.
+		if errors.As(err, &keyError) {
+			break
+		}
+		if err != nil {
+			it.err = err
+			break
+		}
+		// A leaf entry is the only key starting with the prefix, it is found by seeking in the current tree.
+		if !e.IsTree {
+			break
+		}
+		subTree, skipped, err := hbt.loadSubTree(e)
+		if err != nil {
+			it.err = err
+			break
+		}
+		// The keys of the subtree diverge from the prefix, seeking in the current tree will go past them.
+		if !bytes.HasPrefix(trimmedKey, skipped) && !bytes.HasPrefix(skipped, trimmedKey) {
+			break
+		}
+		it.root = subTree
+		it.base = append(it.base, chunkedKey...)
+		it.base = append(it.base, skipped...)
+		if len(trimmedKey) <= len(skipped) {
+			break
+		}
+		prefix = trimmedKey[len(skipped):]
+	}
+	return it
+}
+
+// First positions the iterator on the smallest key of the trie.
+func (it *Iterator) First() bool {
+	if !it.reset() {
+		return false
+	}
+	ok, err := it.top().cursor.First()
+	return it.forward(ok, err)
+}
+
+// Last positions the iterator on the greatest key of the trie.
+func (it *Iterator) Last() bool {
+	if !it.reset() {
+		return false
+	}
+	ok, err := it.top().cursor.Last()
+	return it.backward(ok, err)
+}
+
+// Seek positions the iterator on the smallest key greater than or equal to the given key.
+func (it *Iterator) Seek(key []byte) bool {
+	if !bytes.HasPrefix(key, it.base) {
+		if bytes.Compare(key, it.base) < 0 {
+			return it.First()
+		}
+		it.reset()
+		return it.fail(nil)
+	}
+	key = key[len(it.base):]
+	if !it.reset() {
+		return false
+	}
+	for {
+		chunkedKey, trimmedKey := it.hbt.createChunkFromKey(key)
+		top := it.top()
+		ok, err := top.cursor.Seek(chunkedKey)
+		if err != nil || !ok {
+			return it.forward(ok, err)
+		}
+		e, err := top.cursor.Entry()
+		if err != nil {
+			return it.forward(false, err)
+		}
+		if operations.Equal(e.Key, chunkedKey) {
+			// The remaining of the key has to be looked for in the subtree.
+			if e.IsTree {
+				if err := it.push(e); err != nil {
+					return it.fail(err)
+				}
+				skipped := it.top().prefix[len(top.prefix)+len(e.Key):]
+				if bytes.HasPrefix(trimmedKey, skipped) {
+					key = trimmedKey[len(skipped):]
+					continue
+				}
+				// The key diverges within the prefix skipped by the subtree,
+				// its keys are either all greater or all smaller than the key.
+				if bytes.Compare(trimmedKey, skipped) < 0 {
+					ok, err = it.top().cursor.First()
+					return it.forward(ok, err)
+				}
+				it.pop()
+				ok, err = top.cursor.Next()
+				return it.forward(ok, err)
+			}
+			// The leaf entry may be another key starting with the same chunks.
+			stored, err := it.hbt.pool.ReadKey(e.Value)
+			if err != nil {
+				return it.forward(false, err)
+			}
+			if bytes.Compare(stored[len(top.prefix):], key) < 0 {
+				ok, err = top.cursor.Next()
+			}
+		}
+		return it.forward(ok, err)
+	}
+}
+
+// Next moves the iterator to the next key. It returns false if there is none.
+func (it *Iterator) Next() bool {
+	if !it.valid {
+		return false
+	}
+	ok, err := it.top().cursor.Next()
+	return it.forward(ok, err)
+}
+
+// Prev moves the iterator to the previous key. It returns false if there is none.
+func (it *Iterator) Prev() bool {
+	if !it.valid {
+		return false
+	}
+	ok, err := it.top().cursor.Prev()
+	return it.backward(ok, err)
+}
+
+// Valid states whether the iterator is positioned on a key.
+func (it *Iterator) Valid() bool {
+	return it.valid
+}
+
+// Key returns the key the iterator is positioned on.
+// The full key is read from the value log, if it fails the error is reported by Close.
+func (it *Iterator) Key() []byte {
+	if !it.valid {
+		return nil
+	}
+	key, err := it.hbt.pool.ReadKey(it.entry.Value)
+	if err != nil {
+		it.fail(err)
+		return nil
+	}
+	return key
+}
+
+// Value returns the value the iterator is positioned on.
+// The value is read from the value log, if it fails the error is reported by Close.
+func (it *Iterator) Value() []byte {
+	if !it.valid {
+		return nil
+	}
+	value, err := it.hbt.pool.ReadValue(it.entry.Value)
+	if err != nil {
+		it.fail(err)
+		return nil
+	}
+	return value
+}
+
+// Close releases the iterator and returns the first error encountered while iterating.
+func (it *Iterator) Close() error {
+	it.stack = nil
+	it.valid = false
+	return it.err
+}
+
+// reset positions the iterator back on the root tree. It returns false if the iterator has previously failed.
+func (it *Iterator) reset() bool {
+	it.stack = []*level{{cursor: it.root.Cursor(), prefix: it.base}}
+	it.valid = false
+	return it.err == nil
+}
+
+func (it *Iterator) top() *level {
+	return it.stack[len(it.stack)-1]
+}
+
+// push descends into the subtree referenced by the given tree entry.
+// The prefix of the new level ends with the key bytes skipped by the subtree.
+func (it *Iterator) push(e pool.Entry) error {
+	top := it.top()
+	subTree, skipped, err := it.hbt.loadSubTree(&e)
+	if err != nil {
+		return err
+	}
+	prefix := make([]byte, 0, len(top.prefix)+len(e.Key)+len(skipped))
+	prefix = append(prefix, top.prefix...)
+	prefix = append(prefix, e.Key...)
+	prefix = append(prefix, skipped...)
+	it.stack = append(it.stack, &level{cursor: subTree.Cursor(), prefix: prefix})
+	return nil
+}
+
+// pop goes back to the parent tree. It returns false if the iterator is on the root tree.
+func (it *Iterator) pop() bool {
+	if len(it.stack) == 1 {
+		return false
+	}
+	it.stack = it.stack[:len(it.stack)-1]
+	return true
+}
+
+// forward settles the iterator on the first leaf entry from the current position of the top cursor.
+// It goes up when a tree is exhausted and down into the smallest keys of subtrees.
+func (it *Iterator) forward(ok bool, err error) bool {
+	for {
+		if err != nil {
+			return it.fail(err)
+		}
+		if !ok {
+			if !it.pop() {
+				return it.fail(nil)
+			}
+			ok, err = it.top().cursor.Next()
+			continue
+		}
+		e, err := it.top().cursor.Entry()
+		if err != nil {
+			return it.fail(err)
+		}
+		if !e.IsTree {
+			it.entry, it.valid = e, true
+			return true
+		}
+		if err := it.push(e); err != nil {
+			return it.fail(err)
+		}
+		ok, err = it.top().cursor.First()
+	}
+}
+
+// backward settles the iterator on the last leaf entry from the current position of the top cursor.
+// It goes up when a tree is exhausted and down into the greatest keys of subtrees.
+func (it *Iterator) backward(ok bool, err error) bool {
+	for {
+		if err != nil {
+			return it.fail(err)
+		}
+		if !ok {
+			if !it.pop() {
+				return it.fail(nil)
+			}
+			ok, err = it.top().cursor.Prev()
+			continue
+		}
+		e, err := it.top().cursor.Entry()
+		if err != nil {
+			return it.fail(err)
+		}
+		if !e.IsTree {
+			it.entry, it.valid = e, true
+			return true
+		}
+		if err := it.push(e); err != nil {
+			return it.fail(err)
+		}
+		ok, err = it.top().cursor.Last()
+	}
+}
+
+// fail invalidates the iterator and records the first error encountered.
+func (it *Iterator) fail(err error) bool {
+	if it.err == nil {
+		it.err = err
+	}
+	it.valid = false
+	return false
+}
@@ -13,6 +13,14 @@ func (err *KeyNotFoundError) Error() string {
 	return fmt.Sprintf("key %v not found", err.Key)
 }
 
+type KeyDeletedError struct {
+	Key interface{}
+}
+
+func (err *KeyDeletedError) Error() string {
+	return fmt.Sprintf("key %v has been deleted", err.Key)
+}
+
 type InsertionError struct {
 	Type     interface{}
 	Value    interface{}
@@ -153,6 +161,15 @@ func (err *BufferPoolLimitError) Error() string {
 	return fmt.Sprintf("buffer pool limit reached: %v", err.Limit)
 }
 
+type PageLimitError struct {
+	Frame interface{}
+	Max   interface{}
+}
+
+func (err *PageLimitError) Error() string {
+	return fmt.Sprintf("page limit reached in frame %v: max page id %v", err.Frame, err.Max)
+}
+
 type InvalidNodeIOError struct {
 	Node   interface{}
 	Cursor interface{}
@@ -177,3 +194,90 @@ type OutsideOfRangeError struct {
 func (err *OutsideOfRangeError) Error() string {
 	return fmt.Sprintf("value %v is outside of range %v-%v", err.Actual, err.From, err.To)
 }
+
+type InconsistentStoreError struct {
+	Path   interface{}
+	Reason interface{}
+	Err    error
+}
+
+func (err *InconsistentStoreError) Error() string {
+	if err.Err != nil {
+		return fmt.Sprintf("inconsistent store at %v: %v: %v", err.Path, err.Reason, err.Err)
+	}
+	return fmt.Sprintf("inconsistent store at %v: %v", err.Path, err.Reason)
+}
+
+func (err *InconsistentStoreError) Unwrap() error {
+	return err.Err
+}
+
+type CorruptPageError struct {
+	Frame interface{}
+	Page  interface{}
+}
+
+func (err *CorruptPageError) Error() string {
+	return fmt.Sprintf("corrupt page %v in frame %v: checksum mismatch", err.Page, err.Frame)
+}
+
+type FormatVersionError struct {
+	Path      interface{}
+	Stored    interface{}
+	Supported interface{}
+}
+
+func (err *FormatVersionError) Error() string {
+	return fmt.Sprintf("unsupported format version %v at %v, expected version %v", err.Stored, err.Path, err.Supported)
+}
+
+type ChunkSizeMismatchError struct {
+	Stored    interface{}
+	Requested interface{}
+}
+
+func (err *ChunkSizeMismatchError) Error() string {
+	return fmt.Sprintf("chunk size mismatch: store was created with %v bytes, got %v", err.Stored, err.Requested)
+}
+
+type SyncError struct {
+	Path interface{}
+	Err  error
+}
+
+func (err *SyncError) Error() string {
+	return fmt.Sprintf("cannot sync %v: %v", err.Path, err.Err)
+}
+
+func (err *SyncError) Unwrap() error {
+	return err.Err
+}
+
+type CommittedPageError struct {
+	Frame interface{}
+	Page  interface{}
+}
+
+func (err *CommittedPageError) Error() string {
+	return fmt.Sprintf("page %v in frame %v belongs to a committed version and cannot be written again", err.Page, err.Frame)
+}
+
+type SnapshotModeError struct{}
+
+func (err *SnapshotModeError) Error() string {
+	return "snapshots require the trie to be written in append-only mode"
+}
+
+type PinnedSnapshotError struct {
+	Snapshots interface{}
+}
+
+func (err *PinnedSnapshotError) Error() string {
+	return fmt.Sprintf("cannot compact the files while %v snapshots are pinned to them", err.Snapshots)
+}
+
+type CompactionConflictError struct{}
+
+func (err *CompactionConflictError) Error() string {
+	return "cannot swap in the compacted files, the trie has been committed since they were copied"
+}
@@ -2,19 +2,19 @@ package operations
 
 import "bytes"
 
-// Compare returns the comparison value between two 16 bytes arrays. The result will be 0 if a==b, -1 if a < b, and +1 if a > b.
-func Compare(a, b [16]byte) int {
+// Compare returns the comparison value between two chunks. The result will be 0 if a==b, -1 if a < b, and +1 if a > b.
+func Compare(a, b []byte) int {
 
-	return bytes.Compare(a[:], b[:])
+	return bytes.Compare(a, b)
 
 }
 
-// States whether a key is null.
-func IsNull(a [16]byte) bool {
-	return Compare(a, [16]byte{}) == 0
+// States whether a key is null, i.e., it only holds zeros.
+func IsNull(a []byte) bool {
+	return Compare(a, make([]byte, len(a))) == 0
 }
 
 // States whether two keys are equal
-func Equal(a, b [16]byte) bool {
+func Equal(a, b []byte) bool {
 	return Compare(a, b) == 0
 }
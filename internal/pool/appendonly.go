@@ -0,0 +1,78 @@
+package pool
+
+import (
+	"hbtrie/internal/kverrors"
+)
+
+// In append-only mode, the pages of the last committed version of a b+ tree are never written again.
+// A node is copied to a new page before it is first modified after a commit, and its parent is modified
+// to point to the copy, which copies the parent in turn up to the root. A crash then leaves the committed
+// version untouched whatever the pages written since, and the older versions can still be read.
+// Pages are only allocated at the end of the files: the pages released by the b+ trees are left to the older versions.
+
+// AppendOnly states whether the modified nodes are written to new pages rather than in place.
+func (pool *Bufferpool) AppendOnly() bool {
+	return pool.appendOnly
+}
+
+// Committed states whether the page with the given id of the given frame belongs to the last committed version
+// of its b+ tree. In append-only mode, such a page has to be copied with Shadow before it is modified.
+func (pool *Bufferpool) Committed(frameId, pageId uint64) bool {
+	frame := pool.frames[frameId]
+	return frame != nil && pageId <= frame.base
+}
+
+// Shadow returns a copy of the node with the given id of the given frame on a new page, to be modified in its place.
+// The node leaves memory and its page is left on disk to the committed versions of the b+ tree, until a compaction.
+func (pool *Bufferpool) Shadow(frameId, pageId uint64) (*Node, error) {
+	node, err := pool.Query(frameId, pageId)
+	if err != nil {
+		return nil, err
+	}
+	data, err := node.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	shadow, err := pool.NewNode(frameId)
+	if err != nil {
+		return nil, err
+	}
+	id := shadow.Id
+	err = shadow.UnmarshalBinary(data)
+	if err != nil {
+		return nil, err
+	}
+	shadow.Id = id
+	shadow.Dirty = true
+	pool.drop(frameId, pageId)
+	pool.stale += PageSize
+	return shadow, nil
+}
+
+// drop removes the page with the given id of the given frame from memory without writing it.
+func (pool *Bufferpool) drop(frameId, pageId uint64) {
+	pool.frames[frameId].remove(pageId)
+	if pool.budget != 0 {
+		pool.policy.Remove(PageKey{Frame: frameId, Page: pageId})
+	}
+}
+
+// Records the pages of the frames as committed: they are no longer modified in place in append-only mode,
+// and are written to the journal otherwise.
+func (pool *Bufferpool) committed() {
+	for _, frame := range pool.frames {
+		frame.base = frame.cursor
+	}
+	if pool.single != nil {
+		pool.single.base = pool.single.cursor
+	}
+}
+
+// Returns a CommittedPageError if the given node is a page of the last committed version of its b+ tree
+// being written again in append-only mode.
+func (pool *Bufferpool) checkAppendOnly(frameId uint64, node *Node) error {
+	if pool.appendOnly && pool.Committed(frameId, node.Id) {
+		return &kverrors.CommittedPageError{Frame: frameId, Page: node.Id}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package pool
+
+// arc is the Adaptive Replacement Cache of Megiddo and Modha.
+// Pages accessed once are held by t1 and pages accessed at least twice by t2. The ghosts b1 and b2 remember
+// the pages evicted from each of them: bringing back a page of b1 grows the target size p of t1,
+// bringing back a page of b2 shrinks it. Since the bufferpool makes room before bringing a page,
+// the target is adapted after the eviction rather than before.
+type arc struct {
+	t1, t2   *keyList
+	b1, b2   *keyList
+	p        int // target size of t1
+	capacity int
+}
+
+func newARC(capacity uint64) *arc {
+	return &arc{t1: newKeyList(), t2: newKeyList(), b1: newKeyList(), b2: newKeyList(), capacity: int(capacity)}
+}
+
+func (a *arc) Access(key PageKey) {
+	if a.t1.remove(key) || a.t2.has(key) {
+		a.t2.pushFront(key)
+	}
+}
+
+func (a *arc) Insert(key PageKey) {
+	if a.t1.has(key) || a.t2.has(key) {
+		a.Access(key)
+		return
+	}
+	if a.b1.remove(key) {
+		a.p = min(a.capacity, a.p+max(a.b2.len()/(a.b1.len()+1), 1))
+		a.t2.pushFront(key)
+		return
+	}
+	if a.b2.remove(key) {
+		a.p = max(0, a.p-max(a.b1.len()/(a.b2.len()+1), 1))
+		a.t2.pushFront(key)
+		return
+	}
+	a.t1.pushFront(key)
+	// The history is bounded to the capacity for t1 and b1, and to twice the capacity overall.
+	for a.t1.len()+a.b1.len() > a.capacity && a.b1.len() > 0 {
+		a.b1.popBack()
+	}
+	for a.t1.len()+a.t2.len()+a.b1.len()+a.b2.len() > 2*a.capacity && a.b2.len() > 0 {
+		a.b2.popBack()
+	}
+}
+
+func (a *arc) Remove(key PageKey) {
+	if !a.t1.remove(key) && !a.t2.remove(key) && !a.b1.remove(key) {
+		a.b2.remove(key)
+	}
+}
+
+func (a *arc) Evict() (PageKey, bool) {
+	if a.t1.len() > 0 && (a.t1.len() > a.p || a.t2.len() == 0) {
+		key, _ := a.t1.popBack()
+		a.b1.pushFront(key)
+		return key, true
+	}
+	key, ok := a.t2.popBack()
+	if ok {
+		a.b2.pushFront(key)
+	}
+	return key, ok
+}
+
+func (a *arc) Len() int {
+	return a.t1.len() + a.t2.len()
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
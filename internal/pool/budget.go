@@ -0,0 +1,68 @@
+package pool
+
+import (
+	"math"
+	"os"
+)
+
+// minimum number of pages of a global budget, a b+ tree operation holds up to five pages at once
+const poolMinBudget = 8
+
+// newFrame initialises a frame of the bufferpool with the given file.
+// With a global budget, the frame is not limited by itself: its pages are evicted by the bufferpool.
+func (pool *Bufferpool) newFrame(file *os.File) *frame {
+	if pool.budget != 0 {
+		return newFrame(file, math.MaxUint64, pool.chunkSize, newLRU())
+	}
+	return newFrame(file, pool.allocation, pool.chunkSize, NewReplacementPolicy(pool.policyKind, pool.allocation))
+}
+
+// touch records an access to the given page of the given frame across all the frames.
+// The page is admitted in the global budget if it has just been brought in memory.
+func (pool *Bufferpool) touch(frameId, pageId uint64, resident bool) {
+	if pool.budget == 0 {
+		return
+	}
+	key := PageKey{Frame: frameId, Page: pageId}
+	if resident {
+		pool.policy.Access(key)
+		return
+	}
+	pool.policy.Insert(key)
+}
+
+// reserve evicts the pages chosen by the replacement policy across all the frames until one more page fits in the budget.
+// Dirty pages are written to disk before being evicted.
+func (pool *Bufferpool) reserve() error {
+	if pool.budget == 0 {
+		return nil
+	}
+	for uint64(pool.policy.Len()) >= pool.budget {
+		key, ok := pool.policy.Evict()
+		if !ok {
+			break
+		}
+		frame := pool.frames[key.Frame]
+		if frame == nil {
+			continue
+		}
+		node := frame.remove(key.Page)
+		if node != nil && node.Dirty {
+			err := pool.write(key.Frame, node)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// forget removes the pages of the given frame from the global budget.
+func (pool *Bufferpool) forget(frameId uint64, f *frame) {
+	if pool.budget == 0 {
+		return
+	}
+	for id := range f.pages {
+		pool.policy.Remove(PageKey{Frame: frameId, Page: id})
+	}
+}
@@ -0,0 +1,124 @@
+package pool
+
+import (
+	"errors"
+	"hbtrie/internal/kverrors"
+	"os"
+	"path"
+	"testing"
+)
+
+// residents returns the ids of the pages of the given frame held in memory.
+func residents(p *Bufferpool, frameId uint64) map[uint64]bool {
+	ids := make(map[uint64]bool)
+	for id := range p.frames[frameId].pages {
+		ids[id] = true
+	}
+	return ids
+}
+
+func TestGlobalBudget(t *testing.T) {
+	dataPath := path.Join(os.TempDir(), "hbt_budget_test")
+	t.Cleanup(func() {
+		os.RemoveAll(dataPath)
+	})
+
+	var rangeError *kverrors.OutsideOfRangeError
+	_, err := NewBufferpoolWithOptions(dataPath, &Options{Budget: 2})
+	if !errors.As(err, &rangeError) {
+		t.Errorf("expected an OutsideOfRangeError, got %v", err)
+		t.FailNow()
+	}
+
+	budget := uint64(8)
+	p, err := NewBufferpoolWithOptions(dataPath, &Options{Budget: budget})
+	if err != nil {
+		t.Errorf("while creating bufferpool: %v", err)
+		t.FailNow()
+	}
+	t.Cleanup(func() {
+		p.Close()
+	})
+
+	hot, err := p.Register()
+	if err != nil {
+		t.Errorf("while registering frame: %v", err)
+		t.FailNow()
+	}
+	hotIds := make([]uint64, 0, 3)
+	for i := 0; i < 3; i++ {
+		node, err := p.NewNode(hot)
+		if err != nil {
+			t.Errorf("while creating node: %v", err)
+			t.FailNow()
+		}
+		hotIds = append(hotIds, node.Id)
+	}
+
+	// The pages of the cold frame are evicted first while the hot frame keeps being queried.
+	cold, err := p.Register()
+	if err != nil {
+		t.Errorf("while registering frame: %v", err)
+		t.FailNow()
+	}
+	coldIds := make([]uint64, 0, 20)
+	for i := 0; i < 20; i++ {
+		node, err := p.NewNode(cold)
+		if err != nil {
+			t.Errorf("[step %d] while creating node: %v", i, err)
+			t.FailNow()
+		}
+		err = node.InsertEntryAt(0, Entry{Key: []byte{byte(i)}, Value: uint64(i)})
+		if err != nil {
+			t.Errorf("[step %d] while inserting entry: %v", i, err)
+			t.FailNow()
+		}
+		coldIds = append(coldIds, node.Id)
+		for _, id := range hotIds {
+			_, err := p.Query(hot, id)
+			if err != nil {
+				t.Errorf("[step %d] while querying node %d: %v", i, id, err)
+				t.FailNow()
+			}
+		}
+		if uint64(p.policy.Len()) > budget {
+			t.Errorf("[step %d] expected at most %d pages in memory, got %d", i, budget, p.policy.Len())
+			t.FailNow()
+		}
+	}
+	for _, id := range hotIds {
+		if !residents(p, hot)[id] {
+			t.Errorf("expected page %d of the hot frame to be in memory", id)
+			t.FailNow()
+		}
+	}
+	if n := len(residents(p, cold)); n != int(budget)-len(hotIds) {
+		t.Errorf("expected %d pages of the cold frame in memory, got %d", int(budget)-len(hotIds), n)
+		t.FailNow()
+	}
+
+	// Evicted pages have been written and are read back.
+	for i, id := range coldIds {
+		node, err := p.Query(cold, id)
+		if err != nil {
+			t.Errorf("[step %d] while querying node %d: %v", i, id, err)
+			t.FailNow()
+		}
+		if node.NumberOfEntries != 1 || node.Entries[0].Value != uint64(i) {
+			t.Errorf("[step %d] unexpected node %v", i, node.Entries[0])
+			t.FailNow()
+		}
+	}
+
+	// The pages of an unregistered frame no longer count in the budget.
+	remaining := len(residents(p, hot))
+	err = p.Unregister(cold)
+	if err != nil {
+		t.Errorf("while unregistering frame: %v", err)
+		t.FailNow()
+	}
+	if n := p.policy.Len(); n != remaining {
+		t.Errorf("expected %d pages in memory, got %d", remaining, n)
+		t.FailNow()
+	}
+}
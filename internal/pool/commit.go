@@ -0,0 +1,441 @@
+package pool
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"hbtrie/internal/kverrors"
+	"os"
+	"sort"
+)
+
+// The metadata file of the trie starts with two commit headers, the shadow superblocks, followed by the commit records
+// they point to. A commit writes its record where it doesn't overlap the record of the last commit and syncs it,
+// then writes its header over the other slot with the next sequence number. Until the header is synced,
+// the last commit is left untouched: reopening the trie reads the valid header with the greatest sequence number.
+const (
+	// magic number of a commit header
+	commitMagic = 0x68627472_69656331
+	// magic number, sequence number, offset and length of the record, checksum of the record and of the header
+	commitHeaderSize = 40
+	// byte length of the headers preceding the records
+	commitAreaSize = 2 * commitHeaderSize
+)
+
+// formatVersion is the version of the format of the files of the trie, recorded by each commit.
+// It changes whenever the pages or the records are laid out differently, see checkVersion.
+const formatVersion = 1
+
+// layouts of the frames of a commit
+const (
+	layoutFrameFiles = iota
+	layoutSingleFile
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// commitHeader points to the record of a commit.
+type commitHeader struct {
+	seq    uint64
+	offset uint64
+	length uint64
+	sum    uint32 // checksum of the record
+}
+
+// flags of the mode of a commit
+const (
+	// the trie is written in append-only mode, which it then keeps
+	modeAppendOnly = 1 << iota
+	// the files of the compaction are to replace the files of the trie, see Compact
+	modeCompacting
+)
+
+// commit is the state of the trie recorded at once: the metadata of the trie and of all its frames.
+type commit struct {
+	slot   int
+	header commitHeader
+	trie   hbMetatadata
+	layout uint64
+	frames map[uint64]frameMetadata // nil if the metadata of the frames is only stored with their pages
+	// whether the trie has been written in append-only mode, which it then keeps
+	appendOnly bool
+	// whether the files of a compaction are swapped in, see Compact
+	compacting bool
+	// number of bytes of the files no longer referenced by the trie, see StaleRatio
+	stale uint64
+	// byte length and checksum of the journal to apply for the commit to be complete, see journal
+	journal    uint64
+	journalSum uint32
+	// format version of the files of the trie, zero if written before versions were recorded
+	version uint64
+}
+
+// Implements the binary.BinaryMarshaler interface.
+func (h *commitHeader) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, commitHeaderSize)
+	bin := binary.LittleEndian
+	bin.PutUint64(buf[0:8], commitMagic)
+	bin.PutUint64(buf[8:16], h.seq)
+	bin.PutUint64(buf[16:24], h.offset)
+	bin.PutUint64(buf[24:32], h.length)
+	bin.PutUint32(buf[32:36], h.sum)
+	bin.PutUint32(buf[36:40], crc32.Checksum(buf[:36], castagnoli))
+	return buf, nil
+}
+
+// Implements the binary.BinaryUnmarshaler interface.
+// It returns an error if the header is torn or has never been written.
+func (h *commitHeader) UnmarshalBinary(data []byte) error {
+	if len(data) < commitHeaderSize {
+		return fmt.Errorf("invalid commit header size: %d", len(data))
+	}
+	bin := binary.LittleEndian
+	if bin.Uint64(data[0:8]) != commitMagic {
+		return fmt.Errorf("invalid commit header magic number")
+	}
+	if crc32.Checksum(data[:36], castagnoli) != bin.Uint32(data[36:40]) {
+		return fmt.Errorf("invalid commit header checksum")
+	}
+	h.seq = bin.Uint64(data[8:16])
+	h.offset = bin.Uint64(data[16:24])
+	h.length = bin.Uint64(data[24:32])
+	h.sum = bin.Uint32(data[32:36])
+	return nil
+}
+
+// Implements the binary.BinaryMarshaler interface.
+// The record is the metadata of the trie, the layout of the frames, the id and the metadata of each frame,
+// then the mode of the trie, the number of stale bytes, the length and checksum of the journal and the format version.
+// A record written before the append-only mode ends with the frames, one written before compactions ends with the mode,
+// one written before the journal ends with the number of stale bytes, and is rejected along with any record of another version.
+func (c *commit) MarshalBinary() ([]byte, error) {
+	bin := binary.LittleEndian
+	trie, err := c.trie.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 8, 32+len(trie))
+	bin.PutUint64(buf[0:8], uint64(len(trie)))
+	buf = append(buf, trie...)
+	buf = appendUint64(buf, c.layout)
+	buf = appendUint64(buf, uint64(len(c.frames)))
+	ids := make([]uint64, 0, len(c.frames))
+	for id := range c.frames {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		meta := c.frames[id]
+		data, err := meta.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		buf = appendUint64(buf, id)
+		buf = appendUint64(buf, uint64(len(data)))
+		buf = append(buf, data...)
+	}
+	mode := uint64(0)
+	if c.appendOnly {
+		mode |= modeAppendOnly
+	}
+	if c.compacting {
+		mode |= modeCompacting
+	}
+	buf = appendUint64(buf, mode)
+	buf = appendUint64(buf, c.stale)
+	buf = appendUint64(buf, c.journal)
+	buf = appendUint64(buf, uint64(c.journalSum))
+	buf = appendUint64(buf, c.version)
+	return buf, nil
+}
+
+// Implements the binary.BinaryUnmarshaler interface.
+func (c *commit) UnmarshalBinary(data []byte) error {
+	bin := binary.LittleEndian
+	next := func(n uint64) ([]byte, error) {
+		if uint64(len(data)) < n {
+			return nil, fmt.Errorf("invalid commit record size: %d bytes left, expected %d", len(data), n)
+		}
+		b := data[:n]
+		data = data[n:]
+		return b, nil
+	}
+	b, err := next(8)
+	if err != nil {
+		return err
+	}
+	trie, err := next(bin.Uint64(b))
+	if err != nil {
+		return err
+	}
+	err = c.trie.UnmarshalBinary(trie)
+	if err != nil {
+		return err
+	}
+	b, err = next(16)
+	if err != nil {
+		return err
+	}
+	c.layout = bin.Uint64(b[0:8])
+	n := bin.Uint64(b[8:16])
+	if n > uint64(len(data))/(16+frameMetaSize()) {
+		return fmt.Errorf("invalid commit record size: %d bytes for %d frames", len(data), n)
+	}
+	c.frames = make(map[uint64]frameMetadata, n)
+	for i := uint64(0); i < n; i++ {
+		b, err := next(16)
+		if err != nil {
+			return err
+		}
+		id := bin.Uint64(b[0:8])
+		frame, err := next(bin.Uint64(b[8:16]))
+		if err != nil {
+			return err
+		}
+		meta := frameMetadata{}
+		err = meta.UnmarshalBinary(frame)
+		if err != nil {
+			return err
+		}
+		c.frames[id] = meta
+	}
+	if len(data) >= 8 {
+		mode := bin.Uint64(data[0:8])
+		c.appendOnly = mode&modeAppendOnly != 0
+		c.compacting = mode&modeCompacting != 0
+	}
+	if len(data) >= 16 {
+		c.stale = bin.Uint64(data[8:16])
+	}
+	if len(data) >= 32 {
+		c.journal = bin.Uint64(data[16:24])
+		c.journalSum = uint32(bin.Uint64(data[24:32]))
+	}
+	if len(data) >= 40 {
+		c.version = bin.Uint64(data[32:40])
+	}
+	return nil
+}
+
+// Returns the committed metadata of the given frame, or nil if it is only stored with the pages of the frame:
+// for a legacy commit, or for a commit of the other layout when the frames have just been migrated to a single file.
+func (c *commit) frame(frameId uint64, single bool) (*frameMetadata, error) {
+	if c.frames == nil || (c.layout == layoutSingleFile) != single {
+		return nil, nil
+	}
+	meta, ok := c.frames[frameId]
+	if !ok {
+		return nil, fmt.Errorf("frame %d is not committed", frameId)
+	}
+	return &meta, nil
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, v)
+	return append(buf, b...)
+}
+
+// Reads the last commit of the trie from the metadata file.
+// A metadata file written before commits were introduced only holds the metadata of the trie, it is read without
+// a format version to be rejected, see checkVersion. A snapshot reads the commit it is pinned to.
+func (pool *Bufferpool) readCommit() (*commit, error) {
+	if pool.parent != nil {
+		if pool.pinned == nil {
+			return nil, fmt.Errorf("snapshot already released")
+		}
+		return pool.pinned, nil
+	}
+	info, err := pool.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, info.Size())
+	nbytes, err := pool.file.ReadAt(data, 0)
+	if err != nil && nbytes != len(data) {
+		return nil, err
+	}
+
+	bin := binary.LittleEndian
+	legacy := len(data) >= int(hbMetaSize()) && bin.Uint64(data[0:8]) != commitMagic
+	if len(data) >= commitAreaSize && bin.Uint64(data[commitHeaderSize:commitHeaderSize+8]) == commitMagic {
+		legacy = false
+	}
+	if legacy {
+		c := &commit{slot: -1}
+		err := c.trie.UnmarshalBinary(data)
+		if err != nil {
+			return nil, err
+		}
+		if c.trie.root == 0 || c.trie.chunkSize == 0 || c.trie.chunkSize > MaxChunkSize {
+			return nil, fmt.Errorf("no valid commit nor metadata in %d bytes", len(data))
+		}
+		return c, nil
+	}
+
+	var last *commit
+	for slot := 0; slot < 2; slot++ {
+		from := slot * commitHeaderSize
+		if len(data) < from+commitHeaderSize {
+			break
+		}
+		header := commitHeader{}
+		if header.UnmarshalBinary(data[from:from+commitHeaderSize]) != nil {
+			continue
+		}
+		if last != nil && header.seq <= last.header.seq {
+			continue
+		}
+		// A record that doesn't match its checksum has been torn along with the header pointing to it.
+		if header.offset < commitAreaSize || header.offset+header.length > uint64(len(data)) {
+			continue
+		}
+		record := data[header.offset : header.offset+header.length]
+		if crc32.Checksum(record, castagnoli) != header.sum {
+			continue
+		}
+		c := &commit{slot: slot, header: header}
+		if c.UnmarshalBinary(record) != nil {
+			continue
+		}
+		last = c
+	}
+	if last == nil {
+		return nil, fmt.Errorf("no valid commit in %d bytes of metadata", len(data))
+	}
+	return last, nil
+}
+
+// Writes the given metadata of the trie and of its frames as a new commit, stating whether the files of a compaction
+// are swapped in. The pages the metadata refers to and the journal have to be synced beforehand.
+func (pool *Bufferpool) commit(trie hbMetatadata, frames map[uint64]frameMetadata, compacting bool) error {
+	c := &commit{trie: trie, frames: frames, layout: layoutFrameFiles, appendOnly: pool.appendOnly, compacting: compacting, stale: pool.stale, version: formatVersion}
+	c.journal, c.journalSum = pool.journal.seal()
+	if pool.single != nil {
+		c.layout = layoutSingleFile
+	}
+	record, err := c.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	// The record is written before the record of the last commit if it fits, after it otherwise.
+	c.header = commitHeader{seq: 1, offset: commitAreaSize, length: uint64(len(record))}
+	c.header.sum = crc32.Checksum(record, castagnoli)
+	last, err := pool.readCommit()
+	switch {
+	case err == nil:
+		c.slot = 1 - last.slot
+		c.header.seq = last.header.seq + 1
+		if commitAreaSize+c.header.length > last.header.offset {
+			c.header.offset = last.header.offset + last.header.length
+		}
+	default:
+		err = pool.file.Truncate(0)
+		if err != nil {
+			return err
+		}
+	}
+
+	nbytes, err := pool.file.WriteAt(record, int64(c.header.offset))
+	if err != nil {
+		return err
+	}
+	if nbytes != len(record) {
+		return &kverrors.PartialWriteError{Total: len(record), Written: nbytes}
+	}
+	err = pool.sync(pool.file)
+	if err != nil {
+		return err
+	}
+	header, _ := c.header.MarshalBinary()
+	nbytes, err = pool.file.WriteAt(header, int64(c.slot*commitHeaderSize))
+	if err != nil {
+		return err
+	}
+	if nbytes != len(header) {
+		return &kverrors.PartialWriteError{Total: len(header), Written: nbytes}
+	}
+	err = pool.sync(pool.file)
+	if err != nil {
+		return err
+	}
+
+	// The record of the previous commit is no longer needed once the new one is synced.
+	end := int64(c.header.offset + c.header.length)
+	info, err := pool.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() > end {
+		return pool.file.Truncate(end)
+	}
+	return nil
+}
+
+// Returns a FormatVersionError if the last commit has been written with another format version, or before versions
+// were recorded. A metadata file holding no valid commit is left to HasTrie. It has to be called before any file is read.
+func (pool *Bufferpool) checkVersion() error {
+	info, err := pool.file.Stat()
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+	last, err := pool.readCommit()
+	if err != nil {
+		return nil
+	}
+	if last.version != formatVersion {
+		return &kverrors.FormatVersionError{Path: pool.file.Name(), Stored: last.version, Supported: formatVersion}
+	}
+	return nil
+}
+
+// Syncs the pages written to the open files of the frames and to the value log,
+// then the data path if frame files have been created since it was last synced.
+// The files of the frames are synced before they are closed, see closeFile.
+func (pool *Bufferpool) syncFiles() error {
+	if pool.single != nil {
+		err := pool.sync(pool.single.file)
+		if err != nil {
+			return err
+		}
+	}
+	for e := pool.files.Front(); e != nil; e = e.Next() {
+		f := e.Value.(*frame)
+		if f.file != nil {
+			err := pool.sync(f.file)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err := pool.sync(pool.values.file)
+	if err != nil {
+		return err
+	}
+	// The files of the frames registered since the last commit have to be found once it refers to them.
+	if pool.created {
+		err = pool.syncDir()
+		if err != nil {
+			return err
+		}
+		pool.created = false
+	}
+	return nil
+}
+
+// Removes the files of the frames unregistered since the last commit, which may still refer to them.
+// They are kept while snapshots are pinned to older versions of the trie, which may refer to them as well.
+func (pool *Bufferpool) removeUnlinked() error {
+	if pool.snapshots > 0 {
+		return nil
+	}
+	for id := range pool.unlinked {
+		err := os.Remove(pool.filename(id))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		delete(pool.unlinked, id)
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+package pool
+
+import (
+	"errors"
+	"hash/crc32"
+	"hbtrie/internal/kverrors"
+	"os"
+	"path"
+	"testing"
+)
+
+// newCommitPool returns a bufferpool in the given data path holding a frame whose root has the given number of children.
+func newCommitPool(t *testing.T, dataPath string, children int) (*Bufferpool, uint64) {
+	p, err := NewBufferpoolWithOptions(dataPath, &Options{Allocation: 16})
+	if err != nil {
+		t.Errorf("while creating bufferpool: %v", err)
+		t.FailNow()
+	}
+	frameId, err := p.Register()
+	if err != nil {
+		t.Errorf("while registering frame: %v", err)
+		t.FailNow()
+	}
+	setRoot(t, p, frameId, children)
+	return p, frameId
+}
+
+// setRoot gives the given frame a new root with the given number of children.
+func setRoot(t *testing.T, p *Bufferpool, frameId uint64, children int) {
+	root, err := p.NewNode(frameId)
+	if err != nil {
+		t.Errorf("while creating node: %v", err)
+		t.FailNow()
+	}
+	for j := 0; j < children; j++ {
+		child, err := p.NewNode(frameId)
+		if err != nil {
+			t.Errorf("while creating node: %v", err)
+			t.FailNow()
+		}
+		root.InsertChildAt(j, child)
+	}
+	err = p.Update(frameId, root.Id, uint64(children))
+	if err != nil {
+		t.Errorf("while setting root: %v", err)
+		t.FailNow()
+	}
+}
+
+// reopen closes the given bufferpool and reads the trie back.
+func reopen(t *testing.T, p *Bufferpool, dataPath string) (*Bufferpool, uint64) {
+	p.Close()
+	p, err := NewBufferpoolWithOptions(dataPath, &Options{Allocation: 16})
+	if err != nil {
+		t.Errorf("while reopening bufferpool: %v", err)
+		t.FailNow()
+	}
+	_, size, _, err := p.ReadTrie()
+	if err != nil {
+		t.Errorf("while reading trie: %v", err)
+		t.FailNow()
+	}
+	return p, size
+}
+
+func TestCommitSlots(t *testing.T) {
+	dataPath := path.Join(os.TempDir(), "hbt_commit_test")
+	os.RemoveAll(dataPath)
+	t.Cleanup(func() {
+		os.RemoveAll(dataPath)
+	})
+	p, frameId := newCommitPool(t, dataPath, 2)
+
+	// The commits alternate between the two slots with increasing sequence numbers.
+	for seq := uint64(1); seq <= 4; seq++ {
+		err := p.WriteTrie(frameId, seq)
+		if err != nil {
+			t.Errorf("while writing trie: %v", err)
+			t.FailNow()
+		}
+		last, err := p.readCommit()
+		if err != nil {
+			t.Errorf("while reading commit: %v", err)
+			t.FailNow()
+		}
+		if last.header.seq != seq || last.slot != int(1-seq%2) || last.trie.size != seq {
+			t.Errorf("expected commit %d in slot %d, got %d in slot %d", seq, 1-seq%2, last.header.seq, last.slot)
+			t.FailNow()
+		}
+		if _, ok := last.frames[frameId]; !ok || last.layout != layoutFrameFiles {
+			t.Errorf("expected the metadata of frame %d, got %v", frameId, last.frames)
+			t.FailNow()
+		}
+	}
+
+	// A torn header, or a header pointing to a torn record, leaves the previous commit.
+	last, _ := p.readCommit()
+	p.file.WriteAt([]byte{0xff}, int64(last.slot*commitHeaderSize+12))
+	p, size := reopen(t, p, dataPath)
+	if size != 3 {
+		t.Errorf("expected the previous commit of size %d, got %d", 3, size)
+		t.FailNow()
+	}
+	err := p.WriteTrie(frameId, 5)
+	if err != nil {
+		t.Errorf("while writing trie: %v", err)
+		t.FailNow()
+	}
+	last, _ = p.readCommit()
+	p.file.WriteAt([]byte{0xff}, int64(last.header.offset+last.header.length-1))
+	p, size = reopen(t, p, dataPath)
+	if size != 3 {
+		t.Errorf("expected the previous commit of size %d, got %d", 3, size)
+		t.FailNow()
+	}
+
+	// Without any valid header, the trie cannot be read.
+	p.file.WriteAt(make([]byte, commitAreaSize), 0)
+	_, err = p.HasTrie()
+	if err == nil {
+		t.Errorf("expected an error without a valid commit")
+		t.FailNow()
+	}
+	p.Close()
+}
+
+func TestUncommittedFrames(t *testing.T) {
+	dataPath := path.Join(os.TempDir(), "hbt_commit_test")
+	os.RemoveAll(dataPath)
+	t.Cleanup(func() {
+		os.RemoveAll(dataPath)
+	})
+	p, frameId := newCommitPool(t, dataPath, 2)
+	err := p.WriteTrie(frameId, 1)
+	if err != nil {
+		t.Errorf("while writing trie: %v", err)
+		t.FailNow()
+	}
+	committed, _ := p.GetRoot(frameId)
+
+	// The frames are written with a new root and a new frame is unregistered, then the commit is interrupted.
+	setRoot(t, p, frameId, 3)
+	other, err := p.Register()
+	if err != nil {
+		t.Errorf("while registering frame: %v", err)
+		t.FailNow()
+	}
+	setRoot(t, p, other, 1)
+	err = p.WriteTrie(frameId, 2)
+	if err != nil {
+		t.Errorf("while writing trie: %v", err)
+		t.FailNow()
+	}
+	setRoot(t, p, frameId, 4)
+	err = p.Unregister(other)
+	if err != nil {
+		t.Errorf("while unregistering frame: %v", err)
+		t.FailNow()
+	}
+	err = p.WriteTree(frameId)
+	if err != nil {
+		t.Errorf("while writing frame: %v", err)
+		t.FailNow()
+	}
+
+	// The last commit is read back, along with the frame it refers to.
+	p, size := reopen(t, p, dataPath)
+	t.Cleanup(func() {
+		p.Close()
+	})
+	root, _ := p.GetRoot(frameId)
+	if size != 2 || root == committed || len(p.GetFrames()) != 2 {
+		t.Errorf("expected the second commit, got size %d, root %d and frames %v", size, root, p.GetFrames())
+		t.FailNow()
+	}
+	node, err := p.Query(frameId, root)
+	if err != nil || node.NumberOfChildren != 3 {
+		t.Errorf("expected the committed root with 3 children, got %v: %v", node, err)
+		t.FailNow()
+	}
+}
+
+func TestFormatVersion(t *testing.T) {
+	dataPath := path.Join(os.TempDir(), "hbt_commit_test")
+	os.RemoveAll(dataPath)
+	t.Cleanup(func() {
+		os.RemoveAll(dataPath)
+	})
+	p, frameId := newCommitPool(t, dataPath, 2)
+	err := p.WriteTrie(frameId, 7)
+	if err != nil {
+		t.Errorf("while writing trie: %v", err)
+		t.FailNow()
+	}
+
+	// A commit of another format version is rejected.
+	last, err := p.readCommit()
+	if err != nil {
+		t.Errorf("while reading commit: %v", err)
+		t.FailNow()
+	}
+	last.version = formatVersion + 1
+	record, _ := last.MarshalBinary()
+	last.header.length = uint64(len(record))
+	last.header.sum = crc32.Checksum(record, castagnoli)
+	header, _ := last.header.MarshalBinary()
+	p.file.WriteAt(record, int64(last.header.offset))
+	p.file.WriteAt(header, int64(last.slot*commitHeaderSize))
+	metaPath := p.file.Name()
+	p.Close()
+	expectFormatVersionError(t, dataPath, formatVersion+1)
+
+	// The metadata of the trie alone, as written before commits, is rejected as well.
+	meta := hbMetatadata{root: frameId, size: 7, nframes: frameId, chunkSize: uint64(DefaultChunkSize)}
+	data, _ := meta.MarshalBinary()
+	file, err := os.OpenFile(metaPath, os.O_RDWR, 0755)
+	if err != nil {
+		t.Errorf("while opening metadata file: %v", err)
+		t.FailNow()
+	}
+	file.Truncate(0)
+	file.WriteAt(data[:hbMetaSize()], 0)
+	file.Close()
+	expectFormatVersionError(t, dataPath, 0)
+}
+
+// expectFormatVersionError checks that the bufferpool in the given data path is rejected for the given version.
+func expectFormatVersionError(t *testing.T, dataPath string, version uint64) {
+	p, err := NewBufferpoolWithOptions(dataPath, &Options{Allocation: 16})
+	var versionErr *kverrors.FormatVersionError
+	if !errors.As(err, &versionErr) || versionErr.Stored != version {
+		if err == nil {
+			p.Close()
+		}
+		t.Errorf("expected a FormatVersionError for version %d, got %v", version, err)
+		t.FailNow()
+	}
+}
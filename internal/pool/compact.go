@@ -0,0 +1,508 @@
+package pool
+
+import (
+	"errors"
+	"hbtrie/internal/kverrors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A compaction copies the pages reachable from the roots of the b+ trees, and the records of the value log
+// referenced by their leaves, to fresh files next to the files of the trie. The fresh files are synced, then committed
+// with the compacting flag before they are renamed over the files of the trie: reopening the bufferpool completes
+// the renaming after a crash once the commit is written, and removes the fresh files before.
+const compactSuffix = ".compact"
+
+// CompactionStats describes the files rewritten by a compaction.
+type CompactionStats struct {
+	Pages     uint64 // number of pages copied to the fresh files
+	Values    uint64 // number of records copied to the fresh value log
+	Before    uint64 // byte size of the data files before the compaction
+	After     uint64 // byte size of the data files after the compaction
+	Reclaimed uint64 // number of bytes released by the compaction
+}
+
+// compactor holds the fresh files the live pages and records are copied to.
+type compactor struct {
+	pool   *Bufferpool
+	source *Bufferpool         // read-only bufferpool pinned to the commit copied
+	single *singleFile         // nil if each frame has its own file
+	files  map[uint64]*os.File // fresh file of each frame, unused in a single file layout
+	values *valueLog
+	moved  map[uint64]uint64 // position of each copied record in the fresh value log by its former position
+	stats  CompactionStats
+}
+
+// Compaction copies the last committed version of the trie to fresh files and swaps them in place of the files
+// of the trie. The pages and the records are read from a bufferpool pinned to that version rather than from the
+// bufferpool the compaction is started from, which can be read meanwhile: the committed pages are left untouched
+// as long as the trie is not written, see journal. It is started with StartCompaction, run with Copy and completed with Finish.
+type Compaction struct {
+	c          *compactor
+	root, size uint64
+	seq        uint64 // sequence number of the commit the files are copied from
+	frames     map[uint64]frameMetadata
+	err        error // error of the copy, abandoning the compaction
+}
+
+// Compact writes the trie with the given root and size, then copies its live pages and values to fresh files
+// and swaps them in place of the files of the trie. The pages are renumbered from the root of each b+ tree,
+// the free lists are left empty and the pages left to the older versions in append-only mode are dropped.
+// The pages held in memory are dropped as well, the b+ trees have to be loaded again from their new roots.
+// It returns the number of bytes reclaimed along with the number of pages and records copied.
+// If the fresh files cannot be swapped in once committed, the bufferpool has to be reopened, which completes the swap.
+// The bufferpool cannot be used until it returns, see StartCompaction to read it while the files are copied.
+// It returns a PinnedSnapshotError while snapshots are pinned to the files.
+func (pool *Bufferpool) Compact(root, size uint64) (CompactionStats, error) {
+	c, err := pool.StartCompaction(root, size)
+	if err != nil {
+		return CompactionStats{}, err
+	}
+	// The error of the copy is returned by Finish.
+	c.Copy()
+	return c.Finish()
+}
+
+// StartCompaction writes the trie with the given root and size, then creates the fresh files of a compaction
+// and pins a read-only bufferpool to the commit. The trie must not be written until the compaction is finished.
+// It returns a PinnedSnapshotError while snapshots are pinned to the files.
+func (pool *Bufferpool) StartCompaction(root, size uint64) (*Compaction, error) {
+	if pool.snapshots > 0 {
+		return nil, &kverrors.PinnedSnapshotError{Snapshots: pool.snapshots}
+	}
+	err := pool.WriteTrie(root, size)
+	if err != nil {
+		return nil, err
+	}
+	before, err := pool.diskUsage()
+	if err != nil {
+		return nil, err
+	}
+	source, err := pool.pin()
+	if err != nil {
+		return nil, err
+	}
+	_, _, _, err = source.ReadTrie()
+	if err != nil {
+		source.Release()
+		return nil, err
+	}
+	c, err := pool.newCompactor(source)
+	if err != nil {
+		source.Release()
+		return nil, err
+	}
+	c.stats.Before = before
+	return &Compaction{c: c, root: root, size: size, seq: source.pinned.header.seq}, nil
+}
+
+// Copy copies the live pages and values of the pinned commit to the fresh files and syncs them.
+// It only reads the files of the commit and writes the fresh files, so that it can run in its own goroutine
+// while the bufferpool the compaction is started from is read. Its error is returned by Finish.
+func (c *Compaction) Copy() error {
+	c.frames, c.err = c.c.copyFrames()
+	if c.err == nil {
+		c.err = c.c.sync()
+	}
+	return c.err
+}
+
+// Finish unpins the commit the files have been copied from, then commits the fresh files and swaps them in place
+// of the files of the trie, see Compact. The compaction is abandoned, and the files of the trie left untouched,
+// if the copy failed or if the trie has been committed since the compaction started, in which case it returns
+// a CompactionConflictError. It must not run concurrently with any other use of the bufferpool.
+func (c *Compaction) Finish() (CompactionStats, error) {
+	pool := c.c.pool
+	err := c.c.source.Release()
+	if c.err == nil {
+		c.err = err
+	}
+	if c.err == nil {
+		last, err := pool.readCommit()
+		if err != nil {
+			c.err = err
+		} else if last.header.seq != c.seq {
+			c.err = &kverrors.CompactionConflictError{}
+		}
+	}
+	if c.err != nil {
+		c.c.abort()
+		return CompactionStats{}, c.err
+	}
+
+	stale := pool.stale
+	pool.stale = 0
+	err = pool.commit(pool.trieMetadata(c.root, c.size), c.frames, true)
+	if err != nil {
+		// The commit may have been written anyway, the fresh files are left to the next reopen.
+		pool.stale = stale
+		c.c.close()
+		return CompactionStats{}, err
+	}
+
+	// From now on, the fresh files are the files of the trie.
+	err = c.c.swap(c.frames)
+	if err != nil {
+		return CompactionStats{}, err
+	}
+	err = pool.commit(pool.trieMetadata(c.root, c.size), c.frames, false)
+	if err != nil {
+		return CompactionStats{}, err
+	}
+	stats := c.c.stats
+	stats.After, err = pool.diskUsage()
+	if err != nil {
+		return CompactionStats{}, err
+	}
+	if stats.Before > stats.After {
+		stats.Reclaimed = stats.Before - stats.After
+	}
+	return stats, nil
+}
+
+// StaleRatio returns the share of the bytes of the data files no longer referenced by the trie: the pages released
+// by the b+ trees, the pages left to the older versions in append-only mode and the records of updated or deleted keys.
+// It is an estimate kept along the commits, the records written since the last commit are not accounted for after a crash.
+func (pool *Bufferpool) StaleRatio() float64 {
+	stats := pool.Stats()
+	total := stats.Pages*PageSize + pool.values.cursor
+	if total == 0 {
+		return 0
+	}
+	return float64(stats.FreePages*PageSize+pool.stale) / float64(total)
+}
+
+// Returns the byte size of the files holding the pages and the values of the trie.
+func (pool *Bufferpool) diskUsage() (uint64, error) {
+	filenames := []string{filepath.Join(pool.dataPath, valuesFilename)}
+	if pool.single != nil {
+		filenames = append(filenames, filepath.Join(pool.dataPath, singleFilename))
+	} else {
+		for _, id := range pool.getFrameIds() {
+			filenames = append(filenames, pool.filename(id))
+		}
+	}
+	usage := uint64(0)
+	for _, filename := range filenames {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return 0, err
+		}
+		usage += uint64(info.Size())
+	}
+	return usage, nil
+}
+
+// Returns the paths of the fresh files of a compaction found in the data path.
+func (pool *Bufferpool) freshFiles() ([]string, error) {
+	entries, err := os.ReadDir(pool.dataPath)
+	if err != nil {
+		return nil, err
+	}
+	fresh := []string{}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), compactSuffix) {
+			fresh = append(fresh, filepath.Join(pool.dataPath, entry.Name()))
+		}
+	}
+	return fresh, nil
+}
+
+// Creates the fresh value log, and the fresh single file in a single file layout, to copy the given pinned bufferpool to.
+// The fresh files left by a compaction which failed to commit are removed beforehand.
+func (pool *Bufferpool) newCompactor(source *Bufferpool) (*compactor, error) {
+	fresh, err := pool.freshFiles()
+	if err != nil {
+		return nil, err
+	}
+	for _, filename := range fresh {
+		err := os.Remove(filename)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c := &compactor{pool: pool, source: source, files: make(map[uint64]*os.File), moved: make(map[uint64]uint64)}
+	c.values, err = openValueLog(filepath.Join(pool.dataPath, valuesFilename) + compactSuffix)
+	if err != nil {
+		return nil, err
+	}
+	if pool.single != nil {
+		c.single, err = openSingleFile(filepath.Join(pool.dataPath, singleFilename) + compactSuffix)
+		if err != nil {
+			c.abort()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Copies the live pages of all the frames and returns their new metadata.
+func (c *compactor) copyFrames() (map[uint64]frameMetadata, error) {
+	frames := make(map[uint64]frameMetadata, len(c.source.frames))
+	for _, id := range c.source.getFrameIds() {
+		meta, err := c.copyFrame(id)
+		if err != nil {
+			return nil, err
+		}
+		frames[id] = meta
+	}
+	if c.single != nil {
+		return frames, c.single.writeCatalog(c.single.writePage)
+	}
+	return frames, nil
+}
+
+// Copies the pages reachable from the root of the given frame, breadth first, and the records referenced by its leaves.
+// The pages are numbered in the order they are reached, so that the leaves keep their order.
+func (c *compactor) copyFrame(frameId uint64) (frameMetadata, error) {
+	pool := c.pool
+	f := c.source.frames[frameId]
+	offset := uint64(0)
+	var file *os.File
+	if c.single != nil {
+		c.single.register(frameId)
+		offset = c.single.cursor
+	} else {
+		var err error
+		file, err = os.OpenFile(pool.filename(frameId)+compactSuffix, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
+		if err != nil {
+			return frameMetadata{}, err
+		}
+		c.files[frameId] = file
+	}
+
+	// The pages have all been written by the last commit, they are read from the files of the trie.
+	ids := map[uint64]uint64{f.root: offset + 1}
+	queue := []uint64{f.root}
+	for i := 0; i < len(queue); i++ {
+		node, err := c.source.io(frameId, queue[i])
+		if err != nil {
+			return frameMetadata{}, err
+		}
+		node.Id = ids[queue[i]]
+		for j := uint64(0); j < node.NumberOfChildren; j++ {
+			child := node.Children[j]
+			queue = append(queue, child)
+			ids[child] = offset + uint64(len(queue))
+			node.Children[j] = ids[child]
+		}
+		// The leaves are all reached before the first one is copied, the links point to their new pages.
+		node.Next, node.Prev = ids[node.Next], ids[node.Prev]
+		if pool.appendOnly {
+			node.Next, node.Prev = 0, 0
+		}
+		if node.IsLeaf() {
+			err = c.copyValues(node)
+			if err != nil {
+				return frameMetadata{}, err
+			}
+		}
+		data, err := node.MarshalBinary()
+		if err != nil {
+			return frameMetadata{}, err
+		}
+		if c.single != nil {
+			err = c.single.writePage(node.Id, data)
+		} else {
+			err = pool.writePage(file, node.Id, data)
+		}
+		if err != nil {
+			return frameMetadata{}, err
+		}
+	}
+	n := uint64(len(queue))
+	c.stats.Pages += n
+
+	meta := frameMetadata{root: offset + 1, size: f.size, cursor: offset + n, prefix: f.prefix}
+	if c.single != nil {
+		c.single.cursor += n
+		id, err := c.single.metaPage(frameId)
+		if err != nil {
+			return frameMetadata{}, err
+		}
+		page, err := meta.page()
+		if err != nil {
+			return frameMetadata{}, err
+		}
+		return meta, c.single.writePage(id, page)
+	}
+	data, err := meta.MarshalBinary()
+	if err != nil {
+		return frameMetadata{}, err
+	}
+	nbytes, err := file.WriteAt(data, 0)
+	if err != nil {
+		return frameMetadata{}, err
+	}
+	if nbytes != len(data) {
+		return frameMetadata{}, &kverrors.PartialWriteError{Total: len(data), Written: nbytes}
+	}
+	return meta, nil
+}
+
+// Copies the records referenced by the entries of the given leaf to the fresh value log and updates their positions.
+// A record referenced twice is copied once.
+func (c *compactor) copyValues(leaf *Node) error {
+	for i := uint64(0); i < leaf.NumberOfEntries; i++ {
+		e := &leaf.Entries[i]
+		if e.IsTree {
+			continue
+		}
+		if moved, ok := c.moved[e.Value]; ok {
+			e.Value = moved
+			continue
+		}
+		key, err := c.source.values.readKey(e.Value)
+		if err != nil {
+			return err
+		}
+		value, err := c.source.values.read(e.Value)
+		if err != nil {
+			return err
+		}
+		moved, err := c.values.append(key, value)
+		if err != nil {
+			return err
+		}
+		c.moved[e.Value] = moved
+		e.Value = moved
+		c.stats.Values++
+	}
+	return nil
+}
+
+// Syncs the fresh files.
+func (c *compactor) sync() error {
+	for _, file := range c.files {
+		err := c.pool.sync(file)
+		if err != nil {
+			return err
+		}
+	}
+	if c.single != nil {
+		err := c.pool.sync(c.single.file)
+		if err != nil {
+			return err
+		}
+	}
+	return c.pool.sync(c.values.file)
+}
+
+// Closes the fresh files.
+func (c *compactor) close() {
+	for _, file := range c.files {
+		file.Close()
+	}
+	if c.single != nil {
+		c.single.file.Close()
+	}
+	c.values.file.Close()
+}
+
+// Closes and removes the fresh files, the files of the trie are left untouched.
+func (c *compactor) abort() {
+	c.close()
+	for _, file := range c.files {
+		os.Remove(file.Name())
+	}
+	if c.single != nil {
+		os.Remove(c.single.file.Name())
+	}
+	os.Remove(c.values.file.Name())
+}
+
+// Closes the files of the trie and renames the fresh files over them, then reloads the frames with the given metadata.
+func (c *compactor) swap(frames map[uint64]frameMetadata) error {
+	pool := c.pool
+	for id, f := range pool.frames {
+		err := pool.closeFile(f)
+		if err != nil {
+			return err
+		}
+		pool.forget(id, f)
+	}
+	for id, file := range c.files {
+		err := file.Close()
+		if err != nil {
+			return err
+		}
+		err = os.Rename(file.Name(), pool.filename(id))
+		if err != nil {
+			return err
+		}
+	}
+	filename := filepath.Join(pool.dataPath, valuesFilename)
+	pool.values.file.Close()
+	c.values.file.Close()
+	err := os.Rename(filename+compactSuffix, filename)
+	if err != nil {
+		return err
+	}
+	pool.values, err = openValueLog(filename)
+	if err != nil {
+		return err
+	}
+	if c.single != nil {
+		filename := filepath.Join(pool.dataPath, singleFilename)
+		pool.single.file.Close()
+		c.single.file.Close()
+		err := os.Rename(filename+compactSuffix, filename)
+		if err != nil {
+			return err
+		}
+		pool.single, err = openSingleFile(filename)
+		if err != nil {
+			return err
+		}
+	}
+	err = pool.syncDir()
+	if err != nil {
+		return err
+	}
+
+	for id, meta := range frames {
+		f := pool.newFrame(nil)
+		if pool.single == nil {
+			f.filename = pool.filename(id)
+		}
+		f.root = meta.root
+		f.size = meta.size
+		f.cursor = meta.cursor
+		f.base = meta.cursor
+		f.prefix = meta.prefix
+		pool.frames[id] = f
+	}
+	return nil
+}
+
+// Completes the compaction committed before a crash by renaming its fresh files over the files of the trie,
+// or removes the fresh files of a compaction interrupted before its commit.
+func (pool *Bufferpool) recoverCompaction() error {
+	fresh, err := pool.freshFiles()
+	if err != nil || len(fresh) == 0 {
+		return err
+	}
+	last, err := pool.readCommit()
+	compacting := err == nil && last.compacting
+	for _, filename := range fresh {
+		if compacting {
+			err = os.Rename(filename, strings.TrimSuffix(filename, compactSuffix))
+		} else {
+			err = os.Remove(filename)
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if compacting {
+		// The value log opened along with the bufferpool has been replaced.
+		filename := filepath.Join(pool.dataPath, valuesFilename)
+		pool.values.file.Close()
+		pool.values, err = openValueLog(filename)
+		if err != nil {
+			return err
+		}
+	}
+	return pool.syncDir()
+}
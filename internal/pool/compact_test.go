@@ -0,0 +1,284 @@
+package pool
+
+import (
+	"errors"
+	"hbtrie/internal/kverrors"
+	"os"
+	"path"
+	"testing"
+)
+
+// newCompactionPool returns a bufferpool holding a root with 3 leaves of one entry each, written along with
+// a released page and the superseded records of each key.
+func newCompactionPool(t *testing.T, dataPath string, single bool) (*Bufferpool, uint64) {
+	p, err := NewBufferpoolWithOptions(dataPath, &Options{Allocation: 16, SingleFile: single})
+	if err != nil {
+		t.Errorf("while creating bufferpool: %v", err)
+		t.FailNow()
+	}
+	frameId, err := p.Register()
+	if err != nil {
+		t.Errorf("while registering frame: %v", err)
+		t.FailNow()
+	}
+	released, err := p.NewNode(frameId)
+	if err != nil {
+		t.Errorf("while creating node: %v", err)
+		t.FailNow()
+	}
+	setRoot(t, p, frameId, 3)
+	err = p.FreeNode(frameId, released.Id)
+	if err != nil {
+		t.Errorf("while releasing node: %v", err)
+		t.FailNow()
+	}
+	rootId, _ := p.GetRoot(frameId)
+	root, err := p.Query(frameId, rootId)
+	if err != nil {
+		t.Errorf("while querying root: %v", err)
+		t.FailNow()
+	}
+	for j := 0; j < 3; j++ {
+		key := []byte{byte('a' + j)}
+		for _, value := range []string{"stale", "live"} {
+			position, err := p.WriteValue(key, []byte(value))
+			if err != nil {
+				t.Errorf("while writing value: %v", err)
+				t.FailNow()
+			}
+			leaf, err := p.Query(frameId, root.Children[j])
+			if err != nil {
+				t.Errorf("while querying leaf: %v", err)
+				t.FailNow()
+			}
+			if leaf.NumberOfEntries == 0 {
+				leaf.InsertEntryAt(0, Entry{Key: key, Value: position})
+				continue
+			}
+			err = p.ReleaseValue(leaf.Entries[0].Value)
+			if err != nil {
+				t.Errorf("while releasing value: %v", err)
+				t.FailNow()
+			}
+			leaf.Update(0, position)
+		}
+	}
+	err = p.WriteTrie(frameId, 3)
+	if err != nil {
+		t.Errorf("while writing trie: %v", err)
+		t.FailNow()
+	}
+	return p, frameId
+}
+
+// checkCompacted checks that the leaves of the root of the given frame hold the live values, on consecutive pages.
+func checkCompacted(t *testing.T, p *Bufferpool, frameId uint64) {
+	rootId, _ := p.GetRoot(frameId)
+	root, err := p.Query(frameId, rootId)
+	if err != nil {
+		t.Errorf("while querying root: %v", err)
+		t.FailNow()
+	}
+	if root.NumberOfChildren != 3 {
+		t.Errorf("expected 3 children, got %d", root.NumberOfChildren)
+		t.FailNow()
+	}
+	for j := 0; j < 3; j++ {
+		if root.Children[j] != rootId+uint64(j)+1 {
+			t.Errorf("expected leaf %d on page %d, got %d", j, rootId+uint64(j)+1, root.Children[j])
+			t.FailNow()
+		}
+		leaf, err := p.Query(frameId, root.Children[j])
+		if err != nil {
+			t.Errorf("while querying leaf: %v", err)
+			t.FailNow()
+		}
+		value, err := p.ReadValue(leaf.Entries[0].Value)
+		if err != nil || string(value) != "live" {
+			t.Errorf("expected live value, got %q, error %v", value, err)
+			t.FailNow()
+		}
+	}
+	if p.StaleRatio() != 0 {
+		t.Errorf("expected no stale data, got ratio %f", p.StaleRatio())
+		t.FailNow()
+	}
+	fresh, err := p.freshFiles()
+	if err != nil || len(fresh) != 0 {
+		t.Errorf("expected no fresh file left, got %v, error %v", fresh, err)
+		t.FailNow()
+	}
+}
+
+func TestCompact(t *testing.T) {
+	for _, single := range []bool{false, true} {
+		dataPath := path.Join(os.TempDir(), "hbt_compact_test")
+		os.RemoveAll(dataPath)
+		t.Cleanup(func() {
+			os.RemoveAll(dataPath)
+		})
+		p, frameId := newCompactionPool(t, dataPath, single)
+		if p.StaleRatio() == 0 {
+			t.Errorf("expected stale data before compaction")
+			t.FailNow()
+		}
+
+		// The released page and the stale records are dropped.
+		stats, err := p.Compact(frameId, 3)
+		if err != nil {
+			t.Errorf("while compacting: %v", err)
+			t.FailNow()
+		}
+		if stats.Pages != 4 || stats.Values != 3 {
+			t.Errorf("expected 4 pages and 3 values copied, got %d and %d", stats.Pages, stats.Values)
+			t.FailNow()
+		}
+		if stats.Reclaimed == 0 || stats.Reclaimed != stats.Before-stats.After {
+			t.Errorf("expected reclaimed bytes, got %d from %d to %d", stats.Reclaimed, stats.Before, stats.After)
+			t.FailNow()
+		}
+		if free := p.Stats().FreePages; free != 0 {
+			t.Errorf("expected no free page, got %d", free)
+			t.FailNow()
+		}
+		checkCompacted(t, p, frameId)
+
+		// The compacted trie is committed.
+		p, size := reopen(t, p, dataPath)
+		if size != 3 {
+			t.Errorf("expected size 3, got %d", size)
+			t.FailNow()
+		}
+		checkCompacted(t, p, frameId)
+		p.Close()
+	}
+}
+
+func TestInterruptedCompaction(t *testing.T) {
+	for _, committed := range []bool{false, true} {
+		dataPath := path.Join(os.TempDir(), "hbt_compact_test")
+		os.RemoveAll(dataPath)
+		t.Cleanup(func() {
+			os.RemoveAll(dataPath)
+		})
+		p, frameId := newCompactionPool(t, dataPath, false)
+
+		// A crash interrupts the compaction before the fresh files are swapped in, after their commit or before.
+		c, err := p.StartCompaction(frameId, 3)
+		if err != nil {
+			t.Errorf("while starting compaction: %v", err)
+			t.FailNow()
+		}
+		err = c.Copy()
+		if err == nil {
+			err = c.c.source.Release()
+		}
+		if err == nil && committed {
+			err = p.commit(p.trieMetadata(frameId, 3), c.frames, true)
+		}
+		if err != nil {
+			t.Errorf("while compacting: %v", err)
+			t.FailNow()
+		}
+		c.c.close()
+
+		// Reopening the bufferpool completes the swap or removes the fresh files.
+		p, size := reopen(t, p, dataPath)
+		if size != 3 {
+			t.Errorf("expected size 3, got %d", size)
+			t.FailNow()
+		}
+		fresh, err := p.freshFiles()
+		if err != nil || len(fresh) != 0 {
+			t.Errorf("expected no fresh file left, got %v, error %v", fresh, err)
+			t.FailNow()
+		}
+		stats, err := p.Compact(frameId, 3)
+		if err != nil {
+			t.Errorf("while compacting: %v", err)
+			t.FailNow()
+		}
+		if (stats.Reclaimed == 0) != committed {
+			t.Errorf("expected reclaimed bytes only if not compacted yet, got %d", stats.Reclaimed)
+			t.FailNow()
+		}
+		checkCompacted(t, p, frameId)
+		p.Close()
+	}
+}
+
+func TestConcurrentCompaction(t *testing.T) {
+	for _, single := range []bool{false, true} {
+		dataPath := path.Join(os.TempDir(), "hbt_compact_test")
+		os.RemoveAll(dataPath)
+		t.Cleanup(func() {
+			os.RemoveAll(dataPath)
+		})
+		p, frameId := newCompactionPool(t, dataPath, single)
+
+		// The trie is read while the files are copied.
+		c, err := p.StartCompaction(frameId, 3)
+		if err != nil {
+			t.Errorf("while starting compaction: %v", err)
+			t.FailNow()
+		}
+		done := make(chan error)
+		go func() {
+			done <- c.Copy()
+		}()
+		rootId, _ := p.GetRoot(frameId)
+		for i := 0; i < 100; i++ {
+			root, err := p.Query(frameId, rootId)
+			if err != nil {
+				t.Errorf("while querying root: %v", err)
+				t.FailNow()
+			}
+			leaf, err := p.Query(frameId, root.Children[i%3])
+			if err != nil {
+				t.Errorf("while querying leaf: %v", err)
+				t.FailNow()
+			}
+			value, err := p.ReadValue(leaf.Entries[0].Value)
+			if err != nil || string(value) != "live" {
+				t.Errorf("expected live value, got %q, error %v", value, err)
+				t.FailNow()
+			}
+		}
+		err = <-done
+		if err != nil {
+			t.Errorf("while copying: %v", err)
+			t.FailNow()
+		}
+		_, err = c.Finish()
+		if err != nil {
+			t.Errorf("while finishing compaction: %v", err)
+			t.FailNow()
+		}
+		checkCompacted(t, p, frameId)
+		if p.Snapshots() != 0 {
+			t.Errorf("expected the commit to be unpinned, got %d snapshots", p.Snapshots())
+			t.FailNow()
+		}
+
+		// A compaction is abandoned if the trie is committed before it finishes.
+		c, err = p.StartCompaction(frameId, 3)
+		if err != nil {
+			t.Errorf("while starting compaction: %v", err)
+			t.FailNow()
+		}
+		c.Copy()
+		err = p.WriteTrie(frameId, 3)
+		if err != nil {
+			t.Errorf("while writing trie: %v", err)
+			t.FailNow()
+		}
+		_, err = c.Finish()
+		var conflictError *kverrors.CompactionConflictError
+		if !errors.As(err, &conflictError) {
+			t.Errorf("expected CompactionConflictError, got %v", err)
+			t.FailNow()
+		}
+		checkCompacted(t, p, frameId)
+		p.Close()
+	}
+}
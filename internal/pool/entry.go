@@ -7,43 +7,53 @@ import (
 	"unsafe"
 )
 
-// Entry is the key-value unit of the bptree. it has a size of 25 bytes.
+// Entry is the key-value unit of the bptree. With the default chunk size of 16 bytes, it has a size of 26 bytes.
 type Entry struct {
-	IsTree bool     // 1 byte
-	Key    [16]byte // keys are chunks of 16 bytes
-	Value  uint64   // values are pointers to subsequent b+ trees
+	IsTree bool   // 1 byte
+	Key    []byte // keys are chunks of at most the configured chunk size, prefixed by their length on disk
+	Value  uint64 // positions of values in the value log or pointers to subsequent b+ trees
 }
 
-// Returns the byte length of one entry.
-func EntryLen() int {
+// Returns the byte length of one entry with the given chunk size.
+func EntryLen(chunkSize int) int {
 	b := true
+	l := uint8(0)
 	v := uint64(0)
-	return int(unsafe.Sizeof(b) + 16 + unsafe.Sizeof(v))
+	return int(unsafe.Sizeof(b) + unsafe.Sizeof(l) + unsafe.Sizeof(v) + uintptr(chunkSize))
 }
 
 // Implements the binary.BinaryMarshaler interface.
+// The key comes last so that the entry can be stored in a slot sized for a greater chunk size.
 func (e *Entry) MarshalBinary() ([]byte, error) {
-	buf := make([]byte, EntryLen())
+	if len(e.Key) > MaxChunkSize {
+		return nil, &kverrors.InvalidSizeError{Got: len(e.Key), Should: MaxChunkSize}
+	}
+	buf := make([]byte, EntryLen(len(e.Key)))
 	if e.IsTree {
 		buf[0] = 1
 	}
-	copy(buf[1:17], e.Key[:])
-	binary.LittleEndian.PutUint64(buf[17:], e.Value)
-	if len(buf) != EntryLen() {
-		return nil, &kverrors.BufferOverflowError{Max: EntryLen(), Cursor: len(buf)}
+	buf[1] = uint8(len(e.Key))
+	binary.LittleEndian.PutUint64(buf[2:10], e.Value)
+	cursor := 10 + copy(buf[10:], e.Key)
+	if cursor != EntryLen(len(e.Key)) {
+		return nil, &kverrors.BufferOverflowError{Max: EntryLen(len(e.Key)), Cursor: cursor}
 	}
 	return buf, nil
 }
 
 // Implements the binary.BinaryUnmarshaler interface.
+// The length of the key is read from the data, the remaining bytes are ignored.
 func (e *Entry) UnmarshalBinary(data []byte) error {
-	if len(data) != EntryLen() {
+	if len(data) < EntryLen(0) {
 		return fmt.Errorf("invalid Entry size: %d", len(data))
 	}
-	if data[0] == 1 {
-		e.IsTree = true
+	length := int(data[1])
+	if len(data) < EntryLen(length) {
+		return fmt.Errorf("invalid Entry size: %d for a key of %d bytes", len(data), length)
 	}
-	copy(e.Key[:], data[1:17])
-	e.Value = binary.LittleEndian.Uint64(data[17:])
+	e.IsTree = data[0] == 1
+	e.Value = binary.LittleEndian.Uint64(data[2:10])
+	e.Key = make([]byte, length)
+	copy(e.Key, data[10:10+length])
 	return nil
 }
@@ -1,6 +1,7 @@
 package pool
 
 import (
+	"bytes"
 	"math"
 	"testing"
 	"unsafe"
@@ -13,12 +14,12 @@ func TestMarshalUnmarshalEntry(t *testing.T) {
 		t.FailNow()
 	}
 
-	if EntryLen() != 25 {
-		t.Errorf("expected 25, got %d", EntryLen())
+	if EntryLen(16) != 26 {
+		t.Errorf("expected 26, got %d", EntryLen(16))
 		t.FailNow()
 	}
 
-	k := [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 15}
+	k := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 15}
 	v := uint64(math.MaxUint64)
 	e := Entry{Key: k, Value: v, IsTree: true}
 	data, err := e.MarshalBinary()
@@ -26,7 +27,7 @@ func TestMarshalUnmarshalEntry(t *testing.T) {
 		t.Errorf("while marshaling: %v", err)
 		t.FailNow()
 	}
-	u := Entry{Key: [16]byte{1, 2, 3, 2, 5, 21, 7, 56, 9, 255, 21, 13, 13, 14, 15, 15}, Value: 0, IsTree: false}
+	u := Entry{Key: []byte{1, 2, 3, 2, 5, 21, 7, 56, 9, 255, 21, 13, 13, 14, 15, 15}, Value: 0, IsTree: false}
 	err = u.UnmarshalBinary(data)
 	if err != nil {
 		t.Errorf("while unmarshaling: %v", err)
@@ -36,7 +37,7 @@ func TestMarshalUnmarshalEntry(t *testing.T) {
 		t.Errorf("expected %t, got %t", e.IsTree, u.IsTree)
 		t.FailNow()
 	}
-	if u.Key != k {
+	if !bytes.Equal(u.Key, k) {
 		t.Errorf("expected %d, got %d", k, u.Key)
 		t.FailNow()
 	}
@@ -55,7 +56,32 @@ func TestMarshalUnmarshalEntry(t *testing.T) {
 		t.Errorf("expected %t, got %t", e.IsTree, u.IsTree)
 		t.FailNow()
 	}
-	if u.Key != k {
+	if !bytes.Equal(u.Key, k) {
+		t.Errorf("expected %d, got %d", k, u.Key)
+		t.FailNow()
+	}
+	if u.Value != v {
+		t.Errorf("expected %d, got %d", v, u.Value)
+		t.FailNow()
+	}
+
+	// A short key keeps its trailing zero bytes when stored in a slot sized for a greater chunk size.
+	k = []byte{1, 0}
+	e = Entry{Key: k, Value: v}
+	data, err = e.MarshalBinary()
+	if err != nil {
+		t.Errorf("while marshaling: %v", err)
+		t.FailNow()
+	}
+	slot := bytes.Repeat([]byte{0xff}, EntryLen(16))
+	copy(slot, data)
+	u = *new(Entry)
+	err = u.UnmarshalBinary(slot)
+	if err != nil {
+		t.Errorf("while unmarshaling: %v", err)
+		t.FailNow()
+	}
+	if !bytes.Equal(u.Key, k) {
 		t.Errorf("expected %d, got %d", k, u.Key)
 		t.FailNow()
 	}
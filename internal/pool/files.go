@@ -0,0 +1,65 @@
+package pool
+
+import (
+	"os"
+)
+
+// number of maximum frame files kept open at once
+const poolMaxOpenFiles = 1024
+
+// fileOf returns the file of the given frame and reopens it if it has been closed.
+// The files are kept open in a LRU fashion: when more than poolMaxOpenFiles are open,
+// the least recently used one is closed. Its frame keeps its pages in memory.
+// In a single file layout, it returns the file shared by all the frames.
+func (pool *Bufferpool) fileOf(f *frame) (*os.File, error) {
+	if pool.single != nil {
+		return pool.single.file, nil
+	}
+	if f.file != nil {
+		pool.opened(f)
+		return f.file, nil
+	}
+	file, err := os.OpenFile(f.filename, os.O_RDWR, 0755)
+	if err != nil {
+		return nil, err
+	}
+	f.file = file
+	pool.opened(f)
+	return file, nil
+}
+
+// opened records the given frame as the most recently used open file and closes the least recently used ones.
+// A commit only syncs the open files: the first error syncing or closing a file is recorded in closeErr
+// and fails the following commits, see writeCommit.
+func (pool *Bufferpool) opened(f *frame) {
+	if f.handle != nil {
+		pool.files.MoveToFront(f.handle)
+		return
+	}
+	f.handle = pool.files.PushFront(f)
+	for pool.files.Len() > poolMaxOpenFiles {
+		err := pool.closeFile(pool.files.Back().Value.(*frame))
+		if err != nil && pool.closeErr == nil {
+			pool.closeErr = err
+		}
+	}
+}
+
+// closeFile syncs and closes the file of the given frame. It is reopened on the next access.
+// The pages written to the file are synced beforehand, a commit only syncs the open files.
+func (pool *Bufferpool) closeFile(f *frame) error {
+	if f.handle != nil {
+		pool.files.Remove(f.handle)
+		f.handle = nil
+	}
+	if f.file == nil {
+		return nil
+	}
+	err := pool.sync(f.file)
+	closeErr := f.file.Close()
+	f.file = nil
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
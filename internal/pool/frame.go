@@ -1,71 +1,61 @@
 package pool
 
 import (
+	"container/list"
 	"hbtrie/internal/kverrors"
+	"math"
 	"os"
 )
 
-const frameMaxNumberOfPages = 1000
-
 // pagePosition returns the position of the page in the file.
 func pagePosition(pageId uint64) uint64 {
 	return frameMetaSize() + pageId*PageSize
 }
 
-// Frame is a self-managed unit of the buffer pool. It consists in a double linked list of pages.
-// Each page, when queried, is pushed to the head of the list. Pages on the tail of the list are the least recently used.
-// Pages on the tail should thus be evicted first.
+// maxPageId returns the greatest page id whose page can be addressed in a file, in both layouts.
+func maxPageId() uint64 {
+	return (math.MaxInt64 - frameMetaSize() - PageSize) / PageSize
+}
+
+// Frame is a self-managed unit of the buffer pool. It holds the pages of one b+ tree in memory.
+// Each page, when queried or added, is recorded by the replacement policy of the frame,
+// which chooses the page to evict once the frame is full.
 type frame struct {
-	// id    uint64
-	head  *Page
-	tail  *Page
-	pages map[uint64]*Node
+	pages  map[uint64]*Node
+	policy ReplacementPolicy
 	// dirties    map[uint64]*Node
 	cursor     uint64
 	allocation uint64
+	chunkSize  int
 	root       uint64
 	size       uint64
-	file       *os.File
-}
-
-// Pushes a non-existing page to the head of the frame.
-func (l *frame) push(p *Page) {
-	l.head.next.prev = p
-	p.next = l.head.next
-	p.prev = l.head
-	l.head.next = p
+	prefix     []byte        // key bytes skipped by the b+ tree of the frame
+	base       uint64        // greatest page id of the last committed version of the b+ tree
+	free       *freeList     // pages released by the b+ tree of the frame, unused in a single file layout
+	file       *os.File      // nil while the file is closed by the bufferpool, or in a single file layout
+	filename   string        // used to reopen the file
+	handle     *list.Element // position of the frame among the open files of the bufferpool
 }
 
-// Removes a page from the frame.
-func (l *frame) pop(p *Page) {
-	p.prev.next = p.next
-	p.next.prev = p.prev
-}
-
-// Pushes an existing page to the head of the frame.
-func (l *frame) boost(p *Page) {
-	l.pop(p)
-	l.push(p)
-}
-
-// Initialises a new frame with a given file and an in-memory allocation.
-func newFrame(file *os.File, allocation uint64) *frame {
+// Initialises a new frame with a given file, an in-memory allocation, the chunk size of the keys of its nodes
+// and the policy choosing the pages to evict. The file is nil if the frame shares the single file of the bufferpool.
+func newFrame(file *os.File, allocation uint64, chunkSize int, policy ReplacementPolicy) *frame {
 
 	if allocation < 3 {
 		panic("allocation for a frame must at least be of 3 pages")
 	}
 
 	l := &frame{
-		head:       new(Page),
-		tail:       new(Page),
 		pages:      make(map[uint64]*Node),
+		policy:     policy,
+		free:       &freeList{},
 		allocation: allocation,
+		chunkSize:  chunkSize,
 		file:       file,
 	}
-	l.head.next = l.tail
-	l.tail.prev = l.head
-	l.pages[l.head.Id] = &Node{Page: l.head}
-	l.pages[l.tail.Id] = &Node{Page: l.tail}
+	if file != nil {
+		l.filename = file.Name()
+	}
 	l.cursor = 0
 	return l
 }
@@ -77,34 +67,34 @@ func (l *frame) query(id uint64) *Node {
 		return nil
 	}
 
-	if p, ok := l.pages[id]; ok {
-
-		l.boost(p.Page)
+	node, ok := l.pages[id]
+	if ok {
+		l.policy.Access(PageKey{Page: id})
 	}
 
-	return l.pages[id]
+	return node
 }
 
-// Returns a new node (page) and false if the frame has enough in-memory capacity. Otherwise, it returns nil and false.
-func (l *frame) newNode() (node *Node, full bool) {
+// Returns a new node (page) with the given id and false if the frame has enough in-memory capacity.
+// Otherwise, it returns nil and true.
+func (l *frame) newNode(id uint64) (node *Node, full bool) {
 	if l.full() {
 		return nil, true
 	}
-	l.cursor++
-	if l.cursor > frameMaxNumberOfPages {
-		panic("frame over page limit")
+	if id > l.cursor {
+		l.cursor = id
 	}
-	page := NewPage(l.cursor)
-	node = &Node{Page: page}
+	page := NewPage(id)
+	node = initNode(page, l.chunkSize)
 	node.Dirty = true
 	l.pages[node.Id] = node
-	l.push(node.Page)
+	l.policy.Insert(PageKey{Page: node.Id})
 	return node, false
 }
 
 // States whether the frame has reached is in-memory capacity.
 func (l *frame) full() bool {
-	return len(l.pages) >= int(l.allocation)
+	return uint64(len(l.pages)) >= l.allocation
 }
 
 // Adds a new page to the frame that was previously evicted.
@@ -115,20 +105,30 @@ func (l *frame) add(node *Node) error {
 	if node.Id > l.cursor {
 		return &kverrors.InvalidNodeIOError{Node: node.Id, Cursor: l.cursor}
 	}
-	if node.Id > frameMaxNumberOfPages {
-		return &kverrors.InvalidNodeIOError{Node: node.Id, Cursor: frameMaxNumberOfPages}
-	}
 	l.pages[node.Id] = node
-	l.push(node.Page)
+	l.policy.Insert(PageKey{Page: node.Id})
 	return nil
 }
 
-// evicts the least recently used page and returns it.
+// Removes the page with the given id from the frame and returns it, or nil if it is not in memory.
+func (l *frame) remove(id uint64) *Node {
+	node, ok := l.pages[id]
+	if !ok {
+		return nil
+	}
+	l.policy.Remove(PageKey{Page: id})
+	delete(l.pages, id)
+	return node
+}
+
+// evicts the page chosen by the replacement policy and returns it, or nil if the frame is empty.
 func (l *frame) evict() *Node {
-	p := l.tail.prev
-	l.pop(p)
-	node := l.pages[p.Id]
-	delete(l.pages, p.Id)
+	key, ok := l.policy.Evict()
+	if !ok {
+		return nil
+	}
+	node := l.pages[key.Page]
+	delete(l.pages, key.Page)
 	return node
 }
 
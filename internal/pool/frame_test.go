@@ -0,0 +1,70 @@
+package pool
+
+import (
+	"errors"
+	"hbtrie/internal/kverrors"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestFrameGrowth(t *testing.T) {
+	for _, single := range []bool{false, true} {
+		dataPath := path.Join(os.TempDir(), "hbt_frame_growth_test")
+		os.RemoveAll(dataPath)
+		t.Cleanup(func() {
+			os.RemoveAll(dataPath)
+		})
+
+		p, err := NewBufferpoolWithOptions(dataPath, &Options{Allocation: 16, SingleFile: single})
+		if err != nil {
+			t.Errorf("while creating bufferpool: %v", err)
+			t.FailNow()
+		}
+		frameId, err := p.Register()
+		if err != nil {
+			t.Errorf("while registering frame: %v", err)
+			t.FailNow()
+		}
+
+		// A frame holds far more pages than its former limit of 1000.
+		ids := make([]uint64, 0, 2500)
+		for i := 0; i < 2500; i++ {
+			node, err := p.NewNode(frameId)
+			if err != nil {
+				t.Errorf("[step %d] while creating node: %v", i, err)
+				t.FailNow()
+			}
+			err = node.InsertEntryAt(0, Entry{Key: []byte{byte(i)}, Value: uint64(i)})
+			if err != nil {
+				t.Errorf("[step %d] while inserting entry: %v", i, err)
+				t.FailNow()
+			}
+			ids = append(ids, node.Id)
+		}
+		for i, id := range ids {
+			node, err := p.Query(frameId, id)
+			if err != nil {
+				t.Errorf("[step %d] while querying node %d: %v", i, id, err)
+				t.FailNow()
+			}
+			if node.NumberOfEntries != 1 || node.Entries[0].Value != uint64(i) {
+				t.Errorf("[step %d] unexpected node %v", i, node.Entries[0])
+				t.FailNow()
+			}
+		}
+
+		// Reaching the addressable size of the file is an error.
+		p.frames[frameId].cursor = maxPageId()
+		if p.single != nil {
+			p.single.cursor = maxPageId()
+		}
+		var limitError *kverrors.PageLimitError
+		_, err = p.NewNode(frameId)
+		if !errors.As(err, &limitError) {
+			t.Errorf("expected a PageLimitError, got %v", err)
+			t.FailNow()
+		}
+		p.Close()
+	}
+}
@@ -0,0 +1,184 @@
+package pool
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hbtrie/internal/kverrors"
+)
+
+// freeList holds the ids of the pages released by the b+ trees, reused before new pages are allocated.
+// On disk, the list is chained through trunk pages taken among the free pages themselves:
+// each trunk holds the id of the next trunk, the number of ids it lists, then the ids, and ends with its checksum.
+type freeList struct {
+	ids []uint64
+}
+
+// Returns the number of page ids listed by one trunk page, between its header and its checksum.
+func freeListCapacity() int {
+	return int(PageSize-16-sealLen) / 8
+}
+
+// Adds a free page to the list.
+func (f *freeList) push(id uint64) {
+	f.ids = append(f.ids, id)
+}
+
+// Removes the last freed page from the list and returns it. It returns false if the list is empty.
+func (f *freeList) pop() (uint64, bool) {
+	if len(f.ids) == 0 {
+		return 0, false
+	}
+	id := f.ids[len(f.ids)-1]
+	f.ids = f.ids[:len(f.ids)-1]
+	return id, true
+}
+
+func (f *freeList) len() int {
+	return len(f.ids)
+}
+
+// Writes the trunk pages of the list with the given function and returns the id of the first one,
+// or zero if the list is empty.
+func (f *freeList) write(writePage func(id uint64, data []byte) error) (uint64, error) {
+	capacity := freeListCapacity()
+	bin := binary.LittleEndian
+	next := uint64(0)
+	for i := 0; i < len(f.ids); {
+		trunk := f.ids[i]
+		i++
+		n := len(f.ids) - i
+		if n > capacity {
+			n = capacity
+		}
+		data := make([]byte, PageSize)
+		bin.PutUint64(data[0:8], next)
+		bin.PutUint64(data[8:16], uint64(n))
+		for j := 0; j < n; j++ {
+			bin.PutUint64(data[16+8*j:24+8*j], f.ids[i+j])
+		}
+		i += n
+		seal(data)
+		err := writePage(trunk, data)
+		if err != nil {
+			return 0, err
+		}
+		next = trunk
+	}
+	return next, nil
+}
+
+// Reads the list starting with the given trunk page of the given frame, or of the single file if zero, with the given function.
+// Page ids greater than the given cursor are rejected. It returns a CorruptPageError if a trunk doesn't match its checksum.
+func readFreeList(frameId, head, cursor uint64, readPage func(id uint64) ([]byte, error)) (*freeList, error) {
+	f := &freeList{}
+	capacity := freeListCapacity()
+	bin := binary.LittleEndian
+	for trunk := head; trunk != 0; {
+		if trunk > cursor || f.len() > int(cursor) {
+			return nil, fmt.Errorf("invalid free list trunk page %d, cursor %d", trunk, cursor)
+		}
+		data, err := readPage(trunk)
+		if err != nil {
+			return nil, err
+		}
+		if !sealed(data) {
+			return nil, &kverrors.CorruptPageError{Frame: frameId, Page: trunk}
+		}
+		n := int(bin.Uint64(data[8:16]))
+		if n > capacity {
+			return nil, &kverrors.OverflowError{Type: "Number of free pages", Actual: n, Max: capacity}
+		}
+		f.push(trunk)
+		for j := 0; j < n; j++ {
+			id := bin.Uint64(data[16+8*j : 24+8*j])
+			if id == 0 || id > cursor {
+				return nil, fmt.Errorf("invalid free page %d, cursor %d", id, cursor)
+			}
+			f.push(id)
+		}
+		trunk = bin.Uint64(data[0:8])
+	}
+	return f, nil
+}
+
+// Returns the free list the pages of the given frame are released to and reused from:
+// the one of the frame file, or the one shared by all the frames of a single file.
+func (pool *Bufferpool) freeListOf(f *frame) *freeList {
+	if pool.single != nil {
+		return pool.single.free
+	}
+	return f.free
+}
+
+// FreeNode releases the page with the given id of the given frame, once its b+ tree no longer references it.
+// The page is dropped from memory without being written, and its id is reused by a later NewNode.
+// In append-only mode, the page is left to the committed versions of the b+ tree instead.
+func (pool *Bufferpool) FreeNode(frameId, pageId uint64) error {
+	frame := pool.frames[frameId]
+	if frame == nil {
+		return &kverrors.UnregisteredError{}
+	}
+	if pageId == 0 || pageId > frame.cursor || pageId == frame.root {
+		return &kverrors.InvalidNodeIOError{Node: pageId, Cursor: frame.cursor}
+	}
+	pool.drop(frameId, pageId)
+	if pool.appendOnly {
+		pool.stale += PageSize
+		return nil
+	}
+	pool.freeListOf(frame).push(pageId)
+	return nil
+}
+
+// Releases all the pages of the b+ tree of the given frame and its metadata page to the free list of the single file.
+func (pool *Bufferpool) release(frameId uint64, f *frame) error {
+	ids := make([]uint64, 0)
+	if f.root != 0 {
+		stack := []uint64{f.root}
+		for len(stack) > 0 {
+			id := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			node, ok := f.pages[id]
+			if !ok {
+				var err error
+				node, err = pool.io(frameId, id)
+				if err != nil {
+					return err
+				}
+			}
+			ids = append(ids, id)
+			stack = append(stack, node.Children[:node.NumberOfChildren]...)
+		}
+	}
+	meta, err := pool.single.metaPage(frameId)
+	if err != nil {
+		return err
+	}
+	ids = append(ids, meta)
+	for _, id := range ids {
+		pool.single.free.push(id)
+	}
+	return nil
+}
+
+// Stats describes the pages of the bufferpool.
+type Stats struct {
+	Frames    uint64 // number of registered frames
+	Pages     uint64 // number of pages allocated in the files, free ones included
+	FreePages uint64 // number of pages released by the b+ trees and not reused yet
+}
+
+// Stats returns statistics on the frames and the pages of the bufferpool.
+func (pool *Bufferpool) Stats() Stats {
+	stats := Stats{Frames: uint64(len(pool.frames))}
+	if pool.single != nil {
+		stats.Pages = pool.single.cursor
+		stats.FreePages = uint64(pool.single.free.len())
+		return stats
+	}
+	for _, frame := range pool.frames {
+		stats.Pages += frame.cursor
+		stats.FreePages += uint64(frame.free.len())
+	}
+	return stats
+}
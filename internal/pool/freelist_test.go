@@ -0,0 +1,160 @@
+package pool
+
+import (
+	"errors"
+	"hbtrie/internal/kverrors"
+	"os"
+	"path"
+	"sort"
+	"testing"
+)
+
+func TestWriteReadFreeList(t *testing.T) {
+	pages := make(map[uint64][]byte)
+	writePage := func(id uint64, data []byte) error {
+		pages[id] = data
+		return nil
+	}
+	readPage := func(id uint64) ([]byte, error) {
+		return pages[id], nil
+	}
+
+	// The ids span several trunk pages.
+	n := 3*freeListCapacity() + 7
+	f := &freeList{}
+	for id := uint64(1); id <= uint64(n); id++ {
+		f.push(id)
+	}
+	head, err := f.write(writePage)
+	if err != nil {
+		t.Errorf("while writing free list: %v", err)
+		t.FailNow()
+	}
+	if len(pages) != 4 {
+		t.Errorf("expected 4 trunk pages, got %d", len(pages))
+		t.FailNow()
+	}
+	f2, err := readFreeList(1, head, uint64(n), readPage)
+	if err != nil {
+		t.Errorf("while reading free list: %v", err)
+		t.FailNow()
+	}
+	sort.Slice(f2.ids, func(i, j int) bool { return f2.ids[i] < f2.ids[j] })
+	if f2.len() != n {
+		t.Errorf("expected %d free pages, got %d", n, f2.len())
+		t.FailNow()
+	}
+	for i, id := range f2.ids {
+		if id != uint64(i+1) {
+			t.Errorf("expected page %d, got %d", i+1, id)
+			t.FailNow()
+		}
+	}
+
+	_, err = readFreeList(1, head, uint64(n-1), readPage)
+	if err == nil {
+		t.Errorf("expected an error for pages beyond the cursor")
+		t.FailNow()
+	}
+
+	// A trunk page torn or altered is detected by its checksum.
+	pages[head][PageSize/2] ^= 0xff
+	_, err = readFreeList(1, head, uint64(n), readPage)
+	var corrupt *kverrors.CorruptPageError
+	if !errors.As(err, &corrupt) {
+		t.Errorf("expected a CorruptPageError, got %v", err)
+		t.FailNow()
+	}
+	pages[head][PageSize/2] ^= 0xff
+
+	head, err = (&freeList{}).write(writePage)
+	if err != nil || head != 0 {
+		t.Errorf("expected no trunk page for an empty list, got %d: %v", head, err)
+		t.FailNow()
+	}
+}
+
+func TestReleaseSingleFileFrame(t *testing.T) {
+	dataPath := path.Join(os.TempDir(), "hbt_release_test")
+	os.RemoveAll(dataPath)
+	t.Cleanup(func() {
+		os.RemoveAll(dataPath)
+	})
+
+	p, err := NewBufferpoolWithOptions(dataPath, &Options{Allocation: 16, SingleFile: true})
+	if err != nil {
+		t.Errorf("while creating bufferpool: %v", err)
+		t.FailNow()
+	}
+	frames := make([]uint64, 0, 2)
+	for i := 0; i < 2; i++ {
+		frameId, err := p.Register()
+		if err != nil {
+			t.Errorf("while registering frame: %v", err)
+			t.FailNow()
+		}
+		root, err := p.NewNode(frameId)
+		if err != nil {
+			t.Errorf("while creating node: %v", err)
+			t.FailNow()
+		}
+		for j := 0; j < 3; j++ {
+			child, err := p.NewNode(frameId)
+			if err != nil {
+				t.Errorf("while creating node: %v", err)
+				t.FailNow()
+			}
+			root.InsertChildAt(j, child)
+		}
+		err = p.SetRoot(frameId, root.Id)
+		if err != nil {
+			t.Errorf("while setting root: %v", err)
+			t.FailNow()
+		}
+		frames = append(frames, frameId)
+	}
+	err = p.WriteTrie(frames[0], 0)
+	if err != nil {
+		t.Errorf("while writing trie: %v", err)
+		t.FailNow()
+	}
+
+	// The four pages of the b+ tree and the metadata page of the frame are released.
+	pages := p.Stats().Pages
+	err = p.Unregister(frames[1])
+	if err != nil {
+		t.Errorf("while unregistering frame: %v", err)
+		t.FailNow()
+	}
+	if free := p.Stats().FreePages; free != 5 {
+		t.Errorf("expected 5 free pages, got %d", free)
+		t.FailNow()
+	}
+	_, err = p.NewNode(frames[0])
+	if err != nil {
+		t.Errorf("while creating node: %v", err)
+		t.FailNow()
+	}
+	stats := p.Stats()
+	if stats.FreePages != 4 || stats.Pages != pages {
+		t.Errorf("expected a page reused among %d, got %+v", pages, stats)
+		t.FailNow()
+	}
+	err = p.WriteTrie(frames[0], 0)
+	if err != nil {
+		t.Errorf("while writing trie: %v", err)
+		t.FailNow()
+	}
+	p.Close()
+
+	p, err = NewBufferpoolWithOptions(dataPath, &Options{Allocation: 16})
+	if err != nil {
+		t.Errorf("while reopening bufferpool: %v", err)
+		t.FailNow()
+	}
+	defer p.Close()
+	if free := p.Stats().FreePages; free != 4 {
+		t.Errorf("expected 4 free pages after reopening, got %d", free)
+		t.FailNow()
+	}
+}
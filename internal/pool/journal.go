@@ -0,0 +1,344 @@
+package pool
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"hbtrie/internal/kverrors"
+	"os"
+	"path/filepath"
+)
+
+const journalFilename = "journal.db"
+
+// journalHeaderLen is the byte length of the header preceding each record of the journal:
+// the id of the frame, the position of the data in the file holding it, the length of the data
+// and the checksum of the record.
+const journalHeaderLen = 28
+
+// The pages the last commit may refer to are never written in place before the next commit. Such a page, evicted
+// or written by a commit, is written to the journal instead, along with the frame metadata, the free list trunks,
+// the catalog and the superblock, and read back from it while it is pending. The pages allocated since the last commit
+// are written in place. A commit syncs the journal and records its length and checksum, then applies it in place
+// and empties it. Reopening the bufferpool applies the journal again if it is the one of the last commit,
+// whose writes may have been torn by a crash, and discards it otherwise: its writes have never been committed.
+// With the DisableJournal option, or SyncNone, every page is written in place and the journal stays empty.
+type journal struct {
+	file    *os.File
+	cursor  int64              // position of the next record
+	records []journalRecord    // records of the journal, in the order they are applied
+	index   map[journalKey]int // last record written at each position
+}
+
+// journalKey is a position in the file of a frame, or in the single file if the frame is zero.
+type journalKey struct {
+	frame    uint64
+	position uint64
+}
+
+// journalRecord is data written to the journal, to be applied at its position.
+type journalRecord struct {
+	key    journalKey
+	offset int64 // position of the record in the journal
+	length int   // byte length of the data
+	sum    uint32
+}
+
+// Opens the journal at the given path or creates it if it doesn't exist.
+// The records it holds have to be recovered before new ones are written.
+func openJournal(filename string) (*journal, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &journal{file: file, index: make(map[journalKey]int)}, nil
+}
+
+// Writes the given data to be applied at the given position. The record already written at this position
+// is overwritten if it has the same length, so that the journal only grows with the positions written.
+func (j *journal) write(key journalKey, data []byte) error {
+	buf := make([]byte, journalHeaderLen+len(data))
+	bin := binary.LittleEndian
+	bin.PutUint64(buf[0:8], key.frame)
+	bin.PutUint64(buf[8:16], key.position)
+	bin.PutUint64(buf[16:24], uint64(len(data)))
+	copy(buf[journalHeaderLen:], data)
+	sum := recordChecksum(buf)
+	bin.PutUint32(buf[24:28], sum)
+
+	i, ok := j.index[key]
+	if !ok || j.records[i].length != len(data) {
+		i = len(j.records)
+		j.records = append(j.records, journalRecord{key: key, offset: j.cursor, length: len(data)})
+		j.cursor += int64(len(buf))
+		j.index[key] = i
+	}
+	j.records[i].sum = sum
+	nbytes, err := j.file.WriteAt(buf, j.records[i].offset)
+	if err != nil {
+		return err
+	}
+	if nbytes != len(buf) {
+		return &kverrors.PartialWriteError{Total: len(buf), Written: nbytes}
+	}
+	return nil
+}
+
+// Returns the data last written at the given position, and false if none is pending.
+func (j *journal) read(key journalKey) ([]byte, bool, error) {
+	i, ok := j.index[key]
+	if !ok {
+		return nil, false, nil
+	}
+	r := j.records[i]
+	data := make([]byte, r.length)
+	nbytes, err := j.file.ReadAt(data, r.offset+journalHeaderLen)
+	if err != nil && nbytes != len(data) {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+// Returns the byte length of the journal and the checksum of its records, recorded by the commit it belongs to.
+func (j *journal) seal() (uint64, uint32) {
+	return uint64(j.cursor), journalChecksum(j.records)
+}
+
+// Empties the journal once its records have been applied, or discarded.
+func (j *journal) reset() error {
+	err := j.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+	j.cursor = 0
+	j.records = nil
+	j.index = make(map[journalKey]int)
+	return nil
+}
+
+// Reads the records of the journal, up to the first one torn or altered, and returns them along with their byte length.
+func (j *journal) load() ([]journalRecord, int64, error) {
+	info, err := j.file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	data := make([]byte, info.Size())
+	nbytes, err := j.file.ReadAt(data, 0)
+	if err != nil && nbytes != len(data) {
+		return nil, 0, err
+	}
+	bin := binary.LittleEndian
+	records := []journalRecord{}
+	cursor := 0
+	for len(data)-cursor >= journalHeaderLen {
+		header := data[cursor : cursor+journalHeaderLen]
+		length := bin.Uint64(header[16:24])
+		if length > uint64(len(data)-cursor-journalHeaderLen) {
+			break
+		}
+		buf := data[cursor : cursor+journalHeaderLen+int(length)]
+		sum := recordChecksum(buf)
+		if sum != bin.Uint32(header[24:28]) {
+			break
+		}
+		key := journalKey{frame: bin.Uint64(header[0:8]), position: bin.Uint64(header[8:16])}
+		records = append(records, journalRecord{key: key, offset: int64(cursor), length: int(length), sum: sum})
+		cursor += len(buf)
+	}
+	return records, int64(cursor), nil
+}
+
+// recordChecksum returns the CRC32C checksum of the given record, computed over all its bytes but the checksum itself.
+func recordChecksum(buf []byte) uint32 {
+	sum := crc32.Update(0, castagnoli, buf[:24])
+	return crc32.Update(sum, castagnoli, buf[journalHeaderLen:])
+}
+
+// journalChecksum returns the CRC32C checksum of the checksums of the given records.
+func journalChecksum(records []journalRecord) uint32 {
+	buf := make([]byte, 4*len(records))
+	for i, r := range records {
+		binary.LittleEndian.PutUint32(buf[4*i:4*i+4], r.sum)
+	}
+	return crc32.Checksum(buf, castagnoli)
+}
+
+// Writes the given data of the page with the given id of the given frame, or of the single file.
+// The page is written to the journal if the last commit may refer to it, in place otherwise or if the journal
+// is disabled. The frame is ignored in a single file layout, where the pages up to the cursor of the last commit
+// may be referred to.
+func (pool *Bufferpool) writePageOf(f *frame, frameId, pageId uint64, data []byte) error {
+	base := pool.baseOf(f)
+	if pool.single != nil {
+		frameId = 0
+	}
+	if pageId <= base && !pool.inPlace {
+		return pool.journal.write(journalKey{frame: frameId, position: pool.position(pageId)}, data)
+	}
+	file, err := pool.fileOf(f)
+	if err != nil {
+		return err
+	}
+	return pool.writePage(file, pageId, data)
+}
+
+// Returns the greatest page id of the given frame, or of the single file, the last commit may refer to.
+func (pool *Bufferpool) baseOf(f *frame) uint64 {
+	if pool.single != nil {
+		return pool.single.base
+	}
+	return f.base
+}
+
+// Reads the page with the given id of the given frame from the journal if it is pending there, from the given file otherwise.
+func (pool *Bufferpool) readPageOf(file *os.File, frameId, pageId uint64) ([]byte, error) {
+	if pool.journal != nil {
+		if pool.single != nil {
+			frameId = 0
+		}
+		data, ok, err := pool.journal.read(journalKey{frame: frameId, position: pool.position(pageId)})
+		if err != nil || ok {
+			return data, err
+		}
+	}
+	return pool.readPage(file, pageId)
+}
+
+// Writes the given nodes, to the journal or in place. The files and the journal are synced with the SyncAlways policy.
+func (pool *Bufferpool) writeNodes(pages []stagedPage) error {
+	if len(pages) == 0 {
+		return nil
+	}
+	for _, p := range pages {
+		f := pool.frames[p.frame]
+		if f == nil {
+			return &kverrors.UnregisteredError{}
+		}
+		err := pool.checkAppendOnly(p.frame, p.node)
+		if err != nil {
+			return err
+		}
+		data, err := p.node.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		err = pool.writePageOf(f, p.frame, p.node.Id, data)
+		if err != nil {
+			return err
+		}
+		p.node.Dirty = false
+	}
+	if pool.syncPolicy != SyncAlways {
+		return nil
+	}
+
+	err := pool.syncJournal()
+	if err != nil {
+		return err
+	}
+	if pool.single != nil {
+		return pool.sync(pool.single.file)
+	}
+	synced := make(map[uint64]bool, len(pages))
+	for _, p := range pages {
+		f := pool.frames[p.frame]
+		// A file closed meanwhile has been synced, see closeFile.
+		if synced[p.frame] || f.file == nil {
+			continue
+		}
+		err := pool.sync(f.file)
+		if err != nil {
+			return err
+		}
+		synced[p.frame] = true
+	}
+	return nil
+}
+
+// Syncs the journal unless it is empty, an empty journal being synced once it is emptied.
+func (pool *Bufferpool) syncJournal() error {
+	if pool.journal.cursor == 0 {
+		return nil
+	}
+	return pool.sync(pool.journal.file)
+}
+
+// stagedPage is a node of a frame to be written.
+type stagedPage struct {
+	frame uint64
+	node  *Node
+}
+
+// Applies the given records of the journal in place and syncs the files they are written to, then empties the journal.
+// The files are opened by name, as the frames may not be loaded yet: the records of a frame file removed since
+// they were written are ignored, the commits no longer refer to it.
+func (pool *Bufferpool) applyJournal(records []journalRecord) error {
+	files := make(map[uint64]*os.File)
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for _, r := range records {
+		file, ok := files[r.key.frame]
+		if !ok {
+			filename := filepath.Join(pool.dataPath, singleFilename)
+			if r.key.frame != 0 {
+				filename = pool.filename(r.key.frame)
+			}
+			var err error
+			file, err = os.OpenFile(filename, os.O_RDWR, 0755)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			files[r.key.frame] = file
+		}
+		if file == nil {
+			continue
+		}
+		data := make([]byte, r.length)
+		nbytes, err := pool.journal.file.ReadAt(data, r.offset+journalHeaderLen)
+		if err != nil && nbytes != len(data) {
+			return err
+		}
+		nbytes, err = file.WriteAt(data, int64(r.key.position))
+		if err != nil {
+			return err
+		}
+		if nbytes != len(data) {
+			return &kverrors.PartialWriteError{Total: len(data), Written: nbytes}
+		}
+	}
+	for _, file := range files {
+		if file == nil {
+			continue
+		}
+		err := pool.sync(file)
+		if err != nil {
+			return err
+		}
+	}
+	err := pool.journal.reset()
+	if err != nil {
+		return err
+	}
+	return pool.sync(pool.journal.file)
+}
+
+// Applies the journal of the last commit, whose writes may have been interrupted by a crash,
+// or discards the journal written since the last commit. It has to be called before any file of the trie is read.
+func (pool *Bufferpool) recoverJournal() error {
+	records, length, err := pool.journal.load()
+	if err != nil {
+		return err
+	}
+	last, err := pool.readCommit()
+	if err == nil && last.journal != 0 && uint64(length) == last.journal && journalChecksum(records) == last.journalSum {
+		return pool.applyJournal(records)
+	}
+	err = pool.journal.reset()
+	if err != nil {
+		return err
+	}
+	return pool.sync(pool.journal.file)
+}
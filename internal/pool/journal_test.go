@@ -0,0 +1,305 @@
+package pool
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+// rootChildren returns the number of children of the root of the given frame, as written in place in its file.
+func rootChildren(t *testing.T, p *Bufferpool, frameId uint64) uint64 {
+	rootId, _ := p.GetRoot(frameId)
+	file, err := p.fileOf(p.frames[frameId])
+	if err != nil {
+		t.Errorf("while opening frame file: %v", err)
+		t.FailNow()
+	}
+	data, err := p.readPage(file, rootId)
+	if err != nil {
+		t.Errorf("while reading root: %v", err)
+		t.FailNow()
+	}
+	root := initNode(NewPage(0), p.chunkSize)
+	err = root.UnmarshalBinary(data)
+	if err != nil {
+		t.Errorf("while decoding root: %v", err)
+		t.FailNow()
+	}
+	return root.NumberOfChildren
+}
+
+// addChild adds a new child to the root of the given frame and writes the root.
+func addChild(t *testing.T, p *Bufferpool, frameId uint64) {
+	rootId, _ := p.GetRoot(frameId)
+	child, err := p.NewNode(frameId)
+	if err != nil {
+		t.Errorf("while creating node: %v", err)
+		t.FailNow()
+	}
+	root, err := p.Query(frameId, rootId)
+	if err != nil {
+		t.Errorf("while querying root: %v", err)
+		t.FailNow()
+	}
+	root.InsertChildAt(int(root.NumberOfChildren), child)
+	err = p.write(frameId, root)
+	if err != nil {
+		t.Errorf("while writing root: %v", err)
+		t.FailNow()
+	}
+}
+
+func TestJournal(t *testing.T) {
+	for _, single := range []bool{false, true} {
+		dataPath := path.Join(os.TempDir(), "hbt_journal_test")
+		os.RemoveAll(dataPath)
+		t.Cleanup(func() {
+			os.RemoveAll(dataPath)
+		})
+		p, err := NewBufferpoolWithOptions(dataPath, &Options{Allocation: 16, SingleFile: single})
+		if err != nil {
+			t.Errorf("while creating bufferpool: %v", err)
+			t.FailNow()
+		}
+		frameId, err := p.Register()
+		if err != nil {
+			t.Errorf("while registering frame: %v", err)
+			t.FailNow()
+		}
+		setRoot(t, p, frameId, 3)
+		err = p.WriteTrie(frameId, 3)
+		if err != nil {
+			t.Errorf("while writing trie: %v", err)
+			t.FailNow()
+		}
+
+		// A committed page written again goes to the journal, it is read back from there and left untouched in place.
+		addChild(t, p, frameId)
+		if n := rootChildren(t, p, frameId); n != 3 {
+			t.Errorf("expected the committed root in place with 3 children, got %d", n)
+			t.FailNow()
+		}
+		rootId, _ := p.GetRoot(frameId)
+		p.drop(frameId, rootId)
+		root, err := p.Query(frameId, rootId)
+		if err != nil || root.NumberOfChildren != 4 {
+			t.Errorf("expected the journaled root with 4 children, got %v", err)
+			t.FailNow()
+		}
+
+		// The journal written since the last commit is discarded when the bufferpool is reopened.
+		p, size := reopen(t, p, dataPath)
+		if size != 3 || rootChildren(t, p, frameId) != 3 {
+			t.Errorf("expected the committed trie of size 3, got %d", size)
+			t.FailNow()
+		}
+
+		// The journal of the last commit is applied when the bufferpool is reopened,
+		// repairing the pages torn while it was applied.
+		addChild(t, p, frameId)
+		err = p.Update(frameId, rootId, 4)
+		if err != nil {
+			t.Errorf("while updating frame: %v", err)
+			t.FailNow()
+		}
+		err = p.writeCommit(frameId, 4)
+		if err != nil {
+			t.Errorf("while committing trie: %v", err)
+			t.FailNow()
+		}
+		file, err := p.fileOf(p.frames[frameId])
+		if err != nil {
+			t.Errorf("while opening frame file: %v", err)
+			t.FailNow()
+		}
+		position := int64(p.position(rootId))
+		_, err = file.WriteAt(make([]byte, PageSize/2), position+int64(PageSize/2))
+		if err != nil {
+			t.Errorf("while tearing root: %v", err)
+			t.FailNow()
+		}
+		p, size = reopen(t, p, dataPath)
+		if size != 4 || rootChildren(t, p, frameId) != 4 {
+			t.Errorf("expected the committed trie of size 4, got %d", size)
+			t.FailNow()
+		}
+		info, err := os.Stat(path.Join(p.DataPath(), journalFilename))
+		if err != nil || info.Size() != 0 {
+			t.Errorf("expected an empty journal, got %v", err)
+			t.FailNow()
+		}
+		p.Close()
+	}
+}
+
+func TestDisableJournal(t *testing.T) {
+	for _, options := range []Options{{Allocation: 16, DisableJournal: true}, {Allocation: 16, Sync: SyncNone}} {
+		dataPath := path.Join(os.TempDir(), "hbt_journal_test")
+		os.RemoveAll(dataPath)
+		t.Cleanup(func() {
+			os.RemoveAll(dataPath)
+		})
+		p, err := NewBufferpoolWithOptions(dataPath, &options)
+		if err != nil {
+			t.Errorf("while creating bufferpool: %v", err)
+			t.FailNow()
+		}
+		frameId, err := p.Register()
+		if err != nil {
+			t.Errorf("while registering frame: %v", err)
+			t.FailNow()
+		}
+		setRoot(t, p, frameId, 3)
+		err = p.WriteTrie(frameId, 3)
+		if err != nil {
+			t.Errorf("while writing trie: %v", err)
+			t.FailNow()
+		}
+
+		// A committed page written again goes in place, the journal is left empty.
+		addChild(t, p, frameId)
+		if n := rootChildren(t, p, frameId); n != 4 {
+			t.Errorf("expected the root written in place with 4 children, got %d", n)
+			t.FailNow()
+		}
+		rootId, _ := p.GetRoot(frameId)
+		err = p.Update(frameId, rootId, 4)
+		if err != nil {
+			t.Errorf("while updating frame: %v", err)
+			t.FailNow()
+		}
+		err = p.writeCommit(frameId, 4)
+		if err != nil {
+			t.Errorf("while committing trie: %v", err)
+			t.FailNow()
+		}
+		info, err := p.journal.file.Stat()
+		if err != nil || info.Size() != 0 {
+			t.Errorf("expected an empty journal, got %v", err)
+			t.FailNow()
+		}
+		p, size := reopen(t, p, dataPath)
+		if size != 4 || rootChildren(t, p, frameId) != 4 {
+			t.Errorf("expected the committed trie of size 4, got %d", size)
+			t.FailNow()
+		}
+		p.Close()
+	}
+}
+
+func TestTornJournal(t *testing.T) {
+	dataPath := path.Join(os.TempDir(), "hbt_journal_test")
+	os.RemoveAll(dataPath)
+	t.Cleanup(func() {
+		os.RemoveAll(dataPath)
+	})
+	p, err := NewBufferpoolWithOptions(dataPath, &Options{Allocation: 16})
+	if err != nil {
+		t.Errorf("while creating bufferpool: %v", err)
+		t.FailNow()
+	}
+	defer p.Close()
+
+	// The records are read up to the first one torn by a crash.
+	data := make([]byte, PageSize)
+	for i := uint64(1); i <= 2; i++ {
+		err := p.journal.write(journalKey{frame: 1, position: i * PageSize}, data)
+		if err != nil {
+			t.Errorf("while writing journal: %v", err)
+			t.FailNow()
+		}
+	}
+	_, err = p.journal.file.WriteAt([]byte{0xff}, p.journal.cursor-1)
+	if err != nil {
+		t.Errorf("while tearing journal: %v", err)
+		t.FailNow()
+	}
+	records, length, err := p.journal.load()
+	if err != nil {
+		t.Errorf("while loading journal: %v", err)
+		t.FailNow()
+	}
+	if len(records) != 1 || length != journalHeaderLen+int64(PageSize) {
+		t.Errorf("expected 1 record, got %d in %d bytes", len(records), length)
+		t.FailNow()
+	}
+
+	// A journal which doesn't belong to the last commit is discarded.
+	err = p.recoverJournal()
+	if err != nil {
+		t.Errorf("while recovering journal: %v", err)
+		t.FailNow()
+	}
+	info, err := p.journal.file.Stat()
+	if err != nil || info.Size() != 0 {
+		t.Errorf("expected an empty journal, got %v", err)
+		t.FailNow()
+	}
+}
+
+func TestJournalAuxiliaryPages(t *testing.T) {
+	dataPath := path.Join(os.TempDir(), "hbt_journal_test")
+	os.RemoveAll(dataPath)
+	t.Cleanup(func() {
+		os.RemoveAll(dataPath)
+	})
+	p, err := NewBufferpoolWithOptions(dataPath, &Options{Allocation: 16, SingleFile: true})
+	if err != nil {
+		t.Errorf("while creating bufferpool: %v", err)
+		t.FailNow()
+	}
+	frames := make([]uint64, 0, 2)
+	for i := 0; i < 2; i++ {
+		frameId, err := p.Register()
+		if err != nil {
+			t.Errorf("while registering frame: %v", err)
+			t.FailNow()
+		}
+		setRoot(t, p, frameId, 3)
+		frames = append(frames, frameId)
+	}
+	err = p.WriteTrie(frames[0], 3)
+	if err != nil {
+		t.Errorf("while writing trie: %v", err)
+		t.FailNow()
+	}
+
+	// The superblock, the catalog, the metadata page of the frame and the free-list trunk written by a commit
+	// go to the journal, which repairs them when they are torn while it is applied.
+	err = p.Unregister(frames[1])
+	if err != nil {
+		t.Errorf("while unregistering frame: %v", err)
+		t.FailNow()
+	}
+	addChild(t, p, frames[0])
+	rootId, _ := p.GetRoot(frames[0])
+	err = p.Update(frames[0], rootId, 4)
+	if err != nil {
+		t.Errorf("while updating frame: %v", err)
+		t.FailNow()
+	}
+	err = p.writeCommit(frames[0], 4)
+	if err != nil {
+		t.Errorf("while committing trie: %v", err)
+		t.FailNow()
+	}
+	stats := p.Stats()
+	torn := append([]uint64{0, p.single.metas[frames[0]-1]}, p.single.catalog...)
+	for _, id := range torn {
+		_, err = p.single.file.WriteAt(make([]byte, PageSize/2), int64(id*PageSize+PageSize/2))
+		if err != nil {
+			t.Errorf("while tearing page %d: %v", id, err)
+			t.FailNow()
+		}
+	}
+	p, size := reopen(t, p, dataPath)
+	defer p.Close()
+	if size != 4 || rootChildren(t, p, frames[0]) != 4 {
+		t.Errorf("expected the committed trie of size 4, got %d", size)
+		t.FailNow()
+	}
+	if p.Stats() != stats {
+		t.Errorf("expected %+v after reopening, got %+v", stats, p.Stats())
+		t.FailNow()
+	}
+}
@@ -45,7 +45,7 @@ func (n *Node) DeleteEntryAt(at int) (Entry, error) {
 }
 
 // Searches for the given key in the node. The search is a classical binary search.
-func (n *Node) Search(key [16]byte) (int, bool) {
+func (n *Node) Search(key []byte) (int, bool) {
 	lower := 0
 	upper := int(n.NumberOfEntries - 1)
 	var cursor int
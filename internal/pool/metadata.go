@@ -2,6 +2,8 @@ package pool
 
 import (
 	"encoding/binary"
+	"fmt"
+	"hbtrie/internal/kverrors"
 	"unsafe"
 )
 
@@ -9,60 +11,132 @@ type frameMetadata struct {
 	root   uint64
 	size   uint64
 	cursor uint64
+	free   uint64 // first trunk page of the free list of the frame file, zero if empty
+	prefix []byte // key bytes skipped by the b+ tree, stored after the fixed size fields
 }
 
-// Returns the byte size of one b+ tree metadata.
+// Returns the byte size of the fixed size fields of one b+ tree metadata.
 func frameMetaSize() uint64 {
-	return uint64(unsafe.Sizeof(frameMetadata{}))
+	return 5 * uint64(unsafe.Sizeof(uint64(0)))
+}
+
+// MaxPrefixLen returns the greatest byte length of the prefix skipped by a b+ tree.
+// The metadata of a frame along with its prefix fits in one sealed page.
+func MaxPrefixLen() int {
+	return int(PageSize - frameMetaSize() - sealLen)
 }
 
 // Implements the binary.BinaryMarshaler interface.
 func (m *frameMetadata) MarshalBinary() ([]byte, error) {
-	buf := make([]byte, frameMetaSize())
+	if len(m.prefix) > MaxPrefixLen() {
+		return nil, &kverrors.InvalidSizeError{Got: len(m.prefix), Should: MaxPrefixLen()}
+	}
+	buf := make([]byte, frameMetaSize()+uint64(len(m.prefix)))
 	bin := binary.LittleEndian
 	bin.PutUint64(buf[0:8], m.root)
 	bin.PutUint64(buf[8:16], m.size)
 	bin.PutUint64(buf[16:24], m.cursor)
+	bin.PutUint64(buf[24:32], m.free)
+	bin.PutUint64(buf[32:40], uint64(len(m.prefix)))
+	copy(buf[40:], m.prefix)
 	return buf, nil
 }
 
+// Returns the metadata as a whole sealed page, as stored in a single file.
+// The whole page is written so that it can be read back when it is the last one of the file.
+func (m *frameMetadata) page() ([]byte, error) {
+	data, err := m.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	page := make([]byte, PageSize)
+	copy(page, data)
+	seal(page)
+	return page, nil
+}
+
 // Implements the binary.BinaryUnmarshaler interface.
 func (m *frameMetadata) UnmarshalBinary(data []byte) error {
+	if uint64(len(data)) < frameMetaSize() {
+		return fmt.Errorf("invalid frame metadata size: %d", len(data))
+	}
 	bin := binary.LittleEndian
 	m.root = bin.Uint64(data[0:8])
 	m.size = bin.Uint64(data[8:16])
 	m.cursor = bin.Uint64(data[16:24])
+	m.free = bin.Uint64(data[24:32])
+	length := bin.Uint64(data[32:40])
+	if length > uint64(MaxPrefixLen()) {
+		return &kverrors.InvalidSizeError{Got: int(length), Should: MaxPrefixLen()}
+	}
+	if uint64(len(data)) < frameMetaSize()+length {
+		return fmt.Errorf("invalid frame metadata size: %d for a prefix of %d bytes", len(data), length)
+	}
+	m.prefix = append([]byte(nil), data[40:40+length]...)
 
 	return nil
 }
 
 type hbMetatadata struct {
-	root    uint64
-	size    uint64
-	nframes uint64
+	root      uint64
+	size      uint64
+	nframes   uint64 // greatest frame id
+	chunkSize uint64
+	holes     []uint64 // ids of the unregistered frames below nframes, stored after the fixed size fields
 }
 
-// Returns the byte size of one hb trie metadata.
+// Returns the byte size of the fixed size fields of one hb trie metadata.
 func hbMetaSize() uint64 {
-	return uint64(unsafe.Sizeof(hbMetatadata{}))
+	return 4 * uint64(unsafe.Sizeof(uint64(0)))
 }
 
 // Implements the binary.BinaryMarshaler interface.
 func (m *hbMetatadata) MarshalBinary() ([]byte, error) {
-	buf := make([]byte, hbMetaSize())
+	buf := make([]byte, hbMetaSize()+8+8*uint64(len(m.holes)))
 	bin := binary.LittleEndian
 	bin.PutUint64(buf[0:8], m.root)
 	bin.PutUint64(buf[8:16], m.size)
 	bin.PutUint64(buf[16:24], m.nframes)
+	bin.PutUint64(buf[24:32], m.chunkSize)
+	bin.PutUint64(buf[32:40], uint64(len(m.holes)))
+	for i, id := range m.holes {
+		bin.PutUint64(buf[40+8*i:48+8*i], id)
+	}
 	return buf, nil
 }
 
 // Implements the binary.BinaryUnmarshaler interface.
+// The holes are optional, a trie written without unregistered frames may only hold the fixed size fields.
 func (m *hbMetatadata) UnmarshalBinary(data []byte) error {
+	if uint64(len(data)) < hbMetaSize() {
+		return fmt.Errorf("invalid hb trie metadata size: %d", len(data))
+	}
 	bin := binary.LittleEndian
 	m.root = bin.Uint64(data[0:8])
 	m.size = bin.Uint64(data[8:16])
 	m.nframes = bin.Uint64(data[16:24])
+	m.chunkSize = bin.Uint64(data[24:32])
+	m.holes = nil
+	if uint64(len(data)) < hbMetaSize()+8 {
+		return nil
+	}
+	n := bin.Uint64(data[32:40])
+	if n > m.nframes || uint64(len(data)) < hbMetaSize()+8+8*n {
+		return fmt.Errorf("invalid hb trie metadata size: %d for %d unregistered frames", len(data), n)
+	}
+	for i := uint64(0); i < n; i++ {
+		m.holes = append(m.holes, bin.Uint64(data[40+8*i:48+8*i]))
+	}
 
 	return nil
 }
+
+// States whether the frame with the given id has been unregistered.
+func (m *hbMetatadata) unregistered(frameId uint64) bool {
+	for _, id := range m.holes {
+		if id == frameId {
+			return true
+		}
+	}
+	return false
+}
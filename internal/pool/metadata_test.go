@@ -1,6 +1,7 @@
 package pool
 
 import (
+	"bytes"
 	"math/rand"
 	"testing"
 )
@@ -9,8 +10,10 @@ func TestMarshalUnmarshalFrameMetadata(t *testing.T) {
 	meta := &frameMetadata{}
 	meta.root = rand.Uint64()
 	meta.size = rand.Uint64()
-	if frameMetaSize() != 24 {
-		t.Errorf("expected 24, got %d", frameMetaSize())
+	meta.free = rand.Uint64()
+	meta.prefix = []byte("tenant/0001/")
+	if frameMetaSize() != 40 {
+		t.Errorf("expected 40, got %d", frameMetaSize())
 		t.FailNow()
 	}
 	data, err := meta.MarshalBinary()
@@ -36,16 +39,32 @@ func TestMarshalUnmarshalFrameMetadata(t *testing.T) {
 		t.Errorf("expected %d, got %d", meta.cursor, meta2.cursor)
 		t.FailNow()
 	}
+	if meta.free != meta2.free {
+		t.Errorf("expected %d, got %d", meta.free, meta2.free)
+		t.FailNow()
+	}
+	if !bytes.Equal(meta.prefix, meta2.prefix) {
+		t.Errorf("expected %v, got %v", meta.prefix, meta2.prefix)
+		t.FailNow()
+	}
 
+	meta.prefix = make([]byte, MaxPrefixLen()+1)
+	_, err = meta.MarshalBinary()
+	if err == nil {
+		t.Errorf("expected an error for a prefix of %d bytes", len(meta.prefix))
+		t.FailNow()
+	}
 }
 
 func TestMarshalUnmarshalHBMeta(t *testing.T) {
 	meta := &hbMetatadata{}
 	meta.root = rand.Uint64()
 	meta.size = rand.Uint64()
-	meta.nframes = rand.Uint64()
-	if hbMetaSize() != 24 {
-		t.Errorf("expected 24, got %d", hbMetaSize())
+	meta.chunkSize = rand.Uint64()
+	meta.nframes = 10
+	meta.holes = []uint64{3, 7}
+	if hbMetaSize() != 32 {
+		t.Errorf("expected 32, got %d", hbMetaSize())
 		t.FailNow()
 	}
 	data, err := meta.MarshalBinary()
@@ -71,4 +90,20 @@ func TestMarshalUnmarshalHBMeta(t *testing.T) {
 		t.Errorf("expected %d, got %d", meta.nframes, meta2.nframes)
 		t.FailNow()
 	}
+	if meta.chunkSize != meta2.chunkSize {
+		t.Errorf("expected %d, got %d", meta.chunkSize, meta2.chunkSize)
+		t.FailNow()
+	}
+	if len(meta2.holes) != 2 || !meta2.unregistered(3) || !meta2.unregistered(7) || meta2.unregistered(5) {
+		t.Errorf("expected %v, got %v", meta.holes, meta2.holes)
+		t.FailNow()
+	}
+
+	// A trie written without holes may only hold the fixed size fields.
+	meta3 := &hbMetatadata{}
+	err = meta3.UnmarshalBinary(data[:hbMetaSize()])
+	if err != nil || meta3.holes != nil || meta3.nframes != meta.nframes {
+		t.Errorf("expected no holes, got %v: %v", meta3.holes, err)
+		t.FailNow()
+	}
 }
@@ -1,25 +1,29 @@
 package pool
 
 import (
-
-	"crypto/rand"
 	"encoding/binary"
+	"hash/crc32"
 
 	"hbtrie/internal/kverrors"
 	"unsafe"
 )
 
-// Node is the unit of the B+ tree and is 3897 bytes long
+// Node is the unit of the B+ tree and fits in one page.
+// The number of entries and children it can hold depends on the chunk size of the keys.
 type Node struct {
-	*Page                        // 25 byte
-	Next             uint64      // 8 byte
-	Prev             uint64      // 8 byte
-	Children         [120]uint64 // 960 byte
-	Entries          [120]Entry  // 2880 byte
-	NumberOfChildren uint64      // 8 byte
-	NumberOfEntries  uint64      // 8 byte
+	*Page                     // 25 byte
+	Next             uint64   // 8 byte
+	Prev             uint64   // 8 byte
+	Children         []uint64 // 8 byte each
+	Entries          []Entry  // EntryLen(chunkSize) byte each
+	NumberOfChildren uint64   // 8 byte
+	NumberOfEntries  uint64   // 8 byte
+	chunkSize        int
 }
 
+// position of the checksum in the header of a node
+const checksumOffset = 40
+
 // NodeHeaderLen returns the length of the header of a node.
 func NodeHeaderLen() int {
 
@@ -28,29 +32,74 @@ func NodeHeaderLen() int {
 	Prev := uint64(0)
 	NumberOfChildren := uint64(0)
 	NumberOfEntries := uint64(0)
+	checksum := uint32(0)
 
 	return int(
 		unsafe.Sizeof(id) +
 			unsafe.Sizeof(Next) +
 			unsafe.Sizeof(Prev) +
 			unsafe.Sizeof(NumberOfChildren) +
-			unsafe.Sizeof(NumberOfEntries))
+			unsafe.Sizeof(NumberOfEntries) +
+			unsafe.Sizeof(checksum))
+
+}
+
+// pageChecksum returns the CRC32C checksum of the given page, computed over all its bytes but the checksum itself.
+func pageChecksum(data []byte) uint32 {
+	sum := crc32.Update(0, castagnoli, data[:checksumOffset])
+	return crc32.Update(sum, castagnoli, data[checksumOffset+4:])
+}
 
+// validPage states whether the given page matches the checksum stored in its header.
+func validPage(data []byte) bool {
+	return len(data) == int(PageSize) && binary.LittleEndian.Uint32(data[checksumOffset:checksumOffset+4]) == pageChecksum(data)
+}
+
+// NodeCapacity returns the number of entries (and children) a node can hold for the given chunk size.
+func NodeCapacity(chunkSize int) int {
+	return (int(PageSize) - NodeHeaderLen()) / (EntryLen(chunkSize) + 8)
+}
+
+// initNode initialises an empty node on the given page, sized for keys of the given chunk size.
+func initNode(page *Page, chunkSize int) *Node {
+	capacity := NodeCapacity(chunkSize)
+	return &Node{
+		Page:      page,
+		Children:  make([]uint64, capacity),
+		Entries:   make([]Entry, capacity),
+		chunkSize: chunkSize,
+	}
 }
 
 // NodeLen returns the length of a node.
 func (n *Node) InsertChildAt(at int, child *Node) error {
+	return n.InsertChildIdAt(at, child.Id)
+}
+
+// InsertChildIdAt inserts the child with the given page id at the given index.
+func (n *Node) InsertChildIdAt(at int, id uint64) error {
 	if at < 0 || at > len(n.Children) {
 		return &kverrors.IndexOutOfRangeError{Index: at, Length: len(n.Children)}
 	}
 
 	copy(n.Children[at+1:], n.Children[at:])
-	n.Children[at] = child.Id
+	n.Children[at] = id
 	n.NumberOfChildren++
 	n.Dirty = true
 	return nil
 }
 
+// DeleteChildAt deletes the child at the given index and shifts the remaining children to the left.
+func (n *Node) DeleteChildAt(at int) (uint64, error) {
+	if at < 0 || at >= int(n.NumberOfChildren) {
+		return 0, &kverrors.IndexOutOfRangeError{Index: at, Length: int(n.NumberOfChildren)}
+	}
+	child := n.Children[at]
+	copy(n.Children[at:], n.Children[at+1:])
+	n.NumberOfChildren--
+	n.Dirty = true
+	return child, nil
+}
 
 // the two functions below implement both the BinaryMarshaler and the BinaryUnmarshaler interfaces
 // refer to https://pkg.go.dev/encoding for more informations
@@ -58,10 +107,8 @@ func (n *Node) InsertChildAt(at int, child *Node) error {
 // MarshalBinary implements the BinaryMarshaler interface.
 func (n *Node) MarshalBinary() ([]byte, error) {
 	capacity := int(PageSize) // 4KB
+	// The bytes left unused by the entries and the children are zero.
 	buf := make([]byte, capacity)
-	if _, err := rand.Read(buf); err != nil {
-		return buf, err
-	}
 	bin := binary.LittleEndian
 	bin.PutUint64(buf[0:8], n.Id)
 	bin.PutUint64(buf[8:16], n.NumberOfEntries)
@@ -69,43 +116,49 @@ func (n *Node) MarshalBinary() ([]byte, error) {
 	bin.PutUint64(buf[24:32], n.Next)
 	bin.PutUint64(buf[32:40], n.Prev)
 
-	cursor := 40
+	cursor := 44
 	if cursor != int(NodeHeaderLen()) {
 		return buf, &kverrors.InvalidSizeError{Got: cursor, Should: int(NodeHeaderLen())}
 	}
 
+	// Each entry takes a slot of EntryLen(chunkSize) bytes whatever the length of its key.
+	entryLen := EntryLen(n.chunkSize)
 	for i := 0; i < int(n.NumberOfEntries); i++ {
 		e := n.Entries[i]
+		if len(e.Key) > n.chunkSize {
+			return buf, &kverrors.InvalidSizeError{Got: len(e.Key), Should: n.chunkSize}
+		}
 		eb, err := e.MarshalBinary()
 		if err != nil {
 			return nil, err
 		}
-		for j := 0; j < len(eb); j++ {
-			buf[cursor+j] = eb[j]
-		}
-		cursor += EntryLen()
-		if cursor > capacity {
-			return buf, &kverrors.BufferOverflowError{Max: capacity, Cursor: cursor}
+		if cursor+entryLen > capacity {
+			return buf, &kverrors.BufferOverflowError{Max: capacity, Cursor: cursor + entryLen}
 		}
+		copy(buf[cursor:], eb)
+		cursor += entryLen
 	}
 
 	for i := 0; i < int(n.NumberOfChildren); i++ {
 		c := n.Children[i]
+		if cursor+8 > capacity {
+			return buf, &kverrors.BufferOverflowError{Max: capacity, Cursor: cursor + 8}
+		}
 		bin.PutUint64(buf[cursor:cursor+8], c)
 		cursor += 8
-		if cursor > capacity {
-			return buf, &kverrors.BufferOverflowError{Max: capacity, Cursor: cursor}
-		}
 	}
 
 	if len(buf) != capacity {
 		return buf, &kverrors.InvalidSizeError{Got: len(buf), Should: capacity}
 	}
+	// The checksum covers the whole page, so that a torn or altered page is detected when it is read back.
+	bin.PutUint32(buf[checksumOffset:checksumOffset+4], pageChecksum(buf))
 
 	return buf, nil
 }
 
 // UnmarshalBinary implements the BinaryUnmarshaler interface.
+// The node must have been initialised with initNode for the chunk size of the stored entries.
 func (n *Node) UnmarshalBinary(data []byte) error {
 	capacity := int(PageSize) // 4KB
 	if len(data) != capacity {
@@ -119,21 +172,22 @@ func (n *Node) UnmarshalBinary(data []byte) error {
 	n.Next = bin.Uint64(data[24:32])
 	n.Prev = bin.Uint64(data[32:40])
 
-	cursor := 40
+	cursor := 44
 	if cursor != int(NodeHeaderLen()) {
 		return &kverrors.InvalidSizeError{Got: cursor, Should: int(NodeHeaderLen())}
 	}
 	if n.NumberOfEntries > uint64(len(n.Entries)) {
 		return &kverrors.OverflowError{Type: "Number of entries", Actual: n.NumberOfEntries, Max: len(n.Entries)}
 	}
+	entryLen := EntryLen(n.chunkSize)
 	for i := 0; i < int(n.NumberOfEntries); i++ {
 		e := Entry{}
-		err := e.UnmarshalBinary(data[cursor : cursor+EntryLen()])
+		err := e.UnmarshalBinary(data[cursor : cursor+entryLen])
 		if err != nil {
 			return err
 		}
 		n.Entries[i] = e
-		cursor += EntryLen()
+		cursor += entryLen
 	}
 	if n.NumberOfChildren > uint64(len(n.Children)) {
 		return &kverrors.OverflowError{Type: "Number of children", Actual: n.NumberOfChildren, Max: len(n.Children)}
@@ -145,4 +199,3 @@ func (n *Node) UnmarshalBinary(data []byte) error {
 
 	return nil
 }
-
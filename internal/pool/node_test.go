@@ -0,0 +1,93 @@
+package pool
+
+import (
+	"errors"
+	"hbtrie/internal/kverrors"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestNodeChecksum(t *testing.T) {
+	node := initNode(NewPage(3), DefaultChunkSize)
+	node.Entries[0] = Entry{Key: []byte("key"), Value: 42}
+	node.NumberOfEntries = 1
+	node.Next = 4
+	data, err := node.MarshalBinary()
+	if err != nil {
+		t.Errorf("while marshalling: %v", err)
+		t.FailNow()
+	}
+	if !validPage(data) {
+		t.Errorf("expected a valid page")
+		t.FailNow()
+	}
+
+	// Any altered byte, whether in the header, an entry or the unused bytes, is detected.
+	for _, at := range []int{0, 30, checksumOffset, NodeHeaderLen(), int(PageSize) - 1} {
+		altered := append([]byte{}, data...)
+		altered[at] ^= 0x01
+		if validPage(altered) {
+			t.Errorf("expected an invalid page after altering byte %d", at)
+			t.FailNow()
+		}
+	}
+	if validPage(make([]byte, PageSize)) {
+		t.Errorf("expected an invalid page for a page never written")
+		t.FailNow()
+	}
+}
+
+func TestCorruptPage(t *testing.T) {
+	dataPath := path.Join(os.TempDir(), "hbt_corrupt_test")
+	os.RemoveAll(dataPath)
+	t.Cleanup(func() {
+		os.RemoveAll(dataPath)
+	})
+	for _, single := range []bool{false, true} {
+		p, err := NewBufferpoolWithOptions(dataPath, &Options{Allocation: 16, SingleFile: single})
+		if err != nil {
+			t.Errorf("while creating bufferpool: %v", err)
+			t.FailNow()
+		}
+		frameId, err := p.Register()
+		if err != nil {
+			t.Errorf("while registering frame: %v", err)
+			t.FailNow()
+		}
+		setRoot(t, p, frameId, 2)
+		root, _ := p.GetRoot(frameId)
+		node, _ := p.Query(frameId, root)
+		child := node.Children[1]
+		err = p.WriteTrie(frameId, 0)
+		if err != nil {
+			t.Errorf("while writing trie: %v", err)
+			t.FailNow()
+		}
+
+		// A bit flips in the middle of the page of the second child.
+		file := p.frames[frameId].file
+		if single {
+			file = p.single.file
+		}
+		at := int64(p.position(child) + PageSize/2)
+		b := make([]byte, 1)
+		file.ReadAt(b, at)
+		file.WriteAt([]byte{b[0] ^ 0x10}, at)
+		p, _ = reopen(t, p, dataPath)
+
+		var corrupt *kverrors.CorruptPageError
+		_, err = p.Query(frameId, child)
+		if !errors.As(err, &corrupt) || corrupt.Frame != frameId || corrupt.Page != child {
+			t.Errorf("expected a CorruptPageError for page %d of frame %d, got %v", child, frameId, err)
+			t.FailNow()
+		}
+		_, err = p.Query(frameId, root)
+		if err != nil {
+			t.Errorf("while querying root: %v", err)
+			t.FailNow()
+		}
+		p.Close()
+		p.Clean()
+	}
+}
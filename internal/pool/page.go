@@ -1,5 +1,10 @@
 package pool
 
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
 var PageSize uint64 = 4096
 
 // Page is the unit of the Bufferpool
@@ -12,15 +17,25 @@ type Page struct {
 	// Dirty flag
 	Dirty bool // 1 byte
 
-	// Previous page in the frame linked list
-	prev *Page // 8 byte
-
-	// Next page in the frame linked list
-	next *Page // 8 byte
-
 }
 
 // Initialises a new page with given id. On initialisation the dirty flag is set to true.
 func NewPage(id uint64) *Page {
-	return &Page{Id: id, Dirty: true, prev: nil, next: nil}
+	return &Page{Id: id, Dirty: true}
+}
+
+// sealLen is the byte length of the checksum ending the pages which are not nodes: the free list trunks,
+// and the metadata pages, the catalog pages and the superblock of a single file.
+const sealLen = 4
+
+// seal writes the CRC32C checksum of the given page, computed over all its bytes but the last ones, in its last bytes.
+func seal(page []byte) {
+	end := len(page) - sealLen
+	binary.LittleEndian.PutUint32(page[end:], crc32.Checksum(page[:end], castagnoli))
+}
+
+// sealed states whether the given page is whole and matches the checksum ending it.
+func sealed(page []byte) bool {
+	end := len(page) - sealLen
+	return len(page) == int(PageSize) && binary.LittleEndian.Uint32(page[end:]) == crc32.Checksum(page[:end], castagnoli)
 }
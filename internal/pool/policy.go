@@ -0,0 +1,231 @@
+package pool
+
+import (
+	"container/list"
+	"fmt"
+)
+
+// PageKey identifies a page held in memory. Frame is zero for the policy of a single frame.
+type PageKey struct {
+	Frame uint64
+	Page  uint64
+}
+
+// ReplacementPolicy chooses the pages to evict among the pages held in memory.
+// The bufferpool records every access to a page held in memory and every page it brings in memory,
+// and asks for a page to evict when it is full.
+type ReplacementPolicy interface {
+	// Access records a hit on a page held in memory.
+	Access(key PageKey)
+	// Insert records a page brought in memory.
+	Insert(key PageKey)
+	// Remove forgets a page leaving memory other than by eviction.
+	Remove(key PageKey)
+	// Evict chooses a page to evict and forgets it. It returns false if no page is held in memory.
+	Evict() (PageKey, bool)
+	// Len returns the number of pages held in memory.
+	Len() int
+}
+
+// Policy selects the replacement policy of the bufferpool.
+type Policy int
+
+const (
+	// LRU evicts the least recently used page.
+	LRU Policy = iota
+	// CLOCK gives a second chance to the pages accessed since the hand of the clock last passed them.
+	CLOCK
+	// TwoQ admits pages in a FIFO queue and only promotes the ones accessed again after their eviction,
+	// so that a scan does not flush the frequently used pages.
+	TwoQ
+	// ARC balances recently and frequently used pages, adapting to the workload with the history of evicted pages.
+	ARC
+)
+
+func (p Policy) String() string {
+	switch p {
+	case LRU:
+		return "LRU"
+	case CLOCK:
+		return "CLOCK"
+	case TwoQ:
+		return "2Q"
+	case ARC:
+		return "ARC"
+	}
+	return fmt.Sprintf("Policy(%d)", int(p))
+}
+
+// NewReplacementPolicy returns a new replacement policy of the given kind for the given number of pages.
+func NewReplacementPolicy(p Policy, capacity uint64) ReplacementPolicy {
+	switch p {
+	case CLOCK:
+		return newClock()
+	case TwoQ:
+		return newTwoQ(capacity)
+	case ARC:
+		return newARC(capacity)
+	}
+	return newLRU()
+}
+
+// keyList is a list of page keys with constant time lookups, most recent first.
+type keyList struct {
+	keys     *list.List
+	elements map[PageKey]*list.Element
+}
+
+func newKeyList() *keyList {
+	return &keyList{keys: list.New(), elements: make(map[PageKey]*list.Element)}
+}
+
+func (k *keyList) has(key PageKey) bool {
+	_, ok := k.elements[key]
+	return ok
+}
+
+// pushFront adds the key at the front of the list, or moves it there if it is already in the list.
+func (k *keyList) pushFront(key PageKey) {
+	if e, ok := k.elements[key]; ok {
+		k.keys.MoveToFront(e)
+		return
+	}
+	k.elements[key] = k.keys.PushFront(key)
+}
+
+// remove removes the key from the list. It returns false if the key is not in the list.
+func (k *keyList) remove(key PageKey) bool {
+	e, ok := k.elements[key]
+	if ok {
+		k.keys.Remove(e)
+		delete(k.elements, key)
+	}
+	return ok
+}
+
+// popBack removes the oldest key of the list and returns it. It returns false if the list is empty.
+func (k *keyList) popBack() (PageKey, bool) {
+	e := k.keys.Back()
+	if e == nil {
+		return PageKey{}, false
+	}
+	key := k.keys.Remove(e).(PageKey)
+	delete(k.elements, key)
+	return key, true
+}
+
+func (k *keyList) len() int {
+	return k.keys.Len()
+}
+
+// lru keeps the pages in a list, most recently used first.
+type lru struct {
+	pages *keyList
+}
+
+func newLRU() *lru {
+	return &lru{pages: newKeyList()}
+}
+
+func (l *lru) Access(key PageKey) {
+	if l.pages.has(key) {
+		l.pages.pushFront(key)
+	}
+}
+
+func (l *lru) Insert(key PageKey) {
+	l.pages.pushFront(key)
+}
+
+func (l *lru) Remove(key PageKey) {
+	l.pages.remove(key)
+}
+
+func (l *lru) Evict() (PageKey, bool) {
+	return l.pages.popBack()
+}
+
+func (l *lru) Len() int {
+	return l.pages.len()
+}
+
+// clockPage is a page on the clock, with its reference bit.
+type clockPage struct {
+	key        PageKey
+	referenced bool
+}
+
+// clock keeps the pages in a circular list swept by a hand.
+// Pages are inserted behind the hand and referenced when accessed.
+type clock struct {
+	pages    *list.List
+	elements map[PageKey]*list.Element
+	hand     *list.Element
+}
+
+func newClock() *clock {
+	return &clock{pages: list.New(), elements: make(map[PageKey]*list.Element)}
+}
+
+func (c *clock) Access(key PageKey) {
+	if e, ok := c.elements[key]; ok {
+		e.Value.(*clockPage).referenced = true
+	}
+}
+
+func (c *clock) Insert(key PageKey) {
+	if e, ok := c.elements[key]; ok {
+		e.Value.(*clockPage).referenced = true
+		return
+	}
+	page := &clockPage{key: key}
+	if c.hand == nil {
+		c.elements[key] = c.pages.PushBack(page)
+		return
+	}
+	c.elements[key] = c.pages.InsertBefore(page, c.hand)
+}
+
+func (c *clock) Remove(key PageKey) {
+	if e, ok := c.elements[key]; ok {
+		if c.hand == e {
+			c.advance()
+		}
+		c.pages.Remove(e)
+		delete(c.elements, key)
+		if c.pages.Len() == 0 {
+			c.hand = nil
+		}
+	}
+}
+
+func (c *clock) Evict() (PageKey, bool) {
+	if c.pages.Len() == 0 {
+		return PageKey{}, false
+	}
+	if c.hand == nil {
+		c.hand = c.pages.Front()
+	}
+	for {
+		page := c.hand.Value.(*clockPage)
+		if page.referenced {
+			page.referenced = false
+			c.advance()
+			continue
+		}
+		c.Remove(page.key)
+		return page.key, true
+	}
+}
+
+// advance moves the hand to the next page of the circle.
+func (c *clock) advance() {
+	c.hand = c.hand.Next()
+	if c.hand == nil {
+		c.hand = c.pages.Front()
+	}
+}
+
+func (c *clock) Len() int {
+	return c.pages.Len()
+}
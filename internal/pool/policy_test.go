@@ -0,0 +1,124 @@
+package pool
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+var policies = []Policy{LRU, CLOCK, TwoQ, ARC}
+
+// simulate replays the given page accesses on a policy holding the given number of pages and returns the hit ratio.
+func simulate(policy ReplacementPolicy, capacity int, accesses []uint64) float64 {
+	resident := make(map[PageKey]bool)
+	hits := 0
+	for _, id := range accesses {
+		key := PageKey{Page: id}
+		if resident[key] {
+			policy.Access(key)
+			hits++
+			continue
+		}
+		for policy.Len() >= capacity {
+			evicted, ok := policy.Evict()
+			if !ok {
+				break
+			}
+			delete(resident, evicted)
+		}
+		policy.Insert(key)
+		resident[key] = true
+	}
+	return float64(hits) / float64(len(accesses))
+}
+
+// scanWorkload returns point lookups on a hot set of pages, interrupted by sequential scans of cold pages.
+func scanWorkload(hot, scan, rounds int) []uint64 {
+	r := rand.New(rand.NewSource(1))
+	accesses := make([]uint64, 0, rounds*(4*hot+scan))
+	cold := uint64(hot)
+	for i := 0; i < rounds; i++ {
+		for j := 0; j < 4*hot; j++ {
+			accesses = append(accesses, uint64(r.Intn(hot)))
+		}
+		for j := 0; j < scan; j++ {
+			accesses = append(accesses, cold)
+			cold++
+		}
+	}
+	return accesses
+}
+
+func TestReplacementPolicy(t *testing.T) {
+	for _, p := range policies {
+		capacity := 10
+		policy := NewReplacementPolicy(p, uint64(capacity))
+		resident := make(map[PageKey]bool)
+		for i := uint64(0); i < 100; i++ {
+			for policy.Len() >= capacity {
+				key, ok := policy.Evict()
+				if !ok || !resident[key] {
+					t.Errorf("[%v] step %d: unexpected eviction of %v (%v)", p, i, key, ok)
+					t.FailNow()
+				}
+				delete(resident, key)
+			}
+			key := PageKey{Frame: i % 3, Page: i / 2}
+			if resident[key] {
+				policy.Access(key)
+			} else {
+				policy.Insert(key)
+				resident[key] = true
+			}
+			if i%7 == 0 {
+				policy.Remove(key)
+				delete(resident, key)
+			}
+			if policy.Len() != len(resident) {
+				t.Errorf("[%v] step %d: expected %d pages, got %d", p, i, len(resident), policy.Len())
+				t.FailNow()
+			}
+		}
+
+		// Every remaining page is evicted exactly once.
+		for len(resident) > 0 {
+			key, ok := policy.Evict()
+			if !ok || !resident[key] {
+				t.Errorf("[%v] unexpected eviction of %v (%v)", p, key, ok)
+				t.FailNow()
+			}
+			delete(resident, key)
+		}
+		if key, ok := policy.Evict(); ok || policy.Len() != 0 {
+			t.Errorf("[%v] expected an empty policy, evicted %v", p, key)
+			t.FailNow()
+		}
+	}
+}
+
+func TestScanResistance(t *testing.T) {
+	capacity := 128
+	accesses := scanWorkload(64, capacity, 50)
+	lru := simulate(NewReplacementPolicy(LRU, uint64(capacity)), capacity, accesses)
+	for _, p := range []Policy{TwoQ, ARC} {
+		ratio := simulate(NewReplacementPolicy(p, uint64(capacity)), capacity, accesses)
+		if ratio <= lru {
+			t.Errorf("[%v] expected a hit ratio above LRU (%.3f), got %.3f", p, lru, ratio)
+			t.FailNow()
+		}
+	}
+}
+
+func BenchmarkReplacementPolicy(b *testing.B) {
+	capacity := 128
+	accesses := scanWorkload(64, capacity, 50)
+	for _, p := range policies {
+		b.Run(fmt.Sprint(p), func(b *testing.B) {
+			ratio := 0.0
+			for i := 0; i < b.N; i++ {
+				ratio = simulate(NewReplacementPolicy(p, uint64(capacity)), capacity, accesses)
+			}
+			b.ReportMetric(ratio, "hit-ratio")
+		})
+	}
+}
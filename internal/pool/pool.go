@@ -1,9 +1,11 @@
 package pool
 
 import (
+	"container/list"
 	"errors"
 	"fmt"
 	"hbtrie/internal/kverrors"
+	"math"
 	"os"
 	"path/filepath"
 	"sort"
@@ -13,17 +15,88 @@ import (
 const poolMaxNumberOfTrees = 100000
 const hbFilename = "hb_meta.dbm"
 
+// DefaultChunkSize is the chunk size used by a new bufferpool if none is given.
+const DefaultChunkSize = 16
+
+// MaxChunkSize is the greatest supported chunk size.
+const MaxChunkSize = 255
+
 type Bufferpool struct {
 	frames     map[uint64]*frame
 	allocation uint64
+	chunkSize  int
 	dataPath   string
 	file       *os.File
+	files      *list.List // frames whose file is open, most recently used first
+	values     *valueLog
+	single     *singleFile       // nil if each frame has its own file
+	budget     uint64            // number of pages held in memory across all the frames, zero if limited per frame
+	policyKind Policy            // replacement policy of the frames, or of the global budget
+	policy     ReplacementPolicy // pages held in memory across all the frames, nil if limited per frame
+	unlinked   map[uint64]bool   // unregistered frames whose file is removed once the trie is committed
+	journal    *journal          // writes of the pages the last commit may refer to, nil for a snapshot
+	inPlace    bool              // whether these pages are written in place rather than to the journal
+	syncPolicy SyncPolicy        // when the files are synced
+	created    bool              // whether frame files have been created since the data path was last synced
+	closeErr   error             // first error closing a file evicted from the open files, failing the commits
+	appendOnly bool              // whether the modified nodes are written to new pages, see AppendOnly
+	stale      uint64            // number of bytes of the files no longer referenced by the trie, see StaleRatio
+	snapshots  int               // number of snapshots pinned to the committed versions, see Snapshot
+	parent     *Bufferpool       // bufferpool the snapshot is taken from, nil if not a snapshot
+	pinned     *commit           // commit the snapshot is pinned to, nil once released
+}
+
+// Options used to create a new bufferpool.
+type Options struct {
+	// Number of pages that will be allocated for each frame before IO operations.
+	// It is ignored if a Budget is given.
+	Allocation uint64
+	// Number of pages held in memory across all the frames, at least 8. The pages of any frame are evicted
+	// by one replacement policy, so that the pages of hot subtrees are kept. If zero, the Allocation applies to each frame.
+	Budget uint64
+	// Replacement policy choosing the pages to evict, within each frame or across all the frames with a Budget.
+	// LRU by default.
+	Policy Policy
+	// Byte size of the key chunks held by the entries of the b+ trees.
+	// If zero, the chunk size of the stored trie is used, or DefaultChunkSize for a new one.
+	ChunkSize int
+	// Stores the pages of all the b+ trees in one file rather than one file per frame.
+	// A trie previously written with one file per frame is migrated to the single file.
+	// A data path already holding a single file keeps using it whatever this option.
+	SingleFile bool
+	// Tells when the files are synced to disk: when the trie is written, after every write or never.
+	// SyncOnFlush by default.
+	Sync SyncPolicy
+	// Writes the modified nodes of the b+ trees to new pages rather than in place, see AppendOnly.
+	// A trie previously written in append-only mode keeps using it whatever this option.
+	AppendOnly bool
+	// Writes the pages the last commit may refer to in place rather than to the journal, so that they are written
+	// once. A crash may then tear them or leave the trie between two commits. It is implied by SyncNone,
+	// under which the journal cannot repair the trie. The journal of a trie previously written with it is still applied.
+	DisableJournal bool
 }
 
 // NewBufferpool returns a new bufferpool with the given underlying file and allocation size.
 // The read/write to disk will be performed from/to the given file.
 // The allocation size is the number of pages that will be allocated for each frame before IO operations.
 func NewBufferpool(allocation uint64, dataPath string) (*Bufferpool, error) {
+	return NewBufferpoolWithOptions(dataPath, &Options{Allocation: allocation})
+}
+
+// NewBufferpoolWithOptions returns a new bufferpool in the given data path configured with the given options.
+// It returns a ChunkSizeMismatchError if a trie has been written with a different chunk size in the data path,
+// a FormatVersionError if it has been written with another format version, and an InconsistentStoreError
+// if the data path holds the files of a trie but not its metadata file.
+func NewBufferpoolWithOptions(dataPath string, options *Options) (*Bufferpool, error) {
+	if options.ChunkSize < 0 || options.ChunkSize > MaxChunkSize {
+		return nil, &kverrors.OutsideOfRangeError{From: 1, To: MaxChunkSize, Actual: options.ChunkSize}
+	}
+	if options.Sync < SyncOnFlush || options.Sync > SyncNone {
+		return nil, &kverrors.OutsideOfRangeError{From: SyncOnFlush, To: SyncNone, Actual: options.Sync}
+	}
+	if options.Budget != 0 && options.Budget < poolMinBudget {
+		return nil, &kverrors.OutsideOfRangeError{From: poolMinBudget, To: uint64(math.MaxUint64), Actual: options.Budget}
+	}
 	dp := filepath.Join(dataPath, "hbdata/")
 	err := os.MkdirAll(dp, 0755)
 	if err != nil {
@@ -32,7 +105,19 @@ func NewBufferpool(allocation uint64, dataPath string) (*Bufferpool, error) {
 	hbf := filepath.Join(dp, hbFilename)
 	var file *os.File
 	_, err = os.Stat(hbf)
-	if errors.Is(err, os.ErrNotExist) {
+	created := errors.Is(err, os.ErrNotExist)
+	if created {
+		// The files of a trie whose metadata is missing can neither be read back nor be written over.
+		found, err := dataFiles(dp)
+		if err != nil {
+			return nil, err
+		}
+		if len(found) > 0 {
+			return nil, &kverrors.InconsistentStoreError{
+				Path:   hbf,
+				Reason: fmt.Sprintf("missing metadata for %d data files such as %s", len(found), filepath.Base(found[0])),
+			}
+		}
 		file, err = os.Create(hbf)
 		if err != nil {
 			return nil, err
@@ -43,23 +128,103 @@ func NewBufferpool(allocation uint64, dataPath string) (*Bufferpool, error) {
 			return nil, err
 		}
 	}
-	pool := &Bufferpool{frames: make(map[uint64]*frame), allocation: allocation, dataPath: dp, file: file}
-
-	return pool, err
-}
+	values, err := openValueLog(filepath.Join(dp, valuesFilename))
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	pool := &Bufferpool{
+		frames:     make(map[uint64]*frame),
+		allocation: options.Allocation,
+		chunkSize:  options.ChunkSize,
+		dataPath:   dp,
+		file:       file,
+		files:      list.New(),
+		values:     values,
+		budget:     options.Budget,
+		policyKind: options.Policy,
+		unlinked:   make(map[uint64]bool),
+		syncPolicy: options.Sync,
+		appendOnly: options.AppendOnly,
+		inPlace:    options.DisableJournal || options.Sync == SyncNone,
+	}
+	if pool.budget != 0 {
+		pool.policy = NewReplacementPolicy(options.Policy, options.Budget)
+	}
+	// The metadata file has to be found along with the data files created after it.
+	if created {
+		err = pool.syncDir()
+		if err != nil {
+			pool.Close()
+			return nil, err
+		}
+	}
+	// The files of a trie written with another format cannot be read.
+	err = pool.checkVersion()
+	if err != nil {
+		pool.Close()
+		return nil, err
+	}
+	// A compaction interrupted by a crash is completed or rolled back before any file is read.
+	err = pool.recoverCompaction()
+	if err != nil {
+		pool.Close()
+		return nil, err
+	}
+	// The writes of the last commit interrupted by a crash are completed before any frame is read.
+	pool.journal, err = openJournal(filepath.Join(dp, journalFilename))
+	if err != nil {
+		pool.Close()
+		return nil, err
+	}
+	err = pool.recoverJournal()
+	if err != nil {
+		pool.Close()
+		return nil, err
+	}
 
-func (pool *Bufferpool) write(frameId uint64, page *Node) error {
-	frame := pool.frames[frameId]
-	if frame == nil {
-		return &kverrors.UnregisteredError{}
+	// The chunk size of a stored trie cannot be changed.
+	last, err := pool.readCommit()
+	if err == nil {
+		meta := last.trie
+		if pool.chunkSize != 0 && pool.chunkSize != int(meta.chunkSize) {
+			pool.Close()
+			return nil, &kverrors.ChunkSizeMismatchError{Stored: meta.chunkSize, Requested: pool.chunkSize}
+		}
+		pool.chunkSize = int(meta.chunkSize)
+		pool.appendOnly = pool.appendOnly || last.appendOnly
+		pool.stale = last.stale
 	}
-	file := frame.file
-	position := pagePosition(page.Id)
-	data, err := page.MarshalBinary()
+	if pool.chunkSize == 0 {
+		pool.chunkSize = DefaultChunkSize
+	}
+
+	err = pool.useSingleFile(options.SingleFile)
 	if err != nil {
-		return err
+		pool.Close()
+		return nil, err
 	}
-	nbytes, err := file.WriteAt(data, int64(position))
+
+	return pool, nil
+}
+
+// ChunkSize returns the byte size of the key chunks held by the entries of the b+ trees.
+func (pool *Bufferpool) ChunkSize() int {
+	return pool.chunkSize
+}
+
+// DataPath returns the directory holding the files of the bufferpool, removed along with them by Clean.
+func (pool *Bufferpool) DataPath() string {
+	return pool.dataPath
+}
+
+func (pool *Bufferpool) write(frameId uint64, page *Node) error {
+	return pool.writeNodes([]stagedPage{{frame: frameId, node: page}})
+}
+
+// writePage writes the given data at the position of the page with the given id in the given file.
+func (pool *Bufferpool) writePage(file *os.File, pageId uint64, data []byte) error {
+	nbytes, err := file.WriteAt(data, int64(pool.position(pageId)))
 	if err != nil {
 		return err
 	}
@@ -67,32 +232,47 @@ func (pool *Bufferpool) write(frameId uint64, page *Node) error {
 		return &kverrors.PartialWriteError{Total: len(data), Written: nbytes}
 	}
 	return nil
-
 }
 
-func (pool *Bufferpool) io(frameId, pageId uint64) (*Node, error) {
-	filename := pool.filename(frameId)
-	_, err := os.Stat(filename)
+// readPage reads the page with the given id from the given file.
+func (pool *Bufferpool) readPage(file *os.File, pageId uint64) ([]byte, error) {
+	data := make([]byte, PageSize)
+	nbytes, err := file.ReadAt(data, int64(pool.position(pageId)))
 	if err != nil {
 		return nil, err
 	}
-	file, err := os.OpenFile(filename, os.O_RDWR, 0755)
-	if err != nil {
-		return nil, err
+	if nbytes != len(data) {
+		return nil, &kverrors.PartialReadError{Total: len(data), Read: nbytes}
 	}
+	return data, nil
+}
+
+func (pool *Bufferpool) io(frameId, pageId uint64) (*Node, error) {
 	if frameId == 0 {
 		return nil, &kverrors.InvalidFrameIdError{}
 	}
-	position := pagePosition(pageId)
-	data := make([]byte, PageSize)
-	nbytes, err := file.ReadAt(data, int64(position))
+	frame := pool.frames[frameId]
+	if frame == nil {
+		return nil, &kverrors.UnregisteredError{}
+	}
+	file, err := pool.fileOf(frame)
 	if err != nil {
 		return nil, err
 	}
-	if nbytes != len(data) {
-		return nil, &kverrors.PartialReadError{Total: len(data), Read: nbytes}
+	return pool.readNode(file, frameId, pageId)
+}
+
+// readNode reads the page with the given id of the given frame from the given file.
+// It returns a CorruptPageError if the page doesn't match its checksum.
+func (pool *Bufferpool) readNode(file *os.File, frameId, pageId uint64) (*Node, error) {
+	data, err := pool.readPageOf(file, frameId, pageId)
+	if err != nil {
+		return nil, err
+	}
+	if !validPage(data) {
+		return nil, &kverrors.CorruptPageError{Frame: frameId, Page: pageId}
 	}
-	node := &Node{Page: NewPage(0)}
+	node := initNode(NewPage(0), pool.chunkSize)
 	err = node.UnmarshalBinary(data)
 	if err != nil {
 		return nil, err
@@ -103,6 +283,14 @@ func (pool *Bufferpool) io(frameId, pageId uint64) (*Node, error) {
 	return node, nil
 }
 
+// position returns the position of the page with the given id in the file holding it.
+func (pool *Bufferpool) position(pageId uint64) uint64 {
+	if pool.single != nil {
+		return pageId * PageSize
+	}
+	return pagePosition(pageId)
+}
+
 func (pool *Bufferpool) getFrameIds() []uint64 {
 	keys := make([]uint64, 0, len(pool.frames))
 
@@ -122,30 +310,83 @@ func (pool *Bufferpool) filename(frameId uint64) string {
 	return filename
 }
 
+// dataFiles returns the files of a trie found in the given data path: the frame files, the single file
+// and the value log if it holds records.
+func dataFiles(dataPath string) ([]string, error) {
+	found, err := filepath.Glob(filepath.Join(dataPath, "frame_*.db"))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range []string{singleFilename, valuesFilename} {
+		filename := filepath.Join(dataPath, name)
+		info, err := os.Stat(filename)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if info.Size() > 0 {
+			found = append(found, filename)
+		}
+	}
+	return found, nil
+}
+
 // Register is used for a client to get a frame allocated in the bufferpool.
 // It returns the id of the frame which should be use for subsequent queries.
+// The number of frames is only limited when each frame has its own file.
 func (pool *Bufferpool) Register() (uint64, error) {
 
+	// The file of a frame unregistered since the last commit is kept until the next one.
 	r := uint64(1)
-	for pool.frames[r] != nil {
+	for pool.frames[r] != nil || pool.unlinked[r] {
 		r++
-		if r == poolMaxNumberOfTrees {
+		if r == poolMaxNumberOfTrees && pool.single == nil {
 			return 0, &kverrors.BufferPoolLimitError{}
 		}
 	}
 
+	if pool.single != nil {
+		pool.single.register(r)
+		pool.frames[r] = pool.newFrame(nil)
+		return r, nil
+	}
+
 	filename := pool.filename(r)
 	file, err := os.Create(filename)
 	if err != nil {
 		return 0, err
 	}
-	pool.frames[r] = newFrame(file, pool.allocation)
+	pool.frames[r] = pool.newFrame(file)
+	pool.opened(pool.frames[r])
+	pool.created = true
 	return r, nil
 }
 
-// Unregister deletes the frame with the given id. This operation is irreversible.
-func (pool *Bufferpool) Unregister(id uint64) {
+// Unregister deletes the frame with the given id and its file. This operation is irreversible.
+// The file is removed once the trie is committed without the frame, the last commit may still refer to it.
+// In a single file layout, the pages of its b+ tree and its metadata page are released to the free list of the file,
+// unless they are left to the committed versions of the trie in append-only mode.
+func (pool *Bufferpool) Unregister(id uint64) error {
+	frame := pool.frames[id]
+	if frame != nil && pool.single != nil && !pool.appendOnly {
+		err := pool.release(id, frame)
+		if err != nil {
+			return err
+		}
+	}
+	if frame != nil {
+		pool.closeFile(frame)
+		pool.forget(id, frame)
+	}
 	delete(pool.frames, id)
+	if pool.single != nil {
+		pool.single.unregister(id)
+		return nil
+	}
+	pool.unlinked[id] = true
+	return nil
 }
 
 func (pool *Bufferpool) GetFrames() []uint64 {
@@ -172,6 +413,7 @@ func (pool *Bufferpool) Query(frameId, pageID uint64) (node *Node, err error) {
 	}
 
 	node = frame.query(pageID)
+	resident := node != nil
 	for node == nil {
 		node, err = pool.io(frameId, pageID)
 		if err != nil {
@@ -180,7 +422,16 @@ func (pool *Bufferpool) Query(frameId, pageID uint64) (node *Node, err error) {
 		}
 		for frame.full() {
 			tail := frame.evict()
-			pool.write(frameId, tail)
+			if tail != nil && tail.Dirty {
+				err := pool.write(frameId, tail)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		err = pool.reserve()
+		if err != nil {
+			return nil, err
 		}
 		err = frame.add(node)
 		if err != nil {
@@ -189,6 +440,7 @@ func (pool *Bufferpool) Query(frameId, pageID uint64) (node *Node, err error) {
 		}
 	}
 	// log.Default().Printf("Query: %d %d: success", frameId, pageID)
+	pool.touch(frameId, node.Id, resident)
 
 	return node, nil
 
@@ -201,6 +453,7 @@ func (pool *Bufferpool) NewPage(frameId uint64) (*Node, error) {
 
 // NewNode provides a new node (page) in the frame given as parameter.
 // It may return an error if the client hasn't previously registered the frame (i.e., the frame id is invalid).
+// It returns a PageLimitError once the file holding the frame cannot address another page.
 func (pool *Bufferpool) NewNode(frameId uint64) (*Node, error) {
 
 	frame := pool.frames[frameId]
@@ -208,7 +461,28 @@ func (pool *Bufferpool) NewNode(frameId uint64) (*Node, error) {
 		return nil, &kverrors.UnregisteredError{}
 	}
 
-	node, full := frame.newNode()
+	err := pool.reserve()
+	if err != nil {
+		return nil, err
+	}
+	// Released pages are reused before new ones are allocated, unless they are left to the committed versions.
+	id, reused := uint64(0), false
+	if !pool.appendOnly {
+		id, reused = pool.freeListOf(frame).pop()
+	}
+	if !reused {
+		id = frame.cursor + 1
+		if pool.single != nil {
+			id = pool.single.cursor + 1
+		}
+		if id > maxPageId() {
+			return nil, &kverrors.PageLimitError{Frame: frameId, Max: maxPageId()}
+		}
+		if pool.single != nil {
+			pool.single.allocate()
+		}
+	}
+	node, full := frame.newNode(id)
 	for full {
 		tail := frame.evict()
 		if tail != nil && tail.Dirty {
@@ -217,8 +491,9 @@ func (pool *Bufferpool) NewNode(frameId uint64) (*Node, error) {
 				return nil, err
 			}
 		}
-		node, full = frame.newNode()
+		node, full = frame.newNode(id)
 	}
+	pool.touch(frameId, node.Id, false)
 
 	return node, nil
 
@@ -250,6 +525,48 @@ func (pool *Bufferpool) GetRoot(frameId uint64) (uint64, error) {
 
 }
 
+// Returns the number of entries of the b+ tree in a given frameId
+func (pool *Bufferpool) GetSize(frameId uint64) (uint64, error) {
+
+	frame := pool.frames[frameId]
+	if frame == nil {
+		return 0, &kverrors.UnregisteredError{}
+	}
+
+	return frame.size, nil
+
+}
+
+// Returns the key bytes skipped by the b+ tree in a given frameId.
+func (pool *Bufferpool) GetPrefix(frameId uint64) ([]byte, error) {
+
+	frame := pool.frames[frameId]
+	if frame == nil {
+		return nil, &kverrors.UnregisteredError{}
+	}
+
+	return frame.prefix, nil
+
+}
+
+// Sets the key bytes skipped by the b+ tree in a given frameId.
+// It returns an InvalidSizeError if the prefix is longer than MaxPrefixLen.
+func (pool *Bufferpool) SetPrefix(frameId uint64, prefix []byte) error {
+
+	frame := pool.frames[frameId]
+	if frame == nil {
+		return &kverrors.UnregisteredError{}
+	}
+	if len(prefix) > MaxPrefixLen() {
+		return &kverrors.InvalidSizeError{Got: len(prefix), Should: MaxPrefixLen()}
+	}
+
+	frame.prefix = append([]byte(nil), prefix...)
+
+	return nil
+
+}
+
 // Update allows to update the root/size information of the b+ tree in a given frameId.
 func (pool *Bufferpool) Update(frameId, root, size uint64) error {
 
@@ -264,20 +581,12 @@ func (pool *Bufferpool) Update(frameId, root, size uint64) error {
 
 }
 
-// Reads metadata from the given frameId from disk.
-func (pool *Bufferpool) readMetadata(frameID uint64) (frameMetadata, error) {
-	meta := frameMetadata{0, 0, 0}
-	filename := pool.filename(frameID)
-	_, err := os.Stat(filename)
-	if err != nil {
-		return meta, err
-	}
-	file, err := os.OpenFile(filename, os.O_RDWR, 0755)
-	if err != nil {
-		return meta, err
-	}
+// Reads the metadata of a frame from the given file.
+// The prefix is read along the fixed size fields, the page 0 slot is always followed by the first page.
+func (pool *Bufferpool) readMetadata(file *os.File) (frameMetadata, error) {
+	meta := frameMetadata{}
 	position := uint64(0)
-	data := make([]byte, frameMetaSize())
+	data := make([]byte, frameMetaSize()+uint64(MaxPrefixLen()))
 	nbytes, err := file.ReadAt(data, int64(position))
 	if err != nil {
 		return meta, err
@@ -302,12 +611,28 @@ func (pool *Bufferpool) writeMetadata(frameId uint64, meta frameMetadata) error
 	if frame == nil {
 		return &kverrors.UnregisteredError{}
 	}
-	file := frame.file
-	position := int64(0)
 	data, err := meta.MarshalBinary()
 	if err != nil {
 		return err
 	}
+	if pool.single != nil {
+		id, err := pool.single.metaPage(frameId)
+		if err != nil {
+			return err
+		}
+		page, err := meta.page()
+		if err != nil {
+			return err
+		}
+		return pool.writePageOf(frame, frameId, id, page)
+	}
+	// The commits record the metadata of the frames, the one of a frame file is only read by ReadTree
+	// outside of commits. It is written in place.
+	file, err := pool.fileOf(frame)
+	if err != nil {
+		return err
+	}
+	position := int64(0)
 	nbytes, err := file.WriteAt(data, position)
 	if err != nil {
 		return err
@@ -320,86 +645,155 @@ func (pool *Bufferpool) writeMetadata(frameId uint64, meta frameMetadata) error
 
 }
 
-// Writes the given frame to disk.
+// Writes the given frame to disk, the pages the last commit may refer to being written to the journal.
+// It is synced with the SyncAlways policy only, and is only durable once committed, see WriteTrie.
 func (pool *Bufferpool) WriteTree(frameId uint64) error {
+	_, dirty, err := pool.writeTree(frameId)
+	if err != nil {
+		return err
+	}
+	err = pool.writeNodes(dirty)
+	if err != nil || pool.syncPolicy != SyncAlways {
+		return err
+	}
+	err = pool.syncJournal()
+	if err != nil {
+		return err
+	}
+	file, err := pool.fileOf(pool.frames[frameId])
+	if err != nil {
+		return err
+	}
+	return pool.sync(file)
+}
 
+// Writes the metadata of the given frame to disk and returns it along with the dirty pages of the frame,
+// which are left to the caller to write in one batch with those of the other frames.
+func (pool *Bufferpool) writeTree(frameId uint64) (frameMetadata, []stagedPage, error) {
 	frame := pool.frames[frameId]
 	if frame == nil {
-		return &kverrors.UnregisteredError{}
+		return frameMetadata{}, nil, &kverrors.UnregisteredError{}
 	}
 
-	err := pool.writeMetadata(frameId, frameMetadata{root: frame.root, size: frame.size, cursor: frame.cursor})
+	// The free list of a single file is written along with its catalog.
+	free := uint64(0)
+	if pool.single == nil {
+		var err error
+		free, err = frame.free.write(func(id uint64, data []byte) error {
+			return pool.writePageOf(frame, frameId, id, data)
+		})
+		if err != nil {
+			return frameMetadata{}, nil, err
+		}
+	}
+	meta := frameMetadata{root: frame.root, size: frame.size, cursor: frame.cursor, free: free, prefix: frame.prefix}
+	err := pool.writeMetadata(frameId, meta)
 	if err != nil {
-		return err
+		return frameMetadata{}, nil, err
 	}
-	max := uint64(0)
+	dirty := []stagedPage{}
 	for _, node := range frame.pages {
 		if node.Dirty {
-			err := pool.write(frameId, node)
-			if err != nil {
-				return err
-			}
-		}
-		if node.Id > max {
-			max = node.Id
+			dirty = append(dirty, stagedPage{frame: frameId, node: node})
 		}
 	}
 
-	return nil
-
+	return meta, dirty, nil
 }
 
 // Reads the given frame from disk.
 func (pool *Bufferpool) ReadTree(frameId uint64) (uint64, uint64, error) {
-	if frameId > poolMaxNumberOfTrees {
+	return pool.readTree(frameId, nil)
+}
+
+// Reads the given frame from disk with the given committed metadata,
+// or with the metadata written along with its pages if nil.
+func (pool *Bufferpool) readTree(frameId uint64, committed *frameMetadata) (uint64, uint64, error) {
+	if pool.single != nil {
+		return pool.readSingleTree(frameId, committed)
+	}
+	if frameId == 0 || frameId > poolMaxNumberOfTrees {
 		return 0, 0, &kverrors.InvalidFrameIdError{}
 	}
 
-	meta, err := pool.readMetadata(frameId)
-	if err != nil {
-		return 0, 0, err
-	}
-	root, err := pool.io(frameId, meta.root)
+	filename := pool.filename(frameId)
+	file, err := os.OpenFile(filename, os.O_RDWR, 0755)
 	if err != nil {
-
 		return 0, 0, err
 	}
-	if root.Page == nil {
-
-		return 0, 0, &kverrors.InvalidNodeError{}
+	meta := frameMetadata{}
+	if committed != nil {
+		meta = *committed
+	} else {
+		meta, err = pool.readMetadata(file)
+		if err != nil {
+			file.Close()
+			return 0, 0, err
+		}
 	}
-	if root.Page.Id == 0 {
-		return 0, 0, &kverrors.InvalidNodeError{}
+	if meta.root > meta.cursor {
+		file.Close()
+		return 0, 0, &kverrors.InvalidMetadataError{Root: meta.root, Size: meta.size}
 	}
-	filename := pool.filename(frameId)
-	_, err = os.Stat(filename)
+	root, err := pool.readNode(file, frameId, meta.root)
 	if err != nil {
+		file.Close()
 		return 0, 0, err
 	}
-	file, err := os.OpenFile(filename, os.O_RDWR, 0755)
+	if root.Id != meta.root {
+		file.Close()
+		return 0, 0, &kverrors.InvalidNodeError{}
+	}
+	free, err := readFreeList(frameId, meta.free, meta.cursor, func(id uint64) ([]byte, error) {
+		return pool.readPage(file, id)
+	})
 	if err != nil {
+		file.Close()
 		return 0, 0, err
 	}
-	frame := newFrame(file, pool.allocation)
+	frame := pool.newFrame(file)
 	frame.root = meta.root
 	frame.size = meta.size
 	frame.cursor = meta.cursor
+	frame.base = meta.cursor
+	frame.prefix = meta.prefix
+	frame.free = free
 	pool.frames[frameId] = frame
+	pool.opened(frame)
 
 	return meta.root, meta.size, nil
 
 }
 
-// Closes all the files in the bufferpool.
+// Closes all the files in the bufferpool. A snapshot is released instead, see Release.
 func (pool *Bufferpool) Close() error {
+	if pool.parent != nil {
+		return pool.Release()
+	}
 	for _, frame := range pool.frames {
 		if frame != nil {
-			err := frame.file.Close()
+			err := pool.closeFile(frame)
 			if err != nil {
 				return err
 			}
 		}
 	}
+	if pool.single != nil {
+		err := pool.single.file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if pool.journal != nil {
+		err := pool.journal.file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	err := pool.values.file.Close()
+	if err != nil {
+		return err
+	}
 	return pool.file.Close()
 }
 
@@ -409,79 +803,163 @@ func (pool *Bufferpool) Clean() error {
 }
 
 // Writes the trie with the given root and size to disk.
+// The frames and the values are written and synced before the trie is committed, the pages the previous commit
+// may refer to being written to the journal. The journal is applied in place once the commit is synced,
+// then the data path is synced: reopening the trie reads either this commit or the previous one,
+// whatever the point a crash interrupts the write, see journal.
+// It returns a SyncError if a file cannot be synced, the trie is then not durable. Nothing is synced with SyncNone.
+// A file which could not be synced when it was closed to bound the open files fails every later write,
+// the trie has to be reopened.
+// The ids of the frames unregistered below the greatest one are recorded, so that their files are not looked for.
 func (pool *Bufferpool) WriteTrie(root, size uint64) error {
-	frameIds := pool.getFrameIds()
-	nframes := uint64(len(frameIds))
-	meta := &hbMetatadata{root: root, size: size, nframes: nframes}
-	file := pool.file
-	position := int64(0)
-	data, err := meta.MarshalBinary()
+	err := pool.writeCommit(root, size)
 	if err != nil {
 		return err
 	}
-	nbytes, err := file.WriteAt(data, position)
+	// The commit is durable from now on, a crash before the journal is applied is recovered by reopening the trie.
+	if len(pool.journal.records) > 0 {
+		err = pool.applyJournal(pool.journal.records)
+		if err != nil {
+			return err
+		}
+	}
+	err = pool.removeUnlinked()
 	if err != nil {
 		return err
 	}
-	if nbytes != len(data) {
-		return &kverrors.PartialWriteError{Total: len(data), Written: nbytes}
-	}
+	return pool.syncDir()
+}
 
+// Writes the frames and the journal and syncs them, then commits the trie with the given root and size.
+// The journal is left to be applied.
+func (pool *Bufferpool) writeCommit(root, size uint64) error {
+	// The pages written to a file which could not be synced when it was closed may not be durable.
+	if pool.closeErr != nil {
+		return pool.closeErr
+	}
+	frameIds := pool.getFrameIds()
+	meta := pool.trieMetadata(root, size)
+	frames := make(map[uint64]frameMetadata, len(frameIds))
+	dirty := []stagedPage{}
 	for _, frameId := range frameIds {
-		err := pool.WriteTree(frameId)
+		frame, pages, err := pool.writeTree(frameId)
 		if err != nil {
 			return err
 		}
+		frames[frameId] = frame
+		dirty = append(dirty, pages...)
+	}
+	err := pool.writeNodes(dirty)
+	if err != nil {
+		return err
+	}
+	if pool.single != nil {
+		err := pool.single.writeCatalog(func(id uint64, data []byte) error {
+			return pool.writePageOf(nil, 0, id, data)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	err = pool.syncFiles()
+	if err != nil {
+		return err
+	}
+	err = pool.syncJournal()
+	if err != nil {
+		return err
 	}
 
+	err = pool.commit(meta, frames, false)
+	if err != nil {
+		return err
+	}
+	pool.committed()
 	return nil
 }
 
+// Returns the metadata of the trie with the given root and size, along with the ids of the frames
+// unregistered below the greatest one.
+func (pool *Bufferpool) trieMetadata(root, size uint64) hbMetatadata {
+	frameIds := pool.getFrameIds()
+	nframes := uint64(0)
+	if len(frameIds) > 0 {
+		nframes = frameIds[len(frameIds)-1]
+	}
+	meta := hbMetatadata{root: root, size: size, nframes: nframes, chunkSize: uint64(pool.chunkSize)}
+	for id := uint64(1); id < nframes; id++ {
+		if pool.frames[id] == nil {
+			meta.holes = append(meta.holes, id)
+		}
+	}
+	return meta
+}
+
+// HasTrie states whether a trie has previously been written to disk in the data path of the bufferpool.
+// It returns an error if the metadata file holds no valid commit. A data path holding the files of a trie
+// without its metadata file is rejected when the bufferpool is created.
+func (pool *Bufferpool) HasTrie() (bool, error) {
+	info, err := pool.file.Stat()
+	if err != nil {
+		return false, err
+	}
+	if info.Size() == 0 {
+		return false, nil
+	}
+	_, err = pool.readCommit()
+	if err != nil {
+		return false, &kverrors.InconsistentStoreError{Path: pool.file.Name(), Reason: "cannot read metadata", Err: err}
+	}
+	return true, nil
+}
+
 // Reads the trie from disk and returns the original root id, size and the number of frames.
+// The frames are read with the metadata of the last commit.
+// It returns an InconsistentStoreError if the metadata doesn't match the frames found on disk.
 func (pool *Bufferpool) ReadTrie() (root uint64, size uint64, nframes uint64, err error) {
-	meta := hbMetatadata{}
 	file := pool.file
-	position := int64(0)
-	data := make([]byte, hbMetaSize())
-	nbytes, err := file.ReadAt(data, position)
+	last, err := pool.readCommit()
 	if err != nil {
-		fmt.Println(err)
-
-		return 0, 0, 0, err
-	}
-	if nbytes != len(data) {
-		return 0, 0, 0, &kverrors.PartialReadError{Total: len(data), Read: nbytes}
+		return 0, 0, 0, &kverrors.InconsistentStoreError{Path: file.Name(), Reason: "cannot read metadata", Err: err}
 	}
-	err = meta.UnmarshalBinary(data)
-	if err != nil {
-		return 0, 0, 0, err
+	meta := last.trie
+
+	if meta.chunkSize == 0 || meta.chunkSize > MaxChunkSize {
+		return 0, 0, 0, &kverrors.InconsistentStoreError{
+			Path:   file.Name(),
+			Reason: fmt.Sprintf("invalid chunk size %d", meta.chunkSize),
+		}
 	}
 
-	if meta.root == 0 {
-		return 0, 0, 0, &kverrors.InvalidMetadataError{Root: meta.root, Size: meta.size}
+	if meta.root == 0 || meta.root > meta.nframes {
+		return 0, 0, 0, &kverrors.InconsistentStoreError{
+			Path:   file.Name(),
+			Reason: "invalid metadata",
+			Err:    &kverrors.InvalidMetadataError{Root: meta.root, Size: meta.size},
+		}
 	}
 
 	root, size, nframes = meta.root, meta.size, meta.nframes
 
 	for id := uint64(1); id < nframes+1; id++ {
-		if id == 1 {
-			rootPageId, _, err := pool.ReadTree(id)
-			if err != nil {
-				return 0, 0, nframes, err
-			}
-			if rootPageId == 0 {
-				return 0, 0, nframes, &kverrors.InvalidNodeError{}
-			}
+		if meta.unregistered(id) {
 			continue
 		}
-		r, _, err := pool.ReadTree(id)
-		if err != nil {
-			return 0, 0, 0, err
+		committed, err := last.frame(id, pool.single != nil)
+		if err == nil {
+			_, _, err = pool.readTree(id, committed)
 		}
-		if r == 0 {
-			return root, size, nframes, &kverrors.InvalidNodeError{}
+		if err != nil {
+			path := pool.filename(id)
+			if pool.single != nil {
+				path = pool.single.file.Name()
+			}
+			return 0, 0, 0, &kverrors.InconsistentStoreError{
+				Path:   path,
+				Reason: fmt.Sprintf("cannot read frame %d/%d", id, nframes),
+				Err:    err,
+			}
 		}
-
 	}
 
 	return root, size, nframes, nil
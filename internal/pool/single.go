@@ -0,0 +1,398 @@
+package pool
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hbtrie/internal/kverrors"
+	"os"
+	"path/filepath"
+)
+
+const singleFilename = "trees.db"
+
+// identifies the superblock of a single file layout
+const singleMagic = uint64(0x31656c69667462) // "btfile1"
+
+// singleFile is the storage layout where the pages of all the b+ trees share one file.
+// Page ids are global to the file and allocated by its cursor. The page 0 is a superblock
+// holding the cursor, the first page of a catalog, which lists the metadata page of each frame,
+// and the first trunk page of the free list shared by all the frames. These pages end with their checksum.
+type singleFile struct {
+	file    *os.File
+	cursor  uint64   // greatest allocated page id
+	base    uint64   // greatest page id the last commit may refer to, see journal
+	catalog []uint64 // ids of the catalog pages, chained on disk
+	metas   []uint64 // id of the metadata page of each frame, indexed by frame id - 1. Zero if unregistered.
+	free    *freeList
+}
+
+// Returns the number of metadata page ids held by one catalog page, between the id of the next one and the checksum.
+func catalogCapacity() int {
+	return int(PageSize-8-sealLen) / 8
+}
+
+// Opens the single file with the given name, or creates it with an empty superblock.
+func openSingleFile(filename string) (*singleFile, error) {
+	_, err := os.Stat(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		file, err := os.Create(filename)
+		if err != nil {
+			return nil, err
+		}
+		s := &singleFile{file: file, free: &freeList{}}
+		err = s.writeCatalog(s.writePage)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return s, nil
+	}
+	file, err := os.OpenFile(filename, os.O_RDWR, 0755)
+	if err != nil {
+		return nil, err
+	}
+	s := &singleFile{file: file, free: &freeList{}}
+	err = s.readCatalog()
+	if err != nil {
+		file.Close()
+		return nil, &kverrors.InconsistentStoreError{Path: filename, Reason: "cannot read superblock", Err: err}
+	}
+	return s, nil
+}
+
+// Returns the id of a new page.
+func (s *singleFile) allocate() uint64 {
+	s.cursor++
+	return s.cursor
+}
+
+// Allocates the metadata page of the given frame.
+func (s *singleFile) register(frameId uint64) {
+	for uint64(len(s.metas)) < frameId {
+		s.metas = append(s.metas, 0)
+	}
+	s.metas[frameId-1] = s.allocate()
+}
+
+// Forgets the metadata page of the given frame. Its pages are released by the bufferpool.
+func (s *singleFile) unregister(frameId uint64) {
+	if frameId > 0 && frameId <= uint64(len(s.metas)) {
+		s.metas[frameId-1] = 0
+	}
+}
+
+// Returns the id of the metadata page of the given frame.
+func (s *singleFile) metaPage(frameId uint64) (uint64, error) {
+	if frameId == 0 || frameId > uint64(len(s.metas)) || s.metas[frameId-1] == 0 {
+		return 0, &kverrors.InvalidFrameIdError{}
+	}
+	return s.metas[frameId-1], nil
+}
+
+// Reads the page with the given id.
+func (s *singleFile) readPage(id uint64) ([]byte, error) {
+	data := make([]byte, PageSize)
+	nbytes, err := s.file.ReadAt(data, int64(id*PageSize))
+	if err != nil {
+		return nil, err
+	}
+	if nbytes != len(data) {
+		return nil, &kverrors.PartialReadError{Total: len(data), Read: nbytes}
+	}
+	return data, nil
+}
+
+// Writes the given data at the position of the page with the given id.
+func (s *singleFile) writePage(id uint64, data []byte) error {
+	if uint64(len(data)) > PageSize {
+		return &kverrors.BufferOverflowError{Max: PageSize, Cursor: len(data)}
+	}
+	nbytes, err := s.file.WriteAt(data, int64(id*PageSize))
+	if err != nil {
+		return err
+	}
+	if nbytes != len(data) {
+		return &kverrors.PartialWriteError{Total: len(data), Written: nbytes}
+	}
+	return nil
+}
+
+// Writes the catalog pages, allocating new ones if the frames outgrew them, the free list, then the superblock,
+// with the given function.
+func (s *singleFile) writeCatalog(writePage func(id uint64, data []byte) error) error {
+	capacity := catalogCapacity()
+	for len(s.catalog)*capacity < len(s.metas) {
+		s.catalog = append(s.catalog, s.allocate())
+	}
+	bin := binary.LittleEndian
+	for i, id := range s.catalog {
+		data := make([]byte, PageSize)
+		if i+1 < len(s.catalog) {
+			bin.PutUint64(data[0:8], s.catalog[i+1])
+		}
+		for j := 0; j < capacity && i*capacity+j < len(s.metas); j++ {
+			bin.PutUint64(data[8+8*j:16+8*j], s.metas[i*capacity+j])
+		}
+		seal(data)
+		err := writePage(id, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	free, err := s.free.write(writePage)
+	if err != nil {
+		return err
+	}
+
+	superblock := make([]byte, PageSize)
+	bin.PutUint64(superblock[0:8], singleMagic)
+	bin.PutUint64(superblock[8:16], s.cursor)
+	bin.PutUint64(superblock[16:24], uint64(len(s.metas)))
+	if len(s.catalog) > 0 {
+		bin.PutUint64(superblock[24:32], s.catalog[0])
+	}
+	bin.PutUint64(superblock[32:40], free)
+	seal(superblock)
+	return writePage(0, superblock)
+}
+
+// Reads the superblock and the catalog pages.
+// It returns a CorruptPageError, naming the frame zero, if one of them doesn't match its checksum.
+func (s *singleFile) readCatalog() error {
+	superblock, err := s.readPage(0)
+	if err != nil {
+		return err
+	}
+	if !sealed(superblock) {
+		return &kverrors.CorruptPageError{Frame: 0, Page: 0}
+	}
+	bin := binary.LittleEndian
+	if magic := bin.Uint64(superblock[0:8]); magic != singleMagic {
+		return fmt.Errorf("invalid superblock magic number: %x", magic)
+	}
+	s.cursor = bin.Uint64(superblock[8:16])
+	s.base = s.cursor
+	nframes := int(bin.Uint64(superblock[16:24]))
+	next := bin.Uint64(superblock[24:32])
+	free := bin.Uint64(superblock[32:40])
+
+	capacity := catalogCapacity()
+	s.catalog, s.metas = nil, make([]uint64, 0, nframes)
+	for len(s.metas) < nframes {
+		if next == 0 || next > s.cursor {
+			return fmt.Errorf("invalid catalog page %d for %d frames", next, nframes)
+		}
+		data, err := s.readPage(next)
+		if err != nil {
+			return err
+		}
+		if !sealed(data) {
+			return &kverrors.CorruptPageError{Frame: 0, Page: next}
+		}
+		s.catalog = append(s.catalog, next)
+		for j := 0; j < capacity && len(s.metas) < nframes; j++ {
+			s.metas = append(s.metas, bin.Uint64(data[8+8*j:16+8*j]))
+		}
+		next = bin.Uint64(data[0:8])
+	}
+	s.free, err = readFreeList(0, free, s.cursor, s.readPage)
+	return err
+}
+
+// Opens the single file in the data path if it exists, or creates it if requested.
+// A trie previously written with one file per frame is migrated to the new single file.
+func (pool *Bufferpool) useSingleFile(requested bool) error {
+	filename := filepath.Join(pool.dataPath, singleFilename)
+	_, err := os.Stat(filename)
+	if err == nil {
+		pool.single, err = openSingleFile(filename)
+		return err
+	}
+	if !errors.Is(err, os.ErrNotExist) || !requested {
+		return nil
+	}
+	exists, err := pool.HasTrie()
+	if err != nil {
+		return err
+	}
+	if !exists {
+		pool.single, err = openSingleFile(filename)
+		return err
+	}
+
+	// The migration is written aside, the frame files are only removed once the single file is complete.
+	migrating := filename + ".migrating"
+	os.Remove(migrating)
+	s, err := openSingleFile(migrating)
+	if err != nil {
+		return err
+	}
+	nframes, err := pool.migrate(s)
+	if err == nil {
+		err = pool.sync(s.file)
+	}
+	s.file.Close()
+	if err == nil {
+		err = os.Rename(migrating, filename)
+	}
+	if err == nil {
+		err = pool.syncDir()
+	}
+	if err != nil {
+		os.Remove(migrating)
+		return err
+	}
+	pool.single, err = openSingleFile(filename)
+	if err != nil {
+		return err
+	}
+	for id := uint64(1); id <= nframes; id++ {
+		err := os.Remove(pool.filename(id))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copies the frames of the trie written with one file per frame to the given single file and returns their number.
+// Page ids are offset so that they are global to the single file.
+func (pool *Bufferpool) migrate(s *singleFile) (uint64, error) {
+	last, err := pool.readCommit()
+	if err != nil {
+		return 0, &kverrors.InconsistentStoreError{Path: pool.file.Name(), Reason: "cannot read metadata", Err: err}
+	}
+	meta := last.trie
+	for id := uint64(1); id <= meta.nframes; id++ {
+		if meta.unregistered(id) {
+			continue
+		}
+		committed, err := last.frame(id, false)
+		if err == nil {
+			err = pool.migrateFrame(s, id, committed)
+		}
+		if err != nil {
+			return 0, &kverrors.InconsistentStoreError{
+				Path:   pool.filename(id),
+				Reason: fmt.Sprintf("cannot migrate frame %d/%d", id, meta.nframes),
+				Err:    err,
+			}
+		}
+	}
+	return meta.nframes, s.writeCatalog(s.writePage)
+}
+
+// Copies the pages and the metadata of the given frame file to the given single file.
+// The committed metadata of the frame is used if given, the metadata stored in the frame file otherwise.
+func (pool *Bufferpool) migrateFrame(s *singleFile, frameId uint64, committed *frameMetadata) error {
+	file, err := os.Open(pool.filename(frameId))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	meta := frameMetadata{}
+	if committed != nil {
+		meta = *committed
+	} else {
+		meta, err = pool.readMetadata(file)
+		if err != nil {
+			return err
+		}
+	}
+	free, err := readFreeList(frameId, meta.free, meta.cursor, func(id uint64) ([]byte, error) {
+		return pool.readPage(file, id)
+	})
+	if err != nil {
+		return err
+	}
+	released := make(map[uint64]bool)
+	for _, id := range free.ids {
+		released[id] = true
+	}
+	offset := s.cursor
+	for id := uint64(1); id <= meta.cursor; id++ {
+		if released[id] {
+			s.free.push(id + offset)
+			continue
+		}
+		node, err := pool.readNode(file, frameId, id)
+		if err != nil {
+			return err
+		}
+		node.Id += offset
+		if node.Next != 0 {
+			node.Next += offset
+		}
+		if node.Prev != 0 {
+			node.Prev += offset
+		}
+		for i := uint64(0); i < node.NumberOfChildren; i++ {
+			node.Children[i] += offset
+		}
+		data, err := node.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		err = s.writePage(node.Id, data)
+		if err != nil {
+			return err
+		}
+	}
+	s.cursor += meta.cursor
+	s.register(frameId)
+
+	meta.root += offset
+	meta.cursor += offset
+	meta.free = 0
+	page, err := meta.page()
+	if err != nil {
+		return err
+	}
+	return s.writePage(s.metas[frameId-1], page)
+}
+
+// Reads the given frame from the single file with the given committed metadata,
+// or with the metadata stored in its metadata page if nil.
+func (pool *Bufferpool) readSingleTree(frameId uint64, committed *frameMetadata) (uint64, uint64, error) {
+	id, err := pool.single.metaPage(frameId)
+	if err != nil {
+		return 0, 0, err
+	}
+	meta := frameMetadata{}
+	if committed != nil {
+		meta = *committed
+	} else {
+		data, err := pool.single.readPage(id)
+		if err != nil {
+			return 0, 0, err
+		}
+		if !sealed(data) {
+			return 0, 0, &kverrors.CorruptPageError{Frame: frameId, Page: id}
+		}
+		err = meta.UnmarshalBinary(data)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if meta.root == 0 || meta.root > meta.cursor {
+		return 0, 0, &kverrors.InvalidMetadataError{Root: meta.root, Size: meta.size}
+	}
+	root, err := pool.readNode(pool.single.file, frameId, meta.root)
+	if err != nil {
+		return 0, 0, err
+	}
+	if root.Id != meta.root {
+		return 0, 0, &kverrors.InvalidNodeError{}
+	}
+	frame := pool.newFrame(nil)
+	frame.root = meta.root
+	frame.size = meta.size
+	frame.cursor = meta.cursor
+	frame.base = meta.cursor
+	frame.prefix = meta.prefix
+	pool.frames[frameId] = frame
+
+	return meta.root, meta.size, nil
+}
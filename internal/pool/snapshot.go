@@ -0,0 +1,96 @@
+package pool
+
+import (
+	"container/list"
+	"hbtrie/internal/kverrors"
+	"path/filepath"
+)
+
+// A snapshot is a read-only bufferpool over the files of another one, pinned to its last committed version.
+// In append-only mode, the pages of a committed version are never written again and the value log is only appended to,
+// so the snapshot reads them from the shared files while the trie keeps being written: only the pages it reads are copied
+// to memory. While a snapshot is pinned, the files of the unregistered frames are kept and the files are not compacted.
+
+// Snapshot returns a read-only bufferpool pinned to the last committed version of the trie, to be read with ReadTrie
+// whatever the commits since, and released with Release. The trie has to be written beforehand for the snapshot
+// to hold its latest changes. It returns a SnapshotModeError unless the bufferpool is in append-only mode, the pages being written in place otherwise.
+func (pool *Bufferpool) Snapshot() (*Bufferpool, error) {
+	if !pool.appendOnly {
+		return nil, &kverrors.SnapshotModeError{}
+	}
+	return pool.pin()
+}
+
+// pin returns a read-only bufferpool pinned to the last commit, whatever the mode. Outside of append-only mode,
+// the committed pages are only left untouched until the trie is written again, see Compaction.
+func (pool *Bufferpool) pin() (*Bufferpool, error) {
+	last, err := pool.readCommit()
+	if err != nil {
+		return nil, &kverrors.InconsistentStoreError{Path: pool.file.Name(), Reason: "cannot read metadata", Err: err}
+	}
+	values, err := openValueLog(filepath.Join(pool.dataPath, valuesFilename))
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &Bufferpool{
+		frames:     make(map[uint64]*frame),
+		allocation: pool.allocation,
+		chunkSize:  pool.chunkSize,
+		dataPath:   pool.dataPath,
+		file:       pool.file,
+		files:      list.New(),
+		values:     values,
+		budget:     pool.budget,
+		policyKind: pool.policyKind,
+		unlinked:   make(map[uint64]bool),
+		syncPolicy: SyncNone,
+		appendOnly: pool.appendOnly,
+		parent:     pool,
+		pinned:     last,
+	}
+	if snapshot.budget != 0 {
+		snapshot.policy = NewReplacementPolicy(snapshot.policyKind, snapshot.budget)
+	}
+	if pool.single != nil {
+		// The catalog written with the last commit lists the frames of the pinned version.
+		snapshot.single, err = openSingleFile(filepath.Join(pool.dataPath, singleFilename))
+		if err != nil {
+			values.file.Close()
+			return nil, err
+		}
+	}
+	pool.snapshots++
+	return snapshot, nil
+}
+
+// Snapshots returns the number of snapshots pinned to the files of the bufferpool, including the one a running compaction reads.
+func (pool *Bufferpool) Snapshots() int {
+	return pool.snapshots
+}
+
+// Release closes the files opened by the snapshot and unpins it from the bufferpool it has been taken from.
+// The files of the frames unregistered meanwhile are removed by the next commit of that bufferpool.
+// It does nothing if the bufferpool is not a snapshot or has already been released.
+func (pool *Bufferpool) Release() error {
+	if pool.parent == nil || pool.pinned == nil {
+		return nil
+	}
+	var err error
+	for _, frame := range pool.frames {
+		if closeErr := pool.closeFile(frame); err == nil {
+			err = closeErr
+		}
+	}
+	if pool.single != nil {
+		if closeErr := pool.single.file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if closeErr := pool.values.file.Close(); err == nil {
+		err = closeErr
+	}
+	pool.frames = make(map[uint64]*frame)
+	pool.parent.snapshots--
+	pool.pinned = nil
+	return err
+}
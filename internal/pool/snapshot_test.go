@@ -0,0 +1,118 @@
+package pool
+
+import (
+	"errors"
+	"hbtrie/internal/kverrors"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	dataPath := path.Join(os.TempDir(), "hbt_snapshot_test")
+	os.RemoveAll(dataPath)
+	t.Cleanup(func() {
+		os.RemoveAll(dataPath)
+	})
+	p, err := NewBufferpoolWithOptions(dataPath, &Options{Allocation: 16})
+	if err != nil {
+		t.Errorf("while creating bufferpool: %v", err)
+		t.FailNow()
+	}
+	_, err = p.Snapshot()
+	var modeErr *kverrors.SnapshotModeError
+	if !errors.As(err, &modeErr) {
+		t.Errorf("expected SnapshotModeError, got %v", err)
+		t.FailNow()
+	}
+	p.Close()
+
+	p, err = NewBufferpoolWithOptions(dataPath, &Options{Allocation: 16, AppendOnly: true})
+	if err != nil {
+		t.Errorf("while creating bufferpool: %v", err)
+		t.FailNow()
+	}
+	defer p.Close()
+	frameId, err := p.Register()
+	if err != nil {
+		t.Errorf("while registering frame: %v", err)
+		t.FailNow()
+	}
+	other, err := p.Register()
+	if err != nil {
+		t.Errorf("while registering frame: %v", err)
+		t.FailNow()
+	}
+	setRoot(t, p, frameId, 2)
+	setRoot(t, p, other, 1)
+	err = p.WriteTrie(frameId, 2)
+	if err != nil {
+		t.Errorf("while writing trie: %v", err)
+		t.FailNow()
+	}
+	snapshot, err := p.Snapshot()
+	if err != nil {
+		t.Errorf("while taking snapshot: %v", err)
+		t.FailNow()
+	}
+
+	// The trie is written again with a new root and without the other frame.
+	rootId, _ := p.GetRoot(frameId)
+	setRoot(t, p, frameId, 3)
+	err = p.Unregister(other)
+	if err != nil {
+		t.Errorf("while unregistering frame: %v", err)
+		t.FailNow()
+	}
+	err = p.WriteTrie(frameId, 3)
+	if err != nil {
+		t.Errorf("while writing trie: %v", err)
+		t.FailNow()
+	}
+	_, err = p.Compact(frameId, 3)
+	var pinnedErr *kverrors.PinnedSnapshotError
+	if !errors.As(err, &pinnedErr) {
+		t.Errorf("expected PinnedSnapshotError, got %v", err)
+		t.FailNow()
+	}
+
+	// The snapshot reads the version it is pinned to, the file of the other frame is kept for it.
+	root, size, nframes, err := snapshot.ReadTrie()
+	if err != nil {
+		t.Errorf("while reading snapshot: %v", err)
+		t.FailNow()
+	}
+	if root != frameId || size != 2 || nframes != 2 {
+		t.Errorf("expected root %d, size 2 and 2 frames, got %d, %d and %d", frameId, root, size, nframes)
+		t.FailNow()
+	}
+	if id, _ := snapshot.GetRoot(frameId); id != rootId {
+		t.Errorf("expected root page %d, got %d", rootId, id)
+		t.FailNow()
+	}
+	node, err := snapshot.Query(frameId, rootId)
+	if err != nil || node.NumberOfChildren != 2 {
+		t.Errorf("expected 2 children in pinned root, got error %v", err)
+		t.FailNow()
+	}
+	if _, err := snapshot.Query(other, 1); err != nil {
+		t.Errorf("while querying unregistered frame: %v", err)
+		t.FailNow()
+	}
+
+	// Once released, the file of the other frame is removed by the next commit.
+	err = snapshot.Release()
+	if err != nil || p.Snapshots() != 0 {
+		t.Errorf("expected snapshot to be released, got %d snapshots, error %v", p.Snapshots(), err)
+		t.FailNow()
+	}
+	err = p.WriteTrie(frameId, 3)
+	if err != nil {
+		t.Errorf("while writing trie: %v", err)
+		t.FailNow()
+	}
+	if _, err := os.Stat(p.filename(other)); !os.IsNotExist(err) {
+		t.Errorf("expected file of frame %d to be removed, got %v", other, err)
+		t.FailNow()
+	}
+}
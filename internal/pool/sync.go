@@ -0,0 +1,54 @@
+package pool
+
+import (
+	"hbtrie/internal/kverrors"
+	"os"
+)
+
+// SyncPolicy tells when the files of the bufferpool are synced to disk.
+type SyncPolicy int
+
+const (
+	// The files are synced when the trie is written: the frames and the values first, then the metadata,
+	// then the data path so that the files created and removed since the last write are recorded.
+	SyncOnFlush SyncPolicy = iota
+	// The files are also synced after every write of pages or values, such as the eviction of a dirty page.
+	SyncAlways
+	// The files are never explicitly synced, the operating system writes them back on its own.
+	// A crash may then leave the trie in any state, the journal cannot repair it.
+	SyncNone
+)
+
+// sync syncs the given file unless the files are never synced. It returns a SyncError if it fails.
+func (pool *Bufferpool) sync(file *os.File) error {
+	if pool.syncPolicy == SyncNone {
+		return nil
+	}
+	return syncFile(file)
+}
+
+// syncFile syncs the given file whatever the policy. It returns a SyncError if it fails.
+func syncFile(file *os.File) error {
+	err := file.Sync()
+	if err != nil {
+		return &kverrors.SyncError{Path: file.Name(), Err: err}
+	}
+	return nil
+}
+
+// syncDir syncs the data path, so that the files created, renamed and removed in it survive a crash.
+func (pool *Bufferpool) syncDir() error {
+	if pool.syncPolicy == SyncNone {
+		return nil
+	}
+	dir, err := os.Open(pool.dataPath)
+	if err != nil {
+		return err
+	}
+	err = syncFile(dir)
+	closeErr := dir.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
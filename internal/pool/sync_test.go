@@ -0,0 +1,116 @@
+package pool
+
+import (
+	"errors"
+	"hbtrie/internal/kverrors"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestSyncPolicy(t *testing.T) {
+	dataPath := path.Join(os.TempDir(), "hbt_sync_test")
+	os.RemoveAll(dataPath)
+	t.Cleanup(func() {
+		os.RemoveAll(dataPath)
+	})
+	_, err := NewBufferpoolWithOptions(dataPath, &Options{Allocation: 16, Sync: SyncNone + 1})
+	var rangeError *kverrors.OutsideOfRangeError
+	if !errors.As(err, &rangeError) {
+		t.Errorf("expected OutsideOfRangeError, got %v", err)
+		t.FailNow()
+	}
+
+	for _, policy := range []SyncPolicy{SyncOnFlush, SyncAlways, SyncNone} {
+		os.RemoveAll(dataPath)
+		p, err := NewBufferpoolWithOptions(dataPath, &Options{Allocation: 16, Sync: policy})
+		if err != nil {
+			t.Errorf("while creating bufferpool: %v", err)
+			t.FailNow()
+		}
+		frameId, err := p.Register()
+		if err != nil {
+			t.Errorf("while registering frame: %v", err)
+			t.FailNow()
+		}
+		setRoot(t, p, frameId, 3)
+		_, err = p.WriteValue([]byte("key"), []byte("value"))
+		if err != nil {
+			t.Errorf("while writing value: %v", err)
+			t.FailNow()
+		}
+		err = p.WriteTrie(frameId, 3)
+		if err != nil {
+			t.Errorf("while writing trie with policy %d: %v", policy, err)
+			t.FailNow()
+		}
+		if p.created {
+			t.Errorf("expected data path to be synced with policy %d", policy)
+			t.FailNow()
+		}
+
+		// A file that cannot be synced fails the write, unless the files are never synced.
+		p.values.file.Close()
+		err = p.WriteTrie(frameId, 3)
+		var syncError *kverrors.SyncError
+		if policy == SyncNone {
+			if err != nil {
+				t.Errorf("expected no sync with policy %d, got %v", policy, err)
+				t.FailNow()
+			}
+		} else if !errors.As(err, &syncError) || !errors.Is(err, os.ErrClosed) {
+			t.Errorf("expected SyncError with policy %d, got %v", policy, err)
+			t.FailNow()
+		}
+		p.values.file, _ = os.OpenFile(path.Join(p.DataPath(), valuesFilename), os.O_RDWR, 0755)
+
+		p, size := reopen(t, p, dataPath)
+		if size != 3 {
+			t.Errorf("expected size 3, got %d", size)
+			t.FailNow()
+		}
+		p.Close()
+	}
+}
+
+func TestSyncClosedFile(t *testing.T) {
+	dataPath := path.Join(os.TempDir(), "hbt_sync_test")
+	os.RemoveAll(dataPath)
+	t.Cleanup(func() {
+		os.RemoveAll(dataPath)
+	})
+	p, frameId := newCommitPool(t, dataPath, 3)
+	defer p.Close()
+	err := p.WriteTrie(frameId, 3)
+	if err != nil {
+		t.Errorf("while writing trie: %v", err)
+		t.FailNow()
+	}
+
+	// The file of the frame cannot be synced when it is closed to open the files of other frames.
+	f := p.frames[frameId]
+	f.file.Close()
+	others := make([]*frame, 0, poolMaxOpenFiles)
+	for i := 0; i < poolMaxOpenFiles; i++ {
+		other := &frame{}
+		p.opened(other)
+		others = append(others, other)
+	}
+	if f.file != nil {
+		t.Errorf("expected the file of the frame to be closed")
+		t.FailNow()
+	}
+	for _, other := range others {
+		p.closeFile(other)
+	}
+
+	// The following writes fail although the file is reopened and synced.
+	var syncError *kverrors.SyncError
+	for i := 0; i < 2; i++ {
+		err = p.WriteTrie(frameId, 3)
+		if !errors.As(err, &syncError) || !errors.Is(err, os.ErrClosed) {
+			t.Errorf("expected SyncError, got %v", err)
+			t.FailNow()
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package pool
+
+// twoQ is the full version of the 2Q policy of Johnson and Shasha.
+// Pages are first admitted in the FIFO queue in. When evicted from it, they are remembered in the ghost queue out,
+// and only a page brought back while remembered is promoted to the LRU list main.
+// Pages read once, as by a scan, thus go through in without evicting the pages of main.
+type twoQ struct {
+	in   *keyList // pages accessed once, in FIFO order
+	out  *keyList // ghosts of the pages evicted from in
+	main *keyList // pages accessed again after their eviction from in, in LRU order
+	kin  int      // target size of in
+	kout int      // greatest size of out
+}
+
+func newTwoQ(capacity uint64) *twoQ {
+	q := &twoQ{in: newKeyList(), out: newKeyList(), main: newKeyList(), kin: 1, kout: 1}
+	if capacity/4 > 1 {
+		q.kin = int(capacity / 4)
+	}
+	if capacity/2 > 1 {
+		q.kout = int(capacity / 2)
+	}
+	return q
+}
+
+func (q *twoQ) Access(key PageKey) {
+	// A page of in keeps its position, its accesses are considered correlated.
+	if q.main.has(key) {
+		q.main.pushFront(key)
+	}
+}
+
+func (q *twoQ) Insert(key PageKey) {
+	if q.in.has(key) || q.main.has(key) {
+		q.Access(key)
+		return
+	}
+	if q.out.remove(key) {
+		q.main.pushFront(key)
+		return
+	}
+	q.in.pushFront(key)
+}
+
+func (q *twoQ) Remove(key PageKey) {
+	if !q.in.remove(key) && !q.main.remove(key) {
+		q.out.remove(key)
+	}
+}
+
+func (q *twoQ) Evict() (PageKey, bool) {
+	if q.in.len() > q.kin || q.main.len() == 0 {
+		key, ok := q.in.popBack()
+		if !ok {
+			return key, false
+		}
+		q.out.pushFront(key)
+		for q.out.len() > q.kout {
+			q.out.popBack()
+		}
+		return key, true
+	}
+	return q.main.popBack()
+}
+
+func (q *twoQ) Len() int {
+	return q.in.len() + q.main.len()
+}
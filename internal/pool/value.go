@@ -0,0 +1,136 @@
+package pool
+
+import (
+	"encoding/binary"
+	"hbtrie/internal/kverrors"
+	"math"
+	"os"
+)
+
+const valuesFilename = "values.log"
+
+// valueHeaderLen is the byte length of the header preceding each record in the log:
+// the length of the key followed by the length of the value.
+const valueHeaderLen = 8
+
+// valueLog is an append-only file holding the keys and values of the trie.
+// Leaf entries of the b+ trees store the position of their record in the log,
+// the full key of an entry is thus known without walking down to its last chunk.
+type valueLog struct {
+	file   *os.File
+	cursor uint64 // position of the next record
+}
+
+// Opens the value log at the given path or creates it if it doesn't exist.
+func openValueLog(filename string) (*valueLog, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0755)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &valueLog{file: file, cursor: uint64(info.Size())}, nil
+}
+
+// Appends a record of the key and the value to the log and returns its position.
+func (l *valueLog) append(key, value []byte) (uint64, error) {
+	if len(key) > math.MaxUint32 {
+		return 0, &kverrors.OverflowError{Type: "key", Max: math.MaxUint32, Actual: len(key)}
+	}
+	if len(value) > math.MaxUint32 {
+		return 0, &kverrors.OverflowError{Type: "value", Max: math.MaxUint32, Actual: len(value)}
+	}
+	data := make([]byte, valueHeaderLen+len(key)+len(value))
+	binary.LittleEndian.PutUint32(data[0:4], uint32(len(key)))
+	binary.LittleEndian.PutUint32(data[4:8], uint32(len(value)))
+	copy(data[valueHeaderLen:], key)
+	copy(data[valueHeaderLen+len(key):], value)
+	position := l.cursor
+	nbytes, err := l.file.WriteAt(data, int64(position))
+	if err != nil {
+		return 0, err
+	}
+	if nbytes != len(data) {
+		return 0, &kverrors.PartialWriteError{Total: len(data), Written: nbytes}
+	}
+	l.cursor += uint64(nbytes)
+	return position, nil
+}
+
+// Reads the key of the record at the given position of the log.
+func (l *valueLog) readKey(position uint64) ([]byte, error) {
+	keyLen, _, err := l.readHeader(position)
+	if err != nil {
+		return nil, err
+	}
+	return l.readAt(position+valueHeaderLen, keyLen)
+}
+
+// Reads the value of the record at the given position of the log.
+func (l *valueLog) read(position uint64) ([]byte, error) {
+	keyLen, valueLen, err := l.readHeader(position)
+	if err != nil {
+		return nil, err
+	}
+	return l.readAt(position+valueHeaderLen+keyLen, valueLen)
+}
+
+// Reads the lengths of the key and the value of the record at the given position of the log.
+func (l *valueLog) readHeader(position uint64) (uint64, uint64, error) {
+	header, err := l.readAt(position, valueHeaderLen)
+	if err != nil {
+		return 0, 0, err
+	}
+	bin := binary.LittleEndian
+	return uint64(bin.Uint32(header[0:4])), uint64(bin.Uint32(header[4:8])), nil
+}
+
+// Reads length bytes at the given position of the log.
+func (l *valueLog) readAt(position, length uint64) ([]byte, error) {
+	if position+length > l.cursor {
+		return nil, &kverrors.OutsideOfRangeError{From: 0, To: l.cursor, Actual: position + length}
+	}
+	data := make([]byte, length)
+	nbytes, err := l.file.ReadAt(data, int64(position))
+	if err != nil {
+		return nil, err
+	}
+	if nbytes != len(data) {
+		return nil, &kverrors.PartialReadError{Total: len(data), Read: nbytes}
+	}
+	return data, nil
+}
+
+// WriteValue appends the given key and value to the value log of the bufferpool and returns the position of the record.
+// With the SyncAlways policy, the record is synced before its position is returned.
+func (pool *Bufferpool) WriteValue(key, value []byte) (uint64, error) {
+	position, err := pool.values.append(key, value)
+	if err != nil || pool.syncPolicy != SyncAlways {
+		return position, err
+	}
+	return position, pool.sync(pool.values.file)
+}
+
+// ReadValue returns the value of the record at the given position of the value log of the bufferpool.
+func (pool *Bufferpool) ReadValue(position uint64) ([]byte, error) {
+	return pool.values.read(position)
+}
+
+// ReadKey returns the key of the record at the given position of the value log of the bufferpool.
+func (pool *Bufferpool) ReadKey(position uint64) ([]byte, error) {
+	return pool.values.readKey(position)
+}
+
+// ReleaseValue records the record at the given position of the value log as no longer referenced by the trie,
+// once its key is updated or deleted. Its bytes are reclaimed by the next compaction, see StaleRatio.
+func (pool *Bufferpool) ReleaseValue(position uint64) error {
+	keyLen, valueLen, err := pool.values.readHeader(position)
+	if err != nil {
+		return err
+	}
+	pool.stale += valueHeaderLen + keyLen + valueLen
+	return nil
+}
@@ -0,0 +1,80 @@
+package pool
+
+import (
+	"bytes"
+	"errors"
+	"hbtrie/internal/kverrors"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestAppendReadRecord(t *testing.T) {
+	filename := path.Join(os.TempDir(), "hbt_values_test.log")
+	t.Cleanup(func() {
+		os.Remove(filename)
+	})
+
+	log, err := openValueLog(filename)
+	if err != nil {
+		t.Errorf("while opening value log: %v", err)
+		t.FailNow()
+	}
+
+	keys := make(map[uint64][]byte)
+	values := make(map[uint64][]byte)
+	for i := 0; i < 100; i++ {
+		key := make([]byte, rand.Intn(256))
+		rand.Read(key)
+		value := make([]byte, rand.Intn(8192))
+		rand.Read(value)
+		position, err := log.append(key, value)
+		if err != nil {
+			t.Errorf("[step %d] while appending value: %v", i, err)
+			t.FailNow()
+		}
+		keys[position] = key
+		values[position] = value
+	}
+
+	err = log.file.Close()
+	if err != nil {
+		t.Errorf("while closing value log: %v", err)
+		t.FailNow()
+	}
+	log, err = openValueLog(filename)
+	if err != nil {
+		t.Errorf("while opening value log: %v", err)
+		t.FailNow()
+	}
+	defer log.file.Close()
+
+	for position, value := range values {
+		v, err := log.read(position)
+		if err != nil {
+			t.Errorf("while reading value at %d: %v", position, err)
+			t.FailNow()
+		}
+		if !bytes.Equal(v, value) {
+			t.Errorf("expected %v, got %v", value, v)
+			t.FailNow()
+		}
+		k, err := log.readKey(position)
+		if err != nil {
+			t.Errorf("while reading key at %d: %v", position, err)
+			t.FailNow()
+		}
+		if !bytes.Equal(k, keys[position]) {
+			t.Errorf("expected %v, got %v", keys[position], k)
+			t.FailNow()
+		}
+	}
+
+	var rangeError *kverrors.OutsideOfRangeError
+	_, err = log.read(log.cursor)
+	if !errors.As(err, &rangeError) {
+		t.Errorf("expected an outside of range error, got %v", err)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,290 @@
+package wal
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"hbtrie/internal/kverrors"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// SyncMode tells when the records appended to the log are synced to disk.
+type SyncMode int
+
+const (
+	// Every record is synced before the write is acknowledged.
+	SyncAlways SyncMode = iota
+	// Records are synced by groups: once a group is full or once the first record of the group is old enough.
+	// A write is acknowledged once its group is synced, so that concurrent writers share a sync.
+	SyncGroup
+	// Records are never explicitly synced, the operating system writes them back on its own.
+	SyncNone
+)
+
+const (
+	// default number of records of a group
+	defaultGroupSize = 64
+	// default delay after which the records of an incomplete group are synced
+	defaultGroupDelay = 10 * time.Millisecond
+)
+
+// Options of a log.
+type Options struct {
+	Sync SyncMode
+	// Number of records synced at once in group commit mode, 64 by default.
+	GroupSize int
+	// Delay after which an incomplete group is synced in group commit mode, 10ms by default.
+	GroupDelay time.Duration
+}
+
+// Op is the operation recorded by a record of the log.
+type Op byte
+
+const (
+	OpPut Op = iota + 1
+	OpDelete
+)
+
+// recordHeaderLen is the byte length of the header preceding each record in the log:
+// the checksum of the record, the length of the record, the operation and the length of the key.
+const recordHeaderLen = 13
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Log is an append-only file recording the writes that have not been written to the trie yet.
+// A record is the operation, the key and the value, preceded by its length and checksum
+// so that a record torn by a crash is detected and dropped when the log is replayed.
+type Log struct {
+	mu      sync.Mutex
+	file    *os.File
+	cursor  uint64 // position of the next record
+	options Options
+	pending int         // number of records not synced yet
+	group   *group      // group of the pending records, in group commit mode
+	timer   *time.Timer // syncs the pending records of an incomplete group
+	err     error       // error of the last failed sync, returned until the log is reset
+}
+
+// group gathers the writers waiting for the sync of their records in group commit mode.
+type group struct {
+	done chan struct{} // closed once the records of the group are synced
+	err  error         // error of the sync of the group
+}
+
+// Opens the log at the given path or creates it if it doesn't exist.
+// The records already in the log have to be replayed before new ones are appended.
+func Open(filename string, options *Options) (*Log, error) {
+	if options.Sync < SyncAlways || options.Sync > SyncNone {
+		return nil, &kverrors.OutsideOfRangeError{From: SyncAlways, To: SyncNone, Actual: options.Sync}
+	}
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0755)
+	if err != nil {
+		return nil, err
+	}
+	l := &Log{file: file, options: *options}
+	if l.options.GroupSize <= 0 {
+		l.options.GroupSize = defaultGroupSize
+	}
+	if l.options.GroupDelay <= 0 {
+		l.options.GroupDelay = defaultGroupDelay
+	}
+	return l, nil
+}
+
+// Replay calls the given function with each record of the log, in the order they were appended.
+// The log is truncated after the last valid record: a record torn by a crash has never been acknowledged.
+func (l *Log) Replay(apply func(op Op, key, value []byte) error) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	info, err := l.file.Stat()
+	if err != nil {
+		return err
+	}
+	data := make([]byte, info.Size())
+	nbytes, err := l.file.ReadAt(data, 0)
+	if err != nil && nbytes != len(data) {
+		return err
+	}
+
+	bin := binary.LittleEndian
+	cursor := 0
+	for len(data)-cursor >= recordHeaderLen {
+		header := data[cursor : cursor+recordHeaderLen]
+		length := int(bin.Uint32(header[4:8]))
+		if length < recordHeaderLen-8 || length > len(data)-cursor-8 {
+			break
+		}
+		record := data[cursor+8 : cursor+8+length]
+		if crc32.Checksum(record, castagnoli) != bin.Uint32(header[0:4]) {
+			break
+		}
+		op := Op(record[0])
+		keyLen := int(bin.Uint32(record[1:5]))
+		if (op != OpPut && op != OpDelete) || keyLen > length-5 {
+			break
+		}
+		err := apply(op, record[5:5+keyLen], record[5+keyLen:])
+		if err != nil {
+			return err
+		}
+		cursor += 8 + length
+	}
+
+	l.cursor = uint64(cursor)
+	if cursor != len(data) {
+		return l.file.Truncate(int64(cursor))
+	}
+	return nil
+}
+
+// Put records the insertion of the given key and value.
+func (l *Log) Put(key, value []byte) error {
+	return l.append(OpPut, key, value)
+}
+
+// Delete records the deletion of the given key.
+func (l *Log) Delete(key []byte) error {
+	return l.append(OpDelete, key, nil)
+}
+
+// Appends a record to the log and syncs it according to the sync mode.
+func (l *Log) append(op Op, key, value []byte) error {
+	length := recordHeaderLen - 8 + len(key) + len(value)
+	if length > math.MaxUint32 {
+		return &kverrors.OverflowError{Type: "record", Max: math.MaxUint32, Actual: length}
+	}
+	data := make([]byte, 8+length)
+	bin := binary.LittleEndian
+	bin.PutUint32(data[4:8], uint32(length))
+	data[8] = byte(op)
+	bin.PutUint32(data[9:13], uint32(len(key)))
+	copy(data[recordHeaderLen:], key)
+	copy(data[recordHeaderLen+len(key):], value)
+	bin.PutUint32(data[0:4], crc32.Checksum(data[8:], castagnoli))
+
+	l.mu.Lock()
+	if l.err != nil {
+		l.mu.Unlock()
+		return l.err
+	}
+	nbytes, err := l.file.WriteAt(data, int64(l.cursor))
+	if err == nil && nbytes != len(data) {
+		err = &kverrors.PartialWriteError{Total: len(data), Written: nbytes}
+	}
+	if err != nil {
+		l.mu.Unlock()
+		return err
+	}
+	l.cursor += uint64(nbytes)
+
+	switch l.options.Sync {
+	case SyncAlways:
+		err = l.sync()
+	case SyncGroup:
+		g := l.join()
+		if l.pending >= l.options.GroupSize {
+			l.sync()
+		}
+		l.mu.Unlock()
+		// The record is only acknowledged once the group holding it is synced.
+		<-g.done
+		return g.err
+	}
+	l.mu.Unlock()
+	return err
+}
+
+// join adds a pending record to the current group, and starts a new group if there is none.
+// The records of an incomplete group are synced once the delay has elapsed. The lock has to be held.
+func (l *Log) join() *group {
+	l.pending++
+	if l.group == nil {
+		g := &group{done: make(chan struct{})}
+		l.group = g
+		l.timer = time.AfterFunc(l.options.GroupDelay, func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.group == g {
+				l.sync()
+			}
+		})
+	}
+	return l.group
+}
+
+// Syncs the pending records and releases the writers of the current group with the result.
+// A failed sync is returned by every later write until the log is reset. The lock has to be held.
+func (l *Log) sync() error {
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+	l.pending = 0
+	err := l.file.Sync()
+	if err != nil {
+		l.err = err
+	}
+	l.release(err)
+	return err
+}
+
+// release completes the current group, if any, with the given result of its sync. The lock has to be held.
+func (l *Log) release(err error) {
+	if l.group == nil {
+		return
+	}
+	l.group.err = err
+	close(l.group.done)
+	l.group = nil
+}
+
+// Sync syncs the records appended to the log, whatever the sync mode.
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return l.err
+	}
+	return l.sync()
+}
+
+// Reset empties the log once its records have been written to the trie.
+func (l *Log) Reset() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := l.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+	l.cursor = 0
+	// The records a sync failed to sync have been written to the trie.
+	l.err = nil
+	if l.options.Sync == SyncNone {
+		l.pending = 0
+		return nil
+	}
+	return l.sync()
+}
+
+// Close syncs the pending records and closes the log.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := l.err
+	if err == nil && l.options.Sync != SyncNone {
+		err = l.sync()
+	} else {
+		if l.timer != nil {
+			l.timer.Stop()
+			l.timer = nil
+		}
+		l.release(err)
+	}
+	closeErr := l.file.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
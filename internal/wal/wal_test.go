@@ -0,0 +1,241 @@
+package wal
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+var logPath = path.Join(os.TempDir(), "hb_wal_test.log")
+
+type record struct {
+	op         Op
+	key, value []byte
+}
+
+// replay returns the records of the log at the given path.
+func replay(t *testing.T, options *Options) (*Log, []record) {
+	l, err := Open(logPath, options)
+	if err != nil {
+		t.Errorf("while opening log: %v", err)
+		t.FailNow()
+	}
+	records := make([]record, 0)
+	err = l.Replay(func(op Op, key, value []byte) error {
+		records = append(records, record{op, append([]byte{}, key...), append([]byte{}, value...)})
+		return nil
+	})
+	if err != nil {
+		t.Errorf("while replaying log: %v", err)
+		t.FailNow()
+	}
+	return l, records
+}
+
+func TestReplay(t *testing.T) {
+	for _, mode := range []SyncMode{SyncAlways, SyncGroup, SyncNone} {
+		os.Remove(logPath)
+		l, records := replay(t, &Options{Sync: mode, GroupSize: 8})
+		if len(records) != 0 {
+			t.Errorf("expected an empty log, got %d records", len(records))
+			t.FailNow()
+		}
+		expected := make([]record, 0)
+		for i := 0; i < 100; i++ {
+			key := []byte(fmt.Sprintf("key%03d", i))
+			var err error
+			if i%3 == 2 {
+				err = l.Delete(key)
+				expected = append(expected, record{OpDelete, key, []byte{}})
+			} else {
+				err = l.Put(key, bytes.Repeat(key, i%4))
+				expected = append(expected, record{OpPut, key, bytes.Repeat(key, i%4)})
+			}
+			if err != nil {
+				t.Errorf("[step %d] while appending to log: %v", i, err)
+				t.FailNow()
+			}
+		}
+		err := l.Close()
+		if err != nil {
+			t.Errorf("while closing log: %v", err)
+			t.FailNow()
+		}
+
+		l, records = replay(t, &Options{Sync: mode})
+		if len(records) != len(expected) {
+			t.Errorf("expected %d records, got %d", len(expected), len(records))
+			t.FailNow()
+		}
+		for i, r := range records {
+			if r.op != expected[i].op || !bytes.Equal(r.key, expected[i].key) || !bytes.Equal(r.value, expected[i].value) {
+				t.Errorf("[step %d] expected %v, got %v", i, expected[i], r)
+				t.FailNow()
+			}
+		}
+
+		// Records appended after a replay follow the replayed ones, a reset log is empty.
+		err = l.Put([]byte("last"), nil)
+		if err != nil {
+			t.Errorf("while appending to log: %v", err)
+			t.FailNow()
+		}
+		l.Close()
+		l, records = replay(t, &Options{Sync: mode})
+		if len(records) != len(expected)+1 || !bytes.Equal(records[len(expected)].key, []byte("last")) {
+			t.Errorf("expected %d records ending with %q, got %d", len(expected)+1, "last", len(records))
+			t.FailNow()
+		}
+		err = l.Reset()
+		if err != nil {
+			t.Errorf("while resetting log: %v", err)
+			t.FailNow()
+		}
+		l.Close()
+		l, records = replay(t, &Options{Sync: mode})
+		if len(records) != 0 {
+			t.Errorf("expected an empty log, got %d records", len(records))
+			t.FailNow()
+		}
+		l.Close()
+	}
+	os.Remove(logPath)
+}
+
+func TestTornRecord(t *testing.T) {
+	os.Remove(logPath)
+	t.Cleanup(func() {
+		os.Remove(logPath)
+	})
+	l, _ := replay(t, &Options{})
+	for i := 0; i < 3; i++ {
+		err := l.Put([]byte{byte(i)}, []byte("value"))
+		if err != nil {
+			t.Errorf("while appending to log: %v", err)
+			t.FailNow()
+		}
+	}
+	l.Close()
+	info, err := os.Stat(logPath)
+	if err != nil {
+		t.Errorf("while reading log size: %v", err)
+		t.FailNow()
+	}
+	size := info.Size()
+	record := size / 3
+
+	// A record cut by a crash is dropped along with the bytes after it.
+	err = os.Truncate(logPath, size-3)
+	if err != nil {
+		t.Errorf("while truncating log: %v", err)
+		t.FailNow()
+	}
+	l, records := replay(t, &Options{})
+	l.Close()
+	if len(records) != 2 {
+		t.Errorf("expected %d records, got %d", 2, len(records))
+		t.FailNow()
+	}
+	info, _ = os.Stat(logPath)
+	if info.Size() != 2*record {
+		t.Errorf("expected the log to be truncated to %d bytes, got %d", 2*record, info.Size())
+		t.FailNow()
+	}
+
+	// A record whose bytes changed fails its checksum.
+	file, _ := os.OpenFile(logPath, os.O_RDWR, 0755)
+	file.WriteAt([]byte{0xff}, record+recordHeaderLen)
+	file.Close()
+	l, records = replay(t, &Options{})
+	l.Close()
+	if len(records) != 1 {
+		t.Errorf("expected %d record, got %d", 1, len(records))
+		t.FailNow()
+	}
+}
+
+func TestGroupCommit(t *testing.T) {
+	os.Remove(logPath)
+	t.Cleanup(func() {
+		os.Remove(logPath)
+	})
+	l, _ := replay(t, &Options{Sync: SyncGroup, GroupSize: 4, GroupDelay: time.Hour})
+
+	// A full group is synced at once, releasing all its writers.
+	errs := make(chan error)
+	for i := 0; i < 4; i++ {
+		go func(i int) {
+			errs <- l.Put([]byte{byte(i)}, nil)
+		}(i)
+	}
+	for i := 0; i < 4; i++ {
+		err := <-errs
+		if err != nil {
+			t.Errorf("while appending to log: %v", err)
+			t.FailNow()
+		}
+	}
+
+	// An incomplete group is synced after the delay, a write returning once its group is synced.
+	l.mu.Lock()
+	l.options.GroupDelay = 5 * time.Millisecond
+	l.mu.Unlock()
+	err := l.Put([]byte{4}, nil)
+	if err != nil {
+		t.Errorf("while appending to log: %v", err)
+		t.FailNow()
+	}
+	l.mu.Lock()
+	pending := l.pending
+	l.mu.Unlock()
+	if pending != 0 {
+		t.Errorf("expected a synced group, got %d pending records", pending)
+		t.FailNow()
+	}
+
+	// The error of the sync of a group is returned to all its writers.
+	l.mu.Lock()
+	l.options.GroupDelay = time.Hour
+	l.mu.Unlock()
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			errs <- l.Put([]byte{byte(5 + i)}, nil)
+		}(i)
+	}
+	for {
+		l.mu.Lock()
+		pending = l.pending
+		if pending == 3 {
+			l.file.Close()
+		}
+		l.mu.Unlock()
+		if pending == 3 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if l.Sync() == nil {
+		t.Errorf("expected the sync of a closed log to fail")
+		t.FailNow()
+	}
+	for i := 0; i < 3; i++ {
+		err := <-errs
+		if err == nil {
+			t.Errorf("expected the failed sync to be returned to the writers of the group")
+			t.FailNow()
+		}
+	}
+	if l.Put([]byte{8}, nil) == nil {
+		t.Errorf("expected the failed sync to be returned to later writes")
+		t.FailNow()
+	}
+
+	_, err = Open(logPath, &Options{Sync: SyncNone + 1})
+	if err == nil {
+		t.Errorf("expected an error for sync mode %d", SyncNone+1)
+		t.FailNow()
+	}
+}
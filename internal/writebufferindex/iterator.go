@@ -0,0 +1,271 @@
+package writebufferindex
+
+import (
+	"bytes"
+	"hbtrie/internal/hbtrie"
+	"sort"
+)
+
+// pendingEntry is an entry of the hashtable that has not been flushed yet.
+type pendingEntry struct {
+	key []byte
+	bufferEntry
+}
+
+// Iterator walks the keys of both the hbtrie and the write buffer in lexicographic order.
+// Entries of the write buffer shadow the ones of the hbtrie and deleted keys are skipped.
+// The pending entries are captured when the iterator is created, flushing the write buffer invalidates it.
+type Iterator struct {
+	trie    *hbtrie.Iterator
+	start   []byte         // inclusive lower bound, nil if unbounded
+	end     []byte         // exclusive upper bound, nil if unbounded
+	pending []pendingEntry // sorted by key
+	at      int            // position in the pending entries
+	forward bool           // direction of the last move
+	key     []byte
+	value   []byte
+	valid   bool
+}
+
+// Iterator returns a new iterator over the hbtrie and the pending entries of the write buffer.
+func (wb *WriteBufferIndex) Iterator() *Iterator {
+	return wb.newIterator(wb.hbt.Iterator(), nil, nil)
+}
+
+// RangeIterator returns a new iterator over the keys greater than or equal to start and strictly smaller than end.
+// A nil start or end leaves the range unbounded on that side.
+func (wb *WriteBufferIndex) RangeIterator(start, end []byte) *Iterator {
+	return wb.newIterator(wb.hbt.Iterator(), start, end)
+}
+
+// PrefixIterator returns a new iterator over the keys starting with the given prefix.
+// The hbtrie is only walked from the subtree owning the prefix.
+func (wb *WriteBufferIndex) PrefixIterator(prefix []byte) *Iterator {
+	return wb.newIterator(wb.hbt.PrefixIterator(prefix), prefix, successor(prefix))
+}
+
+// newIterator captures the pending entries of the hashtable within the given bounds.
+func (wb *WriteBufferIndex) newIterator(trie *hbtrie.Iterator, start, end []byte) *Iterator {
+	it := &Iterator{trie: trie, start: start, end: end}
+	pending := make([]pendingEntry, 0)
+	for keyString, entry := range wb.index {
+		key := []byte(keyString)
+		if it.inRange(key) {
+			pending = append(pending, pendingEntry{key: key, bufferEntry: entry})
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return bytes.Compare(pending[i].key, pending[j].key) < 0
+	})
+	it.pending = pending
+	return it
+}
+
+// successor returns the smallest key greater than all the keys starting with the given prefix.
+// It returns nil if there is no such key.
+func successor(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			end := make([]byte, i+1)
+			copy(end, prefix)
+			end[i]++
+			return end
+		}
+	}
+	return nil
+}
+
+// First positions the iterator on the smallest key.
+func (it *Iterator) First() bool {
+	if it.start != nil {
+		return it.Seek(it.start)
+	}
+	it.trie.First()
+	it.at = 0
+	return it.next()
+}
+
+// Last positions the iterator on the greatest key.
+func (it *Iterator) Last() bool {
+	if it.end != nil {
+		it.seekReverse(it.end)
+		return it.prev()
+	}
+	it.trie.Last()
+	it.at = len(it.pending) - 1
+	return it.prev()
+}
+
+// Seek positions the iterator on the smallest key greater than or equal to the given key.
+func (it *Iterator) Seek(key []byte) bool {
+	if it.start != nil && bytes.Compare(key, it.start) < 0 {
+		key = it.start
+	}
+	it.seek(key, true)
+	return it.next()
+}
+
+// Next moves the iterator to the next key. It returns false if there is none.
+func (it *Iterator) Next() bool {
+	if !it.valid {
+		return false
+	}
+	if it.forward {
+		it.skip(it.key)
+	} else {
+		it.seek(it.key, false)
+	}
+	return it.next()
+}
+
+// Prev moves the iterator to the previous key. It returns false if there is none.
+func (it *Iterator) Prev() bool {
+	if !it.valid {
+		return false
+	}
+	if !it.forward {
+		it.skip(it.key)
+	} else {
+		it.seekReverse(it.key)
+	}
+	return it.prev()
+}
+
+// Valid states whether the iterator is positioned on a key.
+func (it *Iterator) Valid() bool {
+	return it.valid
+}
+
+// Key returns the key the iterator is positioned on.
+func (it *Iterator) Key() []byte {
+	if !it.valid {
+		return nil
+	}
+	return it.key
+}
+
+// Value returns the value the iterator is positioned on.
+func (it *Iterator) Value() []byte {
+	if !it.valid {
+		return nil
+	}
+	return it.value
+}
+
+// Close releases the iterator and returns the first error encountered while iterating.
+func (it *Iterator) Close() error {
+	it.pending = nil
+	it.valid = false
+	return it.trie.Close()
+}
+
+// seek positions both sources on the smallest key greater than (or equal to if inclusive) the given key.
+func (it *Iterator) seek(key []byte, inclusive bool) {
+	if it.trie.Seek(key) && !inclusive && bytes.Equal(it.trie.Key(), key) {
+		it.trie.Next()
+	}
+	it.at = sort.Search(len(it.pending), func(i int) bool {
+		cmp := bytes.Compare(it.pending[i].key, key)
+		return cmp > 0 || (inclusive && cmp == 0)
+	})
+}
+
+// seekReverse positions both sources on the greatest key strictly smaller than the given key.
+func (it *Iterator) seekReverse(key []byte) {
+	if it.trie.Seek(key) {
+		it.trie.Prev()
+	} else {
+		it.trie.Last()
+	}
+	it.at = sort.Search(len(it.pending), func(i int) bool {
+		return bytes.Compare(it.pending[i].key, key) >= 0
+	}) - 1
+}
+
+// skip moves the sources positioned on the given key one step further in the current direction.
+func (it *Iterator) skip(key []byte) {
+	step := 1
+	if !it.forward {
+		step = -1
+	}
+	if it.trie.Valid() && bytes.Equal(it.trie.Key(), key) {
+		if it.forward {
+			it.trie.Next()
+		} else {
+			it.trie.Prev()
+		}
+	}
+	if it.at >= 0 && it.at < len(it.pending) && bytes.Equal(it.pending[it.at].key, key) {
+		it.at += step
+	}
+}
+
+// next settles the iterator on the smallest key of both sources that has not been deleted.
+func (it *Iterator) next() bool {
+	it.forward = true
+	for {
+		hasPending := it.at >= 0 && it.at < len(it.pending)
+		if !it.trie.Valid() && !hasPending {
+			it.valid = false
+			return false
+		}
+		// The write buffer shadows the hbtrie when both hold the same key.
+		if hasPending && (!it.trie.Valid() || bytes.Compare(it.pending[it.at].key, it.trie.Key()) <= 0) {
+			if it.settle(it.pending[it.at]) {
+				return true
+			}
+			continue
+		}
+		it.key, it.value, it.valid = it.trie.Key(), it.trie.Value(), true
+		return it.bounded()
+	}
+}
+
+// prev settles the iterator on the greatest key of both sources that has not been deleted.
+func (it *Iterator) prev() bool {
+	it.forward = false
+	for {
+		hasPending := it.at >= 0 && it.at < len(it.pending)
+		if !it.trie.Valid() && !hasPending {
+			it.valid = false
+			return false
+		}
+		// The write buffer shadows the hbtrie when both hold the same key.
+		if hasPending && (!it.trie.Valid() || bytes.Compare(it.pending[it.at].key, it.trie.Key()) >= 0) {
+			if it.settle(it.pending[it.at]) {
+				return true
+			}
+			continue
+		}
+		it.key, it.value, it.valid = it.trie.Key(), it.trie.Value(), true
+		return it.bounded()
+	}
+}
+
+// settle positions the iterator on the given pending entry.
+// If the entry is a tombstone, the sources are moved past it and false is returned.
+func (it *Iterator) settle(entry pendingEntry) bool {
+	if entry.deleted {
+		it.skip(entry.key)
+		return false
+	}
+	it.key, it.value, it.valid = entry.key, entry.value, true
+	return true
+}
+
+// inRange states whether the given key is within the bounds of the iterator.
+func (it *Iterator) inRange(key []byte) bool {
+	if it.start != nil && bytes.Compare(key, it.start) < 0 {
+		return false
+	}
+	if it.end != nil && bytes.Compare(key, it.end) >= 0 {
+		return false
+	}
+	return true
+}
+
+// bounded invalidates the iterator if its current key is outside of its bounds.
+func (it *Iterator) bounded() bool {
+	it.valid = it.inRange(it.key)
+	return it.valid
+}
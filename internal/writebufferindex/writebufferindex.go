@@ -1,46 +1,108 @@
 package writebufferindex
 
 import (
+	"errors"
 	"hbtrie/internal/hbtrie"
 	"hbtrie/internal/kverrors"
 )
 
+// bufferEntry is the value held in the hashtable. A deleted entry is a tombstone
+// that hides the key from the hbtrie until the next flush.
+type bufferEntry struct {
+	value   []byte
+	deleted bool
+}
+
 type WriteBufferIndex struct {
-	index map[string]uint64 // Hashtable
+	index map[string]bufferEntry // Hashtable
 	hbt   *hbtrie.HBTrieInstance
+	len   uint64 // number of keys of the hbtrie once the entries of the hashtable are applied to it
 }
 
 func NewWriteBufferIndex(hbt *hbtrie.HBTrieInstance) *WriteBufferIndex {
-	return &WriteBufferIndex{index: make(map[string]uint64), hbt: hbt}
+	return &WriteBufferIndex{index: make(map[string]bufferEntry), hbt: hbt, len: hbt.Len()}
 }
 
 // Inserts a key to the hashtable.
-func (wb *WriteBufferIndex) Insert(key []byte, value uint64) {
+// The entry is not recorded if the hbtrie cannot be read to tell whether it holds the key.
+func (wb *WriteBufferIndex) Insert(key []byte, value []byte) error {
+	found, err := wb.Contains(key)
+	if err != nil {
+		return err
+	}
+	if !found {
+		wb.len++
+	}
 	// Convert key from byte slice to string
-	wb.index[string(key)] = value
+	// The value is copied as the caller may reuse its buffer.
+	wb.index[string(key)] = bufferEntry{value: append([]byte{}, value...)}
+	return nil
+}
+
+// Records a tombstone for the given key in the hashtable.
+// The tombstone is not recorded if the hbtrie cannot be read to tell whether it holds the key.
+func (wb *WriteBufferIndex) Delete(key []byte) error {
+	found, err := wb.Contains(key)
+	if err != nil {
+		return err
+	}
+	if found {
+		wb.len--
+	}
+	wb.index[string(key)] = bufferEntry{deleted: true}
+	return nil
 }
 
-// Searches a key in the hashtable and returns the value
-func (wb *WriteBufferIndex) Search(key []byte) (uint64, error) {
+// Contains states whether the key is in the hashtable, or in the hbtrie unless the hashtable holds its tombstone.
+func (wb *WriteBufferIndex) Contains(key []byte) (bool, error) {
+	if entry, found := wb.index[string(key)]; found {
+		return !entry.deleted, nil
+	}
+	return wb.hbt.Contains(key)
+}
+
+// Searches a key in the hashtable and returns the value.
+// It returns a KeyDeletedError if the key has been deleted since the last flush.
+func (wb *WriteBufferIndex) Search(key []byte) ([]byte, error) {
 	// Search key in hashtable
-	if val, found := wb.index[string(key)]; found {
-		return val, nil
+	if entry, found := wb.index[string(key)]; found {
+		if entry.deleted {
+			return nil, &kverrors.KeyDeletedError{Key: key}
+		}
+		return append([]byte{}, entry.value...), nil
 	}
 
-	return 0, &kverrors.KeyNotFoundError{Key: key}
+	return nil, &kverrors.KeyNotFoundError{Key: key}
 }
 
-// Inserts all entries from hashtable to hbtrie. After a successfull insertion, the entry is removed from the hashtable.
+// Returns the number of keys of the hbtrie once the entries of the hashtable are applied to it.
+// It is kept up to date by Insert and Delete, which tell whether the hbtrie holds the key.
+func (wb *WriteBufferIndex) Len() uint64 {
+	return wb.len
+}
+
+// Inserts all entries from hashtable to hbtrie and removes the deleted ones from it.
+// After a successfull insertion or deletion, the entry is removed from the hashtable.
 func (wb *WriteBufferIndex) Flush() error {
 	var key []byte
+	var keyError *kverrors.KeyNotFoundError
 	errFlushFailed := &kverrors.PartialWriteError{Total: len(wb.index)}
 	success := 0
 	isWriteError := false
-	for keyString, value := range wb.index {
+	for keyString, entry := range wb.index {
 		// Convert key from string to byte slice again.
 		key = []byte(keyString)
-		err := wb.hbt.Insert(key, value)
-		// Insert has succeed
+		var err error
+		if entry.deleted {
+			err = wb.hbt.Delete(key)
+			// The key may have been inserted and deleted since the last flush.
+			if errors.As(err, &keyError) {
+				err = nil
+			}
+		} else {
+			err = wb.hbt.Insert(key, entry.value)
+		}
+		// Insert or delete has succeed
 		// Delete entry from hashmap
 		if err == nil {
 			success++
@@ -5,13 +5,19 @@ import (
 	"hbtrie/internal/hbtrie"
 	"hbtrie/internal/kverrors"
 	"hbtrie/internal/pool"
+	"hbtrie/internal/wal"
 	"hbtrie/internal/writebufferindex"
 	"os"
 	"path"
+	"sync"
 )
 
+// name of the write-ahead log in the data directory of the store
+const walFilename = "wal.log"
+
 type StoreManager interface {
-	// Creates or opens a store.
+	// Creates or opens a store. If a store has already been flushed in the
+	// given path, it is recovered from disk.
 	// Store will be nil in case of an error.
 	NewStore(*StoreOptions) (Store, error)
 }
@@ -20,6 +26,8 @@ type StoreManager interface {
 
 // Store is an interface for a key-value store and follows the
 // Create, Read, Update, Delete (CRUD) operations
+// Its methods are safe for concurrent use: concurrent writers share the syncs of the write-ahead log.
+// The writes of the same key by concurrent writers are applied in no particular order.
 type Store interface {
 
 	// Closes the store. Changes are commited to disk and file handles is closed.
@@ -28,87 +36,365 @@ type Store interface {
 	DeleteStore() (err error)
 
 	// Get returns the value for the given key.
-	Get(key []byte) (value uint64, err error)
+	Get(key []byte) (value []byte, err error)
 
 	// Set sets the value for the given key
 	// When error is nil outputs true in the case of a successful insertion
 	// and false in the case of an update
-	Put(key []byte, value uint64) (inserted bool, err error)
+	// The write is recorded in the write-ahead log before it is acknowledged.
+	Put(key []byte, value []byte) (inserted bool, err error)
+
+	// Delete removes the given key from the store.
+	// It returns a KeyNotFoundError if the key doesn't exist.
+	// The deletion is recorded in the write-ahead log before it is acknowledged.
+	Delete(key []byte) error
 
 	// Flushes the Write buffer index. Inserts all entries from write buffer to hbtrie
+	// It waits for the compaction running in the background, if any, to finish.
 	FlushWriteBuffer() error
 
 	// Flushes Write Buffer and then writes entries from hbtrie to disk.
+	// The write-ahead log is emptied once the trie has been written.
+	// It returns a SyncError if the trie cannot be synced to disk: the flushed writes are then not durable.
+	// Once the stale data reaches the share set by the compactionRatio option, it starts a compaction
+	// in the background, see Compact, whose error is returned by the next flush.
+	// It waits for the compaction running in the background, if any, to finish.
 	Flush() error
 
-	// Len returns the number of items in the store.
+	// Len returns the number of items in the store, including the writes that have not been flushed yet.
+	Len() uint64
+
+	// Iterator returns an iterator over the keys of the store in lexicographic order,
+	// including the ones that have not been flushed yet.
+	Iterator() Iterator
+
+	// Range returns an iterator over the keys greater than or equal to start and strictly smaller than end.
+	// A nil start or end leaves the range unbounded on that side.
+	Range(start, end []byte) Iterator
+
+	// Prefix returns an iterator over the keys starting with the given prefix.
+	Prefix(prefix []byte) Iterator
+
+	// Stats returns statistics on the keys and the pages of the store.
+	Stats() Stats
+
+	// Compact flushes the store, then copies the live pages and values to fresh files and swaps them in place of the
+	// files of the store, which stays open: the keys can be read and written as before, iterators are invalidated.
+	// The keys are read and written while the files are copied, the writes being held in the write buffer
+	// until the fresh files are swapped in. The flushes wait for the compaction to finish meanwhile.
+	// A crash during the compaction leaves either the former files or the compacted ones when the store is reopened.
+	Compact() (CompactionStats, error)
+
+	// Snapshot flushes the store and returns a read-only view of it, pinned to its state at this point
+	// while the store keeps being written. The snapshot shares the pages of the store rather than copying them,
+	// which requires the appendOnly option: it returns a SnapshotModeError otherwise.
+	// The store cannot be compacted until its snapshots are released.
+	// It waits for the compaction running in the background, if any, to finish.
+	Snapshot() (Snapshot, error)
+}
+
+// Snapshot is a read-only view of a store pinned to its state when it has been taken.
+// It has to be released with Release, before the store is closed.
+type Snapshot interface {
+	// Get returns the value for the given key when the snapshot has been taken.
+	Get(key []byte) (value []byte, err error)
+
+	// Len returns the number of items in the snapshot.
 	Len() uint64
+
+	// Iterator returns an iterator over the keys of the snapshot in lexicographic order.
+	Iterator() Iterator
+
+	// Range returns an iterator over the keys greater than or equal to start and strictly smaller than end.
+	// A nil start or end leaves the range unbounded on that side.
+	Range(start, end []byte) Iterator
+
+	// Prefix returns an iterator over the keys starting with the given prefix.
+	Prefix(prefix []byte) Iterator
+
+	// Release frees the snapshot and the files it holds open. Its iterators are invalidated.
+	Release() error
+}
+
+// Stats describes the content of a store and the pages holding it.
+type Stats struct {
+	// Number of keys flushed to the HB+ trie.
+	Keys uint64
+	// Number of B+ trees of the HB+ trie.
+	Trees uint64
+	// Number of pages allocated to the B+ trees, free pages included.
+	Pages uint64
+	// Number of pages released by the B+ trees, reused before new pages are allocated.
+	FreePages uint64
+}
+
+// CompactionStats describes the files rewritten by a compaction of the store.
+type CompactionStats struct {
+	// Number of pages of the B+ trees copied to the new files.
+	Pages uint64
+	// Number of values copied to the new value log.
+	Values uint64
+	// Byte size of the pages and the values on disk before and after the compaction.
+	Before uint64
+	After  uint64
+	// Number of bytes released by the compaction.
+	Reclaimed uint64
 }
 
+// Iterator walks the keys of a store in lexicographic order.
+// It has to be positioned with First, Last or Seek before use
+// and is invalidated by any subsequent flush of the store, or by the end of a compaction running meanwhile.
+// Unlike the store, it is not safe for concurrent use, nor to use concurrently with the writes of the store.
+type Iterator interface {
+	// First positions the iterator on the smallest key.
+	First() bool
+
+	// Last positions the iterator on the greatest key.
+	Last() bool
+
+	// Seek positions the iterator on the smallest key greater than or equal to the given key.
+	Seek(key []byte) bool
+
+	// Next moves the iterator to the next key. It returns false if there is none.
+	Next() bool
+
+	// Prev moves the iterator to the previous key. It returns false if there is none.
+	Prev() bool
+
+	// Valid states whether the iterator is positioned on a key.
+	Valid() bool
+
+	// Key returns the key the iterator is positioned on.
+	Key() []byte
+
+	// Value returns the value the iterator is positioned on.
+	Value() []byte
+
+	// Close releases the iterator and returns the first error encountered while iterating.
+	Close() error
+}
+
+// ReplacementPolicy chooses the pages evicted from the memory budget of the store.
+type ReplacementPolicy = pool.Policy
+
+const (
+	// LRU evicts the least recently used page.
+	LRU = pool.LRU
+	// CLOCK gives a second chance to the pages accessed since the hand of the clock last passed them.
+	CLOCK = pool.CLOCK
+	// TwoQ only keeps the pages accessed again after their first eviction, so that a scan does not flush the hot pages.
+	TwoQ = pool.TwoQ
+	// ARC balances recently and frequently used pages, adapting to the workload.
+	ARC = pool.ARC
+)
+
+// WALSyncMode tells when the writes recorded in the write-ahead log are synced to disk.
+type WALSyncMode = wal.SyncMode
+
+const (
+	// WALSyncAlways syncs every write before it is acknowledged.
+	WALSyncAlways = wal.SyncAlways
+	// WALSyncGroup syncs the writes by groups, each write being acknowledged once its group is synced.
+	WALSyncGroup = wal.SyncGroup
+	// WALSyncNone never syncs the log, the operating system writes it back on its own.
+	WALSyncNone = wal.SyncNone
+)
+
+// SyncPolicy tells when the files of the trie are synced to disk.
+type SyncPolicy = pool.SyncPolicy
+
+const (
+	// SyncOnFlush syncs the files on every flush, then the metadata, then the directory of the store.
+	SyncOnFlush = pool.SyncOnFlush
+	// SyncAlways also syncs the files after every write of pages or values.
+	SyncAlways = pool.SyncAlways
+	// SyncNone never syncs the files, the operating system writes them back on its own.
+	SyncNone = pool.SyncNone
+)
+
 // Options struct used to create a new store.
 type StoreOptions struct {
 	// file path of the store.
 	storePath string
-	// Configurable chunk size in bytes for HB+ trie
-	// Default 8 bytes
+	// Configurable chunk size in bytes for HB+ trie, up to 255 bytes.
+	// If not set, the chunk size of an existing store is used, or 16 bytes for a new one.
+	// Reopening a store with a different chunk size returns a ChunkSizeMismatchError.
 	chunkSize int
+	// Stores all the B+ trees of the HB+ trie in one file instead of one file per tree.
+	// An existing store written with one file per tree is migrated when it is reopened with this option.
+	singleFile bool
+	// Memory in bytes held by the bufferpool for the pages of all the B+ trees.
+	// If not set, 32 MB are shared by the trees.
+	memoryBudget uint64
+	// Replacement policy choosing the pages evicted from the memory budget: LRU, CLOCK, 2Q or ARC.
+	// If not set, the least recently used pages are evicted first.
+	replacementPolicy ReplacementPolicy
+	// Tells when the writes recorded in the write-ahead log are synced to disk: on every write,
+	// by groups of writes or never. If not set, every write is synced before it is acknowledged.
+	// A write of a group is acknowledged once the group is synced.
+	walSyncMode WALSyncMode
+	// Tells when the files of the trie are synced to disk: on every flush, after every write or never.
+	// If not set, a flush syncs the files, then the metadata, then the directory of the store.
+	// The write-ahead log is synced according to walSyncMode.
+	syncPolicy SyncPolicy
+	// Writes the modified nodes of the B+ trees to new pages, up to their root, rather than in place:
+	// the last flushed version of the trie is never overwritten. A store written in this mode keeps it when reopened.
+	appendOnly bool
+	// Overwrites the pages of the last flushed version of the trie in place rather than staging them in a journal
+	// first, so that they are written once. A crash during a flush may then tear them, or leave a mix of both versions.
+	// The journal is never used with the SyncNone policy.
+	disableJournal bool
+	// Compacts the store in the background after a flush once the pages and the values no longer referenced,
+	// the stale data, reach this share of the bytes on disk, between 0 and 1. If not set, the store is only
+	// compacted by Compact. The store is not compacted while snapshots are pinned to its files.
+	compactionRatio float64
 }
 
 type HBTrieStore struct {
-	storePath   string
-	chunkSize   int
-	pool        *pool.Bufferpool
-	hbtrie      *hbtrie.HBTrieInstance
-	writeBuffer *writebufferindex.WriteBufferIndex
+	storePath       string
+	chunkSize       int
+	pool            *pool.Bufferpool
+	hbtrie          *hbtrie.HBTrieInstance
+	writeBuffer     *writebufferindex.WriteBufferIndex
+	wal             *wal.Log
+	compactionRatio float64    // share of stale data triggering a compaction on flush, zero if disabled
+	mu              sync.Mutex // guards the write buffer and the trie
+	// Held for reading by a write from its record in the log until it is in the write buffer,
+	// and for writing by a flush, which empties the log.
+	logged sync.RWMutex
+	// Compaction copying the files in the background, nil if none. The trie is not written until it is finished.
+	compaction *compaction
+	// Error of the last compaction started by a flush, returned by the next one.
+	compactionErr error
+}
+
+// compaction is a compaction of the files of the store running in the background, see startCompaction.
+type compaction struct {
+	done  chan struct{} // closed once the fresh files are swapped in, or abandoned
+	stats CompactionStats
+	err   error
 }
 
 const (
+	// default memory budget of the bufferpool, in pages of 4KB
 	bufferpoolSize = 8000
 )
 
 func NewStore(options *StoreOptions) (Store, error) {
-	// Chunk size is not set, then default 8 bytes
-	if options.chunkSize == 0 {
-		options.chunkSize = 16
-	}
-
 	if len(options.storePath) == 0 {
 		options.storePath = path.Join(os.TempDir(), "hb_store")
 	}
+	if options.compactionRatio < 0 || options.compactionRatio > 1 {
+		return nil, &kverrors.OutsideOfRangeError{From: 0, To: 1, Actual: options.compactionRatio}
+	}
+
+	budget := uint64(bufferpoolSize)
+	if options.memoryBudget != 0 {
+		budget = options.memoryBudget / pool.PageSize
+	}
 
-	p, err := pool.NewBufferpool(uint64(bufferpoolSize), options.storePath)
+	p, err := pool.NewBufferpoolWithOptions(options.storePath, &pool.Options{
+		Budget:         budget,
+		ChunkSize:      options.chunkSize,
+		SingleFile:     options.singleFile,
+		Policy:         options.replacementPolicy,
+		Sync:           options.syncPolicy,
+		DisableJournal: options.disableJournal,
+		AppendOnly:     options.appendOnly,
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	hbt := hbtrie.NewHBPlusTrie(p)
+	// Recover the trie if it has already been written in the store path.
+	exists, err := p.HasTrie()
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+
+	var hbt *hbtrie.HBTrieInstance
+	if exists {
+		hbt, err = hbtrie.Read(p)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+	} else {
+		hbt = hbtrie.NewHBPlusTrie(p)
+	}
+
 	wb := writebufferindex.NewWriteBufferIndex(hbt)
 
+	// The writes acknowledged since the last flush are replayed into the write buffer.
+	log, err := wal.Open(path.Join(p.DataPath(), walFilename), &wal.Options{Sync: options.walSyncMode})
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	err = log.Replay(func(op wal.Op, key, value []byte) error {
+		if op == wal.OpDelete {
+			return wb.Delete(key)
+		}
+		return wb.Insert(key, value)
+	})
+	if err != nil {
+		log.Close()
+		p.Close()
+		return nil, err
+	}
+
 	return &HBTrieStore{
-		storePath:   options.storePath,
-		chunkSize:   options.chunkSize,
-		pool:        p,
-		hbtrie:      hbt,
-		writeBuffer: wb,
+		storePath:       options.storePath,
+		chunkSize:       p.ChunkSize(),
+		pool:            p,
+		hbtrie:          hbt,
+		writeBuffer:     wb,
+		wal:             log,
+		compactionRatio: options.compactionRatio,
 	}, nil
 }
 
 func (s *HBTrieStore) Close() error {
-	return s.pool.Close()
+	s.lock()
+	defer s.unlock()
+	err := s.flush()
+	if err != nil {
+		return err
+	}
+	err = s.wal.Close()
+	if err != nil {
+		return err
+	}
+	err = s.pool.Close()
+	if err != nil {
+		return err
+	}
+	return s.compactionErr
 }
 
 func (s *HBTrieStore) DeleteStore() error {
+	s.lockTrie()
+	defer s.mu.Unlock()
 	return s.pool.Clean()
 }
 
-func (s *HBTrieStore) Get(key []byte) (value uint64, err error) {
+func (s *HBTrieStore) Get(key []byte) (value []byte, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	var keyError *kverrors.KeyNotFoundError
+	var deletedError *kverrors.KeyDeletedError
 	val, err := s.writeBuffer.Search(key)
 	// If key has been found in write buffer index, then return val
 	if err == nil {
 		return val, nil
 	}
 
+	// If key has been deleted since the last flush, it must not be revived from the hbtrie
+	if errors.As(err, &deletedError) {
+		return nil, &kverrors.KeyNotFoundError{Key: key}
+	}
+
 	// If key has not been found, then search in hbtrie
 	if errors.As(err, &keyError) {
 		val, err = s.hbtrie.Search(key)
@@ -116,30 +402,256 @@ func (s *HBTrieStore) Get(key []byte) (value uint64, err error) {
 	}
 
 	// if writebuffer returned an unknown error, then throw error
-	return 0, err
+	return nil, err
 }
 
-func (s *HBTrieStore) Put(key []byte, value uint64) (inserted bool, err error) {
+func (s *HBTrieStore) Put(key []byte, value []byte) (inserted bool, err error) {
+	// The log is not emptied by a flush until the write is applied to the write buffer.
+	s.logged.RLock()
+	defer s.logged.RUnlock()
+	// The write buffer is only locked once the write is logged, so that concurrent writers share the syncs of the log.
+	err = s.wal.Put(key, value)
+	if err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	// Insert entry to write buffer only
-	s.writeBuffer.Insert(key, value)
+	err = s.writeBuffer.Insert(key, value)
+	if err != nil {
+		return false, err
+	}
 
 	return true, nil
 }
 
+func (s *HBTrieStore) Delete(key []byte) error {
+	s.logged.RLock()
+	defer s.logged.RUnlock()
+	// Make sure the key exists either in the write buffer or in the hbtrie, without reading its value
+	s.mu.Lock()
+	found, err := s.writeBuffer.Contains(key)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if !found {
+		return &kverrors.KeyNotFoundError{Key: key}
+	}
+
+	err = s.wal.Delete(key)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Record a tombstone in the write buffer only
+	return s.writeBuffer.Delete(key)
+}
+
 func (s *HBTrieStore) FlushWriteBuffer() error {
+	s.lockTrie()
+	defer s.mu.Unlock()
 	return s.writeBuffer.Flush()
 }
 
 func (s *HBTrieStore) Flush() error {
-	err := s.FlushWriteBuffer()
+	s.lock()
+	defer s.unlock()
+	err := s.flush()
+	if err != nil {
+		return err
+	}
+	err, s.compactionErr = s.compactionErr, nil
+	if err != nil {
+		return err
+	}
+	// The files are not compacted while snapshots are pinned to them.
+	if s.compactionRatio == 0 || s.pool.Snapshots() > 0 || s.pool.StaleRatio() < s.compactionRatio {
+		return nil
+	}
+	_, err = s.startCompaction(true)
+	return err
+}
+
+// lockTrie locks the write buffer and the trie once no compaction is running, so that the trie can be written.
+func (s *HBTrieStore) lockTrie() {
+	s.mu.Lock()
+	for s.compaction != nil {
+		done := s.compaction.done
+		s.mu.Unlock()
+		<-done
+		s.mu.Lock()
+	}
+}
+
+// lock takes both locks once no compaction is running. The log is only locked once the compaction is finished,
+// so that the writes are not blocked meanwhile.
+func (s *HBTrieStore) lock() {
+	for {
+		s.lockTrie()
+		s.mu.Unlock()
+		s.logged.Lock()
+		s.mu.Lock()
+		// A flush may have started another compaction in between.
+		if s.compaction == nil {
+			return
+		}
+		s.mu.Unlock()
+		s.logged.Unlock()
+	}
+}
+
+// unlock releases both locks taken by lock.
+func (s *HBTrieStore) unlock() {
+	s.mu.Unlock()
+	s.logged.Unlock()
+}
+
+// flush writes the write buffer and the trie to disk, then empties the log. Both locks have to be held.
+func (s *HBTrieStore) flush() error {
+	err := s.writeBuffer.Flush()
 	if err != nil {
 		return err
 	}
 	err = s.hbtrie.Write()
+	if err != nil {
+		return err
+	}
 
-	return err
+	// The writes of the log are now held by the trie.
+	return s.wal.Reset()
+}
+
+func (s *HBTrieStore) Compact() (CompactionStats, error) {
+	s.lock()
+	err := s.flush()
+	var c *compaction
+	if err == nil {
+		c, err = s.startCompaction(false)
+	}
+	s.unlock()
+	if err != nil {
+		return CompactionStats{}, err
+	}
+	<-c.done
+	return c.stats, c.err
+}
+
+// startCompaction starts a compaction of the flushed trie. The files are copied in the background while the store
+// is read and written, then swapped in under the lock. The error of a compaction started by a flush, which nobody
+// waits for, is left to the next flush. Both locks have to be held.
+func (s *HBTrieStore) startCompaction(flushed bool) (*compaction, error) {
+	pc, err := s.hbtrie.StartCompaction()
+	if err != nil {
+		return nil, err
+	}
+	c := &compaction{done: make(chan struct{})}
+	s.compaction = c
+	go func() {
+		// The error of the copy is returned by FinishCompaction.
+		pc.Copy()
+		s.mu.Lock()
+		stats, err := s.hbtrie.FinishCompaction(pc)
+		c.stats = CompactionStats{
+			Pages:     stats.Pages,
+			Values:    stats.Values,
+			Before:    stats.Before,
+			After:     stats.After,
+			Reclaimed: stats.Reclaimed,
+		}
+		c.err = err
+		if flushed && err != nil {
+			s.compactionErr = err
+		}
+		s.compaction = nil
+		s.mu.Unlock()
+		close(c.done)
+	}()
+	return c, nil
 }
 
 func (s *HBTrieStore) Len() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writeBuffer.Len()
+}
+
+func (s *HBTrieStore) Iterator() Iterator {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writeBuffer.Iterator()
+}
+
+func (s *HBTrieStore) Range(start, end []byte) Iterator {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writeBuffer.RangeIterator(start, end)
+}
+
+func (s *HBTrieStore) Prefix(prefix []byte) Iterator {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writeBuffer.PrefixIterator(prefix)
+}
+
+func (s *HBTrieStore) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := s.pool.Stats()
+	return Stats{Keys: s.hbtrie.Len(), Trees: stats.Frames, Pages: stats.Pages, FreePages: stats.FreePages}
+}
+
+func (s *HBTrieStore) Snapshot() (Snapshot, error) {
+	s.lock()
+	defer s.unlock()
+	if !s.pool.AppendOnly() {
+		return nil, &kverrors.SnapshotModeError{}
+	}
+	err := s.flush()
+	if err != nil {
+		return nil, err
+	}
+	p, err := s.pool.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	hbt, err := hbtrie.Read(p)
+	if err != nil {
+		p.Release()
+		return nil, err
+	}
+	// The snapshot is read through an empty write buffer, which bounds its iterators.
+	return &HBTrieSnapshot{pool: p, hbtrie: hbt, index: writebufferindex.NewWriteBufferIndex(hbt)}, nil
+}
+
+// HBTrieSnapshot is a snapshot of a HBTrieStore, read from a bufferpool pinned to the files of the store.
+type HBTrieSnapshot struct {
+	pool   *pool.Bufferpool
+	hbtrie *hbtrie.HBTrieInstance
+	index  *writebufferindex.WriteBufferIndex
+}
+
+func (s *HBTrieSnapshot) Get(key []byte) ([]byte, error) {
+	return s.hbtrie.Search(key)
+}
+
+func (s *HBTrieSnapshot) Len() uint64 {
 	return s.hbtrie.Len()
 }
+
+func (s *HBTrieSnapshot) Iterator() Iterator {
+	return s.index.Iterator()
+}
+
+func (s *HBTrieSnapshot) Range(start, end []byte) Iterator {
+	return s.index.RangeIterator(start, end)
+}
+
+func (s *HBTrieSnapshot) Prefix(prefix []byte) Iterator {
+	return s.index.PrefixIterator(prefix)
+}
+
+func (s *HBTrieSnapshot) Release() error {
+	return s.pool.Release()
+}
@@ -1,16 +1,26 @@
 package store
 
 import (
+	"bytes"
 	"crypto/sha512"
+	"errors"
+	"fmt"
+	"hbtrie/internal/kverrors"
+	"hbtrie/internal/pool"
 	"math/rand"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 var (
 	store         Store
-	values        map[[256]byte]uint64
+	values        map[[256]byte][]byte
 	testStorePath = path.Join(os.TempDir(), "hb_store_test")
 )
 
@@ -29,13 +39,21 @@ func RandStringBytes(n int) []byte {
 	return b
 }
 
+// Random value generator
+// Returns a byte slice of random size containing random bytes.
+func RandValue() []byte {
+	b := make([]byte, rand.Intn(256))
+	rand.Read(b)
+	return b
+}
+
 func TestInit(t *testing.T) {
 	var err error
 	store, err = NewStore(&StoreOptions{storePath: testStorePath, chunkSize: 8})
 	if err != nil {
 		t.Fatalf("Cannot initialize store. Got %v", err)
 	}
-	values = make(map[[256]byte]uint64)
+	values = make(map[[256]byte][]byte)
 
 	h := sha512.New()
 
@@ -43,7 +61,7 @@ func TestInit(t *testing.T) {
 		h.Write([]byte{byte(i)})
 		key := [256]byte{}
 		copy(key[:], h.Sum(nil)[:])
-		value := rand.Uint64()
+		value := RandValue()
 		values[key] = value
 	}
 
@@ -75,7 +93,7 @@ func TestInitWithoutPath(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Cannot initialize store. Got %v", err)
 	}
-	values = make(map[[256]byte]uint64)
+	values = make(map[[256]byte][]byte)
 
 	h := sha512.New()
 
@@ -89,7 +107,7 @@ func TestInitWithoutPath(t *testing.T) {
 		copy(key[128:160], h.Sum(nil)[:])
 		copy(key[160:192], h.Sum(nil)[:])
 		copy(key[192:], h.Sum(nil)[:])
-		value := rand.Uint64()
+		value := RandValue()
 		values[key] = value
 	}
 
@@ -108,7 +126,7 @@ func TestInitWithoutChunkSize(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Cannot initialize store. Got %v", err)
 	}
-	values = make(map[[256]byte]uint64)
+	values = make(map[[256]byte][]byte)
 
 	h := sha512.New()
 
@@ -123,7 +141,7 @@ func TestInitWithoutChunkSize(t *testing.T) {
 		copy(key[160:192], h.Sum(nil)[:])
 		copy(key[192:], h.Sum(nil)[:])
 
-		value := rand.Uint64()
+		value := RandValue()
 		values[key] = value
 	}
 
@@ -141,7 +159,7 @@ func TestInitWithDefault(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Cannot initialize store. Got %v", err)
 	}
-	values = make(map[[256]byte]uint64)
+	values = make(map[[256]byte][]byte)
 
 	h := sha512.New()
 
@@ -155,7 +173,7 @@ func TestInitWithDefault(t *testing.T) {
 		copy(key[128:160], h.Sum(nil)[:])
 		copy(key[160:192], h.Sum(nil)[:])
 		copy(key[192:], h.Sum(nil)[:])
-		value := rand.Uint64()
+		value := RandValue()
 		values[key] = value
 	}
 
@@ -188,7 +206,7 @@ func TestGet(t *testing.T) {
 			t.Fatalf("Cannot get a value from store: %v", err)
 		}
 
-		if v != actual {
+		if !bytes.Equal(v, actual) {
 			t.Fatalf("expected %v, got %v\n", v, actual)
 		}
 	}
@@ -216,7 +234,7 @@ func TestGetAfterFlush(t *testing.T) {
 			t.Fatalf("Cannot get a value from store: %v", err)
 		}
 
-		if v != actual {
+		if !bytes.Equal(v, actual) {
 			t.Fatalf("expected %v, got %v\n", v, actual)
 		}
 	}
@@ -229,8 +247,8 @@ func TestUpdate(t *testing.T) {
 	}
 
 	for k, v := range values {
-		r := rand.Uint64()
-		if r != v {
+		r := RandValue()
+		if !bytes.Equal(r, v) {
 			success, err := store.Put(k[:], r)
 
 			if err != nil {
@@ -261,7 +279,7 @@ func TestInsert2Bytes(t *testing.T) {
 		t.Fatalf("Cannot initialize store. Got %v", err)
 	}
 
-	values = make(map[[256]byte]uint64)
+	values = make(map[[256]byte][]byte)
 
 	h := sha512.New()
 
@@ -269,14 +287,15 @@ func TestInsert2Bytes(t *testing.T) {
 		h.Write([]byte{byte(i)})
 		key := [256]byte{}
 		copy(key[:], h.Sum(nil)[:2])
-		value := rand.Uint64()
+		value := RandValue()
 		values[key] = value
 	}
 
+	// Keys are made of one chunk of 2 bytes.
 	for k, v := range values {
-		success, err := store.Put(k[:], v)
+		success, err := store.Put(k[:2], v)
 		if err != nil || !success {
-			t.Errorf("while inserting to kv store(%d): %v", k, err)
+			t.Errorf("while inserting to kv store(%d): %v", k[:2], err)
 			t.FailNow()
 		}
 	}
@@ -304,3 +323,1824 @@ func TestInsert2Bytes(t *testing.T) {
 		t.Fatalf("Cannot close the store: Error %v", err)
 	}
 }
+
+func TestReopen(t *testing.T) {
+	storePath := path.Join(os.TempDir(), "testing_reopen_hb_store")
+	store, err := NewStore(&StoreOptions{storePath: storePath})
+	if err != nil {
+		t.Fatalf("Cannot initialize store. Got %v", err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(storePath)
+	})
+
+	values = make(map[[256]byte][]byte)
+
+	h := sha512.New()
+
+	for i := 0; i < size; i++ {
+		h.Write([]byte{byte(i)})
+		key := [256]byte{}
+		copy(key[:64], h.Sum(nil)[:])
+		copy(key[64:128], h.Sum(nil)[:])
+		value := RandValue()
+		values[key] = value
+	}
+
+	for k, v := range values {
+		success, err := store.Put(k[:], v)
+		if err != nil || !success {
+			t.Fatalf("while inserting to kv store(%d): %v", k, err)
+		}
+	}
+
+	err = store.Close()
+	if err != nil {
+		t.Fatalf("Cannot close the store: %v", err)
+	}
+
+	store, err = NewStore(&StoreOptions{storePath: storePath})
+	if err != nil {
+		t.Fatalf("Cannot reopen the store. Got %v", err)
+	}
+
+	expected := len(values)
+	actual := int(store.Len())
+
+	if expected != actual {
+		t.Fatalf("expected %d, got %d", expected, actual)
+	}
+
+	for k, v := range values {
+		actual, err := store.Get(k[:])
+		if err != nil {
+			t.Fatalf("Cannot get a value from store: %v", err)
+		}
+
+		if !bytes.Equal(v, actual) {
+			t.Fatalf("expected %v, got %v\n", v, actual)
+		}
+	}
+
+	err = store.Close()
+	if err != nil {
+		t.Fatalf("Cannot close the store: %v", err)
+	}
+}
+
+func TestChunkSize(t *testing.T) {
+	for _, chunkSize := range []int{4, 8, 32, pool.MaxChunkSize} {
+		storePath := path.Join(os.TempDir(), fmt.Sprintf("testing_chunk_%d_hb_store", chunkSize))
+		t.Cleanup(func() {
+			os.RemoveAll(storePath)
+		})
+
+		store, err := NewStore(&StoreOptions{storePath: storePath, chunkSize: chunkSize})
+		if err != nil {
+			t.Fatalf("Cannot initialize store. Got %v", err)
+		}
+
+		// The nodes of the greatest chunk size hold few entries, the B+ tree grows past 3 levels.
+		entries := make(map[string][]byte)
+		for i := 0; i < 3000; i++ {
+			entries[string(RandStringBytes(40))] = RandValue()
+		}
+		for k, v := range entries {
+			_, err := store.Put([]byte(k), v)
+			if err != nil {
+				t.Fatalf("[chunk size %d] while inserting to kv store(%s): %v", chunkSize, k, err)
+			}
+		}
+		err = store.Close()
+		if err != nil {
+			t.Fatalf("Cannot close the store: %v", err)
+		}
+
+		// The chunk size of the stored trie is used when none is given.
+		store, err = NewStore(&StoreOptions{storePath: storePath})
+		if err != nil {
+			t.Fatalf("Cannot reopen the store. Got %v", err)
+		}
+		if actual := store.(*HBTrieStore).chunkSize; actual != chunkSize {
+			t.Fatalf("expected chunk size %d, got %d", chunkSize, actual)
+		}
+		for k, v := range entries {
+			actual, err := store.Get([]byte(k))
+			if err != nil {
+				t.Fatalf("[chunk size %d] Cannot get a value from store: %v", chunkSize, err)
+			}
+			if !bytes.Equal(v, actual) {
+				t.Fatalf("[chunk size %d] expected %v, got %v", chunkSize, v, actual)
+			}
+		}
+		err = store.Close()
+		if err != nil {
+			t.Fatalf("Cannot close the store: %v", err)
+		}
+
+		// A different chunk size is rejected.
+		var mismatch *kverrors.ChunkSizeMismatchError
+		_, err = NewStore(&StoreOptions{storePath: storePath, chunkSize: chunkSize / 2})
+		if !errors.As(err, &mismatch) {
+			t.Fatalf("expected a chunk size mismatch error, got %v", err)
+		}
+	}
+}
+
+func TestReopenInconsistent(t *testing.T) {
+	storePath := path.Join(os.TempDir(), "testing_inconsistent_hb_store")
+	t.Cleanup(func() {
+		os.RemoveAll(storePath)
+	})
+
+	store, err := NewStore(&StoreOptions{storePath: storePath})
+	if err != nil {
+		t.Fatalf("Cannot initialize store. Got %v", err)
+	}
+	// Two keys sharing their first chunks lead to subtrees.
+	prefix := RandStringBytes(32)
+	for i := 0; i < 2; i++ {
+		_, err = store.Put(append(prefix[:32:32], RandStringBytes(32)...), RandValue())
+		if err != nil {
+			t.Fatalf("while inserting to kv store: %v", err)
+		}
+	}
+	err = store.Close()
+	if err != nil {
+		t.Fatalf("Cannot close the store: %v", err)
+	}
+
+	// Remove one of the subtrees referenced by the metadata.
+	err = os.Remove(path.Join(storePath, "hbdata", "frame_2.db"))
+	if err != nil {
+		t.Fatalf("Cannot remove frame file: %v", err)
+	}
+
+	var inconsistent *kverrors.InconsistentStoreError
+	_, err = NewStore(&StoreOptions{storePath: storePath})
+	if !errors.As(err, &inconsistent) {
+		t.Fatalf("expected an inconsistent store error, got %v", err)
+	}
+
+	// Truncate the metadata file.
+	err = os.Truncate(path.Join(storePath, "hbdata", "hb_meta.dbm"), 10)
+	if err != nil {
+		t.Fatalf("Cannot truncate metadata file: %v", err)
+	}
+
+	_, err = NewStore(&StoreOptions{storePath: storePath})
+	if !errors.As(err, &inconsistent) {
+		t.Fatalf("expected an inconsistent store error, got %v", err)
+	}
+
+	// Remove the metadata file, the frame files are not taken for a new store.
+	err = os.Remove(path.Join(storePath, "hbdata", "hb_meta.dbm"))
+	if err != nil {
+		t.Fatalf("Cannot remove metadata file: %v", err)
+	}
+
+	_, err = NewStore(&StoreOptions{storePath: storePath})
+	if !errors.As(err, &inconsistent) {
+		t.Fatalf("expected an inconsistent store error, got %v", err)
+	}
+	if _, err := os.Stat(path.Join(storePath, "hbdata", "hb_meta.dbm")); !os.IsNotExist(err) {
+		t.Fatalf("expected no metadata file to be created, got %v", err)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	storePath := path.Join(os.TempDir(), "testing_delete_hb_store")
+	store, err := NewStore(&StoreOptions{storePath: storePath})
+	if err != nil {
+		t.Fatalf("Cannot initialize store. Got %v", err)
+	}
+	t.Cleanup(func() {
+		store.Close()
+		store.DeleteStore()
+	})
+
+	values = make(map[[256]byte][]byte)
+
+	h := sha512.New()
+
+	for i := 0; i < size; i++ {
+		h.Write([]byte{byte(i)})
+		key := [256]byte{}
+		copy(key[:], h.Sum(nil)[:])
+		value := RandValue()
+		values[key] = value
+	}
+
+	for k, v := range values {
+		success, err := store.Put(k[:], v)
+		if err != nil || !success {
+			t.Fatalf("while inserting to kv store(%d): %v", k, err)
+		}
+	}
+
+	if int(store.Len()) != len(values) {
+		t.Fatalf("expected %d keys before the flush, got %d", len(values), store.Len())
+	}
+
+	keys := make([][256]byte, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+
+	// Half of the keys are deleted before the flush, the other half after.
+	deleted := make(map[[256]byte]bool)
+	for step, k := range keys {
+		if step%4 == 0 {
+			err := store.Delete(k[:])
+			if err != nil {
+				t.Fatalf("while deleting from kv store(%d): %v", k, err)
+			}
+			deleted[k] = true
+		}
+	}
+
+	err = store.FlushWriteBuffer()
+	if err != nil {
+		t.Fatalf("while flushing kv store: %v", err)
+	}
+
+	for step, k := range keys {
+		if step%4 == 1 {
+			err := store.Delete(k[:])
+			if err != nil {
+				t.Fatalf("while deleting from kv store(%d): %v", k, err)
+			}
+			deleted[k] = true
+		}
+	}
+
+	var keyError *kverrors.KeyNotFoundError
+	for k, v := range values {
+		actual, err := store.Get(k[:])
+		if deleted[k] {
+			if !errors.As(err, &keyError) {
+				t.Fatalf("expected key %v to be deleted, got %v", k, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Cannot get a value from store: %v", err)
+		}
+		if !bytes.Equal(v, actual) {
+			t.Fatalf("expected %v, got %v\n", v, actual)
+		}
+	}
+
+	err = store.Delete(RandStringBytes(32))
+	if !errors.As(err, &keyError) {
+		t.Fatalf("expected a key not found error, got %v", err)
+	}
+
+	// The pending deletions are counted before they are flushed.
+	expected := len(values) - len(deleted)
+	actual := int(store.Len())
+	if expected != actual {
+		t.Fatalf("expected %d before the flush, got %d", expected, actual)
+	}
+
+	err = store.Flush()
+	if err != nil {
+		t.Fatalf("while flushing kv store: %v", err)
+	}
+
+	actual = int(store.Len())
+	if expected != actual {
+		t.Fatalf("expected %d, got %d", expected, actual)
+	}
+
+	for k := range deleted {
+		_, err := store.Get(k[:])
+		if !errors.As(err, &keyError) {
+			t.Fatalf("expected key %v to be deleted, got %v", k, err)
+		}
+	}
+
+	// Updating a flushed key leaves the count unchanged, reinserting a deleted one counts it again.
+	for k := range deleted {
+		_, err := store.Put(k[:], values[k])
+		if err != nil {
+			t.Fatalf("while reinserting to kv store(%d): %v", k, err)
+		}
+		break
+	}
+	_, err = store.Put(keys[2][:], RandValue())
+	if err != nil {
+		t.Fatalf("while updating kv store(%d): %v", keys[2], err)
+	}
+	if actual = int(store.Len()); actual != expected+1 {
+		t.Fatalf("expected %d after the updates, got %d", expected+1, actual)
+	}
+}
+
+func TestIterator(t *testing.T) {
+	storePath := path.Join(os.TempDir(), "testing_iterator_hb_store")
+	store, err := NewStore(&StoreOptions{storePath: storePath})
+	if err != nil {
+		t.Fatalf("Cannot initialize store. Got %v", err)
+	}
+	t.Cleanup(func() {
+		store.Close()
+		store.DeleteStore()
+	})
+
+	expected := make(map[string][]byte)
+	keys := make([][]byte, 0, size)
+	for i := 0; i < size; i++ {
+		key := RandStringBytes(32)
+		value := RandValue()
+		_, err := store.Put(key, value)
+		if err != nil {
+			t.Fatalf("while inserting to kv store(%d): %v", key, err)
+		}
+		keys = append(keys, key)
+		expected[string(key)] = value
+	}
+
+	err = store.FlushWriteBuffer()
+	if err != nil {
+		t.Fatalf("while flushing kv store: %v", err)
+	}
+
+	// Pending updates, insertions and deletions have to be merged with the flushed keys.
+	for i, key := range keys {
+		switch i % 4 {
+		case 0:
+			value := RandValue()
+			store.Put(key, value)
+			expected[string(key)] = value
+		case 1:
+			err := store.Delete(key)
+			if err != nil {
+				t.Fatalf("while deleting from kv store(%d): %v", key, err)
+			}
+			delete(expected, string(key))
+		case 2:
+			key := RandStringBytes(32)
+			value := RandValue()
+			store.Put(key, value)
+			expected[string(key)] = value
+		}
+	}
+
+	sorted := make([]string, 0, len(expected))
+	for key := range expected {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	it := store.Iterator()
+	step := 0
+	for ok := it.First(); ok; ok = it.Next() {
+		if string(it.Key()) != sorted[step] {
+			t.Fatalf("[step %d] expected %s, got %s", step, sorted[step], it.Key())
+		}
+		if !bytes.Equal(it.Value(), expected[sorted[step]]) {
+			t.Fatalf("[step %d] expected %v, got %v", step, expected[sorted[step]], it.Value())
+		}
+		step++
+	}
+	if step != len(sorted) {
+		t.Fatalf("expected %d keys, got %d", len(sorted), step)
+	}
+
+	step = len(sorted) - 1
+	for ok := it.Last(); ok; ok = it.Prev() {
+		if string(it.Key()) != sorted[step] {
+			t.Fatalf("[step %d] expected %s, got %s", step, sorted[step], it.Key())
+		}
+		step--
+	}
+	if step != -1 {
+		t.Fatalf("expected %d keys, got %d", len(sorted), len(sorted)-1-step)
+	}
+
+	// Changing direction in the middle of the iteration
+	at := len(sorted) / 2
+	if !it.Seek([]byte(sorted[at])) || string(it.Key()) != sorted[at] {
+		t.Fatalf("expected %s, got %s", sorted[at], it.Key())
+	}
+	if !it.Next() || string(it.Key()) != sorted[at+1] {
+		t.Fatalf("expected %s, got %s", sorted[at+1], it.Key())
+	}
+	if !it.Prev() || !it.Prev() || string(it.Key()) != sorted[at-1] {
+		t.Fatalf("expected %s, got %s", sorted[at-1], it.Key())
+	}
+
+	err = it.Close()
+	if err != nil {
+		t.Fatalf("while closing iterator: %v", err)
+	}
+}
+
+func TestRangeAndPrefix(t *testing.T) {
+	storePath := path.Join(os.TempDir(), "testing_range_hb_store")
+	store, err := NewStore(&StoreOptions{storePath: storePath})
+	if err != nil {
+		t.Fatalf("Cannot initialize store. Got %v", err)
+	}
+	t.Cleanup(func() {
+		store.Close()
+		store.DeleteStore()
+	})
+
+	// Create 5 tenants sharing a 16 bytes prefix
+	tenants := make([][]byte, 0, 5)
+	for i := 0; i < 5; i++ {
+		tenants = append(tenants, RandStringBytes(16))
+	}
+
+	expected := make(map[string][]byte)
+	for i := 0; i < size; i++ {
+		key := append(append([]byte{}, tenants[rand.Intn(len(tenants))]...), RandStringBytes(16)...)
+		value := RandValue()
+		store.Put(key, value)
+		expected[string(key)] = value
+		// Half of the keys are flushed, the others remain in the write buffer.
+		if i == size/2 {
+			err = store.FlushWriteBuffer()
+			if err != nil {
+				t.Fatalf("while flushing kv store: %v", err)
+			}
+		}
+	}
+
+	sorted := make([]string, 0, len(expected))
+	for key := range expected {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	check := func(it Iterator, match func(key string) bool) {
+		matching := make([]string, 0)
+		for _, key := range sorted {
+			if match(key) {
+				matching = append(matching, key)
+			}
+		}
+		step := 0
+		for ok := it.First(); ok; ok = it.Next() {
+			if step >= len(matching) || string(it.Key()) != matching[step] {
+				t.Fatalf("[step %d] unexpected key %s", step, it.Key())
+			}
+			if !bytes.Equal(it.Value(), expected[matching[step]]) {
+				t.Fatalf("[step %d] expected %v, got %v", step, expected[matching[step]], it.Value())
+			}
+			step++
+		}
+		if step != len(matching) {
+			t.Fatalf("expected %d keys, got %d", len(matching), step)
+		}
+		step = len(matching) - 1
+		for ok := it.Last(); ok; ok = it.Prev() {
+			if step < 0 || string(it.Key()) != matching[step] {
+				t.Fatalf("[step %d] unexpected key %s", step, it.Key())
+			}
+			step--
+		}
+		if step != -1 {
+			t.Fatalf("expected %d keys, got %d", len(matching), len(matching)-1-step)
+		}
+		err := it.Close()
+		if err != nil {
+			t.Fatalf("while closing iterator: %v", err)
+		}
+	}
+
+	for _, tenant := range tenants {
+		prefixes := [][]byte{tenant[:2], tenant, append(append([]byte{}, tenant...), sorted[0][16:18]...)}
+		for _, prefix := range prefixes {
+			check(store.Prefix(prefix), func(key string) bool {
+				return strings.HasPrefix(key, string(prefix))
+			})
+		}
+	}
+	check(store.Prefix(RandStringBytes(20)), func(key string) bool { return false })
+
+	for i := 0; i < 10; i++ {
+		start, end := sorted[rand.Intn(len(sorted))], sorted[rand.Intn(len(sorted))]
+		if start > end {
+			start, end = end, start
+		}
+		check(store.Range([]byte(start), []byte(end)), func(key string) bool {
+			return key >= start && key < end
+		})
+	}
+	check(store.Range(nil, []byte(sorted[len(sorted)/2])), func(key string) bool {
+		return key < sorted[len(sorted)/2]
+	})
+	check(store.Range([]byte(sorted[len(sorted)/2]), nil), func(key string) bool {
+		return key >= sorted[len(sorted)/2]
+	})
+}
+
+func TestLargeValues(t *testing.T) {
+	storePath := path.Join(os.TempDir(), "testing_values_hb_store")
+	store, err := NewStore(&StoreOptions{storePath: storePath})
+	if err != nil {
+		t.Fatalf("Cannot initialize store. Got %v", err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(storePath)
+	})
+
+	expected := make(map[string][]byte)
+	for _, n := range []int{0, 1, 8, 4096, 100000, 1 << 20} {
+		key := RandStringBytes(24)
+		value := make([]byte, n)
+		rand.Read(value)
+		_, err := store.Put(key, value)
+		if err != nil {
+			t.Fatalf("while inserting to kv store(%d): %v", key, err)
+		}
+		expected[string(key)] = value
+	}
+
+	err = store.Close()
+	if err != nil {
+		t.Fatalf("Cannot close the store: %v", err)
+	}
+
+	store, err = NewStore(&StoreOptions{storePath: storePath})
+	if err != nil {
+		t.Fatalf("Cannot reopen the store. Got %v", err)
+	}
+
+	for k, v := range expected {
+		actual, err := store.Get([]byte(k))
+		if err != nil {
+			t.Fatalf("Cannot get a value from store: %v", err)
+		}
+		if !bytes.Equal(v, actual) {
+			t.Fatalf("expected a value of %d bytes, got %d bytes", len(v), len(actual))
+		}
+	}
+
+	err = store.Close()
+	if err != nil {
+		t.Fatalf("Cannot close the store: %v", err)
+	}
+}
+
+func TestTrailingZeroBytes(t *testing.T) {
+	storePath := path.Join(os.TempDir(), "testing_zeros_hb_store")
+	store, err := NewStore(&StoreOptions{storePath: storePath, chunkSize: 4})
+	if err != nil {
+		t.Fatalf("Cannot initialize store. Got %v", err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(storePath)
+	})
+
+	keys := [][]byte{[]byte("a"), []byte("a\x00"), []byte("a\x00\x00"), []byte("ab\x00\x00\x00"), []byte("ab\x00\x00\x00\x00")}
+	for i, key := range keys {
+		inserted, err := store.Put(key, []byte{byte(i)})
+		if err != nil || !inserted {
+			t.Fatalf("while inserting to kv store(%v): %t %v", key, inserted, err)
+		}
+	}
+
+	// Pending keys and flushed ones are merged by the iterator.
+	err = store.FlushWriteBuffer()
+	if err != nil {
+		t.Fatalf("while flushing kv store: %v", err)
+	}
+	_, err = store.Put([]byte("a\x00\x00\x00"), []byte{byte(len(keys))})
+	if err != nil {
+		t.Fatalf("while inserting to kv store: %v", err)
+	}
+	keys = append(keys[:3], append([][]byte{[]byte("a\x00\x00\x00")}, keys[3:]...)...)
+
+	it := store.Iterator()
+	step := 0
+	for ok := it.First(); ok; ok = it.Next() {
+		if !bytes.Equal(it.Key(), keys[step]) {
+			t.Fatalf("[step %d] expected %v, got %v", step, keys[step], it.Key())
+		}
+		step++
+	}
+	if step != len(keys) {
+		t.Fatalf("expected %d keys, got %d", len(keys), step)
+	}
+
+	err = store.Close()
+	if err != nil {
+		t.Fatalf("Cannot close the store: %v", err)
+	}
+	store, err = NewStore(&StoreOptions{storePath: storePath})
+	if err != nil {
+		t.Fatalf("Cannot reopen the store. Got %v", err)
+	}
+	if int(store.Len()) != len(keys) {
+		t.Fatalf("expected %d, got %d", len(keys), store.Len())
+	}
+	for _, key := range keys {
+		_, err := store.Get(key)
+		if err != nil {
+			t.Fatalf("Cannot get %v from store: %v", key, err)
+		}
+	}
+	err = store.Close()
+	if err != nil {
+		t.Fatalf("Cannot close the store: %v", err)
+	}
+}
+
+func TestSharedChunk(t *testing.T) {
+	storePath := path.Join(os.TempDir(), "testing_shared_chunk_hb_store")
+	store, err := NewStore(&StoreOptions{storePath: storePath, chunkSize: 8})
+	if err != nil {
+		t.Fatalf("Cannot initialize store. Got %v", err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(storePath)
+	})
+
+	// A key of exactly one chunk and a longer key sharing it, flushed in both orders.
+	keys := [][]byte{[]byte("tenant01"), []byte("tenant01/users"), []byte("tenant02/users"), []byte("tenant02")}
+	for _, key := range keys {
+		_, err := store.Put(key, key)
+		if err != nil {
+			t.Fatalf("while inserting to kv store(%s): %v", key, err)
+		}
+		err = store.FlushWriteBuffer()
+		if err != nil {
+			t.Fatalf("while flushing kv store: %v", err)
+		}
+	}
+
+	err = store.Close()
+	if err != nil {
+		t.Fatalf("Cannot close the store: %v", err)
+	}
+	store, err = NewStore(&StoreOptions{storePath: storePath})
+	if err != nil {
+		t.Fatalf("Cannot reopen the store. Got %v", err)
+	}
+	if int(store.Len()) != len(keys) {
+		t.Fatalf("expected %d, got %d", len(keys), store.Len())
+	}
+	for _, key := range keys {
+		actual, err := store.Get(key)
+		if err != nil {
+			t.Fatalf("Cannot get %s from store: %v", key, err)
+		}
+		if !bytes.Equal(key, actual) {
+			t.Fatalf("expected %s, got %s", key, actual)
+		}
+	}
+	err = store.Close()
+	if err != nil {
+		t.Fatalf("Cannot close the store: %v", err)
+	}
+}
+
+func TestSingleFile(t *testing.T) {
+	storePath := path.Join(os.TempDir(), "testing_single_file_hb_store")
+	t.Cleanup(func() {
+		os.RemoveAll(storePath)
+	})
+
+	// Pairs of keys sharing their first two chunks lead to more subtrees than a catalog page holds.
+	store, err := NewStore(&StoreOptions{storePath: storePath, chunkSize: 4, singleFile: true})
+	if err != nil {
+		t.Fatalf("Cannot initialize store. Got %v", err)
+	}
+	entries := make(map[string][]byte)
+	for i := 0; i < 600; i++ {
+		entries[fmt.Sprintf("%08d/a", i)] = RandValue()
+		entries[fmt.Sprintf("%08d/b", i)] = RandValue()
+	}
+	for k, v := range entries {
+		_, err := store.Put([]byte(k), v)
+		if err != nil {
+			t.Fatalf("while inserting to kv store(%s): %v", k, err)
+		}
+	}
+	err = store.Close()
+	if err != nil {
+		t.Fatalf("Cannot close the store: %v", err)
+	}
+
+	files, err := os.ReadDir(path.Join(storePath, "hbdata"))
+	if err != nil {
+		t.Fatalf("Cannot list the store files: %v", err)
+	}
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), "frame_") {
+			t.Fatalf("unexpected frame file %s", file.Name())
+		}
+	}
+
+	// The layout of the stored trie is kept without the option.
+	store, err = NewStore(&StoreOptions{storePath: storePath})
+	if err != nil {
+		t.Fatalf("Cannot reopen the store. Got %v", err)
+	}
+	if int(store.Len()) != len(entries) {
+		t.Fatalf("expected %d, got %d", len(entries), store.Len())
+	}
+	for k, v := range entries {
+		actual, err := store.Get([]byte(k))
+		if err != nil {
+			t.Fatalf("Cannot get %s from store: %v", k, err)
+		}
+		if !bytes.Equal(v, actual) {
+			t.Fatalf("expected %v, got %v", v, actual)
+		}
+	}
+	err = store.Close()
+	if err != nil {
+		t.Fatalf("Cannot close the store: %v", err)
+	}
+}
+
+func TestMigrateToSingleFile(t *testing.T) {
+	storePath := path.Join(os.TempDir(), "testing_migrate_hb_store")
+	t.Cleanup(func() {
+		os.RemoveAll(storePath)
+	})
+
+	store, err := NewStore(&StoreOptions{storePath: storePath, chunkSize: 4})
+	if err != nil {
+		t.Fatalf("Cannot initialize store. Got %v", err)
+	}
+	entries := make(map[string][]byte)
+	for i := 0; i < 300; i++ {
+		entries[fmt.Sprintf("tenant/%04d/%s", i%20, RandStringBytes(8))] = RandValue()
+	}
+	for k, v := range entries {
+		_, err := store.Put([]byte(k), v)
+		if err != nil {
+			t.Fatalf("while inserting to kv store(%s): %v", k, err)
+		}
+	}
+	err = store.Close()
+	if err != nil {
+		t.Fatalf("Cannot close the store: %v", err)
+	}
+	frame := path.Join(storePath, "hbdata", "frame_1.db")
+	if _, err := os.Stat(frame); err != nil {
+		t.Fatalf("expected a frame file: %v", err)
+	}
+
+	// Reopening with a single file migrates the trie and removes the frame files.
+	store, err = NewStore(&StoreOptions{storePath: storePath, singleFile: true})
+	if err != nil {
+		t.Fatalf("Cannot reopen the store. Got %v", err)
+	}
+	if _, err := os.Stat(frame); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected the frame file to be removed, got %v", err)
+	}
+	for k, v := range entries {
+		actual, err := store.Get([]byte(k))
+		if err != nil {
+			t.Fatalf("Cannot get %s from store: %v", k, err)
+		}
+		if !bytes.Equal(v, actual) {
+			t.Fatalf("expected %v, got %v", v, actual)
+		}
+	}
+
+	// The migrated trie keeps growing in the single file.
+	for i := 0; i < 300; i++ {
+		entries[fmt.Sprintf("tenant/%04d/%s", i%30, RandStringBytes(8))] = RandValue()
+	}
+	for k, v := range entries {
+		_, err := store.Put([]byte(k), v)
+		if err != nil {
+			t.Fatalf("while inserting to kv store(%s): %v", k, err)
+		}
+	}
+	err = store.Close()
+	if err != nil {
+		t.Fatalf("Cannot close the store: %v", err)
+	}
+	store, err = NewStore(&StoreOptions{storePath: storePath})
+	if err != nil {
+		t.Fatalf("Cannot reopen the store. Got %v", err)
+	}
+	if int(store.Len()) != len(entries) {
+		t.Fatalf("expected %d, got %d", len(entries), store.Len())
+	}
+	for k, v := range entries {
+		actual, err := store.Get([]byte(k))
+		if err != nil {
+			t.Fatalf("Cannot get %s from store: %v", k, err)
+		}
+		if !bytes.Equal(v, actual) {
+			t.Fatalf("expected %v, got %v", v, actual)
+		}
+	}
+	err = store.Close()
+	if err != nil {
+		t.Fatalf("Cannot close the store: %v", err)
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	storePath := path.Join(os.TempDir(), "testing_budget_hb_store")
+	t.Cleanup(func() {
+		os.RemoveAll(storePath)
+	})
+
+	// Far fewer pages than subtrees are held in memory across all of them.
+	store, err := NewStore(&StoreOptions{storePath: storePath, chunkSize: 4, memoryBudget: 16 * 4096})
+	if err != nil {
+		t.Fatalf("Cannot initialize store. Got %v", err)
+	}
+	entries := make(map[string][]byte)
+	for i := 0; i < 2000; i++ {
+		entries[fmt.Sprintf("tenant/%04d/%s", i%100, RandStringBytes(8))] = RandValue()
+	}
+	for k, v := range entries {
+		_, err := store.Put([]byte(k), v)
+		if err != nil {
+			t.Fatalf("while inserting to kv store(%s): %v", k, err)
+		}
+	}
+	err = store.FlushWriteBuffer()
+	if err != nil {
+		t.Fatalf("while flushing kv store: %v", err)
+	}
+	for k, v := range entries {
+		actual, err := store.Get([]byte(k))
+		if err != nil {
+			t.Fatalf("Cannot get %s from store: %v", k, err)
+		}
+		if !bytes.Equal(v, actual) {
+			t.Fatalf("expected %v, got %v", v, actual)
+		}
+	}
+	err = store.Close()
+	if err != nil {
+		t.Fatalf("Cannot close the store: %v", err)
+	}
+
+	store, err = NewStore(&StoreOptions{storePath: storePath, memoryBudget: 16 * 4096})
+	if err != nil {
+		t.Fatalf("Cannot reopen the store. Got %v", err)
+	}
+	if int(store.Len()) != len(entries) {
+		t.Fatalf("expected %d, got %d", len(entries), store.Len())
+	}
+	for k, v := range entries {
+		actual, err := store.Get([]byte(k))
+		if err != nil {
+			t.Fatalf("Cannot get %s from store: %v", k, err)
+		}
+		if !bytes.Equal(v, actual) {
+			t.Fatalf("expected %v, got %v", v, actual)
+		}
+	}
+	err = store.Close()
+	if err != nil {
+		t.Fatalf("Cannot close the store: %v", err)
+	}
+}
+
+func TestCorruptPage(t *testing.T) {
+	storePath := path.Join(os.TempDir(), "testing_corrupt_hb_store")
+	os.RemoveAll(storePath)
+	t.Cleanup(func() {
+		os.RemoveAll(storePath)
+	})
+	store, err := NewStore(&StoreOptions{storePath: storePath, chunkSize: 4, memoryBudget: 8 * 4096})
+	if err != nil {
+		t.Fatalf("Cannot initialize store. Got %v", err)
+	}
+	keys := make([][]byte, 0, 500)
+	for i := 0; i < 500; i++ {
+		key := []byte(fmt.Sprintf("tenant/%04d/%s", i%50, RandStringBytes(8)))
+		_, err := store.Put(key, RandValue())
+		if err != nil {
+			t.Fatalf("while inserting to kv store(%s): %v", key, err)
+		}
+		keys = append(keys, key)
+	}
+	err = store.Close()
+	if err != nil {
+		t.Fatalf("Cannot close the store: %v", err)
+	}
+	store, err = NewStore(&StoreOptions{storePath: storePath, memoryBudget: 8 * 4096})
+	if err != nil {
+		t.Fatalf("Cannot reopen the store. Got %v", err)
+	}
+
+	// One byte of every page of the subtrees is altered once the store is open.
+	// The root tree, registered first, is left intact so that the subtrees are loaded from it.
+	frames, err := filepath.Glob(path.Join(store.(*HBTrieStore).pool.DataPath(), "frame_*.db"))
+	if err != nil || len(frames) < 2 {
+		t.Fatalf("expected the files of several subtrees, got %d: %v", len(frames), err)
+	}
+	for _, name := range frames {
+		if filepath.Base(name) == "frame_1.db" {
+			continue
+		}
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatalf("while reading %s: %v", name, err)
+		}
+		for offset := 4096 + 2048; offset < len(data); offset += 4096 {
+			data[offset] ^= 0xff
+		}
+		err = os.WriteFile(name, data, 0755)
+		if err != nil {
+			t.Fatalf("while writing %s: %v", name, err)
+		}
+	}
+
+	// The pages evicted from the memory budget are read back and reported as corrupt.
+	corrupt := 0
+	var pageError *kverrors.CorruptPageError
+	for _, key := range keys {
+		_, err := store.Get(key)
+		if errors.As(err, &pageError) {
+			corrupt++
+		} else if err != nil {
+			t.Fatalf("expected a CorruptPageError for %s, got %v", key, err)
+		}
+	}
+	if corrupt == 0 {
+		t.Fatalf("expected corrupt pages to be reported")
+	}
+}
+
+func TestReplacementPolicies(t *testing.T) {
+	storePath := path.Join(os.TempDir(), "testing_policies_hb_store")
+	t.Cleanup(func() {
+		os.RemoveAll(storePath)
+	})
+
+	entries := make(map[string][]byte)
+	for i := 0; i < 1000; i++ {
+		entries[fmt.Sprintf("tenant/%04d/%s", i%50, RandStringBytes(8))] = RandValue()
+	}
+	for _, policy := range []ReplacementPolicy{LRU, CLOCK, TwoQ, ARC} {
+		os.RemoveAll(storePath)
+		store, err := NewStore(&StoreOptions{storePath: storePath, chunkSize: 4, memoryBudget: 16 * 4096, replacementPolicy: policy})
+		if err != nil {
+			t.Fatalf("[%v] Cannot initialize store. Got %v", policy, err)
+		}
+		for k, v := range entries {
+			_, err := store.Put([]byte(k), v)
+			if err != nil {
+				t.Fatalf("[%v] while inserting to kv store(%s): %v", policy, k, err)
+			}
+		}
+		err = store.FlushWriteBuffer()
+		if err != nil {
+			t.Fatalf("[%v] while flushing kv store: %v", policy, err)
+		}
+		for k, v := range entries {
+			actual, err := store.Get([]byte(k))
+			if err != nil {
+				t.Fatalf("[%v] Cannot get %s from store: %v", policy, k, err)
+			}
+			if !bytes.Equal(v, actual) {
+				t.Fatalf("[%v] expected %v, got %v", policy, v, actual)
+			}
+		}
+		err = store.Close()
+		if err != nil {
+			t.Fatalf("[%v] Cannot close the store: %v", policy, err)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	storePath := path.Join(os.TempDir(), "testing_stats_hb_store")
+	t.Cleanup(func() {
+		os.RemoveAll(storePath)
+	})
+
+	store, err := NewStore(&StoreOptions{storePath: storePath})
+	if err != nil {
+		t.Fatalf("Cannot initialize store. Got %v", err)
+	}
+	for i := 0; i < 5000; i++ {
+		_, err := store.Put([]byte(fmt.Sprintf("key%06d", i)), RandValue())
+		if err != nil {
+			t.Fatalf("while inserting to kv store: %v", err)
+		}
+	}
+	err = store.FlushWriteBuffer()
+	if err != nil {
+		t.Fatalf("while flushing kv store: %v", err)
+	}
+	stats := store.Stats()
+	if stats.Keys != 5000 || stats.Trees != 1 || stats.Pages == 0 || stats.FreePages != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// The leaves emptied by the deletes are released.
+	for i := 0; i < 2500; i++ {
+		err := store.Delete([]byte(fmt.Sprintf("key%06d", i)))
+		if err != nil {
+			t.Fatalf("while deleting from kv store: %v", err)
+		}
+	}
+	err = store.Close()
+	if err != nil {
+		t.Fatalf("Cannot close the store: %v", err)
+	}
+	store, err = NewStore(&StoreOptions{storePath: storePath})
+	if err != nil {
+		t.Fatalf("Cannot reopen the store. Got %v", err)
+	}
+	deleted := store.Stats()
+	if deleted.Keys != 2500 || deleted.Pages != stats.Pages || deleted.FreePages == 0 {
+		t.Fatalf("unexpected stats %+v after deleting from %+v", deleted, stats)
+	}
+
+	for i := 0; i < 2500; i++ {
+		_, err := store.Put([]byte(fmt.Sprintf("key%06d", i)), RandValue())
+		if err != nil {
+			t.Fatalf("while inserting to kv store: %v", err)
+		}
+	}
+	err = store.FlushWriteBuffer()
+	if err != nil {
+		t.Fatalf("while flushing kv store: %v", err)
+	}
+	reused := store.Stats()
+	if reused.Keys != 5000 || reused.FreePages >= deleted.FreePages {
+		t.Fatalf("unexpected stats %+v after reinserting in %+v", reused, deleted)
+	}
+	err = store.Close()
+	if err != nil {
+		t.Fatalf("Cannot close the store: %v", err)
+	}
+}
+
+func TestCollapseSubTrees(t *testing.T) {
+	for _, singleFile := range []bool{false, true} {
+		storePath := path.Join(os.TempDir(), "testing_collapse_hb_store")
+		options := &StoreOptions{storePath: storePath, chunkSize: 4, singleFile: singleFile}
+		store, err := NewStore(options)
+		if err != nil {
+			t.Fatalf("Cannot initialize store. Got %v", err)
+		}
+		// Every user has a subtree for its fields.
+		key := func(user, field int) []byte { return []byte(fmt.Sprintf("user%04d/field%d", user, field)) }
+		for user := 0; user < 200; user++ {
+			for field := 0; field < 3; field++ {
+				_, err := store.Put(key(user, field), key(user, field))
+				if err != nil {
+					t.Fatalf("while inserting to kv store: %v", err)
+				}
+			}
+		}
+		err = store.FlushWriteBuffer()
+		if err != nil {
+			t.Fatalf("while flushing kv store: %v", err)
+		}
+		trees := store.Stats().Trees
+
+		// Deleting all the fields of a user but one removes its subtree, deleting them all removes its chunk.
+		for user := 0; user < 200; user++ {
+			for field := 0; field < 3; field++ {
+				if field == 0 && user%2 == 0 {
+					continue
+				}
+				err := store.Delete(key(user, field))
+				if err != nil {
+					t.Fatalf("while deleting from kv store: %v", err)
+				}
+			}
+		}
+		err = store.Close()
+		if err != nil {
+			t.Fatalf("Cannot close the store: %v", err)
+		}
+		store, err = NewStore(options)
+		if err != nil {
+			t.Fatalf("Cannot reopen the store. Got %v", err)
+		}
+		stats := store.Stats()
+		if stats.Keys != 100 || stats.Trees >= trees {
+			t.Fatalf("unexpected stats %+v, %d trees before deleting", stats, trees)
+		}
+		for user := 0; user < 200; user++ {
+			value, err := store.Get(key(user, 0))
+			if user%2 == 0 && (err != nil || !bytes.Equal(value, key(user, 0))) {
+				t.Fatalf("expected %v, got %v: %v", key(user, 0), value, err)
+			}
+			if user%2 == 1 && err == nil {
+				t.Fatalf("expected %v to be deleted, got %v", key(user, 0), value)
+			}
+		}
+
+		// The trie grows back over the removed subtrees.
+		for user := 0; user < 200; user++ {
+			_, err := store.Put(key(user, 1), key(user, 1))
+			if err != nil {
+				t.Fatalf("while inserting to kv store: %v", err)
+			}
+		}
+		err = store.Close()
+		if err != nil {
+			t.Fatalf("Cannot close the store: %v", err)
+		}
+		store, err = NewStore(options)
+		if err != nil {
+			t.Fatalf("Cannot reopen the store. Got %v", err)
+		}
+		for user := 0; user < 200; user++ {
+			value, err := store.Get(key(user, 1))
+			if err != nil || !bytes.Equal(value, key(user, 1)) {
+				t.Fatalf("expected %v, got %v: %v", key(user, 1), value, err)
+			}
+		}
+		if store.Len() != 300 {
+			t.Fatalf("expected %d keys, got %d", 300, store.Len())
+		}
+		err = store.DeleteStore()
+		if err != nil {
+			t.Fatalf("Cannot delete the store: %v", err)
+		}
+	}
+}
+
+func TestWriteAheadLog(t *testing.T) {
+	for _, mode := range []WALSyncMode{WALSyncAlways, WALSyncGroup, WALSyncNone} {
+		storePath := path.Join(os.TempDir(), "testing_wal_hb_store")
+		options := &StoreOptions{storePath: storePath, walSyncMode: mode}
+		store, err := NewStore(options)
+		if err != nil {
+			t.Fatalf("Cannot initialize store. Got %v", err)
+		}
+		for i := 0; i < 100; i++ {
+			_, err := store.Put([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("flushed%03d", i)))
+			if err != nil {
+				t.Fatalf("while inserting to kv store: %v", err)
+			}
+		}
+		err = store.Flush()
+		if err != nil {
+			t.Fatalf("while flushing kv store: %v", err)
+		}
+		for i := 0; i < 200; i++ {
+			key := []byte(fmt.Sprintf("key%03d", i))
+			if i%4 == 0 && i < 100 {
+				err = store.Delete(key)
+			} else {
+				_, err = store.Put(key, []byte(fmt.Sprintf("logged%03d", i)))
+			}
+			if err != nil {
+				t.Fatalf("while writing to kv store: %v", err)
+			}
+		}
+
+		// The store crashes: neither the write buffer nor the trie is written.
+		s := store.(*HBTrieStore)
+		s.wal.Close()
+		s.pool.Close()
+
+		store, err = NewStore(options)
+		if err != nil {
+			t.Fatalf("Cannot reopen the store. Got %v", err)
+		}
+		for i := 0; i < 200; i++ {
+			key := []byte(fmt.Sprintf("key%03d", i))
+			value, err := store.Get(key)
+			if i%4 == 0 && i < 100 {
+				var keyError *kverrors.KeyNotFoundError
+				if !errors.As(err, &keyError) {
+					t.Fatalf("expected %s to be deleted, got %s: %v", key, value, err)
+				}
+				continue
+			}
+			expected := []byte(fmt.Sprintf("logged%03d", i))
+			if err != nil || !bytes.Equal(value, expected) {
+				t.Fatalf("expected %s, got %s: %v", expected, value, err)
+			}
+		}
+
+		// The log is emptied by a flush, the writes are then held by the trie.
+		err = store.Flush()
+		if err != nil {
+			t.Fatalf("while flushing kv store: %v", err)
+		}
+		info, err := os.Stat(path.Join(storePath, "hbdata", walFilename))
+		if err != nil || info.Size() != 0 {
+			t.Fatalf("expected an empty log, got %v: %v", info, err)
+		}
+		if store.Len() != 175 {
+			t.Fatalf("expected %d keys, got %d", 175, store.Len())
+		}
+		err = store.Close()
+		if err != nil {
+			t.Fatalf("Cannot close the store: %v", err)
+		}
+		os.RemoveAll(storePath)
+	}
+}
+
+func TestGroupCommit(t *testing.T) {
+	storePath := path.Join(os.TempDir(), "testing_group_commit_hb_store")
+	os.RemoveAll(storePath)
+	t.Cleanup(func() {
+		os.RemoveAll(storePath)
+	})
+	options := &StoreOptions{storePath: storePath, walSyncMode: WALSyncGroup}
+	store, err := NewStore(options)
+	if err != nil {
+		t.Fatalf("Cannot initialize store. Got %v", err)
+	}
+
+	// Concurrent writers share the syncs of their groups rather than waiting for the delay of each write.
+	const writers, writes = 16, 25
+	start := time.Now()
+	errs := make(chan error, writers)
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				key := []byte(fmt.Sprintf("writer%02d/key%02d", w, i))
+				_, err := store.Put(key, key)
+				if err == nil && i%5 == 0 {
+					err = store.Delete(key)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	// A flush running along the writers keeps the writes it doesn't hold in the log.
+	err = store.Flush()
+	if err != nil {
+		t.Fatalf("while flushing kv store: %v", err)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("while writing to kv store: %v", err)
+	}
+	elapsed := time.Since(start)
+	if sequential := writers * writes * 10 * time.Millisecond; elapsed >= sequential/2 {
+		t.Fatalf("expected the writers to share the syncs, took %v against %v for sequential writes", elapsed, sequential)
+	}
+	expected := uint64(writers * writes * 4 / 5)
+	if store.Len() != expected {
+		t.Fatalf("expected %d keys, got %d", expected, store.Len())
+	}
+
+	// The store crashes: the writes are replayed from the log.
+	s := store.(*HBTrieStore)
+	s.wal.Close()
+	s.pool.Close()
+	store, err = NewStore(options)
+	if err != nil {
+		t.Fatalf("Cannot reopen the store. Got %v", err)
+	}
+	defer store.Close()
+	if store.Len() != expected {
+		t.Fatalf("expected %d keys after reopening, got %d", expected, store.Len())
+	}
+	for w := 0; w < writers; w++ {
+		for i := 0; i < writes; i++ {
+			key := []byte(fmt.Sprintf("writer%02d/key%02d", w, i))
+			value, err := store.Get(key)
+			if i%5 == 0 {
+				var keyError *kverrors.KeyNotFoundError
+				if !errors.As(err, &keyError) {
+					t.Fatalf("expected %s to be deleted, got %s: %v", key, value, err)
+				}
+			} else if err != nil || !bytes.Equal(value, key) {
+				t.Fatalf("expected %s, got %s: %v", key, value, err)
+			}
+		}
+	}
+}
+
+func TestJournal(t *testing.T) {
+	for _, singleFile := range []bool{false, true} {
+		storePath := path.Join(os.TempDir(), "testing_journal_hb_store")
+		os.RemoveAll(storePath)
+		// A small budget evicts pages while the keys are flushed, the committed ones are written to the journal.
+		options := &StoreOptions{storePath: storePath, chunkSize: 4, singleFile: singleFile, memoryBudget: 16 * 4096}
+		store, err := NewStore(options)
+		if err != nil {
+			t.Fatalf("Cannot initialize store. Got %v", err)
+		}
+		for i := 0; i < 2000; i++ {
+			_, err := store.Put([]byte(fmt.Sprintf("user%04d", i)), []byte(fmt.Sprintf("value%04d", i)))
+			if err != nil {
+				t.Fatalf("while inserting to kv store: %v", err)
+			}
+		}
+		err = store.Flush()
+		if err != nil {
+			t.Fatalf("while flushing kv store: %v", err)
+		}
+
+		// The store crashes once the deletes and inserts are written to the pages of the trie, but before they are
+		// committed: the committed trie is left untouched, the writes are replayed from the write-ahead log.
+		for i := 0; i < 4000; i++ {
+			key := []byte(fmt.Sprintf("user%04d", i))
+			if i < 2000 && i%2 == 0 {
+				err = store.Delete(key)
+			} else if i >= 2000 {
+				_, err = store.Put(key, []byte(fmt.Sprintf("value%04d", i)))
+			}
+			if err != nil {
+				t.Fatalf("while writing to kv store: %v", err)
+			}
+		}
+		err = store.FlushWriteBuffer()
+		if err != nil {
+			t.Fatalf("while flushing the write buffer: %v", err)
+		}
+		s := store.(*HBTrieStore)
+		s.wal.Close()
+		s.pool.Close()
+
+		store, err = NewStore(options)
+		if err != nil {
+			t.Fatalf("Cannot reopen the store. Got %v", err)
+		}
+		for i := 0; i < 4000; i++ {
+			key := []byte(fmt.Sprintf("user%04d", i))
+			value, err := store.Get(key)
+			if i < 2000 && i%2 == 0 {
+				var keyError *kverrors.KeyNotFoundError
+				if !errors.As(err, &keyError) {
+					t.Fatalf("expected %s to be deleted, got %s: %v", key, value, err)
+				}
+				continue
+			}
+			expected := []byte(fmt.Sprintf("value%04d", i))
+			if err != nil || !bytes.Equal(value, expected) {
+				t.Fatalf("expected %s, got %s: %v", expected, value, err)
+			}
+		}
+		err = store.DeleteStore()
+		if err != nil {
+			t.Fatalf("Cannot delete the store: %v", err)
+		}
+	}
+}
+
+func TestSyncPolicy(t *testing.T) {
+	for _, policy := range []SyncPolicy{SyncOnFlush, SyncAlways, SyncNone} {
+		storePath := path.Join(os.TempDir(), "testing_sync_hb_store")
+		os.RemoveAll(storePath)
+		options := &StoreOptions{storePath: storePath, syncPolicy: policy}
+		store, err := NewStore(options)
+		if err != nil {
+			t.Fatalf("Cannot initialize store. Got %v", err)
+		}
+		for i := 0; i < 500; i++ {
+			_, err := store.Put([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%03d", i)))
+			if err != nil {
+				t.Fatalf("while inserting to kv store: %v", err)
+			}
+		}
+		err = store.Close()
+		if err != nil {
+			t.Fatalf("Cannot close the store with policy %d: %v", policy, err)
+		}
+
+		store, err = NewStore(options)
+		if err != nil {
+			t.Fatalf("Cannot reopen the store. Got %v", err)
+		}
+		for i := 0; i < 500; i++ {
+			expected := []byte(fmt.Sprintf("value%03d", i))
+			value, err := store.Get([]byte(fmt.Sprintf("key%03d", i)))
+			if err != nil || !bytes.Equal(value, expected) {
+				t.Fatalf("expected %s, got %s: %v", expected, value, err)
+			}
+		}
+		err = store.DeleteStore()
+		if err != nil {
+			t.Fatalf("Cannot delete the store: %v", err)
+		}
+	}
+}
+
+func TestAppendOnly(t *testing.T) {
+	for _, singleFile := range []bool{false, true} {
+		storePath := path.Join(os.TempDir(), "testing_append_only_hb_store")
+		os.RemoveAll(storePath)
+		// A small budget writes the modified pages to disk before the trie is flushed.
+		options := &StoreOptions{storePath: storePath, chunkSize: 4, singleFile: singleFile, memoryBudget: 16 * 4096, appendOnly: true}
+		store, err := NewStore(options)
+		if err != nil {
+			t.Fatalf("Cannot initialize store. Got %v", err)
+		}
+		for i := 0; i < 1000; i++ {
+			_, err := store.Put([]byte(fmt.Sprintf("user%04d", i)), []byte(fmt.Sprintf("flushed%04d", i)))
+			if err != nil {
+				t.Fatalf("while inserting to kv store: %v", err)
+			}
+		}
+		err = store.Flush()
+		if err != nil {
+			t.Fatalf("while flushing kv store: %v", err)
+		}
+		pages := store.Stats().Pages
+		for i := 0; i < 1000; i++ {
+			key := []byte(fmt.Sprintf("user%04d", i))
+			if i%3 == 0 {
+				err = store.Delete(key)
+			} else {
+				_, err = store.Put(key, []byte(fmt.Sprintf("updated%04d", i)))
+			}
+			if err != nil {
+				t.Fatalf("while writing to kv store: %v", err)
+			}
+		}
+		err = store.Flush()
+		if err != nil {
+			t.Fatalf("while flushing kv store: %v", err)
+		}
+		if store.Stats().Pages <= pages {
+			t.Fatalf("expected pages to be appended, got %d after %d", store.Stats().Pages, pages)
+		}
+		err = store.Close()
+		if err != nil {
+			t.Fatalf("Cannot close the store: %v", err)
+		}
+
+		// The mode is kept whatever the options of the reopened store.
+		store, err = NewStore(&StoreOptions{storePath: storePath})
+		if err != nil {
+			t.Fatalf("Cannot reopen the store. Got %v", err)
+		}
+		if !store.(*HBTrieStore).pool.AppendOnly() {
+			t.Fatalf("expected the store to be reopened in append-only mode")
+		}
+		it := store.Iterator()
+		count := 0
+		for ok := it.First(); ok; ok = it.Next() {
+			i := 0
+			fmt.Sscanf(string(it.Key()), "user%04d", &i)
+			if i%3 == 0 || !bytes.Equal(it.Value(), []byte(fmt.Sprintf("updated%04d", i))) {
+				t.Fatalf("unexpected entry %s: %s", it.Key(), it.Value())
+			}
+			count++
+		}
+		if count != 666 || store.Len() != 666 {
+			t.Fatalf("expected %d keys, got %d iterated and %d", 666, count, store.Len())
+		}
+		err = store.DeleteStore()
+		if err != nil {
+			t.Fatalf("Cannot delete the store: %v", err)
+		}
+	}
+}
+
+// checkCompactedStore checks that the keys of the given store are the ones written by TestCompact.
+func checkCompactedStore(t *testing.T, store Store) {
+	it := store.Iterator()
+	count := 0
+	for ok := it.First(); ok; ok = it.Next() {
+		i := 0
+		fmt.Sscanf(string(it.Key()), "user%04d", &i)
+		if i%3 == 0 || !bytes.Equal(it.Value(), []byte(fmt.Sprintf("updated%04d", i))) {
+			t.Fatalf("unexpected entry %s: %s", it.Key(), it.Value())
+		}
+		count++
+	}
+	if err := it.Close(); err != nil {
+		t.Fatalf("while iterating kv store: %v", err)
+	}
+	if count != 666 || store.Len() != 666 {
+		t.Fatalf("expected %d keys, got %d iterated and %d", 666, count, store.Len())
+	}
+}
+
+func TestCompact(t *testing.T) {
+	for _, options := range []StoreOptions{{}, {singleFile: true}, {appendOnly: true}} {
+		storePath := path.Join(os.TempDir(), "testing_compact_hb_store")
+		os.RemoveAll(storePath)
+		options.storePath, options.chunkSize, options.memoryBudget = storePath, 4, 16*4096
+		store, err := NewStore(&options)
+		if err != nil {
+			t.Fatalf("Cannot initialize store. Got %v", err)
+		}
+		for i := 0; i < 1000; i++ {
+			_, err := store.Put([]byte(fmt.Sprintf("user%04d", i)), []byte(fmt.Sprintf("flushed%04d", i)))
+			if err != nil {
+				t.Fatalf("while inserting to kv store: %v", err)
+			}
+		}
+		err = store.Flush()
+		if err != nil {
+			t.Fatalf("while flushing kv store: %v", err)
+		}
+		for i := 0; i < 1000; i++ {
+			key := []byte(fmt.Sprintf("user%04d", i))
+			if i%3 == 0 {
+				err = store.Delete(key)
+			} else {
+				_, err = store.Put(key, []byte(fmt.Sprintf("updated%04d", i)))
+			}
+			if err != nil {
+				t.Fatalf("while writing to kv store: %v", err)
+			}
+		}
+
+		// The writes not flushed yet are compacted along with the others.
+		stats, err := store.Compact()
+		if err != nil {
+			t.Fatalf("while compacting kv store: %v", err)
+		}
+		if stats.Reclaimed == 0 || stats.Values != 666 {
+			t.Fatalf("expected reclaimed bytes and %d values copied, got %+v", 666, stats)
+		}
+		if store.Stats().FreePages != 0 {
+			t.Fatalf("expected no free page after compaction, got %d", store.Stats().FreePages)
+		}
+		checkCompactedStore(t, store)
+
+		// The store is still written after the compaction.
+		for i := 1000; i < 1100; i++ {
+			_, err := store.Put([]byte(fmt.Sprintf("other%04d", i)), []byte("value"))
+			if err != nil {
+				t.Fatalf("while inserting to kv store: %v", err)
+			}
+		}
+		for i := 1000; i < 1100; i++ {
+			err := store.Delete([]byte(fmt.Sprintf("other%04d", i)))
+			if err != nil {
+				t.Fatalf("while deleting from kv store: %v", err)
+			}
+		}
+		err = store.Close()
+		if err != nil {
+			t.Fatalf("Cannot close the store: %v", err)
+		}
+
+		store, err = NewStore(&StoreOptions{storePath: storePath})
+		if err != nil {
+			t.Fatalf("Cannot reopen the store. Got %v", err)
+		}
+		checkCompactedStore(t, store)
+		err = store.DeleteStore()
+		if err != nil {
+			t.Fatalf("Cannot delete the store: %v", err)
+		}
+	}
+}
+
+func TestCompactionRatio(t *testing.T) {
+	storePath := path.Join(os.TempDir(), "testing_compaction_ratio_hb_store")
+	os.RemoveAll(storePath)
+	_, err := NewStore(&StoreOptions{storePath: storePath, compactionRatio: 1.5})
+	var rangeErr *kverrors.OutsideOfRangeError
+	if !errors.As(err, &rangeErr) {
+		t.Fatalf("expected OutsideOfRangeError, got %v", err)
+	}
+
+	store, err := NewStore(&StoreOptions{storePath: storePath, compactionRatio: 0.5})
+	if err != nil {
+		t.Fatalf("Cannot initialize store. Got %v", err)
+	}
+	defer store.DeleteStore()
+	hb := store.(*HBTrieStore)
+	key := []byte("user")
+	compactions := 0
+	last := 0.0
+	for i := 0; i < 1000; i++ {
+		_, err := store.Put(key, []byte(fmt.Sprintf("value%04d", i)))
+		if err != nil {
+			t.Fatalf("while inserting to kv store: %v", err)
+		}
+		// Each flush supersedes the value flushed before, the store being compacted in the background past the ratio.
+		err = store.Flush()
+		if err != nil {
+			t.Fatalf("while flushing kv store: %v", err)
+		}
+		hb.lockTrie()
+		ratio := hb.pool.StaleRatio()
+		hb.mu.Unlock()
+		if ratio >= 0.5 {
+			t.Fatalf("expected the store to be compacted past a ratio of 0.5, got %f", ratio)
+		}
+		if ratio < last {
+			compactions++
+		}
+		last = ratio
+	}
+	if compactions == 0 {
+		t.Fatalf("expected the store to be compacted")
+	}
+	value, err := store.Get(key)
+	if err != nil || string(value) != "value0999" {
+		t.Fatalf("expected value0999, got %q, error %v", value, err)
+	}
+}
+
+func TestConcurrentCompaction(t *testing.T) {
+	for _, options := range []StoreOptions{{}, {singleFile: true}, {appendOnly: true}} {
+		storePath := path.Join(os.TempDir(), "testing_concurrent_compaction_hb_store")
+		os.RemoveAll(storePath)
+		options.storePath, options.chunkSize, options.memoryBudget = storePath, 4, 16*4096
+		options.walSyncMode = WALSyncNone
+		store, err := NewStore(&options)
+		if err != nil {
+			t.Fatalf("Cannot initialize store. Got %v", err)
+		}
+		hb := store.(*HBTrieStore)
+		for i := 0; i < 5000; i++ {
+			_, err := store.Put([]byte(fmt.Sprintf("user%04d", i)), []byte(fmt.Sprintf("flushed%04d", i)))
+			if err != nil {
+				t.Fatalf("while inserting to kv store: %v", err)
+			}
+		}
+		err = store.Flush()
+		if err != nil {
+			t.Fatalf("while flushing kv store: %v", err)
+		}
+
+		// The keys are read and written while the files are copied, until the compaction is done.
+		done := make(chan error, 1)
+		go func() {
+			_, err := store.Compact()
+			done <- err
+		}()
+		during := 0
+		finished := false
+		for i := 0; i < 5000 || !finished; i++ {
+			key := []byte(fmt.Sprintf("user%04d", i%5000))
+			if i%2 == 0 {
+				_, err = store.Put(key, []byte(fmt.Sprintf("updated%04d", i%5000)))
+			} else {
+				_, err = store.Get(key)
+			}
+			if err != nil {
+				t.Fatalf("while accessing kv store: %v", err)
+			}
+			hb.mu.Lock()
+			if hb.compaction != nil {
+				during++
+			}
+			hb.mu.Unlock()
+			select {
+			case err = <-done:
+				if err != nil {
+					t.Fatalf("while compacting kv store: %v", err)
+				}
+				finished = true
+			default:
+			}
+		}
+		if during == 0 {
+			t.Fatalf("expected the keys to be accessed during the compaction")
+		}
+		err = store.Flush()
+		if err != nil {
+			t.Fatalf("while flushing kv store: %v", err)
+		}
+		err = store.Close()
+		if err != nil {
+			t.Fatalf("Cannot close the store: %v", err)
+		}
+
+		store, err = NewStore(&StoreOptions{storePath: storePath})
+		if err != nil {
+			t.Fatalf("Cannot reopen the store. Got %v", err)
+		}
+		for i := 0; i < 5000; i++ {
+			expected := fmt.Sprintf("flushed%04d", i)
+			if i%2 == 0 {
+				expected = fmt.Sprintf("updated%04d", i)
+			}
+			value, err := store.Get([]byte(fmt.Sprintf("user%04d", i)))
+			if err != nil || string(value) != expected {
+				t.Fatalf("expected %s, got %q, error %v", expected, value, err)
+			}
+		}
+		err = store.DeleteStore()
+		if err != nil {
+			t.Fatalf("Cannot delete the store: %v", err)
+		}
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	storePath := path.Join(os.TempDir(), "testing_snapshot_hb_store")
+	os.RemoveAll(storePath)
+	store, err := NewStore(&StoreOptions{storePath: storePath})
+	if err != nil {
+		t.Fatalf("Cannot initialize store. Got %v", err)
+	}
+	_, err = store.Snapshot()
+	var modeErr *kverrors.SnapshotModeError
+	if !errors.As(err, &modeErr) {
+		t.Fatalf("expected SnapshotModeError, got %v", err)
+	}
+	err = store.DeleteStore()
+	if err != nil {
+		t.Fatalf("Cannot delete the store: %v", err)
+	}
+
+	store, err = NewStore(&StoreOptions{storePath: storePath, chunkSize: 4, memoryBudget: 16 * 4096, appendOnly: true})
+	if err != nil {
+		t.Fatalf("Cannot initialize store. Got %v", err)
+	}
+	defer store.DeleteStore()
+	for i := 0; i < 1000; i++ {
+		_, err := store.Put([]byte(fmt.Sprintf("user%04d", i)), []byte(fmt.Sprintf("pinned%04d", i)))
+		if err != nil {
+			t.Fatalf("while inserting to kv store: %v", err)
+		}
+	}
+
+	// The writes not flushed yet are part of the snapshot.
+	snapshot, err := store.Snapshot()
+	if err != nil {
+		t.Fatalf("while taking snapshot: %v", err)
+	}
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("user%04d", i))
+		if i%3 == 0 {
+			err = store.Delete(key)
+		} else {
+			_, err = store.Put(key, []byte(fmt.Sprintf("updated%04d", i)))
+		}
+		if err != nil {
+			t.Fatalf("while writing to kv store: %v", err)
+		}
+		_, err = store.Put([]byte(fmt.Sprintf("later%04d", i)), []byte("value"))
+		if err != nil {
+			t.Fatalf("while inserting to kv store: %v", err)
+		}
+	}
+	err = store.Flush()
+	if err != nil {
+		t.Fatalf("while flushing kv store: %v", err)
+	}
+	_, err = store.Compact()
+	var pinnedErr *kverrors.PinnedSnapshotError
+	if !errors.As(err, &pinnedErr) {
+		t.Fatalf("expected PinnedSnapshotError, got %v", err)
+	}
+
+	// The snapshot still holds the keys and values it has been taken with.
+	if snapshot.Len() != 1000 {
+		t.Fatalf("expected %d keys in snapshot, got %d", 1000, snapshot.Len())
+	}
+	for i := 0; i < 1000; i++ {
+		value, err := snapshot.Get([]byte(fmt.Sprintf("user%04d", i)))
+		if err != nil || !bytes.Equal(value, []byte(fmt.Sprintf("pinned%04d", i))) {
+			t.Fatalf("expected pinned%04d, got %q, error %v", i, value, err)
+		}
+	}
+	_, err = snapshot.Get([]byte("later0000"))
+	var keyErr *kverrors.KeyNotFoundError
+	if !errors.As(err, &keyErr) {
+		t.Fatalf("expected KeyNotFoundError, got %v", err)
+	}
+	it := snapshot.Iterator()
+	count := 0
+	for ok := it.First(); ok; ok = it.Next() {
+		if !bytes.Equal(it.Key(), []byte(fmt.Sprintf("user%04d", count))) {
+			t.Fatalf("expected user%04d, got %s", count, it.Key())
+		}
+		count++
+	}
+	if err := it.Close(); err != nil || count != 1000 {
+		t.Fatalf("expected %d keys iterated, got %d, error %v", 1000, count, err)
+	}
+	it = snapshot.Range([]byte("user0100"), []byte("user0200"))
+	count = 0
+	for ok := it.First(); ok; ok = it.Next() {
+		count++
+	}
+	if err := it.Close(); err != nil || count != 100 {
+		t.Fatalf("expected %d keys in range, got %d, error %v", 100, count, err)
+	}
+
+	// The store moves on, and is compacted once the snapshot is released.
+	if store.Len() != 1666 {
+		t.Fatalf("expected %d keys in store, got %d", 1666, store.Len())
+	}
+	err = snapshot.Release()
+	if err != nil {
+		t.Fatalf("while releasing snapshot: %v", err)
+	}
+	_, err = store.Compact()
+	if err != nil {
+		t.Fatalf("while compacting kv store: %v", err)
+	}
+	value, err := store.Get([]byte("user0001"))
+	if err != nil || !bytes.Equal(value, []byte("updated0001")) {
+		t.Fatalf("expected updated0001, got %q, error %v", value, err)
+	}
+	err = store.Close()
+	if err != nil {
+		t.Fatalf("Cannot close the store: %v", err)
+	}
+}